@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/caldog20/calnet/pkg/adminapi"
+)
+
+// auditPageSize is the maximum page size accepted by the server
+const auditPageSize = 1000
+
+func auditTail(ctx context.Context, args []string) error {
+	opts := &options{}
+	q := adminapi.AuditQuery{Limit: auditPageSize}
+	var n int
+	var follow bool
+	var interval time.Duration
+	var since time.Duration
+
+	fs := newFlagSet("audit tail", opts)
+	fs.IntVar(&n, "n", 20, "number of recent events to show")
+	fs.BoolVar(&follow, "f", false, "keep polling for new events")
+	fs.DurationVar(&interval, "interval", time.Second*2, "poll interval when following")
+	fs.DurationVar(&since, "since", 0, "only read events newer than this duration")
+	fs.StringVar(&q.Action, "action", "", "only show events with this action")
+	fs.StringVar(&q.Actor, "actor", "", "only show events from this actor")
+	fs.Uint64Var(&q.NodeID, "node", 0, "only show events for this node id")
+	_, err := parse(fs, args, opts, 0, 0)
+	if err != nil {
+		return err
+	}
+	if since > 0 {
+		q.Since = time.Now().Add(-since)
+	}
+	c, err := opts.client()
+	if err != nil {
+		return err
+	}
+
+	// Events are returned oldest first so page through to the end keeping the last n
+	var recent []adminapi.AuditEvent
+	for {
+		page, err := c.AuditEvents(ctx, q)
+		if err != nil {
+			return err
+		}
+		recent = append(recent, page.Events...)
+		if len(recent) > n {
+			recent = recent[len(recent)-n:]
+		}
+		if len(page.Events) > 0 {
+			q.After = page.Events[len(page.Events)-1].ID
+		}
+		if page.Next == 0 {
+			break
+		}
+	}
+
+	p := newAuditPrinter(opts)
+	for _, e := range recent {
+		p.print(&e)
+	}
+	p.flush()
+
+	if !follow {
+		return nil
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		page, err := c.AuditEvents(ctx, q)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		for _, e := range page.Events {
+			p.print(&e)
+		}
+		p.flush()
+		if len(page.Events) > 0 {
+			q.After = page.Events[len(page.Events)-1].ID
+		}
+	}
+}
+
+// auditPrinter writes events as table rows or JSON lines so output can be streamed
+type auditPrinter struct {
+	json   bool
+	header bool
+	rows   []string
+}
+
+func newAuditPrinter(opts *options) *auditPrinter {
+	return &auditPrinter{json: opts.output == "json"}
+}
+
+func (p *auditPrinter) print(e *adminapi.AuditEvent) {
+	if p.json {
+		data, err := json.Marshal(e)
+		if err == nil {
+			fmt.Println(string(data))
+		}
+		return
+	}
+	node := "-"
+	if e.NodeID != 0 {
+		node = strconv.FormatUint(e.NodeID, 10)
+	}
+	p.rows = append(p.rows, fmt.Sprintf(
+		"%d\t%s\t%s\t%s\t%s\t%s",
+		e.ID,
+		formatTime(e.Time),
+		e.Action,
+		orDash(e.Actor),
+		node,
+		orDash(e.SourceIP),
+	))
+}
+
+func (p *auditPrinter) flush() {
+	if p.json || (len(p.rows) == 0 && p.header) {
+		return
+	}
+	header := "ID\tTIME\tACTION\tACTOR\tNODE\tSOURCE"
+	if p.header {
+		header = ""
+	}
+	if err := printTable(header, p.rows); err != nil {
+		fmt.Fprintln(os.Stderr, "error writing output:", err)
+	}
+	p.header = true
+	p.rows = p.rows[:0]
+}
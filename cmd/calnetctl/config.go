@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	defaultServerURL = "http://127.0.0.1:8081"
+	configFileName   = "calnetctl.json"
+)
+
+// Config is read from a JSON file, by default calnet/calnetctl.json in the user config directory.
+// Environment variables take precedence over the file and flags take precedence over both.
+type Config struct {
+	ServerURL string `json:"server_url"`
+	APIToken  string `json:"api_token"`
+}
+
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "./"
+	}
+	return filepath.Join(dir, "calnet", configFileName)
+}
+
+// loadConfig reads the config file at path and applies the environment.
+// A missing config file is only an error when the path was given explicitly.
+func loadConfig(path string) (Config, error) {
+	conf := Config{ServerURL: defaultServerURL}
+
+	if path == "" {
+		path = os.Getenv("CALNET_CTL_CONFIG")
+	}
+	explicit := path != ""
+	if !explicit {
+		path = defaultConfigPath()
+	}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err = json.Unmarshal(data, &conf); err != nil {
+			return conf, fmt.Errorf("error parsing config file %s: %w", path, err)
+		}
+	case errors.Is(err, os.ErrNotExist) && !explicit:
+	default:
+		return conf, err
+	}
+
+	if v := os.Getenv("CALNET_SERVER_URL"); v != "" {
+		conf.ServerURL = v
+	}
+	if v := os.Getenv("CALNET_API_TOKEN"); v != "" {
+		conf.APIToken = v
+	}
+	return conf, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/caldog20/calnet/pkg/adminapi"
+)
+
+func keyStatus(pk *adminapi.ProvisionKey) string {
+	switch {
+	case pk.Revoked:
+		return "revoked"
+	case !pk.Expiry.IsZero() && time.Now().After(pk.Expiry):
+		return "expired"
+	case !pk.Reusable && pk.Uses > 0:
+		return "used"
+	}
+	return "valid"
+}
+
+func keysCreate(ctx context.Context, args []string) error {
+	opts := &options{}
+	req := adminapi.CreateProvisionKeyRequest{}
+	var tags string
+	var expiry time.Duration
+
+	fs := newFlagSet("keys create", opts)
+	fs.StringVar(&req.Description, "description", "", "description of the key")
+	fs.StringVar(&req.User, "user", "", "user assigned to nodes registered with the key")
+	fs.StringVar(&tags, "tags", "", "comma separated tags assigned to nodes registered with the key")
+	fs.BoolVar(&req.Reusable, "reusable", false, "allow the key to register more than one node")
+	fs.DurationVar(&expiry, "expiry", 0, "duration until the key expires, 0 never expires")
+	_, err := parse(fs, args, opts, 0, 0)
+	if err != nil {
+		return err
+	}
+	if tags != "" {
+		req.Tags = strings.Split(tags, ",")
+	}
+	if expiry > 0 {
+		req.Expiry = time.Now().Add(expiry)
+	}
+	c, err := opts.client()
+	if err != nil {
+		return err
+	}
+
+	pk, err := c.CreateProvisionKey(ctx, req)
+	if err != nil {
+		return err
+	}
+	if opts.output == "json" {
+		return printJSON(pk)
+	}
+	fmt.Printf("created provisioning key %d, it will not be shown again:\n%s\n", pk.ID, pk.Key)
+	return nil
+}
+
+func keysList(ctx context.Context, args []string) error {
+	opts := &options{}
+	fs := newFlagSet("keys list", opts)
+	_, err := parse(fs, args, opts, 0, 0)
+	if err != nil {
+		return err
+	}
+	c, err := opts.client()
+	if err != nil {
+		return err
+	}
+
+	pks, err := c.ProvisionKeys(ctx)
+	if err != nil {
+		return err
+	}
+	if opts.output == "json" {
+		return printJSON(pks)
+	}
+	rows := make([]string, len(pks))
+	for i, pk := range pks {
+		expiry := "never"
+		if !pk.Expiry.IsZero() {
+			expiry = formatAgo(pk.Expiry)
+		}
+		rows[i] = fmt.Sprintf(
+			"%d\t%s\t%s\t%s\t%t\t%d\t%s\t%s",
+			pk.ID,
+			orDash(pk.Description),
+			orDash(pk.User),
+			formatList(pk.Tags),
+			pk.Reusable,
+			pk.Uses,
+			keyStatus(&pk),
+			expiry,
+		)
+	}
+	return printTable("ID\tDESCRIPTION\tUSER\tTAGS\tREUSABLE\tUSES\tSTATUS\tEXPIRY", rows)
+}
+
+func keysRevoke(ctx context.Context, args []string) error {
+	opts := &options{}
+	fs := newFlagSet("keys revoke <id>", opts)
+	args, err := parse(fs, args, opts, 1, 1)
+	if err != nil {
+		return err
+	}
+	id, err := parseID(args[0])
+	if err != nil {
+		return err
+	}
+	c, err := opts.client()
+	if err != nil {
+		return err
+	}
+
+	pk, err := c.RevokeProvisionKey(ctx, id)
+	if err != nil {
+		return err
+	}
+	if opts.output == "json" {
+		return printJSON(pk)
+	}
+	fmt.Printf("revoked provisioning key %d\n", pk.ID)
+	return nil
+}
@@ -0,0 +1,192 @@
+// Command calnetctl manages a calnet control server through its REST API.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+
+	"github.com/caldog20/calnet/pkg/adminapi"
+)
+
+const usage = `usage: calnetctl <command> [flags] [args]
+
+commands:
+  nodes list                     list nodes
+  nodes get <id>                 show a node
+  nodes disable <id>             disable a node
+  nodes enable <id>              enable a node
+  nodes expire <id>              expire the key of a node
+  nodes delete <id>              delete a node
+  nodes rename <id> <name>       rename a node
+  keys create                    create a provisioning key
+  keys list                      list provisioning keys
+  keys revoke <id>               revoke a provisioning key
+  users                          list users
+  routes approve <id> [prefix]   set the approved routes of a node
+  audit tail                     show recent audit events
+  store backup <file|->          download a backup of the store database
+  store export <file|->          download a JSON export of the store
+  config reload                  reload the server config
+
+Every command accepts:
+  -server <url>   admin server url, or unix:/path (env CALNET_SERVER_URL)
+  -token <token>  api token (env CALNET_API_TOKEN)
+  -config <path>  config file (env CALNET_CTL_CONFIG)
+  -o <format>     output format: table or json
+
+Run calnetctl <command> -h for command flags.
+`
+
+type command struct {
+	name string
+	run  func(ctx context.Context, args []string) error
+}
+
+var commands = map[string][]command{
+	"nodes": {
+		{"list", nodesList},
+		{"get", nodesGet},
+		{"disable", nodesDisable},
+		{"enable", nodesEnable},
+		{"expire", nodesExpire},
+		{"delete", nodesDelete},
+		{"rename", nodesRename},
+	},
+	"keys": {
+		{"create", keysCreate},
+		{"list", keysList},
+		{"revoke", keysRevoke},
+	},
+	"users": {
+		{"", usersList},
+		{"list", usersList},
+	},
+	"routes": {
+		{"approve", routesApprove},
+	},
+	"audit": {
+		{"tail", auditTail},
+	},
+	"store": {
+		{"backup", storeBackup},
+		{"export", storeExport},
+	},
+	"config": {
+		{"reload", configReload},
+	},
+}
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "calnetctl:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "-help" || args[0] == "help" {
+		fmt.Fprint(os.Stderr, usage)
+		return nil
+	}
+
+	subs, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprint(os.Stderr, usage)
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+
+	name, rest := "", args[1:]
+	if len(rest) > 0 && rest[0] != "" && rest[0][0] != '-' {
+		name, rest = rest[0], rest[1:]
+	}
+	for _, sub := range subs {
+		if sub.name == name {
+			ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer cancel()
+			return sub.run(ctx, rest)
+		}
+	}
+
+	fmt.Fprint(os.Stderr, usage)
+	if name == "" {
+		return fmt.Errorf("%s requires a subcommand", args[0])
+	}
+	return fmt.Errorf("unknown command %q", args[0]+" "+name)
+}
+
+// options are the flags shared by every command
+type options struct {
+	server     string
+	token      string
+	configPath string
+	output     string
+}
+
+// newFlagSet returns a flag set for a command with the shared flags registered to opts
+func newFlagSet(name string, opts *options) *flag.FlagSet {
+	fs := flag.NewFlagSet("calnetctl "+name, flag.ContinueOnError)
+	fs.StringVar(&opts.server, "server", "", "control server url")
+	fs.StringVar(&opts.token, "token", "", "api token")
+	fs.StringVar(&opts.configPath, "config", "", "path to config file")
+	fs.StringVar(&opts.output, "o", "table", "output format: table or json")
+	return fs
+}
+
+// parse parses args and checks the number of positional arguments, which are returned.
+// Flags may be given before or after positional arguments.
+func parse(
+	fs *flag.FlagSet,
+	args []string,
+	opts *options,
+	minArgs, maxArgs int,
+) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+
+	if len(positional) < minArgs || (maxArgs >= 0 && len(positional) > maxArgs) {
+		fs.Usage()
+		return nil, errors.New("wrong number of arguments")
+	}
+	if opts.output != "table" && opts.output != "json" {
+		return nil, fmt.Errorf("invalid output format %q: must be table or json", opts.output)
+	}
+	return positional, nil
+}
+
+// client returns an API client for the server and token from flags, env or the config file
+func (o *options) client() (*adminapi.Client, error) {
+	conf, err := loadConfig(o.configPath)
+	if err != nil {
+		return nil, err
+	}
+	if o.server != "" {
+		conf.ServerURL = o.server
+	}
+	if o.token != "" {
+		conf.APIToken = o.token
+	}
+	return adminapi.NewClient(conf.ServerURL, conf.APIToken)
+}
+
+func parseID(s string) (uint64, error) {
+	id, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid id %q", s)
+	}
+	return id, nil
+}
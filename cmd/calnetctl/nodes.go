@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/caldog20/calnet/pkg/adminapi"
+)
+
+func nodeStatus(n *adminapi.Node) string {
+	switch {
+	case n.Disabled:
+		return "disabled"
+	case !n.KeyExpiry.IsZero() && time.Now().After(n.KeyExpiry):
+		return "expired"
+	}
+	return "active"
+}
+
+func printNodes(opts *options, nodes []adminapi.Node) error {
+	if opts.output == "json" {
+		return printJSON(nodes)
+	}
+	rows := make([]string, len(nodes))
+	for i, n := range nodes {
+		rows[i] = fmt.Sprintf(
+			"%d\t%s\t%s\t%s\t%s\t%t\t%s\t%s",
+			n.ID,
+			orDash(n.Name),
+			n.IP,
+			orDash(n.User),
+			nodeStatus(&n),
+			n.Online,
+			formatAgo(n.KeyExpiry),
+			formatAgo(n.LastSeen),
+		)
+	}
+	return printTable("ID\tNAME\tIP\tUSER\tSTATUS\tONLINE\tKEY EXPIRY\tLAST SEEN", rows)
+}
+
+func printNode(opts *options, n *adminapi.Node) error {
+	if opts.output == "json" {
+		return printJSON(n)
+	}
+	hostname, osName := "-", "-"
+	if n.Hostinfo != nil {
+		hostname = orDash(n.Hostinfo.Hostname)
+		osName = orDash(n.Hostinfo.OS + "/" + n.Hostinfo.Arch)
+	}
+	return printFields([][2]string{
+		{"ID", strconv.FormatUint(n.ID, 10)},
+		{"Name", orDash(n.Name)},
+		{"Hostname", hostname},
+		{"OS", osName},
+		{"IP", n.IP.String()},
+		{"Prefix", n.NetPrefix.String()},
+		{"User", orDash(n.User)},
+		{"Tags", formatList(n.Tags)},
+		{"Status", nodeStatus(n)},
+		{"Online", strconv.FormatBool(n.Online)},
+		{"Node Key", n.NodeKey.EncodeToString()},
+		{"Key Expiry", formatTime(n.KeyExpiry)},
+		{"Advertised Routes", formatPrefixes(n.AdvertisedRoutes)},
+		{"Approved Routes", formatPrefixes(n.ApprovedRoutes)},
+		{"Last Seen", formatTime(n.LastSeen)},
+		{"Created", formatTime(n.CreatedAt)},
+		{"Updated", formatTime(n.UpdatedAt)},
+	})
+}
+
+// optionalBool is a boolean flag that is nil unless given
+type optionalBool struct {
+	v **bool
+}
+
+func (b optionalBool) String() string {
+	if b.v == nil || *b.v == nil {
+		return ""
+	}
+	return strconv.FormatBool(**b.v)
+}
+
+func (b optionalBool) Set(s string) error {
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	*b.v = &v
+	return nil
+}
+
+func (b optionalBool) IsBoolFlag() bool {
+	return true
+}
+
+func nodesList(ctx context.Context, args []string) error {
+	opts := &options{}
+	q := adminapi.NodeQuery{}
+	var prefix string
+	var limit int
+
+	fs := newFlagSet("nodes list", opts)
+	fs.StringVar(&q.User, "user", "", "only show nodes of this user")
+	fs.StringVar(&q.Tag, "tag", "", "only show nodes with this tag")
+	fs.StringVar(&q.Hostname, "hostname", "", "only show nodes with a name or hostname containing")
+	fs.StringVar(&prefix, "prefix", "", "only show nodes with an IP in this prefix")
+	fs.Var(optionalBool{&q.Disabled}, "disabled", "only show disabled nodes, or enabled with =false")
+	fs.Var(optionalBool{&q.Expired}, "expired", "only show expired nodes, or unexpired with =false")
+	fs.Var(optionalBool{&q.Online}, "online", "only show online nodes, or offline with =false")
+	fs.StringVar(&q.Sort, "sort", "id", "sort by id, created, last_seen or expiry")
+	fs.BoolVar(&q.Descending, "desc", false, "sort in descending order")
+	fs.IntVar(&limit, "limit", 0, "maximum number of nodes to show, 0 shows every node")
+	_, err := parse(fs, args, opts, 0, 0)
+	if err != nil {
+		return err
+	}
+	if prefix != "" {
+		if q.Prefix, err = netip.ParsePrefix(prefix); err != nil {
+			return fmt.Errorf("invalid prefix %q: %w", prefix, err)
+		}
+	}
+	c, err := opts.client()
+	if err != nil {
+		return err
+	}
+
+	var nodes []adminapi.Node
+	if limit > 0 {
+		q.Limit = limit
+		page, err := c.Nodes(ctx, q)
+		if err != nil {
+			return err
+		}
+		nodes = page.Nodes
+	} else {
+		nodes, err = c.AllNodes(ctx, q)
+		if err != nil {
+			return err
+		}
+	}
+	return printNodes(opts, nodes)
+}
+
+func nodesGet(ctx context.Context, args []string) error {
+	opts := &options{}
+	fs := newFlagSet("nodes get <id>", opts)
+	args, err := parse(fs, args, opts, 1, 1)
+	if err != nil {
+		return err
+	}
+	id, err := parseID(args[0])
+	if err != nil {
+		return err
+	}
+	c, err := opts.client()
+	if err != nil {
+		return err
+	}
+
+	n, err := c.Node(ctx, id)
+	if err != nil {
+		return err
+	}
+	return printNode(opts, n)
+}
+
+// nodeAction returns a command that calls action with the node id argument and prints the result
+func nodeAction(
+	name string,
+	action func(*adminapi.Client, context.Context, uint64) (*adminapi.Node, error),
+) func(context.Context, []string) error {
+	return func(ctx context.Context, args []string) error {
+		opts := &options{}
+		fs := newFlagSet("nodes "+name+" <id>", opts)
+		args, err := parse(fs, args, opts, 1, 1)
+		if err != nil {
+			return err
+		}
+		id, err := parseID(args[0])
+		if err != nil {
+			return err
+		}
+		c, err := opts.client()
+		if err != nil {
+			return err
+		}
+
+		n, err := action(c, ctx, id)
+		if err != nil {
+			return err
+		}
+		return printNode(opts, n)
+	}
+}
+
+var (
+	nodesDisable = nodeAction("disable", (*adminapi.Client).DisableNode)
+	nodesEnable  = nodeAction("enable", (*adminapi.Client).EnableNode)
+	nodesExpire  = nodeAction("expire", (*adminapi.Client).ExpireNode)
+)
+
+func nodesDelete(ctx context.Context, args []string) error {
+	opts := &options{}
+	fs := newFlagSet("nodes delete <id>", opts)
+	args, err := parse(fs, args, opts, 1, 1)
+	if err != nil {
+		return err
+	}
+	id, err := parseID(args[0])
+	if err != nil {
+		return err
+	}
+	c, err := opts.client()
+	if err != nil {
+		return err
+	}
+
+	if err = c.DeleteNode(ctx, id); err != nil {
+		return err
+	}
+	fmt.Printf("deleted node %d\n", id)
+	return nil
+}
+
+func nodesRename(ctx context.Context, args []string) error {
+	opts := &options{}
+	fs := newFlagSet("nodes rename <id> <name>", opts)
+	args, err := parse(fs, args, opts, 2, 2)
+	if err != nil {
+		return err
+	}
+	id, err := parseID(args[0])
+	if err != nil {
+		return err
+	}
+	c, err := opts.client()
+	if err != nil {
+		return err
+	}
+
+	n, err := c.RenameNode(ctx, id, args[1])
+	if err != nil {
+		return err
+	}
+	return printNode(opts, n)
+}
+
+func routesApprove(ctx context.Context, args []string) error {
+	opts := &options{}
+	fs := newFlagSet("routes approve <id> [prefix...]", opts)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: calnetctl routes approve <id> [prefix...]")
+		fmt.Fprintln(
+			fs.Output(),
+			"Replaces the approved routes of the node, no prefixes removes every approval.",
+		)
+		fs.PrintDefaults()
+	}
+	args, err := parse(fs, args, opts, 1, -1)
+	if err != nil {
+		return err
+	}
+	id, err := parseID(args[0])
+	if err != nil {
+		return err
+	}
+	routes := make([]netip.Prefix, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		p, err := netip.ParsePrefix(arg)
+		if err != nil {
+			return fmt.Errorf("invalid route %q: %w", arg, err)
+		}
+		routes = append(routes, p)
+	}
+	c, err := opts.client()
+	if err != nil {
+		return err
+	}
+
+	n, err := c.ApproveRoutes(ctx, id, routes)
+	if err != nil {
+		return err
+	}
+	return printNode(opts, n)
+}
+
+func usersList(ctx context.Context, args []string) error {
+	opts := &options{}
+	fs := newFlagSet("users", opts)
+	_, err := parse(fs, args, opts, 0, 0)
+	if err != nil {
+		return err
+	}
+	c, err := opts.client()
+	if err != nil {
+		return err
+	}
+
+	users, err := c.Users(ctx)
+	if err != nil {
+		return err
+	}
+	if opts.output == "json" {
+		return printJSON(users)
+	}
+	rows := make([]string, len(users))
+	for i, u := range users {
+		rows[i] = fmt.Sprintf("%s\t%d\t%s", u.Name, u.Nodes, formatAgo(u.LastSeen))
+	}
+	return printTable("USER\tNODES\tLAST SEEN", rows)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/caldog20/calnet/pkg/adminapi"
+)
+
+func configReload(ctx context.Context, args []string) error {
+	opts := &options{}
+	fs := newFlagSet("config reload", opts)
+	if _, err := parse(fs, args, opts, 0, 0); err != nil {
+		return err
+	}
+	c, err := opts.client()
+	if err != nil {
+		return err
+	}
+
+	changed, err := c.ReloadConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if opts.output == "json" {
+		return printJSON(adminapi.ConfigReload{Changed: changed})
+	}
+	if len(changed) == 0 {
+		fmt.Println("config reloaded, nothing changed")
+		return nil
+	}
+	fmt.Printf("config reloaded, changed %s\n", strings.Join(changed, ", "))
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/caldog20/calnet/pkg/adminapi"
+)
+
+type downloadFunc func(c *adminapi.Client, ctx context.Context, w io.Writer) (int64, error)
+
+func storeBackup(ctx context.Context, args []string) error {
+	return storeDownload(ctx, "store backup", "backup", args, (*adminapi.Client).Backup)
+}
+
+func storeExport(ctx context.Context, args []string) error {
+	return storeDownload(ctx, "store export", "export", args, (*adminapi.Client).Export)
+}
+
+// storeDownload writes a download to the file named by the only argument, or stdout for "-".
+// The file is written next to its destination and renamed into place when complete,
+// so an interrupted download never leaves a truncated file behind.
+func storeDownload(
+	ctx context.Context,
+	name, kind string,
+	args []string,
+	download downloadFunc,
+) error {
+	opts := &options{}
+	fs := newFlagSet(name, opts)
+	pos, err := parse(fs, args, opts, 1, 1)
+	if err != nil {
+		return err
+	}
+	c, err := opts.client()
+	if err != nil {
+		return err
+	}
+	// Downloads are bounded by ctx instead of the default client timeout
+	c.SetHTTPClient(&http.Client{})
+
+	if pos[0] == "-" {
+		_, err := download(c, ctx, os.Stdout)
+		return err
+	}
+
+	path := pos[0]
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	n, err := download(c, ctx, f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "wrote %d byte %s to %s\n", n, kind, path)
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+
+	"github.com/caldog20/calnet/control/server/config"
+)
+
+// listenAdmin listens on the admin address, creating the Unix socket with the
+// configured permissions for a unix: address
+func listenAdmin(conf config.Config) (net.Listener, error) {
+	path := conf.AdminUnixSocket()
+	if path == "" {
+		return net.Listen("tcp", conf.Admin.ListenAddr)
+	}
+
+	// A server that didn't shut down cleanly leaves its socket behind
+	info, err := os.Lstat(path)
+	switch {
+	case err == nil && info.Mode()&os.ModeSocket == 0:
+		return nil, fmt.Errorf("%s exists and is not a socket", path)
+	case err == nil:
+		if err = os.Remove(path); err != nil {
+			return nil, err
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(path, conf.AdminSocketMode()); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// registerPprof registers the net/http/pprof handlers under /debug/pprof/
+func registerPprof(mux *http.ServeMux) {
+	mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+	mux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("POST /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/caldog20/calnet/control/server/config"
+)
+
+// runConfig runs the config subcommands
+func runConfig(args []string) error {
+	fs := flag.NewFlagSet("config", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: controlserver [-config path] [flags] config print")
+		fmt.Fprintln(fs.Output(), "\nprint shows the effective config and where each value was set")
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 || fs.Arg(0) != "print" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	loaded, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	printConfig(loaded)
+	return nil
+}
+
+// redactedKeys are the config values holding secrets, which are not printed
+var redactedKeys = []string{"api_tokens", "raft.secret"}
+
+// printConfig writes every config value with its source to stdout. The values of
+// redactedKeys are not printed.
+func printConfig(loaded *config.Loaded) {
+	file := loaded.File
+	if file == "" {
+		file = "none"
+	}
+	fmt.Fprintf(os.Stdout, "config file: %s\n\n", file)
+
+	flags := make(map[string]string, len(flagKeys))
+	for name, key := range flagKeys {
+		flags[key] = name
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tVALUE\tSOURCE")
+	for _, key := range config.Keys() {
+		v, _ := loaded.Value(key)
+		value := formatValue(v, slices.Contains(redactedKeys, key))
+
+		source := string(loaded.Sources[key])
+		switch loaded.Sources[key] {
+		case config.SourceEnv:
+			source += " " + config.EnvName(key)
+		case config.SourceFlag:
+			source += " -" + flags[key]
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", key, value, source)
+	}
+	w.Flush()
+}
+
+// formatValue formats a config value the way it is set in the environment, with
+// set strings and map values replaced if redact is set
+func formatValue(v any, redact bool) string {
+	m, ok := v.(map[string]string)
+	if !ok {
+		if s, isString := v.(string); isString && redact && s != "" {
+			return "<redacted>"
+		}
+		return fmt.Sprint(v)
+	}
+	pairs := make([]string, 0, len(m))
+	for _, k := range slices.Sorted(maps.Keys(m)) {
+		value := m[k]
+		if redact {
+			value = "<redacted>"
+		}
+		pairs = append(pairs, k+"="+value)
+	}
+	return strings.Join(pairs, ",")
+}
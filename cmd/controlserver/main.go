@@ -2,77 +2,175 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
-	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/caldog20/calnet/control/server/apiservice"
 	"github.com/caldog20/calnet/control/server/config"
 	"github.com/caldog20/calnet/control/server/controlservice"
+	"github.com/caldog20/calnet/control/server/events"
+	"github.com/caldog20/calnet/control/server/logging"
+	"github.com/caldog20/calnet/control/server/metrics"
 	"github.com/caldog20/calnet/control/server/relayservice"
 	"github.com/caldog20/calnet/control/server/store"
 	"github.com/caldog20/calnet/control/server/stunservice"
-	"golang.org/x/crypto/acme/autocert"
+	"github.com/caldog20/calnet/control/server/tlsconfig"
+	"github.com/caldog20/calnet/control/server/webhookservice"
+	"github.com/caldog20/calnet/control/server/webui"
 )
 
 var (
-	httpPort   = flag.Int("http-port", 0, "http listen port")
-	stunPort   = flag.Int("stun-port", 0, "stun listen port")
-	debugMode  = flag.Bool("debug", false, "enable debug mode disables encryption and ssl")
-	configPath = flag.String(
+	httpPort    = flag.Int("http-port", 0, "http listen port")
+	stunPort    = flag.Int("stun-port", 0, "stun listen port")
+	metricsPort = flag.Int("metrics-port", 0, "deprecated: prometheus metrics listen port")
+	debugMode   = flag.Bool("debug", false, "enable debug mode disables encryption and ssl")
+	logLevel    = flag.String("log-level", "", "log level (debug, info, warn, error)")
+	configPath  = flag.String(
 		"config",
 		"",
 		"path to read config file - if unset, config will try to read from standard os config paths",
 	)
 )
 
+var logger = logging.Logger(logging.SubsystemServer)
+
+// commands run instead of the server when named as the first argument
+var commands = map[string]struct {
+	run    func(args []string) error
+	errMsg string
+}{
+	"migrate": {runMigrate, "error migrating store"},
+	"export":  {runExport, "error exporting store"},
+	"import":  {runImport, "error importing store"},
+	"restore": {runRestore, "error restoring store"},
+	"config":  {runConfig, "error running config command"},
+}
+
+func fatal(msg string, err error) {
+	logger.Error(msg, logging.Err(err))
+	os.Exit(1)
+}
+
 func main() {
 	flag.Parse()
+	if cmd, ok := commands[flag.Arg(0)]; ok {
+		if err := cmd.run(flag.Args()[1:]); err != nil {
+			fatal(cmd.errMsg, err)
+		}
+		return
+	}
+
 	conf := getConfig()
 
-	db, err := store.NewBoltStore(conf.StorePath)
+	if err := logging.Setup(conf.Log, os.Stderr); err != nil {
+		fatal("error configuring logging", err)
+	}
+	if conf.Debug {
+		logger.Warn("server running in debug mode!")
+	}
+	for _, msg := range conf.Deprecations() {
+		logger.Warn(msg)
+	}
+
+	db, err := openStore(conf)
 	if err != nil {
-		log.Fatal(err)
+		fatal("error opening store", err)
 	}
 	defer db.Close()
 
+	bus := events.NewBus()
+
+	webhooks := webhookservice.New(db)
+	webhooks.Start(bus)
+	defer webhooks.Close()
+
 	control := controlservice.New(conf, db)
+	control.SetEventBus(bus)
 	defer control.Close()
 
 	relay := relayservice.New()
 	relay.SetKeyVerifier(control.VerifyKeyForRelay)
+	relay.SetRateLimits(conf.RateLimit)
 	defer relay.Close()
 
-	api := apiservice.New(db)
+	tlsConf, err := tlsconfig.New(conf)
+	if err != nil {
+		fatal("error configuring tls", err)
+	}
+	var adminTLSConf *tls.Config
+	if conf.AdminUnixSocket() == "" {
+		adminTLSConf, err = tlsconfig.Admin(tlsConf, conf)
+		if err != nil {
+			fatal("error configuring admin tls", err)
+		}
+	}
+
+	api := apiservice.New(conf, db)
+	api.SetEventBus(bus)
+	if conf.TLS.ClientCAFile != "" {
+		api.RequireClientCert()
+	}
+
+	reload := &reloader{control: control, relay: relay, conf: conf}
+	api.SetConfigReloader(reload.reload)
 
+	// Nodes only reach the control and relay routes, everything else is served on
+	// the admin listener
 	mux := http.NewServeMux()
 	control.RegisterRoutes(mux)
 	relay.RegisterRoutes(mux)
-	api.RegisterRoutes(mux)
 
+	adminMux := http.NewServeMux()
+	api.RegisterRoutes(adminMux)
+	webui.RegisterRoutes(adminMux)
+	adminMux.Handle("GET /metrics", metrics.Handler())
+	if conf.Admin.Pprof {
+		registerPprof(adminMux)
+	}
+
+	var handlers inflight
 	srv := &http.Server{
-		Handler: mux,
+		Handler: handlers.handler(mux),
+	}
+	adminSrv := &http.Server{
+		Handler: handlers.handler(adminMux),
 	}
+	// Shutdown closes the listeners and then runs these, so pollers and relay clients
+	// reconnect elsewhere and event streams end instead of holding the servers open
+	srv.RegisterOnShutdown(func() {
+		control.Drain(conf.Shutdown.ReconnectURL)
+		relay.Drain(goingAwayReason(conf.Shutdown.ReconnectURL))
+	})
+	adminSrv.RegisterOnShutdown(api.Drain)
 
-	var l net.Listener
-	if conf.AutoCertDomain != "" {
-		l = autocert.NewListener(conf.AutoCertDomain)
-	} else {
-		l, err = net.Listen("tcp", fmt.Sprintf(":%d", uint16(conf.HTTPPort)))
-		if err != nil {
-			log.Fatal(err)
-		}
+	l, err := net.Listen("tcp", conf.HTTPListenAddr())
+	if err != nil {
+		fatal("error listening for http", err)
 	}
-	log.Printf("http server listening on %s", l.Addr().String())
+	logger.Info("http server listening", "addr", l.Addr().String(), "tls", tlsConf != nil)
 	defer l.Close()
 
+	adminListener, err := listenAdmin(conf)
+	if err != nil {
+		fatal("error listening for admin http", err)
+	}
+	logger.Info(
+		"admin server listening",
+		"addr", conf.Admin.ListenAddr,
+		"tls", adminTLSConf != nil,
+		"pprof", conf.Admin.Pprof,
+	)
+	defer adminListener.Close()
+
 	ctx, cancel := signal.NotifyContext(
 		context.Background(),
 		os.Interrupt,
@@ -81,58 +179,135 @@ func main() {
 	)
 	defer cancel()
 
-	go srv.Serve(l)
+	go reload.watchSignal(ctx)
+	if tlsConf != nil {
+		// The certificates come from the TLS config
+		srv.TLSConfig = tlsConf
+		go srv.ServeTLS(l, "", "")
+	} else {
+		go srv.Serve(l)
+	}
+	if adminTLSConf != nil {
+		adminSrv.TLSConfig = adminTLSConf
+		go adminSrv.ServeTLS(adminListener, "", "")
+	} else {
+		go adminSrv.Serve(adminListener)
+	}
 
-	err = stunservice.ListenAndServe(ctx, fmt.Sprintf(":%d", uint16(conf.StunPort)))
-	if err != nil {
-		log.Printf("stun server error: %s", err)
-		cancel()
+	var metricsSrv *http.Server
+	if conf.MetricsPort != 0 {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("GET /metrics", metrics.Handler())
+		metricsSrv = &http.Server{
+			Addr:    conf.MetricsListenAddr(),
+			Handler: metricsMux,
+		}
+		logger.Info("metrics server listening", "addr", metricsSrv.Addr)
+		go func() {
+			if err := metricsSrv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("metrics server error", logging.Err(err))
+			}
+		}()
 	}
 
+	stunCtx, stopStun := context.WithCancel(context.Background())
+	stunDone := make(chan struct{})
+	go func() {
+		defer close(stunDone)
+		err := stunservice.ListenAndServe(stunCtx, fmt.Sprintf(":%d", uint16(conf.StunPort)))
+		if err != nil {
+			logger.Error("stun server error", logging.Err(err))
+			cancel()
+		}
+	}()
+
 	<-ctx.Done()
+	// A second signal stops the server without waiting for the shutdown
+	cancel()
 
-	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second*5)
-	err = srv.Shutdown(shutdownCtx)
-	if err != nil {
-		log.Printf("error gracefully closing http server: %s", err)
-		srv.Close()
+	timeout := time.Duration(conf.Shutdown.TimeoutSeconds) * time.Second
+	logger.Info("shutting down", "timeout", timeout)
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), timeout)
+	defer cancelShutdown()
+
+	var wg sync.WaitGroup
+	for name, s := range map[string]*http.Server{"http": srv, "admin": adminSrv} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			shutdownServer(shutdownCtx, name, s)
+		}()
 	}
+	stopStun()
+	<-stunDone
+	wg.Wait()
+	// Relay conns are hijacked from the HTTP server, so Shutdown doesn't wait for them
+	relay.Wait(shutdownCtx)
+	if metricsSrv != nil {
+		metricsSrv.Close()
+	}
+	// Handlers of connections closed after the timeout may still be running
+	handlers.wait()
+	logger.Info("connections drained, closing store")
 }
 
-func getConfig() config.Config {
-	var conf config.Config
+// flagKeys maps the flags that override config values to their config keys
+var flagKeys = map[string]string{
+	"http-port":    "http_port",
+	"stun-port":    "stun_port",
+	"metrics-port": "metrics_port",
+	"debug":        "debug_mode",
+	"log-level":    "log.level",
+}
 
+// getConfig loads the config, writing a config file with the defaults and a new
+// admin API token first if there is none
+func getConfig() config.Config {
 	if *configPath != "" {
 		config.SetConfigPath(*configPath)
 	}
-
-	err := conf.ReadConfigFromFile()
+	file, err := config.FindConfigFile()
 	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			conf.SetDefaults()
-			err = conf.WriteConfigFile()
-			if err != nil {
-				log.Printf("error writing config file to disk: %s", err)
-			}
+		fatal("error finding config file", err)
+	}
+	if file == "" {
+		var conf config.Config
+		conf.SetDefaults()
+		if err = conf.WriteConfigFile(); err != nil {
+			logger.Error("error writing config file to disk", logging.Err(err))
 		}
 	}
 
-	// Flags are prioritized over config entries for now
-	// These are not currently writen back to the config file
-	if *httpPort != 0 {
-		conf.HTTPPort = *httpPort
+	loaded, err := loadConfig()
+	if err != nil {
+		fatal("error loading config", err)
 	}
+	return loaded.Config
+}
 
-	if *stunPort != 0 {
-		conf.StunPort = *stunPort
+// loadConfig loads the config from the defaults, the config file, CALNET_*
+// environment variables and flags
+func loadConfig() (*config.Loaded, error) {
+	if *configPath != "" {
+		config.SetConfigPath(*configPath)
 	}
 
-	if *debugMode {
-		log.Println("server running in debug mode!")
-		if conf.Debug != *debugMode {
-			conf.Debug = *debugMode
-		}
+	overrides := config.Overrides{
+		Env:   os.Environ(),
+		Flags: make(map[string]string),
 	}
+	flag.Visit(func(f *flag.Flag) {
+		if key, ok := flagKeys[f.Name]; ok {
+			overrides.Flags[key] = f.Value.String()
+		}
+	})
+	return config.Load(overrides)
+}
 
-	return conf
+// openStore opens the configured store, joining the raft cluster for the raft driver
+func openStore(conf config.Config) (store.Store, error) {
+	if conf.StoreDriver == store.DriverRaft {
+		return store.NewRaftStore(conf.Raft)
+	}
+	return store.Open(conf.StoreDriver, conf.StorePath)
 }
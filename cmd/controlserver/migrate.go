@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/caldog20/calnet/control/server/store"
+)
+
+// runMigrate applies pending store migrations without starting the server,
+// or with -dry-run reports the migrations that would be applied
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "report pending migrations without applying them")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: controlserver [-config path] migrate [-dry-run]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	conf := getConfig()
+	status, err := store.Migrate(conf.StoreDriver, conf.StorePath, *dryRun)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stdout, "store: %s %s\n", status.Driver, status.Path)
+	fmt.Fprintf(os.Stdout, "schema version: %d (latest %d)\n", status.Current, status.Latest)
+	if len(status.Pending) == 0 {
+		fmt.Fprintln(os.Stdout, "schema is up to date")
+		return nil
+	}
+	if *dryRun {
+		fmt.Fprintln(os.Stdout, "migrations that would be applied:")
+	} else {
+		fmt.Fprintln(os.Stdout, "applied migrations:")
+	}
+	for _, m := range status.Pending {
+		fmt.Fprintf(os.Stdout, "  %d: %s\n", m.Version, m.Description)
+	}
+	if *dryRun {
+		fmt.Fprintln(os.Stdout, "dry run, no changes were made")
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/caldog20/calnet/control/server/config"
+	"github.com/caldog20/calnet/control/server/controlservice"
+	"github.com/caldog20/calnet/control/server/logging"
+	"github.com/caldog20/calnet/control/server/relayservice"
+)
+
+// reloader applies config changes to the running server
+type reloader struct {
+	control *controlservice.Control
+	relay   *relayservice.Relay
+
+	mu   sync.Mutex
+	conf config.Config
+}
+
+// reload loads the config again and applies the values that can change while the
+// server runs: log levels and format, rate limits and the node key expiry. If any
+// other value changed nothing is applied and an error wrapping
+// config.ErrRestartRequired is returned.
+func (r *reloader) reload() ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	loaded, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	conf := loaded.Config
+	changed, err := config.CheckReload(&r.conf, &conf)
+	if err != nil {
+		return nil, err
+	}
+	if len(changed) == 0 {
+		logger.Info("config reloaded without changes")
+		return nil, nil
+	}
+
+	if err = logging.Setup(conf.Log, os.Stderr); err != nil {
+		return nil, err
+	}
+	r.control.SetRateLimits(conf.RateLimit)
+	r.control.SetKeyExpiry(conf.KeyExpiryDays)
+	r.relay.SetRateLimits(conf.RateLimit)
+	r.conf = conf
+	logger.Info("config reloaded", "changed", changed)
+	return changed, nil
+}
+
+// watchSignal reloads the config on SIGHUP until ctx is done
+func (r *reloader) watchSignal(ctx context.Context) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	defer signal.Stop(ch)
+	for {
+		select {
+		case <-ch:
+			logger.Info("reloading config on SIGHUP")
+			if _, err := r.reload(); err != nil {
+				logger.Error("error reloading config", logging.Err(err))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/caldog20/calnet/control/server/logging"
+)
+
+// inflight tracks the HTTP handlers that are running, so the store is only
+// closed once every handler that might use it has returned
+type inflight struct {
+	wg sync.WaitGroup
+}
+
+// handler returns h counted as in flight while it runs
+func (f *inflight) handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		f.wg.Add(1)
+		defer f.wg.Done()
+		h.ServeHTTP(w, req)
+	})
+}
+
+// wait waits until every handler has returned
+func (f *inflight) wait() {
+	f.wg.Wait()
+}
+
+// shutdownServer shuts srv down gracefully, closing the connections that are
+// still open when ctx is done
+func shutdownServer(ctx context.Context, name string, srv *http.Server) {
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Error("error gracefully closing server", "server", name, logging.Err(err))
+		srv.Close()
+	}
+}
+
+// goingAwayReason is the close reason sent to relay clients when the server shuts down
+func goingAwayReason(reconnectURL string) string {
+	if reconnectURL == "" {
+		return "server going away"
+	}
+	return "server going away, reconnect to " + reconnectURL
+}
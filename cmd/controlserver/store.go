@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/caldog20/calnet/control/server/store"
+)
+
+// runExport writes a JSON export of the store to a file, or stdout for "-".
+// The server must be stopped, use calnetctl store export while it is running.
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: controlserver [-config path] export <file|->")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	conf := getConfig()
+	s, err := store.Open(conf.StoreDriver, conf.StorePath)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	e, err := store.ExportStore(s, &conf)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	if fs.Arg(0) == "-" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	if err = os.WriteFile(fs.Arg(0), b, 0600); err != nil {
+		return err
+	}
+	fmt.Fprintf(
+		os.Stderr,
+		"exported %d nodes, %d provisioning keys and %d webhooks to %s\n",
+		len(e.Nodes),
+		len(e.ProvisionKeys),
+		len(e.Webhooks),
+		fs.Arg(0),
+	)
+	return nil
+}
+
+// runImport creates the nodes, provisioning keys and webhooks of a JSON export in
+// the store, or with -dry-run only validates the export against the store
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "validate the export without importing it")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: controlserver [-config path] import [-dry-run] <file>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	b, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	e := &store.Export{}
+	if err = json.Unmarshal(b, e); err != nil {
+		return fmt.Errorf("invalid export: %w", err)
+	}
+
+	conf := getConfig()
+	s, err := store.Open(conf.StoreDriver, conf.StorePath)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if e.NetworkPrefix.IsValid() && e.NetworkPrefix != conf.NetworkPrefix {
+		fmt.Fprintf(
+			os.Stderr,
+			"warning: export is from network prefix %s, importing into %s\n",
+			e.NetworkPrefix,
+			conf.NetworkPrefix,
+		)
+	}
+
+	if e.Settings != nil && *e.Settings != *store.ExportSettings(&conf) {
+		fmt.Fprintf(
+			os.Stderr,
+			"warning: export settings %+v differ from the config %+v, update the config to keep them\n",
+			*e.Settings,
+			*store.ExportSettings(&conf),
+		)
+	}
+
+	if *dryRun {
+		if err = e.Validate(s, conf.NetworkPrefix); err != nil {
+			return err
+		}
+		fmt.Fprintf(
+			os.Stdout,
+			"export is valid: %d nodes, %d provisioning keys and %d webhooks would be imported\n",
+			len(e.Nodes),
+			len(e.ProvisionKeys),
+			len(e.Webhooks),
+		)
+		return nil
+	}
+
+	result, err := store.Import(s, e, conf.NetworkPrefix)
+	if result != nil {
+		fmt.Fprintf(
+			os.Stdout,
+			"imported %d nodes, %d provisioning keys and %d webhooks\n",
+			result.Nodes,
+			result.ProvisionKeys,
+			result.Webhooks,
+		)
+	}
+	return err
+}
+
+// runRestore replaces the store with a backup taken by calnetctl store backup
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: controlserver [-config path] restore <backup file>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	conf := getConfig()
+	if _, err := os.Stat(fs.Arg(0)); err != nil {
+		return err
+	}
+	if err := store.Restore(conf.StoreDriver, fs.Arg(0), conf.StorePath); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "restored %s from %s\n", conf.StorePath, fs.Arg(0))
+	return nil
+}
@@ -0,0 +1,44 @@
+package client
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+)
+
+// backoff returns exponentially increasing delays between min and max. Each delay
+// is jittered between half and all of its value so clients that failed together
+// don't retry together.
+type backoff struct {
+	min, max time.Duration
+	attempt  int
+}
+
+func (c *Client) newBackoff() *backoff {
+	return &backoff{min: c.minBackoff, max: c.maxBackoff}
+}
+
+func (b *backoff) next() time.Duration {
+	d := b.max
+	if b.attempt < 32 {
+		d = min(b.min<<b.attempt, b.max)
+	}
+	b.attempt++
+	return d/2 + rand.N(d/2+1)
+}
+
+func (b *backoff) reset() {
+	b.attempt = 0
+}
+
+// sleep waits for d and reports whether it did before ctx was done
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
@@ -5,52 +5,223 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log"
+	"maps"
 	"net/http"
+	"net/netip"
 	"net/url"
+	"os"
+	"runtime"
 	"sync"
+	"time"
 
+	"github.com/caldog20/calnet/control/client/state"
 	"github.com/caldog20/calnet/pkg/controlapi"
 	"github.com/caldog20/calnet/pkg/keys"
 )
 
+const (
+	// Timeout for checking a control server is healthy
+	healthCheckTimeout = time.Second * 5
+	// Backoff while no control server is healthy or polls are failing
+	minBackoff = time.Second
+	maxBackoff = time.Second * 30
+	// Logins attempted after the node key expired before the poll loop gives up
+	maxReloginAttempts = 10
+)
+
+// ErrKeyMismatch is returned by a health check when a control server presents a
+// different key than the one pinned or learnt for it
+var ErrKeyMismatch = errors.New("control server key does not match the pinned key")
+
+// ErrKeyExpired is the error of an EventLoginFailed event when the control server
+// still reports the node key expired after the poll loop stopped logging in again.
+// The key must be renewed by an admin or the node registered with a new key.
+var ErrKeyExpired = errors.New("node key is expired")
+
+// Server is a control server the client can connect to
+type Server struct {
+	URL string
+	// Key pins the public key of the server. If it's zero the key is fetched from
+	// the server the first time the client connects to it and pinned from then on.
+	Key keys.PublicKey
+}
+
+// server is a configured Server. key is guarded by Client.mu.
+type server struct {
+	url *url.URL
+	key keys.PublicKey
+}
+
+// unavailableError is a request that failed because the control server is down
+// or unreachable, so the client fails over to another server
+type unavailableError struct {
+	server string
+	err    error
+}
+
+func (e *unavailableError) Error() string {
+	return fmt.Sprintf("control server %s unavailable: %s", e.server, e.err)
+}
+
+func (e *unavailableError) Unwrap() error {
+	return e.err
+}
+
 type Client struct {
-	c          *http.Client
-	controlURL *url.URL
+	c *http.Client
 
-	// Control Server Public Key
-	controlPublic keys.PublicKey
+	// Control servers in order of preference
+	servers []*server
+	// Whether all the servers share one key
+	sharedKey bool
 	// Node Control Private Key
 	controlPrivate keys.PrivateKey
 	// Node Data Public Key
 	nodePublic keys.PublicKey
-
-	mu       sync.Mutex
-	loggedIn bool
+	// Keeps pinned server keys and the last netmap if set
+	state *state.Store
+
+	// Bounds of the backoff between failover rounds and failed polls
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	mu sync.Mutex
+	// Index of the server in use, which is kept until a request to it fails
+	current int
+	// Whether the current server passed a health check and hasn't failed since
+	healthy      bool
+	loggedIn     bool
+	provisionKey string
+	hostinfo     *controlapi.Hostinfo
+	// Server a control server that is going away told the client to reconnect
+	// to, tried first on the next failover
+	reconnect *server
+	// Channels of the event subscribers
+	subs map[chan Event]struct{}
 }
 
-func New(controlKey keys.PrivateKey, nodeKey keys.PublicKey, serverAddr string) *Client {
-	u, err := url.Parse(serverAddr)
-	if err != nil {
-		panic("invalid server url")
+// New returns a client for the control servers, which are tried in order. The
+// client stays on a server until a request to it fails, then fails over to the
+// first healthy server in the list.
+func New(controlKey keys.PrivateKey, nodeKey keys.PublicKey, servers []Server) (*Client, error) {
+	if len(servers) == 0 {
+		return nil, errors.New("at least one control server is required")
 	}
-	return &Client{
+	c := &Client{
 		c:              &http.Client{},
-		controlURL:     u,
 		controlPrivate: controlKey,
 		nodePublic:     nodeKey,
+		minBackoff:     minBackoff,
+		maxBackoff:     maxBackoff,
+		subs:           make(map[chan Event]struct{}),
+	}
+	for _, s := range servers {
+		u, err := url.Parse(s.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid control server url %q: %w", s.URL, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid control server url %q: must be an http or https url", s.URL)
+		}
+		c.servers = append(c.servers, &server{url: u, key: s.Key})
 	}
+
+	hostname, _ := os.Hostname()
+	c.hostinfo = &controlapi.Hostinfo{
+		Hostname: hostname,
+		OS:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+	}
+	return c, nil
 }
 
-func (c *Client) getServerKey() error {
-	resp, err := c.c.Get(c.controlURL.JoinPath("key").String())
+// NewFromState returns a client using the node keys in st. Server keys pinned in
+// st are used for servers without a configured key, keys the client pins are
+// saved to st, and so is every netmap so the node can start on its cached netmap
+// while no control server is reachable.
+func NewFromState(st *state.Store, servers []Server) (*Client, error) {
+	saved := st.State()
+	c, err := New(saved.ControlKey, saved.NodeKey.PublicKey(), servers)
+	if err != nil {
+		return nil, err
+	}
+	c.state = st
+	for _, s := range c.servers {
+		if s.key.IsZero() {
+			s.key = saved.ServerKeys[s.url.String()]
+		}
+	}
+	return c, nil
+}
+
+// SetSharedKey sets whether all the control servers share one key, as servers of
+// one cluster do. A key pinned for or learnt from any server is then required of
+// every server. Otherwise each server's key is pinned separately.
+func (c *Client) SetSharedKey(shared bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sharedKey = shared
+	if !shared {
+		return nil
+	}
+	var key keys.PublicKey
+	for _, s := range c.servers {
+		if s.key.IsZero() {
+			continue
+		}
+		if !key.IsZero() && s.key != key {
+			return errors.New("control servers with a shared key have different pinned keys")
+		}
+		key = s.key
+	}
+	for _, s := range c.servers {
+		s.key = key
+	}
+	return nil
+}
+
+// ServerURL returns the URL of the control server in use
+func (c *Client) ServerURL() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.servers[c.current].url.String()
+}
+
+// SetProvisionKey sets the provisioning key sent to register the node on its first login
+func (c *Client) SetProvisionKey(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.provisionKey = key
+}
+
+// SetAdvertisedRoutes sets the routes advertised to the control server on the next login
+func (c *Client) SetAdvertisedRoutes(routes []netip.Prefix) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	hi := *c.hostinfo
+	hi.Routes = routes
+	c.hostinfo = &hi
+}
+
+// checkServer fetches the key of s to check it is up, pinning the key if none is
+// pinned yet
+func (c *Client) checkServer(ctx context.Context, s *server) error {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", s.url.JoinPath("key").String(), nil)
+	resp, err := c.c.Do(req)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
 
 	serverKeyResp := &controlapi.ControlKey{}
-	defer resp.Body.Close()
 	b, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return err
@@ -64,47 +235,222 @@ func (c *Client) getServerKey() error {
 		return errors.New("control server key is zero")
 	}
 
-	// c.mu.Lock()
-	// defer c.mu.Unlock()
-	c.controlPublic = serverKeyResp.PublicKey
-
+	c.mu.Lock()
+	pinned := s.key.IsZero()
+	if pinned {
+		if c.sharedKey {
+			for _, other := range c.servers {
+				other.key = serverKeyResp.PublicKey
+			}
+		}
+		s.key = serverKeyResp.PublicKey
+	}
+	key := s.key
+	c.mu.Unlock()
+	if key != serverKeyResp.PublicKey {
+		return ErrKeyMismatch
+	}
+	if pinned {
+		c.savePinnedKeys()
+	}
 	return nil
 }
 
-func (c *Client) Login(ctx context.Context) (*controlapi.LoginResponse, error) {
+// savePinnedKeys saves the pinned server keys to the state
+func (c *Client) savePinnedKeys() {
+	if c.state == nil {
+		return
+	}
+	pinned := make(map[string]keys.PublicKey)
+	c.mu.Lock()
+	for _, s := range c.servers {
+		if !s.key.IsZero() {
+			pinned[s.url.String()] = s.key
+		}
+	}
+	c.mu.Unlock()
+	err := c.state.Update(func(st *state.State) {
+		if st.ServerKeys == nil {
+			st.ServerKeys = make(map[string]keys.PublicKey)
+		}
+		maps.Copy(st.ServerKeys, pinned)
+	})
+	if err != nil {
+		log.Printf("error saving pinned control server keys: %s", err)
+	}
+}
+
+// activeServer returns the server in use and its key, failing over if it has
+// failed or hasn't been checked yet
+func (c *Client) activeServer(ctx context.Context) (*server, keys.PublicKey, error) {
+	c.mu.Lock()
+	s, key, healthy := c.servers[c.current], c.servers[c.current].key, c.healthy
+	c.mu.Unlock()
+	if healthy {
+		return s, key, nil
+	}
+	return c.failover(ctx)
+}
+
+// failover switches to the first healthy server in order, checking every server
+// with increasing backoff between rounds until one is healthy or ctx is done
+func (c *Client) failover(ctx context.Context) (*server, keys.PublicKey, error) {
+	b := c.newBackoff()
+	for {
+		for _, i := range c.failoverOrder() {
+			s := c.servers[i]
+			err := c.checkServer(ctx, s)
+			if err != nil {
+				log.Printf("control server %s failed health check: %s", s.url, err)
+				continue
+			}
+			c.mu.Lock()
+			if c.current != i {
+				log.Printf("switching to control server %s", s.url)
+			}
+			c.current = i
+			c.healthy = true
+			key := s.key
+			c.mu.Unlock()
+			return s, key, nil
+		}
+
+		d := b.next()
+		log.Printf("no healthy control server, retrying in %s", d)
+		if !sleep(ctx, d) {
+			return nil, keys.PublicKey{}, ctx.Err()
+		}
+	}
+}
+
+// failoverOrder returns the indexes of the servers in the order a failover round
+// checks them: the server the client was told to reconnect to first, then every
+// server in order
+func (c *Client) failoverOrder() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	order := make([]int, 0, len(c.servers))
+	for i, s := range c.servers {
+		if s == c.reconnect {
+			order = append(order, i)
+		}
+	}
+	for i, s := range c.servers {
+		if s != c.reconnect {
+			order = append(order, i)
+		}
+	}
+	c.reconnect = nil
+	return order
+}
+
+// setReconnect records the server that s told the client to reconnect to when it
+// went away. URLs of servers the client isn't configured with are ignored.
+func (c *Client) setReconnect(s *server, reconnectURL string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, other := range c.servers {
+		if other != s && other.url.String() == reconnectURL {
+			log.Printf("control server %s is going away, reconnecting to %s", s.url, other.url)
+			c.reconnect = other
+			return
+		}
+	}
+	log.Printf("control server %s is going away, ignoring unknown server %s", s.url, reconnectURL)
+}
+
+// serverFailed marks s as failed so the next request fails over
+func (c *Client) serverFailed(s *server, err error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if c.servers[c.current] == s && c.healthy {
+		log.Printf("control server %s failed: %s", s.url, err)
+		c.healthy = false
+	}
+}
+
+// do sends an encrypted request to s. Errors reaching the server and server errors
+// are returned as an unavailableError.
+func (c *Client) do(
+	ctx context.Context,
+	s *server,
+	key keys.PublicKey,
+	path string,
+	body []byte,
+) (*http.Response, error) {
+	encrypted := c.controlPrivate.EncryptBox(body, key)
+	req, _ := http.NewRequestWithContext(
+		ctx,
+		"POST",
+		s.url.JoinPath(path).String(),
+		bytes.NewReader(encrypted),
+	)
+	req.Header.Set("X-Control-Key", c.controlPrivate.PublicKey().EncodeToString())
+	resp, err := c.c.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, &unavailableError{server: s.url.String(), err: err}
+	}
+	if resp.StatusCode >= http.StatusInternalServerError {
+		resp.Body.Close()
+		if u := resp.Header.Get(controlapi.ReconnectHeader); u != "" {
+			c.setReconnect(s, u)
+		}
+		return nil, &unavailableError{
+			server: s.url.String(),
+			err:    fmt.Errorf("unexpected status %s", resp.Status),
+		}
+	}
+	return resp, nil
+}
 
-	if c.controlPublic.IsZero() {
-		err := c.getServerKey()
+// Login logs in to the control server in use, failing over to another server
+// while it is unavailable
+func (c *Client) Login(ctx context.Context) (*controlapi.LoginResponse, error) {
+	for {
+		s, key, err := c.activeServer(ctx)
 		if err != nil {
 			return nil, err
 		}
+		resp, err := c.login(ctx, s, key)
+		var unavailable *unavailableError
+		if errors.As(err, &unavailable) {
+			c.serverFailed(s, err)
+			continue
+		}
+		return resp, err
 	}
+}
 
+func (c *Client) login(
+	ctx context.Context,
+	s *server,
+	key keys.PublicKey,
+) (*controlapi.LoginResponse, error) {
+	c.mu.Lock()
 	loginReq := controlapi.LoginRequest{
 		NodeKey:      c.nodePublic,
-		ProvisionKey: "please",
+		ProvisionKey: c.provisionKey,
+		Hostinfo:     c.hostinfo,
 	}
+	c.mu.Unlock()
 
 	b, err := json.Marshal(loginReq)
 	if err != nil {
 		return nil, err
 	}
 
-	encrypted := c.controlPrivate.EncryptBox(b, c.controlPublic)
-
-	req, _ := http.NewRequest(
-		"POST",
-		c.controlURL.JoinPath("/login").String(),
-		bytes.NewReader(encrypted),
-	)
-	req.Header.Set("X-Control-Key", c.controlPrivate.PublicKey().EncodeToString())
-	resp, err := c.c.Do(req)
+	resp, err := c.do(ctx, s, key, "/login", b)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
+	// Errors such as a bad provisioning key or rate limiting are plain text
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError("login", resp)
+	}
 
 	loginResp := controlapi.LoginResponse{}
 	b, err = io.ReadAll(resp.Body)
@@ -112,7 +458,7 @@ func (c *Client) Login(ctx context.Context) (*controlapi.LoginResponse, error) {
 		return nil, err
 	}
 
-	decrypted, ok := c.controlPrivate.DecryptBox(b, c.controlPublic)
+	decrypted, ok := c.controlPrivate.DecryptBox(b, key)
 	if !ok {
 		return nil, errors.New("error decrypting control login response")
 	}
@@ -122,104 +468,9 @@ func (c *Client) Login(ctx context.Context) (*controlapi.LoginResponse, error) {
 		return nil, err
 	}
 
-	if loginResp.LoggedIn {
-		c.loggedIn = true
-	}
-
-	return &loginResp, nil
-}
-
-func (c *Client) StartPoll(ctx context.Context, callback func(*controlapi.PollResponse)) error {
-	pollCtx, cancel := context.WithCancel(ctx)
-	defer cancel()
-
-	pollReq := &controlapi.PollRequest{}
-
 	c.mu.Lock()
-	if !c.loggedIn {
-		return errors.New("client must be logged in before polling")
-	}
-	if c.controlPublic.IsZero() {
-		return errors.New("control server key is zero: cannot poll")
-	}
+	c.loggedIn = loginResp.LoggedIn
 	c.mu.Unlock()
 
-	pollFunc := func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-			}
-
-			c.mu.Lock()
-			cKey := c.controlPrivate
-			sKey := c.controlPublic
-			nKey := c.nodePublic
-			c.mu.Unlock()
-
-			pollReq.NodeKey = nKey
-			b, err := json.Marshal(pollReq)
-			if err != nil {
-				log.Printf("error marshalling poll request: %s", err)
-				return
-			}
-
-			encrypted := cKey.EncryptBox(b, sKey)
-
-			req, _ := http.NewRequestWithContext(
-				pollCtx,
-				"POST",
-				c.controlURL.JoinPath("/poll").String(),
-				bytes.NewReader(encrypted),
-			)
-			req.Header.Set("X-Control-Key", cKey.PublicKey().EncodeToString())
-
-			resp, err := c.c.Do(req)
-			if err != nil {
-				log.Printf("polling fatal error: %s", err)
-				return
-			}
-			defer resp.Body.Close()
-
-			if resp.StatusCode == http.StatusNoContent {
-				continue
-			}
-
-			b, err = io.ReadAll(resp.Body)
-			if err != nil {
-				log.Printf("error reading response body")
-				continue
-			}
-
-			decrypted, ok := c.controlPrivate.DecryptBox(b, c.controlPublic)
-			if !ok {
-				log.Println("error decrypting control login response")
-				continue
-			}
-
-			pollResp := &controlapi.PollResponse{}
-			err = json.Unmarshal(decrypted, pollResp)
-			if err != nil {
-				log.Println("error unmarshalling poll response")
-				continue
-			}
-
-			if pollResp.KeyExpired {
-				log.Println("node key is now expired, stopping poll")
-				c.mu.Lock()
-				c.loggedIn = false
-				c.mu.Unlock()
-				cancel()
-			}
-
-			if callback != nil {
-				callback(pollResp)
-			}
-		}
-	}
-
-	go pollFunc()
-
-	return nil
+	return &loginResp, nil
 }
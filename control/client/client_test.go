@@ -2,33 +2,57 @@ package client
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/caldog20/calnet/control/client/state"
 	"github.com/caldog20/calnet/pkg/controlapi"
 	"github.com/caldog20/calnet/pkg/keys"
 )
 
-const (
-	TestControlURL = "http://127.0.0.1:8080"
-)
-
 var (
 	nodePrivate    = keys.NewPrivateKey()
 	controlPrivate = keys.NewPrivateKey()
-	c              *Client
+	// Client for the live control server at CALNET_TEST_CONTROL_URL, nil if it is
+	// unset
+	c *Client
 )
 
 func TestMain(m *testing.M) {
-	nodePrivate = keys.NewPrivateKey()
-	controlPrivate = keys.NewPrivateKey()
-	c = New(controlPrivate, nodePrivate.PublicKey(), TestControlURL)
+	if url := os.Getenv("CALNET_TEST_CONTROL_URL"); url != "" {
+		var err error
+		c, err = New(controlPrivate, nodePrivate.PublicKey(), []Server{{URL: url}})
+		if err != nil {
+			panic(err)
+		}
+		c.SetProvisionKey(os.Getenv("CALNET_PROVISION_KEY"))
+	}
 	os.Exit(m.Run())
 }
 
+// requireControlServer skips tests that need a live control server when none
+// is configured
+func requireControlServer(t *testing.T) {
+	t.Helper()
+	if c == nil {
+		t.Skip("CALNET_TEST_CONTROL_URL is not set")
+	}
+}
+
 func TestControlClientLogin(t *testing.T) {
-	login, err := c.Login(context.TODO())
+	requireControlServer(t)
+	// Login retries until a control server is healthy
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Second*10)
+	defer cancel()
+	login, err := c.Login(ctx)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -38,6 +62,7 @@ func TestControlClientLogin(t *testing.T) {
 }
 
 func TestControlClientPoll(t *testing.T) {
+	requireControlServer(t)
 	resp := &controlapi.PollResponse{}
 	gotResp := make(chan struct{})
 	ctx, cancel := context.WithTimeout(context.TODO(), time.Second*10)
@@ -69,3 +94,477 @@ func TestControlClientPoll(t *testing.T) {
 		t.Fatalf("got key expired, expected registered new node key")
 	}
 }
+
+// fakeControl is a control server that logs in every node
+type fakeControl struct {
+	*httptest.Server
+	key    keys.PrivateKey
+	down   atomic.Bool
+	logins atomic.Int32
+	// Status logins are refused with if set
+	loginStatus atomic.Int32
+	// Whether logins report the node key expired
+	keyExpired atomic.Bool
+	// Each poll is answered by the next poll func, polls wait until there is one
+	polls chan func(w http.ResponseWriter, nodeKey keys.PublicKey)
+}
+
+func newFakeControl(t *testing.T, key keys.PrivateKey) *fakeControl {
+	f := &fakeControl{
+		key:   key,
+		polls: make(chan func(http.ResponseWriter, keys.PublicKey), 10),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /key", func(w http.ResponseWriter, _ *http.Request) {
+		json.NewEncoder(w).Encode(&controlapi.ControlKey{PublicKey: f.key.PublicKey()})
+	})
+	mux.HandleFunc("POST /login", func(w http.ResponseWriter, r *http.Request) {
+		nodeKey := keys.PublicKey{}
+		if err := nodeKey.DecodeFromString(r.Header.Get("X-Control-Key")); err != nil {
+			http.Error(w, "bad key", http.StatusBadRequest)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		if _, ok := f.key.DecryptBox(b, nodeKey); !ok {
+			http.Error(w, "error decrypting message", http.StatusBadRequest)
+			return
+		}
+		if code := int(f.loginStatus.Load()); code != 0 {
+			w.Header().Set("Retry-After", "3")
+			http.Error(w, http.StatusText(code), code)
+			return
+		}
+		f.logins.Add(1)
+		expired := f.keyExpired.Load()
+		resp, _ := json.Marshal(&controlapi.LoginResponse{LoggedIn: !expired, KeyExpired: expired})
+		w.Write(f.key.EncryptBox(resp, nodeKey))
+	})
+	mux.HandleFunc("POST /poll", func(w http.ResponseWriter, r *http.Request) {
+		nodeKey := keys.PublicKey{}
+		nodeKey.DecodeFromString(r.Header.Get("X-Control-Key"))
+		// The server only notices the client going away once the body is read
+		io.ReadAll(r.Body)
+		select {
+		case poll := <-f.polls:
+			poll(w, nodeKey)
+		case <-r.Context().Done():
+		}
+	})
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if f.down.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func newTestClient(t *testing.T, servers ...Server) *Client {
+	t.Helper()
+	c, err := New(keys.NewPrivateKey(), keys.NewPrivateKey().PublicKey(), servers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.minBackoff = time.Millisecond * 10
+	c.maxBackoff = time.Millisecond * 50
+	return c
+}
+
+func TestNewInvalidURL(t *testing.T) {
+	for _, u := range []string{"", "127.0.0.1:8080", "ftp://control", "http://%zz"} {
+		_, err := New(keys.NewPrivateKey(), keys.NewPrivateKey().PublicKey(), []Server{{URL: u}})
+		if err == nil {
+			t.Errorf("expected error for control url %q", u)
+		}
+	}
+	if _, err := New(keys.NewPrivateKey(), keys.NewPrivateKey().PublicKey(), nil); err == nil {
+		t.Error("expected error without control servers")
+	}
+}
+
+func TestFailover(t *testing.T) {
+	a := newFakeControl(t, keys.NewPrivateKey())
+	b := newFakeControl(t, keys.NewPrivateKey())
+	c := newTestClient(t, Server{URL: a.URL}, Server{URL: b.URL})
+
+	a.down.Store(true)
+	if _, err := c.Login(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if c.ServerURL() != b.URL || b.logins.Load() != 1 {
+		t.Fatalf("logged in to %s, expected %s", c.ServerURL(), b.URL)
+	}
+
+	// The client stays on a working server when a preferred one comes back
+	a.down.Store(false)
+	if _, err := c.Login(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if c.ServerURL() != b.URL || b.logins.Load() != 2 {
+		t.Fatalf("logged in to %s, expected to stay on %s", c.ServerURL(), b.URL)
+	}
+
+	b.down.Store(true)
+	if _, err := c.Login(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if c.ServerURL() != a.URL || a.logins.Load() != 1 {
+		t.Fatalf("logged in to %s, expected %s", c.ServerURL(), a.URL)
+	}
+
+	// With every server down the client backs off until the context is done
+	a.down.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	if _, err := c.Login(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got error %v with every server down, expected context.DeadlineExceeded", err)
+	}
+}
+
+func TestLoginStatus(t *testing.T) {
+	f := newFakeControl(t, keys.NewPrivateKey())
+	c := newTestClient(t, Server{URL: f.URL})
+
+	for _, code := range []int{http.StatusUnauthorized, http.StatusTooManyRequests} {
+		f.loginStatus.Store(int32(code))
+		_, err := c.Login(context.Background())
+		var status *statusError
+		if !errors.As(err, &status) {
+			t.Fatalf("got error %v for a %d login, expected a status error", err, code)
+		}
+		if status.msg != http.StatusText(code) || status.retryAfter != time.Second*3 {
+			t.Errorf("got message %q and retry after %s", status.msg, status.retryAfter)
+		}
+	}
+}
+
+func TestPinnedKeys(t *testing.T) {
+	a := newFakeControl(t, keys.NewPrivateKey())
+	b := newFakeControl(t, keys.NewPrivateKey())
+
+	// A server presenting a different key than its pinned one is skipped
+	c := newTestClient(t,
+		Server{URL: a.URL, Key: keys.NewPrivateKey().PublicKey()},
+		Server{URL: b.URL, Key: b.key.PublicKey()},
+	)
+	if _, err := c.Login(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if c.ServerURL() != b.URL {
+		t.Fatalf("logged in to %s, expected %s", c.ServerURL(), b.URL)
+	}
+
+	// Keys learnt from a server are pinned
+	c = newTestClient(t, Server{URL: a.URL})
+	if _, err := c.Login(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	a.key = keys.NewPrivateKey()
+	err := c.checkServer(context.Background(), c.servers[0])
+	if !errors.Is(err, ErrKeyMismatch) {
+		t.Fatalf("got error %v for changed server key, expected ErrKeyMismatch", err)
+	}
+}
+
+func TestSharedKey(t *testing.T) {
+	key := keys.NewPrivateKey()
+	a := newFakeControl(t, key)
+	b := newFakeControl(t, key)
+	other := newFakeControl(t, keys.NewPrivateKey())
+
+	c := newTestClient(t, Server{URL: a.URL}, Server{URL: other.URL}, Server{URL: b.URL})
+	if err := c.SetSharedKey(true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Login(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The key learnt from a is required of every server, so the client skips
+	// other with its own key and fails over to b
+	a.down.Store(true)
+	c.serverFailed(c.servers[0], errors.New("test"))
+	if _, err := c.Login(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if c.ServerURL() != b.URL || other.logins.Load() != 0 {
+		t.Fatalf("logged in to %s, expected %s", c.ServerURL(), b.URL)
+	}
+
+	c = newTestClient(t,
+		Server{URL: a.URL, Key: key.PublicKey()},
+		Server{URL: b.URL, Key: keys.NewPrivateKey().PublicKey()},
+	)
+	if err := c.SetSharedKey(true); err == nil {
+		t.Fatal("expected error for different pinned keys with a shared key")
+	}
+}
+
+// pollResponse returns a poll func answering with resp
+func (f *fakeControl) pollResponse(
+	resp *controlapi.PollResponse,
+) func(http.ResponseWriter, keys.PublicKey) {
+	return func(w http.ResponseWriter, nodeKey keys.PublicKey) {
+		b, _ := json.Marshal(resp)
+		w.Write(f.key.EncryptBox(b, nodeKey))
+	}
+}
+
+func pollStatus(code int) func(http.ResponseWriter, keys.PublicKey) {
+	return func(w http.ResponseWriter, _ keys.PublicKey) {
+		http.Error(w, http.StatusText(code), code)
+	}
+}
+
+func nextEvent(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for client event")
+		return Event{}
+	}
+}
+
+func TestStartPollNotLoggedIn(t *testing.T) {
+	f := newFakeControl(t, keys.NewPrivateKey())
+	c := newTestClient(t, Server{URL: f.URL})
+	if err := c.StartPoll(context.Background(), nil); err == nil {
+		t.Fatal("expected error polling before logging in")
+	}
+	// The client must not be left locked
+	done := make(chan struct{})
+	go func() {
+		c.SetProvisionKey("key")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("client is still locked after StartPoll failed")
+	}
+}
+
+func TestPollLoop(t *testing.T) {
+	f := newFakeControl(t, keys.NewPrivateKey())
+	c := newTestClient(t, Server{URL: f.URL})
+	if _, err := c.Login(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	events, unsubscribe := c.Subscribe(10)
+	defer unsubscribe()
+
+	var polls atomic.Int32
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := c.StartPoll(ctx, func(*controlapi.PollResponse) { polls.Add(1) })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := func(want EventType) Event {
+		t.Helper()
+		e := nextEvent(t, events)
+		if e.Type != want {
+			t.Fatalf("got %s event, expected %s", e.Type, want)
+		}
+		return e
+	}
+
+	netmap := &controlapi.PollResponse{Config: &controlapi.NodeConfig{ID: 1}}
+	f.polls <- f.pollResponse(netmap)
+	expect(EventConnected)
+	if e := expect(EventNetmapUpdated); e.Poll.Config.ID != 1 || e.Server != f.URL {
+		t.Fatalf("got netmap event %+v", e)
+	}
+
+	// Timed out polls continue, client errors are retried
+	f.polls <- pollStatus(http.StatusNoContent)
+	f.polls <- pollStatus(http.StatusBadRequest)
+	if e := expect(EventDisconnected); e.Err == nil {
+		t.Fatal("disconnected event has no error")
+	}
+	f.polls <- f.pollResponse(netmap)
+	expect(EventConnected)
+	expect(EventNetmapUpdated)
+
+	// The client fails over from an unavailable server and back to it once it's healthy
+	f.polls <- pollStatus(http.StatusServiceUnavailable)
+	expect(EventDisconnected)
+	f.polls <- f.pollResponse(netmap)
+	expect(EventConnected)
+	expect(EventNetmapUpdated)
+
+	// An expired key logs in again and keeps polling
+	f.polls <- f.pollResponse(&controlapi.PollResponse{KeyExpired: true})
+	expect(EventKeyExpired)
+	f.polls <- f.pollResponse(netmap)
+	expect(EventConnected)
+	expect(EventNetmapUpdated)
+	if f.logins.Load() != 2 {
+		t.Errorf("got %d logins, expected a login after the key expired", f.logins.Load())
+	}
+	if polls.Load() != 5 {
+		t.Errorf("callback got %d poll responses, expected 5", polls.Load())
+	}
+
+	// Nothing is published after the poll loop stops
+	cancel()
+	f.polls <- f.pollResponse(netmap)
+	select {
+	case e := <-events:
+		t.Fatalf("got %s event after the poll loop stopped", e.Type)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestPollLoginFailed(t *testing.T) {
+	f := newFakeControl(t, keys.NewPrivateKey())
+	c := newTestClient(t, Server{URL: f.URL})
+	if _, err := c.Login(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	events, unsubscribe := c.Subscribe(10)
+	defer unsubscribe()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := c.StartPoll(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The key stays expired, the poll loop gives up after maxReloginAttempts
+	f.keyExpired.Store(true)
+	f.polls <- f.pollResponse(&controlapi.PollResponse{KeyExpired: true})
+	for _, want := range []EventType{EventConnected, EventKeyExpired, EventLoginFailed} {
+		e := nextEvent(t, events)
+		if e.Type != want {
+			t.Fatalf("got %s event, expected %s", e.Type, want)
+		}
+		if want == EventLoginFailed && !errors.Is(e.Err, ErrKeyExpired) {
+			t.Fatalf("got login failed error %v, expected %v", e.Err, ErrKeyExpired)
+		}
+	}
+	if got := f.logins.Load(); got != maxReloginAttempts+1 {
+		t.Errorf("got %d logins, expected %d", got, maxReloginAttempts+1)
+	}
+
+	// The poll loop stopped
+	f.polls <- f.pollResponse(&controlapi.PollResponse{})
+	select {
+	case e := <-events:
+		t.Fatalf("got %s event after the poll loop stopped", e.Type)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestPollReconnect(t *testing.T) {
+	a := newFakeControl(t, keys.NewPrivateKey())
+	b := newFakeControl(t, keys.NewPrivateKey())
+	target := newFakeControl(t, keys.NewPrivateKey())
+	c := newTestClient(t, Server{URL: a.URL}, Server{URL: b.URL}, Server{URL: target.URL})
+	if _, err := c.Login(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	events, unsubscribe := c.Subscribe(10)
+	defer unsubscribe()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := c.StartPoll(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	a.polls <- a.pollResponse(&controlapi.PollResponse{})
+	if e := nextEvent(t, events); e.Type != EventConnected || e.Server != a.URL {
+		t.Fatalf("got %s event from %s, expected connected to %s", e.Type, e.Server, a.URL)
+	}
+	if e := nextEvent(t, events); e.Type != EventNetmapUpdated {
+		t.Fatalf("got %s event, expected %s", e.Type, EventNetmapUpdated)
+	}
+
+	// A server going away points the client at another server, which is tried
+	// before the others
+	a.polls <- func(w http.ResponseWriter, _ keys.PublicKey) {
+		w.Header().Set(controlapi.ReconnectHeader, target.URL)
+		http.Error(w, "server going away", http.StatusServiceUnavailable)
+	}
+	if e := nextEvent(t, events); e.Type != EventDisconnected {
+		t.Fatalf("got %s event, expected %s", e.Type, EventDisconnected)
+	}
+	target.polls <- target.pollResponse(&controlapi.PollResponse{})
+	if e := nextEvent(t, events); e.Type != EventConnected || e.Server != target.URL {
+		t.Fatalf("got %s event from %s, expected connected to %s", e.Type, e.Server, target.URL)
+	}
+}
+
+func TestStateOffline(t *testing.T) {
+	f := newFakeControl(t, keys.NewPrivateKey())
+	path := filepath.Join(t.TempDir(), "state.json")
+	st, err := state.Open(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewFromState(st, []Server{{URL: f.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.minBackoff = time.Millisecond * 10
+	c.maxBackoff = time.Millisecond * 50
+	if _, err = c.Login(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if st.State().ServerKeys[f.URL] != f.key.PublicKey() {
+		t.Fatal("learnt server key was not saved to the state")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events, unsubscribe := c.Subscribe(10)
+	if err = c.StartPoll(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	f.polls <- f.pollResponse(&controlapi.PollResponse{Config: &controlapi.NodeConfig{ID: 1}})
+	for e := nextEvent(t, events); e.Type != EventNetmapUpdated; e = nextEvent(t, events) {
+	}
+	cancel()
+	unsubscribe()
+
+	// Restarted while the control server is down, the client starts polling
+	// without logging in and runs on the cached netmap. A new server with the
+	// same key is used so the cancelled poll can't take its poll funcs.
+	f = newFakeControl(t, f.key)
+	f.down.Store(true)
+	st, err = state.Open(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = NewFromState(st, []Server{{URL: f.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.minBackoff = time.Millisecond * 10
+	c.maxBackoff = time.Millisecond * 50
+	events, unsubscribe = c.Subscribe(10)
+	defer unsubscribe()
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	if err = c.StartPoll(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	e := nextEvent(t, events)
+	if e.Type != EventNetmapUpdated || !e.Cached || e.Poll.Config.ID != 1 {
+		t.Fatalf("got event %+v, expected the cached netmap", e)
+	}
+
+	// Polling resumes once the server is back
+	f.down.Store(false)
+	f.polls <- f.pollResponse(&controlapi.PollResponse{Config: &controlapi.NodeConfig{ID: 2}})
+	if e = nextEvent(t, events); e.Type != EventConnected {
+		t.Fatalf("got %s event, expected connected", e.Type)
+	}
+	if e = nextEvent(t, events); e.Type != EventNetmapUpdated || e.Poll.Config.ID != 2 {
+		t.Fatalf("got event %+v, expected the new netmap", e)
+	}
+}
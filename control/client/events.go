@@ -0,0 +1,70 @@
+package client
+
+import (
+	"log"
+	"sync"
+
+	"github.com/caldog20/calnet/pkg/controlapi"
+)
+
+// EventType is the type of a poll lifecycle Event
+type EventType string
+
+const (
+	// The poll loop is polling a control server with a valid login
+	EventConnected EventType = "connected"
+	// A poll failed, the loop reconnects with backoff
+	EventDisconnected EventType = "disconnected"
+	// A poll returned a new netmap
+	EventNetmapUpdated EventType = "netmap_updated"
+	// The node key expired, the loop logs in again until the key is renewed
+	EventKeyExpired EventType = "key_expired"
+	// Logging in again after the node key expired failed, the loop stopped
+	EventLoginFailed EventType = "login_failed"
+)
+
+// Event is a change in the state of the poll loop
+type Event struct {
+	Type EventType
+	// URL of the control server
+	Server string
+	// The poll response with the netmap, set for EventNetmapUpdated
+	Poll *controlapi.PollResponse
+	// Whether Poll is the netmap cached in the state, which is published when
+	// polling starts
+	Cached bool
+	// The error that ended the poll, set for EventDisconnected, or the last login
+	// error for EventLoginFailed
+	Err error
+}
+
+// Subscribe returns a channel receiving poll loop events and a function to
+// unsubscribe, which closes the channel. Events are dropped for subscribers
+// whose buffer is full.
+func (c *Client) Subscribe(buffer int) (<-chan Event, func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan Event, buffer)
+	c.subs[ch] = struct{}{}
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			c.mu.Lock()
+			delete(c.subs, ch)
+			c.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+func (c *Client) publish(e Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for ch := range c.subs {
+		select {
+		case ch <- e:
+		default:
+			log.Printf("client event subscriber is full, dropping %s event", e.Type)
+		}
+	}
+}
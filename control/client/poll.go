@@ -0,0 +1,244 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caldog20/calnet/control/client/state"
+	"github.com/caldog20/calnet/pkg/controlapi"
+	"github.com/caldog20/calnet/pkg/keys"
+)
+
+// statusError is a request the control server answered with an unexpected status
+type statusError struct {
+	// Request that failed, such as login or poll
+	op     string
+	status string
+	msg    string
+	// From the Retry-After header of a rate limited request
+	retryAfter time.Duration
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s failed with status %s: %s", e.op, e.status, e.msg)
+}
+
+// newStatusError returns the error for the response to op with an unexpected
+// status, reading the message from the start of the body
+func newStatusError(op string, resp *http.Response) *statusError {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	err := &statusError{op: op, status: resp.Status, msg: strings.TrimSpace(string(msg))}
+	if secs, convErr := strconv.Atoi(resp.Header.Get("Retry-After")); convErr == nil {
+		err.retryAfter = time.Duration(secs) * time.Second
+	}
+	return err
+}
+
+// StartPoll starts polling the control server for netmap updates until ctx is done.
+// Failed polls are retried with backoff, failing over to another control server
+// while the current one is unavailable, and the client logs in again if the node
+// key expires. callback is called with every poll response, and the changes are
+// published to subscribers as events. If logging in again keeps failing the loop
+// publishes EventLoginFailed and stops.
+//
+// A client with a state that has a cached netmap can poll without logging in,
+// the cached netmap is passed to callback first so the node can run offline
+// until a control server is reachable.
+func (c *Client) StartPoll(ctx context.Context, callback func(*controlapi.PollResponse)) error {
+	c.mu.Lock()
+	loggedIn := c.loggedIn
+	c.mu.Unlock()
+	cached := c.CachedNetmap()
+	if !loggedIn && cached == nil {
+		return errors.New("client must be logged in before polling")
+	}
+
+	go c.pollLoop(ctx, cached, callback)
+	return nil
+}
+
+// CachedNetmap returns the last netmap saved in the state, or nil
+func (c *Client) CachedNetmap() *controlapi.PollResponse {
+	if c.state == nil {
+		return nil
+	}
+	return c.state.State().LastPoll
+}
+
+func (c *Client) pollLoop(
+	ctx context.Context,
+	cached *controlapi.PollResponse,
+	callback func(*controlapi.PollResponse),
+) {
+	if cached != nil {
+		if callback != nil {
+			callback(cached)
+		}
+		c.publish(Event{Type: EventNetmapUpdated, Poll: cached, Cached: true})
+	}
+
+	b := c.newBackoff()
+	connected := false
+	for {
+		s, key, err := c.activeServer(ctx)
+		if err != nil {
+			return
+		}
+
+		resp, err := c.poll(ctx, s, key)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			var unavailable *unavailableError
+			if errors.As(err, &unavailable) {
+				c.serverFailed(s, err)
+			}
+			if connected {
+				connected = false
+				c.publish(Event{Type: EventDisconnected, Server: s.url.String(), Err: err})
+			}
+			d := b.next()
+			var status *statusError
+			if errors.As(err, &status) {
+				d = max(d, status.retryAfter)
+			}
+			log.Printf("poll failed, retrying in %s: %s", d, err)
+			if !sleep(ctx, d) {
+				return
+			}
+			continue
+		}
+
+		b.reset()
+		if !connected {
+			connected = true
+			c.publish(Event{Type: EventConnected, Server: s.url.String()})
+		}
+		// The poll timed out without changes
+		if resp == nil {
+			continue
+		}
+
+		if callback != nil {
+			callback(resp)
+		}
+		if resp.KeyExpired {
+			log.Println("node key is expired, logging in again")
+			connected = false
+			c.publish(Event{Type: EventKeyExpired, Server: s.url.String()})
+			if err := c.relogin(ctx); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Printf("giving up logging in again, stopping poll: %s", err)
+				c.publish(Event{Type: EventLoginFailed, Server: s.url.String(), Err: err})
+				return
+			}
+			continue
+		}
+		c.saveNetmap(resp)
+		c.publish(Event{Type: EventNetmapUpdated, Server: s.url.String(), Poll: resp})
+	}
+}
+
+func (c *Client) saveNetmap(resp *controlapi.PollResponse) {
+	if c.state == nil {
+		return
+	}
+	err := c.state.Update(func(st *state.State) {
+		st.LastPoll = resp
+		st.LastPollTime = time.Now()
+	})
+	if err != nil {
+		log.Printf("error saving netmap to state: %s", err)
+	}
+}
+
+// poll sends one poll to s. It returns a nil response without an error if the
+// poll timed out without changes.
+func (c *Client) poll(
+	ctx context.Context,
+	s *server,
+	key keys.PublicKey,
+) (*controlapi.PollResponse, error) {
+	c.mu.Lock()
+	pollReq := &controlapi.PollRequest{NodeKey: c.nodePublic}
+	c.mu.Unlock()
+
+	b, err := json.Marshal(pollReq)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do(ctx, s, key, "/poll", b)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNoContent:
+		return nil, nil
+	default:
+		return nil, newStatusError("poll", resp)
+	}
+
+	b, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading poll response: %w", err)
+	}
+
+	decrypted, ok := c.controlPrivate.DecryptBox(b, key)
+	if !ok {
+		return nil, errors.New("error decrypting control poll response")
+	}
+
+	pollResp := &controlapi.PollResponse{}
+	err = json.Unmarshal(decrypted, pollResp)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling poll response: %w", err)
+	}
+	return pollResp, nil
+}
+
+// relogin logs in until the login succeeds, backing off between attempts and for
+// as long as a rate limited login asks. It returns the last error after
+// maxReloginAttempts, ErrKeyExpired if the server kept reporting the key expired,
+// or the error of ctx if it was done first.
+func (c *Client) relogin(ctx context.Context) error {
+	b := c.newBackoff()
+	for attempt := 1; ; attempt++ {
+		resp, err := c.Login(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == nil && resp.LoggedIn {
+			return nil
+		}
+		if err == nil {
+			err = ErrKeyExpired
+		}
+		if attempt == maxReloginAttempts {
+			return err
+		}
+		d := b.next()
+		var status *statusError
+		if errors.As(err, &status) {
+			d = max(d, status.retryAfter)
+		}
+		log.Printf("login failed, retrying in %s: %s", d, err)
+		if !sleep(ctx, d) {
+			return ctx.Err()
+		}
+	}
+}
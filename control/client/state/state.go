@@ -0,0 +1,271 @@
+// Package state keeps the state a node needs across restarts in a file: its
+// keys, so it keeps its registration and IP, the pinned control server keys and
+// the last netmap, so it can keep working while the control server is unreachable.
+package state
+
+import (
+	crand "crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/caldog20/calnet/pkg/controlapi"
+	"github.com/caldog20/calnet/pkg/keys"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+const fileVersion = 1
+
+// scrypt parameters for deriving the file key from a passphrase
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptSalt   = 16
+	secretKeyLen = 32
+	nonceLen     = 24
+)
+
+var (
+	// ErrPassphraseRequired is returned opening an encrypted state file without a passphrase
+	ErrPassphraseRequired = errors.New("state file is encrypted and needs a passphrase")
+	// ErrWrongPassphrase is returned when a state file can't be decrypted with the passphrase
+	ErrWrongPassphrase = errors.New("wrong passphrase for state file")
+)
+
+// State is what a node keeps across restarts
+type State struct {
+	// Node control private key, which identifies the node to the control server
+	ControlKey keys.PrivateKey `json:"control_key"`
+	// Node data private key
+	NodeKey keys.PrivateKey `json:"node_key"`
+	// Pinned control server keys keyed by server URL
+	ServerKeys map[string]keys.PublicKey `json:"server_keys,omitempty"`
+	// The last poll response with a netmap and when it was received
+	LastPoll     *controlapi.PollResponse `json:"last_poll,omitempty"`
+	LastPollTime time.Time                `json:"last_poll_time,omitzero"`
+}
+
+// file is the state file format. The state is either stored as is or encrypted.
+type file struct {
+	Version   int        `json:"version"`
+	State     *State     `json:"state,omitempty"`
+	Encrypted *encrypted `json:"encrypted,omitempty"`
+}
+
+// encrypted is the state sealed with a secretbox keyed by the scrypt hash of the
+// passphrase
+type encrypted struct {
+	Salt []byte `json:"salt"`
+	N    int    `json:"n"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+	// Nonce followed by the sealed state JSON
+	Box []byte `json:"box"`
+}
+
+// Store is a state file that is rewritten on every update
+type Store struct {
+	path string
+	// Set when the file is encrypted, with the parameters key was derived with
+	key *[secretKeyLen]byte
+	kdf encrypted
+
+	mu    sync.Mutex
+	state State
+}
+
+// Open loads the state file at path, creating it with new keys if it doesn't exist.
+// With a passphrase the file is encrypted, a file that was not encrypted is
+// encrypted when it is opened.
+func Open(path, passphrase string) (*Store, error) {
+	s := &Store{path: path}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		if passphrase != "" {
+			if err = s.newPassphrase(passphrase); err != nil {
+				return nil, err
+			}
+		}
+		s.state = State{
+			ControlKey: keys.NewPrivateKey(),
+			NodeKey:    keys.NewPrivateKey(),
+		}
+		if err = s.save(); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	f := file{}
+	if err = json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("error decoding state file: %w", err)
+	}
+	if f.Version > fileVersion {
+		return nil, fmt.Errorf("state file version %d is newer than supported version %d",
+			f.Version, fileVersion)
+	}
+
+	switch {
+	case f.Encrypted != nil:
+		if passphrase == "" {
+			return nil, ErrPassphraseRequired
+		}
+		e := f.Encrypted
+		// Files are only written with these parameters, larger ones would only
+		// make deriving the key take more time and memory than intended
+		if e.N > scryptN || e.R > scryptR || e.P > scryptP {
+			return nil, fmt.Errorf(
+				"state file scrypt parameters N=%d r=%d p=%d exceed N=%d r=%d p=%d",
+				e.N, e.R, e.P, scryptN, scryptR, scryptP)
+		}
+		kdf := *e
+		kdf.Box = nil
+		if err = s.deriveKey(passphrase, kdf); err != nil {
+			return nil, err
+		}
+		if len(e.Box) < nonceLen {
+			return nil, errors.New("encrypted state is truncated")
+		}
+		var nonce [nonceLen]byte
+		copy(nonce[:], e.Box)
+		plain, ok := secretbox.Open(nil, e.Box[nonceLen:], &nonce, s.key)
+		if !ok {
+			return nil, ErrWrongPassphrase
+		}
+		if err = json.Unmarshal(plain, &s.state); err != nil {
+			return nil, fmt.Errorf("error decoding state: %w", err)
+		}
+	case f.State != nil:
+		s.state = *f.State
+		if passphrase != "" {
+			if err = s.newPassphrase(passphrase); err != nil {
+				return nil, err
+			}
+			if err = s.save(); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, errors.New("state file has no state")
+	}
+
+	if s.state.ControlKey.IsZero() || s.state.NodeKey.IsZero() {
+		return nil, errors.New("state file is missing the node keys")
+	}
+	return s, nil
+}
+
+// newPassphrase derives the file key from passphrase with a new salt
+func (s *Store) newPassphrase(passphrase string) error {
+	salt := make([]byte, scryptSalt)
+	if _, err := io.ReadFull(crand.Reader, salt); err != nil {
+		return err
+	}
+	return s.deriveKey(passphrase, encrypted{Salt: salt, N: scryptN, R: scryptR, P: scryptP})
+}
+
+// deriveKey derives the file key from passphrase with the salt and scrypt
+// parameters of kdf
+func (s *Store) deriveKey(passphrase string, kdf encrypted) error {
+	k, err := scrypt.Key([]byte(passphrase), kdf.Salt, kdf.N, kdf.R, kdf.P, secretKeyLen)
+	if err != nil {
+		return fmt.Errorf("error deriving state file key: %w", err)
+	}
+	s.key = (*[secretKeyLen]byte)(k)
+	s.kdf = kdf
+	return nil
+}
+
+// State returns a copy of the state. The netmap is shared and must not be modified.
+func (s *Store) State() State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.state
+	st.ServerKeys = maps.Clone(st.ServerKeys)
+	return st
+}
+
+// Update calls fn to modify the state and saves it
+func (s *Store) Update(fn func(*State)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(&s.state)
+	return s.save()
+}
+
+// save writes the state to a temporary file that replaces the state file, so
+// the file is never partially written. The directory is synced after the rename
+// so the new file survives a crash.
+func (s *Store) save() error {
+	f := file{Version: fileVersion}
+	if s.key == nil {
+		f.State = &s.state
+	} else {
+		plain, err := json.Marshal(&s.state)
+		if err != nil {
+			return err
+		}
+		var nonce [nonceLen]byte
+		if _, err = io.ReadFull(crand.Reader, nonce[:]); err != nil {
+			return err
+		}
+		e := s.kdf
+		e.Box = secretbox.Seal(nonce[:], plain, &nonce, s.key)
+		f.Encrypted = &e
+	}
+	b, err := json.MarshalIndent(&f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// CreateTemp creates the file with 0600 permissions
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(s.path))
+}
+
+// syncDir flushes a rename in dir to disk. Windows can't sync directories and
+// makes renames durable without it.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err = d.Sync(); err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
@@ -0,0 +1,135 @@
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caldog20/calnet/pkg/controlapi"
+	"github.com/caldog20/calnet/pkg/keys"
+)
+
+func TestState(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	s, err := Open(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := s.State()
+	if st.ControlKey.IsZero() || st.NodeKey.IsZero() {
+		t.Fatal("new state has no keys")
+	}
+
+	serverKey := keys.NewPrivateKey().PublicKey()
+	netmap := &controlapi.PollResponse{Config: &controlapi.NodeConfig{ID: 1}}
+	err = s.Update(func(st *State) {
+		st.ServerKeys = map[string]keys.PublicKey{"https://control": serverKey}
+		st.LastPoll = netmap
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("state file has permissions %v, expected 0600", info.Mode().Perm())
+	}
+	// Nothing is left from the atomic writes
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("got %d files in the state dir, expected only the state file", len(entries))
+	}
+
+	reopened, err := Open(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := reopened.State()
+	if !got.ControlKey.Compare(st.ControlKey) || !got.NodeKey.Compare(st.NodeKey) {
+		t.Error("reopened state has different keys")
+	}
+	if got.ServerKeys["https://control"] != serverKey {
+		t.Error("reopened state lost the pinned server key")
+	}
+	if got.LastPoll == nil || got.LastPoll.Config.ID != 1 {
+		t.Errorf("reopened state has netmap %+v", got.LastPoll)
+	}
+}
+
+func TestEncryptedState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	s, err := Open(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	controlKey := s.State().ControlKey
+	keyText, _ := controlKey.MarshalText()
+
+	// A plain state file is encrypted when opened with a passphrase
+	if _, err = Open(path, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, keyText) {
+		t.Fatal("encrypted state file contains the control key")
+	}
+
+	if _, err = Open(path, ""); !errors.Is(err, ErrPassphraseRequired) {
+		t.Errorf("got error %v without a passphrase, expected ErrPassphraseRequired", err)
+	}
+	if _, err = Open(path, "wrong"); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("got error %v with the wrong passphrase, expected ErrWrongPassphrase", err)
+	}
+
+	s, err = Open(path, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.State().ControlKey.Compare(controlKey) {
+		t.Fatal("decrypted state has a different control key")
+	}
+	// Updates stay encrypted
+	if err = s.Update(func(st *State) { st.LastPoll = &controlapi.PollResponse{} }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Open(path, ""); !errors.Is(err, ErrPassphraseRequired) {
+		t.Errorf("got error %v after an update, expected ErrPassphraseRequired", err)
+	}
+}
+
+func TestEncryptedStateScryptLimits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	if _, err := Open(path, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := file{}
+	if err = json.Unmarshal(b, &f); err != nil {
+		t.Fatal(err)
+	}
+
+	// A file can't make opening it derive the key with more work than it is written with
+	f.Encrypted.N = scryptN << 1
+	if b, err = json.Marshal(&f); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Open(path, "secret"); err == nil {
+		t.Fatal("expected error opening a state file with a larger scrypt N")
+	}
+}
@@ -1,21 +1,427 @@
 package apiservice
 
 import (
+	"encoding/json"
+	"errors"
 	"net/http"
+	"strings"
+	"sync"
 
+	"github.com/caldog20/calnet/control/server/config"
+	"github.com/caldog20/calnet/control/server/events"
 	"github.com/caldog20/calnet/control/server/internal/store"
+	"github.com/caldog20/calnet/control/server/logging"
+	"github.com/caldog20/calnet/pkg/adminapi"
 )
 
+var logger = logging.Logger(logging.SubsystemAPI)
+
 type RestAPI struct {
 	disableAuth bool
+	tokens      map[string]string
 	store       store.Store
+	bus         *events.Bus
+	sessions    *sessionStore
+	openAPI     func() ([]byte, error)
+	// Reloads the server config, nil if reloading is not supported
+	reloadConfig ConfigReloader
+	// Requests must present a verified TLS client certificate
+	requireClientCert bool
+	// Recorded in exports as the network prefix and settings the nodes were created with
+	exportConf config.Config
+	// Closed by Drain to end the event streams
+	draining  chan struct{}
+	drainOnce sync.Once
+}
+
+func New(conf config.Config, store store.Store) *RestAPI {
+	r := &RestAPI{
+		store:       store,
+		tokens:      conf.APITokens,
+		disableAuth: conf.Debug,
+		sessions:    newSessionStore(),
+		exportConf:  conf,
+		draining:    make(chan struct{}),
+	}
+	r.openAPI = sync.OnceValues(func() ([]byte, error) {
+		return buildOpenAPI(r.routes())
+	})
+	return r
+}
+
+// SetEventBus sets the bus that node events from API mutations are published to
+func (r *RestAPI) SetEventBus(bus *events.Bus) {
+	r.bus = bus
+}
+
+// Drain ends the event streams, which would otherwise keep the admin server from
+// shutting down. Clients resume them from another server with Last-Event-ID.
+func (r *RestAPI) Drain() {
+	r.drainOnce.Do(func() { close(r.draining) })
 }
 
-func New(store store.Store) *RestAPI {
-	return &RestAPI{store: store}
+// route is an endpoint of the API. Routes are registered on the mux and documented
+// in the OpenAPI document from the same table so the two cannot drift apart.
+type route struct {
+	method      string
+	path        string
+	handler     http.HandlerFunc
+	operationID string
+	tag         string
+	summary     string
+	// Routes are authenticated with a bearer token unless public is set
+	public bool
+	query  []queryParam
+	// Request body model, nil if the route takes no body
+	request any
+	// Status and model of a successful response, a nil response has no body
+	status   int
+	response any
+	// Content type of the response if it is not application/json
+	contentType string
+	// Error status codes the route returns besides those documented for every route
+	errors []int
+}
+
+type queryParam struct {
+	name        string
+	typ         string
+	description string
+	enum        []string
+}
+
+var (
+	limitParam = queryParam{"limit", "integer", "maximum number of results", nil}
+
+	nodeQueryParams = []queryParam{
+		{"user", "string", "only nodes registered to the user", nil},
+		{"tag", "string", "only nodes with the tag", nil},
+		{"hostname", "string", "case-insensitive substring of the node name or hostname", nil},
+		{"prefix", "string", "only nodes with an IP inside the prefix", nil},
+		{"disabled", "boolean", "only disabled or enabled nodes", nil},
+		{"expired", "boolean", "only nodes with an expired or valid key", nil},
+		{"online", "boolean", "only online or offline nodes", nil},
+		{"sort", "string", "sort field", []string{"id", "created", "last_seen", "expiry"}},
+		{"order", "string", "sort order", []string{"asc", "desc"}},
+		limitParam,
+		{"cursor", "string", "next cursor of the previous page", nil},
+		{"fields", "string", "comma separated node fields to return", nil},
+	}
+
+	auditQueryParams = []queryParam{
+		{"action", "string", "only events with the action", nil},
+		{"actor", "string", "only events from the actor", nil},
+		{"node_id", "integer", "only events for the node", nil},
+		{"since", "string", "only events at or after this RFC3339 time", nil},
+		{"until", "string", "only events before this RFC3339 time", nil},
+		{"after", "integer", "next cursor of the previous page", nil},
+		limitParam,
+	}
+)
+
+func (r *RestAPI) routes() []route {
+	node := func(method, path, id, summary string, h http.HandlerFunc, request any) route {
+		return route{
+			method:      method,
+			path:        path,
+			handler:     h,
+			operationID: id,
+			tag:         "nodes",
+			summary:     summary,
+			request:     request,
+			status:      http.StatusOK,
+			response:    adminapi.Node{},
+		}
+	}
+
+	return []route{
+		{
+			method:      http.MethodGet,
+			path:        "/api/v1/openapi.json",
+			handler:     r.handleOpenAPI,
+			operationID: "getOpenAPI",
+			tag:         "meta",
+			summary:     "OpenAPI document describing this API",
+			public:      true,
+			status:      http.StatusOK,
+			response:    map[string]any{},
+		},
+		{
+			method:      http.MethodPost,
+			path:        "/api/v1/session",
+			handler:     r.handleCreateSession,
+			operationID: "createSession",
+			tag:         "session",
+			summary: "Exchange an API token for a session cookie and CSRF token. " +
+				"Unsafe requests authenticated by the cookie must send the X-CSRF-Token header.",
+			public:   true,
+			request:  adminapi.CreateSessionRequest{},
+			status:   http.StatusCreated,
+			response: adminapi.Session{},
+			errors:   []int{http.StatusUnauthorized, http.StatusUnsupportedMediaType},
+		},
+		{
+			method:      http.MethodDelete,
+			path:        "/api/v1/session",
+			handler:     r.handleDeleteSession,
+			operationID: "deleteSession",
+			tag:         "session",
+			summary:     "Log out of a session",
+			public:      true,
+			status:      http.StatusNoContent,
+		},
+		{
+			method:      http.MethodGet,
+			path:        "/api/v1/nodes",
+			handler:     r.handleGetNodes,
+			operationID: "listNodes",
+			tag:         "nodes",
+			summary:     "List nodes matching a filter, a page at a time",
+			query:       nodeQueryParams,
+			status:      http.StatusOK,
+			response:    adminapi.Nodes{},
+		},
+		node(http.MethodGet, "/api/v1/node/{id}", "getNode", "Get a node",
+			r.handleGetNodeByID, nil),
+		{
+			method:      http.MethodDelete,
+			path:        "/api/v1/node/{id}",
+			handler:     r.handleDeleteNode,
+			operationID: "deleteNode",
+			tag:         "nodes",
+			summary:     "Delete a node",
+			status:      http.StatusNoContent,
+		},
+		node(http.MethodPost, "/api/v1/node/{id}/disable", "disableNode", "Disable a node",
+			r.handleDisableNode, nil),
+		node(http.MethodPost, "/api/v1/node/{id}/enable", "enableNode", "Enable a node",
+			r.handleEnableNode, nil),
+		node(http.MethodPost, "/api/v1/node/{id}/expire", "expireNode", "Expire the node key",
+			r.handleExpireNode, nil),
+		node(http.MethodPost, "/api/v1/node/{id}/rename", "renameNode", "Rename a node",
+			r.handleRenameNode, adminapi.RenameNodeRequest{}),
+		node(http.MethodPost, "/api/v1/node/{id}/routes", "approveRoutes",
+			"Replace the approved routes of a node", r.handleApproveRoutes,
+			adminapi.ApproveRoutesRequest{}),
+		{
+			method:      http.MethodGet,
+			path:        "/api/v1/users",
+			handler:     r.handleGetUsers,
+			operationID: "listUsers",
+			tag:         "users",
+			summary:     "List users with registered nodes",
+			status:      http.StatusOK,
+			response:    adminapi.Users{},
+		},
+		{
+			method:      http.MethodGet,
+			path:        "/api/v1/keys",
+			handler:     r.handleGetProvisionKeys,
+			operationID: "listProvisionKeys",
+			tag:         "keys",
+			summary:     "List provisioning keys",
+			status:      http.StatusOK,
+			response:    adminapi.ProvisionKeys{},
+		},
+		{
+			method:      http.MethodPost,
+			path:        "/api/v1/keys",
+			handler:     r.handleCreateProvisionKey,
+			operationID: "createProvisionKey",
+			tag:         "keys",
+			summary:     "Create a provisioning key, the key is only returned in this response",
+			request:     adminapi.CreateProvisionKeyRequest{},
+			status:      http.StatusCreated,
+			response:    adminapi.ProvisionKey{},
+		},
+		{
+			method:      http.MethodPost,
+			path:        "/api/v1/key/{id}/revoke",
+			handler:     r.handleRevokeProvisionKey,
+			operationID: "revokeProvisionKey",
+			tag:         "keys",
+			summary:     "Revoke a provisioning key",
+			status:      http.StatusOK,
+			response:    adminapi.ProvisionKey{},
+		},
+		{
+			method:      http.MethodGet,
+			path:        "/api/v1/events",
+			handler:     r.handleEvents,
+			operationID: "streamEvents",
+			tag:         "events",
+			summary:     "Stream node events as Server-Sent Events",
+			query: []queryParam{
+				{"types", "string", "comma separated event types to stream", nil},
+				{"last_event_id", "integer", "resume after this event id", nil},
+			},
+			status:      http.StatusOK,
+			response:    adminapi.Event{},
+			contentType: "text/event-stream",
+		},
+		{
+			method:      http.MethodGet,
+			path:        "/api/v1/audit",
+			handler:     r.handleGetAuditEvents,
+			operationID: "listAuditEvents",
+			tag:         "audit",
+			summary:     "List audit events oldest first, a page at a time",
+			query:       auditQueryParams,
+			status:      http.StatusOK,
+			response:    adminapi.AuditEvents{},
+		},
+		{
+			method:      http.MethodGet,
+			path:        "/api/v1/audit/export",
+			handler:     r.handleExportAuditEvents,
+			operationID: "exportAuditEvents",
+			tag:         "audit",
+			summary:     "Export every matching audit event as JSON lines",
+			// The export ignores limit and returns every event
+			query:       auditQueryParams[:len(auditQueryParams)-1],
+			status:      http.StatusOK,
+			response:    adminapi.AuditEvent{},
+			contentType: "application/x-ndjson",
+		},
+		{
+			method:      http.MethodGet,
+			path:        "/api/v1/webhooks",
+			handler:     r.handleGetWebhooks,
+			operationID: "listWebhooks",
+			tag:         "webhooks",
+			summary:     "List webhooks",
+			status:      http.StatusOK,
+			response:    adminapi.Webhooks{},
+		},
+		{
+			method:      http.MethodPost,
+			path:        "/api/v1/webhooks",
+			handler:     r.handleCreateWebhook,
+			operationID: "createWebhook",
+			tag:         "webhooks",
+			summary:     "Create a webhook, the secret is only returned in this response",
+			request:     adminapi.CreateWebhookRequest{},
+			status:      http.StatusCreated,
+			response:    adminapi.Webhook{},
+		},
+		{
+			method:      http.MethodDelete,
+			path:        "/api/v1/webhook/{id}",
+			handler:     r.handleDeleteWebhook,
+			operationID: "deleteWebhook",
+			tag:         "webhooks",
+			summary:     "Delete a webhook",
+			status:      http.StatusNoContent,
+		},
+		{
+			method:      http.MethodGet,
+			path:        "/api/v1/webhook/{id}/deliveries",
+			handler:     r.handleGetWebhookDeliveries,
+			operationID: "listWebhookDeliveries",
+			tag:         "webhooks",
+			summary:     "List the most recent delivery attempts of a webhook",
+			query:       []queryParam{limitParam},
+			status:      http.StatusOK,
+			response:    adminapi.WebhookDeliveries{},
+		},
+		{
+			method:      http.MethodGet,
+			path:        "/api/v1/backup",
+			handler:     r.handleBackup,
+			operationID: "backupStore",
+			tag:         "store",
+			summary:     "Download a consistent copy of the store database while the server runs",
+			status:      http.StatusOK,
+			response:    []byte{},
+			contentType: "application/octet-stream",
+			errors:      []int{http.StatusNotImplemented},
+		},
+		{
+			method:      http.MethodGet,
+			path:        "/api/v1/export",
+			handler:     r.handleExport,
+			operationID: "exportStore",
+			tag:         "store",
+			summary:     "Export nodes, users, provisioning keys and webhooks as JSON",
+			status:      http.StatusOK,
+			response:    json.RawMessage{},
+		},
+		{
+			method:      http.MethodPost,
+			path:        "/api/v1/config/reload",
+			handler:     r.handleReloadConfig,
+			operationID: "reloadConfig",
+			tag:         "config",
+			summary: "Reload the server config and apply the values that can change " +
+				"while the server runs. Changes that need a restart are rejected with 409.",
+			status:   http.StatusOK,
+			response: adminapi.ConfigReload{},
+			errors: []int{
+				http.StatusConflict,
+				http.StatusUnprocessableEntity,
+				http.StatusNotImplemented,
+			},
+		},
+	}
 }
 
+// RegisterRoutes registers every API route under /api/ on mux.
+// Requests under /api/ that match no route get a JSON error response.
 func (r *RestAPI) RegisterRoutes(mux *http.ServeMux) {
-	mux.HandleFunc("GET /api/v1/nodes", r.handleGetNodes)
-	mux.HandleFunc("GET /api/v1/node/{id}", r.handleGetNodeByID)
+	api := http.NewServeMux()
+	for _, rt := range r.routes() {
+		h := rt.handler
+		if !rt.public {
+			h = r.authenticated(h)
+		}
+		api.HandleFunc(rt.method+" "+rt.path, h)
+	}
+	var h http.Handler = jsonErrors(api)
+	if r.requireClientCert {
+		h = requireClientCert(h)
+	}
+	mux.Handle("/api/", h)
+}
+
+func (r *RestAPI) handleOpenAPI(w http.ResponseWriter, req *http.Request) {
+	doc, err := r.openAPI()
+	if err != nil {
+		writeJSONError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(doc)
+}
+
+// jsonErrors serves requests with mux. The 404 and 405 responses the mux writes
+// for requests matching no route are rewritten as JSON errors like every other error.
+func jsonErrors(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if _, pattern := mux.Handler(req); pattern == "" {
+			w = &errorRewriter{ResponseWriter: w}
+		}
+		mux.ServeHTTP(w, req)
+	})
+}
+
+// errorRewriter keeps the status code and headers of an error response
+// and replaces the plain text body with a JSON error
+type errorRewriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (e *errorRewriter) WriteHeader(code int) {
+	if e.wroteHeader {
+		return
+	}
+	e.wroteHeader = true
+	e.Header().Del("X-Content-Type-Options")
+	writeJSONError(e.ResponseWriter, errors.New(strings.ToLower(http.StatusText(code))), code)
+}
+
+// Write discards the plain text body
+func (e *errorRewriter) Write(b []byte) (int, error) {
+	return len(b), nil
 }
@@ -0,0 +1,525 @@
+package apiservice
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caldog20/calnet/control/server/events"
+	"github.com/caldog20/calnet/control/server/internal/node"
+	"github.com/caldog20/calnet/control/server/internal/provision"
+	"github.com/caldog20/calnet/control/server/internal/store"
+	"github.com/caldog20/calnet/control/server/internal/webhook"
+	"github.com/caldog20/calnet/pkg/adminapi"
+	"github.com/caldog20/calnet/pkg/controlapi"
+	"github.com/caldog20/calnet/pkg/keys"
+)
+
+func newTestClient(t *testing.T) (*adminapi.Client, store.Store) {
+	t.Helper()
+	c, api := newTestClientAPI(t)
+	return c, api.store
+}
+
+func newTestClientAPI(t *testing.T) (*adminapi.Client, *RestAPI) {
+	t.Helper()
+	api, srv := newTestAPI(t)
+	c, err := adminapi.NewClient(srv.URL, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, api
+}
+
+func createNode(t *testing.T, db store.Store, user string, routes ...netip.Prefix) *node.Node {
+	t.Helper()
+	n := &node.Node{
+		NodeKey:  keys.NewPrivateKey().PublicKey(),
+		Name:     "host",
+		User:     user,
+		Hostinfo: &controlapi.Hostinfo{Hostname: "host", Routes: routes},
+	}
+	if err := db.CreateNode(n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestNodeActions(t *testing.T) {
+	c, api := newTestClientAPI(t)
+	db := api.store
+	ctx := context.Background()
+	lan := netip.MustParsePrefix("192.168.1.0/24")
+	n := createNode(t, db, "alice", lan)
+
+	nodes, err := c.AllNodes(ctx, adminapi.NodeQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 1 || nodes[0].ID != n.ID {
+		t.Fatalf("got nodes %+v, expected node %d", nodes, n.ID)
+	}
+
+	renamed, err := c.RenameNode(ctx, n.ID, "Web-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renamed.Name != "web-1" {
+		t.Errorf("got name %q, expected web-1", renamed.Name)
+	}
+
+	var apiErr *adminapi.Error
+	_, err = c.RenameNode(ctx, n.ID, "-bad name")
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("got error %v renaming to invalid name, expected 400", err)
+	}
+
+	approved, err := c.ApproveRoutes(ctx, n.ID, []netip.Prefix{lan})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(approved.ApprovedRoutes) != 1 || approved.ApprovedRoutes[0] != lan {
+		t.Errorf("got approved routes %v, expected [%s]", approved.ApprovedRoutes, lan)
+	}
+
+	_, err = c.ApproveRoutes(ctx, n.ID, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")})
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("got error %v approving unadvertised route, expected 400", err)
+	}
+
+	disabled, err := c.DisableNode(ctx, n.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !disabled.Disabled {
+		t.Error("node not disabled")
+	}
+
+	if _, err = c.ExpireNode(ctx, n.ID); err != nil {
+		t.Fatal(err)
+	}
+	published, _ := api.bus.Since(0)
+	if e := published[len(published)-1]; e.Type != events.NodeKeyExpired || e.NodeID != n.ID {
+		t.Errorf(
+			"got %s event for node %d after expiring, expected %s",
+			e.Type,
+			e.NodeID,
+			events.NodeKeyExpired,
+		)
+	}
+
+	if err = c.DeleteNode(ctx, n.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Node(ctx, n.ID); !adminapi.IsNotFound(err) {
+		t.Errorf("got error %v getting deleted node, expected not found", err)
+	}
+
+	page, err := c.AuditEvents(ctx, adminapi.AuditQuery{NodeID: n.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// rename, approve routes, disable, expire and delete
+	if len(page.Events) != 5 {
+		t.Errorf("got %d audit events, expected 5", len(page.Events))
+	}
+}
+
+func TestNodeQuery(t *testing.T) {
+	c, db := newTestClient(t)
+	ctx := context.Background()
+
+	for i, hostname := range []string{"web-1", "web-2", "db-1", "db-2", "cache"} {
+		n := &node.Node{
+			NodeKey:   keys.NewPrivateKey().PublicKey(),
+			Name:      hostname,
+			IP:        netip.AddrFrom4([4]byte{100, 70, byte(i / 2), byte(i + 1)}),
+			User:      "alice",
+			KeyExpiry: time.Now().Add(time.Hour * time.Duration(5-i)),
+			Disabled:  i == 4,
+		}
+		if i%2 == 0 {
+			n.User = "bob"
+			n.Tags = []string{"tag:prod"}
+		}
+		if err := db.CreateNode(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	disabled, enabled := true, false
+	for _, tc := range []struct {
+		name  string
+		query adminapi.NodeQuery
+		ids   []uint64
+	}{
+		{"user", adminapi.NodeQuery{User: "alice"}, []uint64{2, 4}},
+		{"tag", adminapi.NodeQuery{Tag: "tag:prod"}, []uint64{1, 3, 5}},
+		{"disabled", adminapi.NodeQuery{Disabled: &disabled}, []uint64{5}},
+		{"enabled", adminapi.NodeQuery{Disabled: &enabled, Tag: "tag:prod"}, []uint64{1, 3}},
+		{"prefix", adminapi.NodeQuery{Prefix: netip.MustParsePrefix("100.70.1.0/24")}, []uint64{3, 4}},
+		{"hostname", adminapi.NodeQuery{Hostname: "WEB"}, []uint64{1, 2}},
+		{"sort expiry", adminapi.NodeQuery{Sort: "expiry"}, []uint64{5, 4, 3, 2, 1}},
+		{"sort id desc", adminapi.NodeQuery{Descending: true}, []uint64{5, 4, 3, 2, 1}},
+		// Pages of two are followed through the cursor
+		{
+			"paged",
+			adminapi.NodeQuery{Sort: "created", Descending: true, Limit: 2},
+			[]uint64{5, 4, 3, 2, 1},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			nodes, err := c.AllNodes(ctx, tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := make([]uint64, len(nodes))
+			for i, n := range nodes {
+				ids[i] = n.ID
+			}
+			if !slices.Equal(ids, tc.ids) {
+				t.Errorf("got node ids %v, expected %v", ids, tc.ids)
+			}
+		})
+	}
+
+	page, err := c.Nodes(ctx, adminapi.NodeQuery{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var apiErr *adminapi.Error
+	_, err = c.Nodes(ctx, adminapi.NodeQuery{Sort: "expiry", Cursor: page.Next})
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("got error %v using cursor with a different sort, expected 400", err)
+	}
+}
+
+func TestNodeFields(t *testing.T) {
+	api, srv := newTestAPI(t)
+	createNode(t, api.store, "alice")
+
+	resp := doRequest(t, http.MethodGet, srv.URL+"/api/v1/nodes?fields=id,name", "")
+	defer resp.Body.Close()
+	nodes := struct {
+		Nodes []map[string]any `json:"nodes"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&nodes); err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes.Nodes) != 1 || len(nodes.Nodes[0]) != 2 || nodes.Nodes[0]["name"] != "host" {
+		t.Errorf("got nodes %v, expected only id and name", nodes.Nodes)
+	}
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/api/v1/nodes?fields=id,secret", "")
+	expectJSONError(t, resp, http.StatusBadRequest)
+}
+
+func TestProvisionKeys(t *testing.T) {
+	c, db := newTestClient(t)
+	ctx := context.Background()
+
+	created, err := c.CreateProvisionKey(ctx, adminapi.CreateProvisionKeyRequest{
+		Description: "ci runners",
+		User:        "ci",
+		Tags:        []string{"tag:ci"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Key == "" {
+		t.Fatal("created key was not returned")
+	}
+
+	pks, err := c.ProvisionKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pks) != 1 || pks[0].Key != "" {
+		t.Fatalf("got keys %+v, expected one key without the secret", pks)
+	}
+
+	// Single use keys can only register one node
+	pk, err := db.UseProvisionKey(provision.Hash(created.Key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pk.User != "ci" {
+		t.Errorf("got user %q, expected ci", pk.User)
+	}
+	if _, err = db.UseProvisionKey(provision.Hash(created.Key)); !errors.Is(err, provision.ErrUsed) {
+		t.Errorf("got error %v reusing single use key, expected %v", err, provision.ErrUsed)
+	}
+
+	reusable, err := c.CreateProvisionKey(ctx, adminapi.CreateProvisionKeyRequest{Reusable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, err := c.RevokeProvisionKey(ctx, reusable.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !revoked.Revoked {
+		t.Error("key not revoked")
+	}
+	_, err = db.UseProvisionKey(provision.Hash(reusable.Key))
+	if !errors.Is(err, provision.ErrRevoked) {
+		t.Errorf("got error %v using revoked key, expected %v", err, provision.ErrRevoked)
+	}
+}
+
+func TestUsers(t *testing.T) {
+	c, db := newTestClient(t)
+	createNode(t, db, "bob")
+	createNode(t, db, "alice")
+	createNode(t, db, "alice")
+	createNode(t, db, "")
+
+	users, err := c.Users(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users[0].Name != "alice" || users[0].Nodes != 2 || users[1].Name != "bob" {
+		t.Errorf("got users %+v, expected alice with 2 nodes and bob", users)
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+	_, srv := newTestAPI(t)
+	c, err := adminapi.NewClient(srv.URL, "wrong")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var apiErr *adminapi.Error
+	_, err = c.Nodes(context.Background(), adminapi.NodeQuery{})
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("got error %v, expected 401", err)
+	}
+	if apiErr.Message != "invalid bearer token" {
+		t.Errorf("got message %q", apiErr.Message)
+	}
+}
+
+func TestUnixSocketClient(t *testing.T) {
+	_, srv := newTestAPI(t)
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unixSrv := &http.Server{Handler: srv.Config.Handler}
+	go unixSrv.Serve(l)
+	t.Cleanup(func() { unixSrv.Close() })
+
+	c, err := adminapi.NewClient("unix:"+path, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Nodes(context.Background(), adminapi.NodeQuery{}); err != nil {
+		t.Fatalf("got error %v listing nodes over the unix socket", err)
+	}
+
+	if _, err = adminapi.NewClient("unix:", "token"); err == nil {
+		t.Fatal("expected an error for a unix server url without a socket path")
+	}
+}
+
+func TestRequireClientCert(t *testing.T) {
+	api, _ := newTestAPI(t)
+	api.RequireClientCert()
+	mux := http.NewServeMux()
+	api.RegisterRoutes(mux)
+
+	for name, state := range map[string]*tls.ConnectionState{
+		"plain http":     nil,
+		"no certificate": {},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/openapi.json", nil)
+		req.TLS = state
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s: got status %d, expected 403", name, w.Code)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/openapi.json", nil)
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("got status %d with a verified client certificate, expected 200", w.Code)
+	}
+}
+
+// doRequest sends an authenticated request with an optional body
+func doRequest(t *testing.T, method, url, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer token")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// expectJSONError checks resp is a JSON error response with status code
+func expectJSONError(t *testing.T, resp *http.Response, code int) {
+	t.Helper()
+	defer resp.Body.Close()
+	if resp.StatusCode != code {
+		t.Errorf("got status %d, expected %d", resp.StatusCode, code)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("got content type %q, expected application/json", ct)
+	}
+	body := adminapi.ErrorResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("error decoding error response: %v", err)
+	}
+	if body.Code != code || body.Error == "" {
+		t.Errorf("got error response %+v, expected code %d and a message", body, code)
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	api, srv := newTestAPI(t)
+	n := createNode(t, api.store, "alice")
+	renameURL := srv.URL + "/api/v1/node/" + strconv.FormatUint(n.ID, 10) + "/rename"
+
+	resp := doRequest(t, http.MethodGet, srv.URL+"/api/v1/unknown", "")
+	expectJSONError(t, resp, http.StatusNotFound)
+
+	resp = doRequest(t, http.MethodPut, srv.URL+"/api/v1/nodes", "")
+	if allow := resp.Header.Get("Allow"); !strings.Contains(allow, http.MethodGet) {
+		t.Errorf("got Allow header %q, expected GET", allow)
+	}
+	expectJSONError(t, resp, http.StatusMethodNotAllowed)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/api/v1/node/abc", "")
+	expectJSONError(t, resp, http.StatusBadRequest)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/api/v1/node/1000", "")
+	expectJSONError(t, resp, http.StatusNotFound)
+
+	resp = doRequest(t, http.MethodPost, renameURL, "{")
+	expectJSONError(t, resp, http.StatusBadRequest)
+
+	large := `{"name":"` + strings.Repeat("a", maxRequestBodySize) + `"}`
+	resp = doRequest(t, http.MethodPost, renameURL, large)
+	expectJSONError(t, resp, http.StatusRequestEntityTooLarge)
+}
+
+func TestWebhookDeliveriesLimit(t *testing.T) {
+	c, db := newTestClient(t)
+	sub := &webhook.Subscription{URL: "http://localhost/hook"}
+	if err := db.CreateWebhook(sub); err != nil {
+		t.Fatal(err)
+	}
+	for range webhook.MaxDeliveryLimit + 1 {
+		if err := db.AppendWebhookDelivery(&webhook.Delivery{SubscriptionID: sub.ID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		limit    int
+		expected int
+	}{
+		{0, webhook.DefaultDeliveryLimit},
+		{5, 5},
+		{webhook.MaxDeliveryLimit * 10, webhook.MaxDeliveryLimit},
+	}
+	for _, tt := range tests {
+		deliveries, err := c.WebhookDeliveries(context.Background(), sub.ID, tt.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(deliveries) != tt.expected {
+			t.Errorf("limit %d: got %d deliveries, expected %d",
+				tt.limit, len(deliveries), tt.expected)
+		}
+	}
+
+	var apiErr *adminapi.Error
+	for _, limit := range []int{-1, -100} {
+		_, err := c.WebhookDeliveries(context.Background(), sub.ID, limit)
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+			t.Errorf("limit %d: got error %v, expected status 400", limit, err)
+		}
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	api, srv := newTestAPI(t)
+
+	// The document is public
+	resp, err := http.Get(srv.URL + "/api/v1/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, expected 200", resp.StatusCode)
+	}
+
+	doc := struct {
+		OpenAPI    string                               `json:"openapi"`
+		Paths      map[string]map[string]map[string]any `json:"paths"`
+		Components struct {
+			Schemas map[string]any `json:"schemas"`
+		} `json:"components"`
+	}{}
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(raw, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.OpenAPI != openAPIVersion {
+		t.Errorf("got openapi version %q, expected %s", doc.OpenAPI, openAPIVersion)
+	}
+
+	for _, rt := range api.routes() {
+		if _, ok := doc.Paths[rt.path][strings.ToLower(rt.method)]; !ok {
+			t.Errorf("route %s %s is not documented", rt.method, rt.path)
+		}
+	}
+
+	// Every referenced schema must be defined in the components
+	for _, m := range regexp.MustCompile(`"#/components/schemas/(\w+)"`).FindAllSubmatch(raw, -1) {
+		if _, ok := doc.Components.Schemas[string(m[1])]; !ok {
+			t.Errorf("schema %s is referenced but not defined", m[1])
+		}
+	}
+
+	node, ok := doc.Components.Schemas["Node"].(map[string]any)
+	if !ok {
+		t.Fatal("Node schema missing")
+	}
+	props, _ := node["properties"].(map[string]any)
+	for field := range nodeFields {
+		if _, ok := props[field]; !ok {
+			t.Errorf("Node schema is missing field %s", field)
+		}
+	}
+}
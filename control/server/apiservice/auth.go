@@ -0,0 +1,87 @@
+package apiservice
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/caldog20/calnet/control/server/internal/audit"
+)
+
+type actorContextKey struct{}
+
+// authenticated wraps a handler and requires a valid bearer token from the configured API tokens,
+// or a session cookie created from one by the web UI.
+// The name of the matched token is stored in the request context as the audit actor.
+func (r *RestAPI) authenticated(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if r.disableAuth {
+			ctx := context.WithValue(req.Context(), actorContextKey{}, audit.APIActor("debug"))
+			next(w, req.WithContext(ctx))
+			return
+		}
+
+		var name string
+		token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if ok {
+			name, ok = r.lookupToken(token)
+			if !ok {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeJSONError(w, errors.New("invalid bearer token"), http.StatusUnauthorized)
+				return
+			}
+		} else {
+			var err error
+			name, err = r.sessionFromRequest(req)
+			if errors.Is(err, errCSRF) {
+				writeJSONError(w, err, http.StatusForbidden)
+				return
+			}
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeJSONError(w, err, http.StatusUnauthorized)
+				return
+			}
+		}
+
+		ctx := context.WithValue(req.Context(), actorContextKey{}, audit.APIActor(name))
+		next(w, req.WithContext(ctx))
+	}
+}
+
+func (r *RestAPI) lookupToken(token string) (string, bool) {
+	if token == "" {
+		return "", false
+	}
+	for name, t := range r.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func actorFromContext(ctx context.Context) string {
+	actor, _ := ctx.Value(actorContextKey{}).(string)
+	return actor
+}
+
+// RequireClientCert makes every API request, including the public routes, present
+// a TLS client certificate verified against the client CAs of the listener. It must
+// be called before RegisterRoutes.
+func (r *RestAPI) RequireClientCert() {
+	r.requireClientCert = true
+}
+
+func requireClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+			err := errors.New("a verified client certificate is required")
+			writeJSONError(w, err, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,54 @@
+package apiservice
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/caldog20/calnet/control/server/internal/audit"
+	"github.com/caldog20/calnet/control/server/logging"
+	"github.com/caldog20/calnet/control/server/store"
+)
+
+// handleBackup streams a copy of the store database. The copy is written from a
+// single read transaction so it is consistent without stopping the server.
+func (r *RestAPI) handleBackup(w http.ResponseWriter, req *http.Request) {
+	b, ok := r.store.(store.Backuper)
+	if !ok {
+		writeJSONError(
+			w,
+			errors.New("the configured store does not support backups"),
+			http.StatusNotImplemented,
+		)
+		return
+	}
+
+	name := "calnet-" + time.Now().UTC().Format("20060102T150405Z") + ".db"
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	n, err := b.Backup(w)
+	if err != nil {
+		logger.Error("error writing store backup", logging.Err(err))
+		// Nothing has been sent yet, so the error can still be reported
+		if n == 0 {
+			w.Header().Del("Content-Disposition")
+			writeJSONError(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+	logger.Info("wrote store backup", "bytes", n)
+	r.audit(req, audit.NewEvent(audit.ActionStoreBackup, "", "", 0, nil, nil))
+}
+
+func (r *RestAPI) handleExport(w http.ResponseWriter, req *http.Request) {
+	e, err := store.ExportStore(r.store, &r.exportConf)
+	if err != nil {
+		writeJSONError(w, err, http.StatusInternalServerError)
+		return
+	}
+	r.audit(req, audit.NewEvent(audit.ActionStoreExport, "", "", 0, nil, nil))
+
+	name := "calnet-export-" + e.Time.Format("20060102T150405Z") + ".json"
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	writeJSON(w, req, http.StatusOK, e)
+}
@@ -0,0 +1,87 @@
+package apiservice
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caldog20/calnet/control/server/internal/audit"
+	"github.com/caldog20/calnet/control/server/store"
+	"github.com/caldog20/calnet/pkg/adminapi"
+)
+
+func TestBackup(t *testing.T) {
+	db, err := store.Open(store.DriverBolt, filepath.Join(t.TempDir(), "store.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	api, srv := newTestAPIWithStore(t, db)
+	n := createNode(t, api.store, "alice")
+
+	c, err := adminapi.NewClient(srv.URL, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "backup.db")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Backup(context.Background(), f); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	backup, err := store.Open(store.DriverBolt, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.Close()
+	if _, err = backup.GetNodeByKey(n.NodeKey); err != nil {
+		t.Errorf("error reading node from backup: %v", err)
+	}
+
+	events, err := api.store.GetAuditEvents(audit.Filter{Action: audit.ActionStoreBackup})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Errorf("got %d backup audit events, expected 1", len(events))
+	}
+}
+
+func TestBackupNotImplemented(t *testing.T) {
+	_, srv := newTestAPI(t)
+	resp := doRequest(t, http.MethodGet, srv.URL+"/api/v1/backup", "")
+	expectJSONError(t, resp, http.StatusNotImplemented)
+}
+
+func TestExport(t *testing.T) {
+	c, db := newTestClient(t)
+	n := createNode(t, db, "alice")
+
+	var buf bytes.Buffer
+	if _, err := c.Export(context.Background(), &buf); err != nil {
+		t.Fatal(err)
+	}
+	e := store.Export{}
+	if err := json.Unmarshal(buf.Bytes(), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Version != store.ExportVersion || len(e.Nodes) != 1 || e.Nodes[0].NodeKey != n.NodeKey {
+		t.Errorf("got export %+v", e)
+	}
+	if len(e.Users) != 1 || e.Users[0] != "alice" {
+		t.Errorf("got users %v, expected [alice]", e.Users)
+	}
+	if e.NetworkPrefix.String() != "100.70.0.0/24" {
+		t.Errorf("got network prefix %s", e.NetworkPrefix)
+	}
+}
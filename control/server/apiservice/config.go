@@ -0,0 +1,42 @@
+package apiservice
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/caldog20/calnet/control/server/config"
+	"github.com/caldog20/calnet/control/server/internal/audit"
+	"github.com/caldog20/calnet/pkg/adminapi"
+)
+
+// ConfigReloader reloads the server config and returns the keys of the values
+// that changed. It returns an error wrapping config.ErrRestartRequired if the new
+// config changes values that can't change while the server runs.
+type ConfigReloader func() ([]string, error)
+
+// SetConfigReloader sets the function the config reload endpoint calls
+func (r *RestAPI) SetConfigReloader(f ConfigReloader) {
+	r.reloadConfig = f
+}
+
+func (r *RestAPI) handleReloadConfig(w http.ResponseWriter, req *http.Request) {
+	if r.reloadConfig == nil {
+		writeJSONError(w, errors.New("config reload is not supported"), http.StatusNotImplemented)
+		return
+	}
+
+	changed, err := r.reloadConfig()
+	if err != nil {
+		status := http.StatusUnprocessableEntity
+		if errors.Is(err, config.ErrRestartRequired) {
+			status = http.StatusConflict
+		}
+		writeJSONError(w, err, status)
+		return
+	}
+	if changed == nil {
+		changed = []string{}
+	}
+	r.audit(req, audit.NewEvent(audit.ActionConfigReload, "", "", 0, nil, changed))
+	writeJSON(w, req, http.StatusOK, adminapi.ConfigReload{Changed: changed})
+}
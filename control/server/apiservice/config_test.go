@@ -0,0 +1,55 @@
+package apiservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/caldog20/calnet/control/server/config"
+	"github.com/caldog20/calnet/control/server/internal/audit"
+	"github.com/caldog20/calnet/pkg/adminapi"
+)
+
+func TestReloadConfig(t *testing.T) {
+	api, srv := newTestAPI(t)
+	resp := doRequest(t, http.MethodPost, srv.URL+"/api/v1/config/reload", "")
+	expectJSONError(t, resp, http.StatusNotImplemented)
+
+	var reloadErr error
+	api.SetConfigReloader(func() ([]string, error) {
+		if reloadErr != nil {
+			return nil, reloadErr
+		}
+		return []string{"log.level"}, nil
+	})
+
+	c, err := adminapi.NewClient(srv.URL, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed, err := c.ReloadConfig(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(changed, []string{"log.level"}) {
+		t.Errorf("got changed keys %v, expected log.level", changed)
+	}
+	events, err := api.store.GetAuditEvents(audit.Filter{Action: audit.ActionConfigReload})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Errorf("got %d config reload audit events, expected 1", len(events))
+	}
+
+	reloadErr = fmt.Errorf("%w: http_port", config.ErrRestartRequired)
+	resp = doRequest(t, http.MethodPost, srv.URL+"/api/v1/config/reload", "")
+	expectJSONError(t, resp, http.StatusConflict)
+
+	reloadErr = errors.New("invalid config")
+	resp = doRequest(t, http.MethodPost, srv.URL+"/api/v1/config/reload", "")
+	expectJSONError(t, resp, http.StatusUnprocessableEntity)
+}
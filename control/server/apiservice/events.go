@@ -0,0 +1,158 @@
+package apiservice
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caldog20/calnet/control/server/events"
+	"github.com/caldog20/calnet/control/server/logging"
+	"github.com/caldog20/calnet/pkg/adminapi"
+)
+
+const (
+	sseKeepaliveInterval = time.Second * 15
+	sseBufferSize        = 64
+	// Sent when the requested Last-Event-ID is no longer in the event history.
+	// Clients should refetch the node list before continuing with the stream.
+	sseResyncEvent = "resync"
+)
+
+func newEvent(e events.Event) adminapi.Event {
+	ev := adminapi.Event{
+		ID:     e.ID,
+		Type:   adminapi.EventType(e.Type),
+		Time:   e.Time,
+		NodeID: e.NodeID,
+	}
+	if e.Node != nil {
+		n := newNode(e.Node)
+		ev.Node = &n
+	}
+	return ev
+}
+
+// handleEvents streams node events to the client as Server-Sent Events.
+// Clients can resume a stream by sending the Last-Event-ID header (or last_event_id
+// query parameter) and filter event types with a comma separated types query parameter.
+func (r *RestAPI) handleEvents(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok || r.bus == nil {
+		writeJSONError(w, errors.New("event streaming not supported"), http.StatusInternalServerError)
+		return
+	}
+
+	var lastID uint64
+	lastIDStr := req.Header.Get("Last-Event-ID")
+	if lastIDStr == "" {
+		lastIDStr = req.URL.Query().Get("last_event_id")
+	}
+	resume := lastIDStr != ""
+	if resume {
+		var err error
+		if lastID, err = strconv.ParseUint(lastIDStr, 10, 64); err != nil {
+			writeJSONError(w, errors.New("error parsing last event id"), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var types []events.Type
+	if v := req.URL.Query().Get("types"); v != "" {
+		for _, t := range strings.Split(v, ",") {
+			if !events.Type(t).Valid() {
+				writeJSONError(w, errors.New("invalid event type: "+t), http.StatusBadRequest)
+				return
+			}
+			types = append(types, events.Type(t))
+		}
+	}
+
+	var backlog []events.Event
+	var ch <-chan events.Event
+	var unsubscribe func()
+	if resume {
+		backlog, ok, ch, unsubscribe = r.bus.SubscribeSince(lastID, sseBufferSize)
+	} else {
+		ch, unsubscribe = r.bus.Subscribe(sseBufferSize)
+	}
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if resume && !ok {
+		fmt.Fprintf(w, "event: %s\ndata: {}\n\n", sseResyncEvent)
+	}
+
+	writeEvent := func(e events.Event) error {
+		lastID = e.ID
+		if len(types) > 0 && !slices.Contains(types, e.Type) {
+			return nil
+		}
+		data, err := json.Marshal(newEvent(e))
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+		return err
+	}
+
+	for _, e := range backlog {
+		if err := writeEvent(e); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(sseKeepaliveInterval)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-r.draining:
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case e, open := <-ch:
+			if !open {
+				return
+			}
+			if e.ID <= lastID {
+				continue
+			}
+			// Events were dropped because this subscriber fell behind, fill the gap from history
+			if lastID != 0 && e.ID > lastID+1 {
+				missed, ok := r.bus.Since(lastID)
+				if !ok {
+					fmt.Fprintf(w, "event: %s\ndata: {}\n\n", sseResyncEvent)
+				}
+				for _, m := range missed {
+					if m.ID >= e.ID {
+						break
+					}
+					if err := writeEvent(m); err != nil {
+						return
+					}
+				}
+			}
+			if err := writeEvent(e); err != nil {
+				logger.Debug("error writing event", logging.Err(err))
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
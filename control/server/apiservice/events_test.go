@@ -0,0 +1,92 @@
+package apiservice
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caldog20/calnet/control/server/config"
+	"github.com/caldog20/calnet/control/server/events"
+	"github.com/caldog20/calnet/control/server/internal/node"
+	"github.com/caldog20/calnet/control/server/store"
+)
+
+func newTestAPI(t *testing.T) (*RestAPI, *httptest.Server) {
+	t.Helper()
+	return newTestAPIWithStore(t, store.NewMemoryStore())
+}
+
+func newTestAPIWithStore(t *testing.T, db store.Store) (*RestAPI, *httptest.Server) {
+	t.Helper()
+	api := New(
+		config.Config{
+			APITokens:     map[string]string{"test": "token"},
+			NetworkPrefix: netip.MustParsePrefix("100.70.0.0/24"),
+		},
+		db,
+	)
+	api.SetEventBus(events.NewBus())
+
+	mux := http.NewServeMux()
+	api.RegisterRoutes(mux)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return api, srv
+}
+
+func TestEventsResumeFromLastEventID(t *testing.T) {
+	api, srv := newTestAPI(t)
+
+	for i := 1; i <= 3; i++ {
+		api.bus.Publish(events.New(events.NodeUpdated, &node.Node{ID: uint64(i)}))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/api/v1/events", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	req.Header.Set("Last-Event-ID", "1")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("got content type %s, expected text/event-stream", ct)
+	}
+
+	go api.bus.Publish(events.New(events.NodeDeleted, &node.Node{ID: 4}))
+
+	var ids []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() && len(ids) < 3 {
+		if id, ok := strings.CutPrefix(scanner.Text(), "id: "); ok {
+			ids = append(ids, id)
+		}
+	}
+
+	if strings.Join(ids, ",") != "2,3,4" {
+		t.Fatalf("got event ids %v, expected 2,3,4", ids)
+	}
+}
+
+func TestEventsRequiresAuth(t *testing.T) {
+	_, srv := newTestAPI(t)
+
+	resp, err := http.Get(srv.URL + "/api/v1/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.Header.Get("WWW-Authenticate") != "Bearer" {
+		t.Fatal("got no bearer challenge, expected unauthenticated request to be rejected")
+	}
+}
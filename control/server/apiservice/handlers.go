@@ -3,68 +3,261 @@ package apiservice
 import (
 	"encoding/json"
 	"errors"
-	"log"
+	"fmt"
 	"net/http"
+	"net/netip"
+	"net/url"
+	"reflect"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/caldog20/calnet/control/server/events"
+	"github.com/caldog20/calnet/control/server/internal/audit"
+	"github.com/caldog20/calnet/control/server/internal/node"
+	"github.com/caldog20/calnet/control/server/internal/provision"
+	"github.com/caldog20/calnet/control/server/internal/ratelimit"
+	"github.com/caldog20/calnet/control/server/internal/webhook"
+	"github.com/caldog20/calnet/control/server/logging"
 	"github.com/caldog20/calnet/control/server/store"
+	"github.com/caldog20/calnet/pkg/adminapi"
 )
 
-type JSONError struct {
-	Error string `json:"error"`
-	Code  int    `json:"code"`
-}
+// maxRequestBodySize limits the size of JSON request bodies
+const maxRequestBodySize = 1 << 20
 
+// writeJSONError writes err as an adminapi.ErrorResponse with status code.
+// Every error response of the API is written by this function.
 func writeJSONError(w http.ResponseWriter, err error, code int) {
-	werr := json.NewEncoder(w).Encode(JSONError{
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	werr := json.NewEncoder(w).Encode(adminapi.ErrorResponse{
 		Error: err.Error(),
 		Code:  code,
 	})
 	if werr != nil {
-		log.Printf("error writing json error %s", werr)
+		logger.Warn("error writing json error", logging.Err(werr))
+	}
+}
+
+func writeJSON(w http.ResponseWriter, req *http.Request, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		logger.Warn("error encoding json response", "route", req.Pattern, logging.Err(err))
+	}
+}
+
+// decodeJSON decodes the request body into v. On failure an error response
+// is written and false is returned.
+func decodeJSON(w http.ResponseWriter, req *http.Request, v any) bool {
+	err := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxRequestBodySize)).Decode(v)
+	if err == nil {
+		return true
+	}
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		writeJSONError(
+			w,
+			fmt.Errorf("request body larger than %d bytes", maxErr.Limit),
+			http.StatusRequestEntityTooLarge,
+		)
+		return false
+	}
+	writeJSONError(w, fmt.Errorf("error decoding request body: %w", err), http.StatusBadRequest)
+	return false
+}
+
+func newNode(n *node.Node) adminapi.Node {
+	return adminapi.Node{
+		ID:               n.ID,
+		Name:             n.Name,
+		NodeKey:          n.NodeKey,
+		KeyExpiry:        n.KeyExpiry,
+		IP:               n.IP,
+		NetPrefix:        n.Prefix,
+		Hostinfo:         n.Hostinfo,
+		AdvertisedRoutes: nonNil(n.AdvertisedRoutes()),
+		ApprovedRoutes:   nonNil(n.ApprovedRoutes),
+		LastSeen:         n.LastConnected,
+		CreatedAt:        n.CreatedAt,
+		UpdatedAt:        n.UpdatedAt,
+		User:             n.User,
+		Tags:             nonNil(n.Tags),
+		Disabled:         n.Disabled,
+		Online:           n.Online,
+	}
+}
+
+// nonNil returns an empty slice for nil so lists are encoded as [] instead of null
+func nonNil[T any](s []T) []T {
+	if s == nil {
+		return []T{}
+	}
+	return s
+}
+
+func parseNodeListOptions(req *http.Request) (node.ListOptions, error) {
+	q := req.URL.Query()
+	opts := node.ListOptions{
+		Filter: node.Filter{
+			User:     q.Get("user"),
+			Tag:      q.Get("tag"),
+			Hostname: q.Get("hostname"),
+		},
+		Sort: node.SortField(q.Get("sort")),
+	}
+
+	var err error
+	for name, dst := range map[string]**bool{
+		"disabled": &opts.Disabled,
+		"expired":  &opts.Expired,
+		"online":   &opts.Online,
+	} {
+		if v := q.Get(name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return opts, fmt.Errorf("error parsing %s, must be true or false", name)
+			}
+			*dst = &b
+		}
+	}
+	if v := q.Get("prefix"); v != "" {
+		if opts.Prefix, err = netip.ParsePrefix(v); err != nil {
+			return opts, errors.New("error parsing prefix")
+		}
+		opts.Prefix = opts.Prefix.Masked()
+	}
+	switch q.Get("order") {
+	case "", "asc":
+	case "desc":
+		opts.Descending = true
+	default:
+		return opts, errors.New("order must be asc or desc")
+	}
+	if v := q.Get("limit"); v != "" {
+		if opts.Limit, err = strconv.Atoi(v); err != nil {
+			return opts, errors.New("error parsing limit")
+		}
+	}
+	if v := q.Get("cursor"); v != "" {
+		if opts.After, err = node.ParseCursor(v); err != nil {
+			return opts, err
+		}
+	}
+	return opts, opts.Validate()
+}
+
+// nodeFields are the JSON field names of a node that can be selected with the fields parameter
+var nodeFields = func() map[string]bool {
+	fields := make(map[string]bool)
+	t := reflect.TypeFor[adminapi.Node]()
+	for i := range t.NumField() {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		fields[name] = true
+	}
+	return fields
+}()
+
+func parseNodeFields(req *http.Request) ([]string, error) {
+	v := req.URL.Query().Get("fields")
+	if v == "" {
+		return nil, nil
+	}
+	fields := strings.Split(v, ",")
+	for _, f := range fields {
+		if !nodeFields[f] {
+			return nil, fmt.Errorf("unknown node field %q", f)
+		}
 	}
+	return fields, nil
+}
+
+// selectFields returns the JSON object of n with only the given fields
+func selectFields(n adminapi.Node, fields []string) (map[string]json.RawMessage, error) {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return nil, err
+	}
+	all := make(map[string]json.RawMessage)
+	if err = json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	selected := make(map[string]json.RawMessage, len(fields))
+	for _, f := range fields {
+		selected[f] = all[f]
+	}
+	return selected, nil
 }
 
 func (r *RestAPI) handleGetNodes(w http.ResponseWriter, req *http.Request) {
-	nodes, err := r.store.GetNodes()
+	opts, err := parseNodeListOptions(req)
+	if err != nil {
+		writeJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+	fields, err := parseNodeFields(req)
+	if err != nil {
+		writeJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	nodes, err := r.store.ListNodes(opts)
 	if err != nil {
 		writeJSONError(w, err, http.StatusInternalServerError)
 		return
 	}
 
-	nodesResp := Nodes{}
+	nodesResp := adminapi.Nodes{Nodes: make([]adminapi.Node, 0, len(nodes))}
 	for _, n := range nodes {
-		nodesResp.Nodes = append(nodesResp.Nodes, Node{
-			ID:        n.ID,
-			NodeKey:   n.NodeKey,
-			KeyExpiry: n.KeyExpiry,
-			IP:        n.IP,
-			NetPrefix: n.Prefix,
-			LastSeen:  n.LastConnected,
-			CreatedAt: n.CreatedAt,
-			UpdatedAt: n.UpdatedAt,
-			User:      n.User,
-			Disabled:  n.Disabled,
-		})
+		nodesResp.Nodes = append(nodesResp.Nodes, newNode(&n))
+	}
+	// A full page means there may be more nodes after the last one returned
+	if len(nodes) > 0 && len(nodes) == opts.PageSize() {
+		nodesResp.Next = opts.CursorFor(&nodes[len(nodes)-1]).Encode()
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	err = json.NewEncoder(w).Encode(nodesResp)
-	if err != nil {
-		log.Println("handleGetNodes: error encoding json response:", err)
+	var resp any = nodesResp
+	if fields != nil {
+		partial := struct {
+			Nodes []map[string]json.RawMessage `json:"nodes"`
+			Next  string                       `json:"next,omitempty"`
+		}{
+			Nodes: make([]map[string]json.RawMessage, 0, len(nodesResp.Nodes)),
+			Next:  nodesResp.Next,
+		}
+		for _, n := range nodesResp.Nodes {
+			selected, err := selectFields(n, fields)
+			if err != nil {
+				writeJSONError(w, err, http.StatusInternalServerError)
+				return
+			}
+			partial.Nodes = append(partial.Nodes, selected)
+		}
+		resp = partial
 	}
+
+	writeJSON(w, req, http.StatusOK, resp)
 }
 
 func (r *RestAPI) handleGetNodeByID(w http.ResponseWriter, req *http.Request) {
-	id := req.PathValue("id")
-	nodeID, err := strconv.ParseUint(id, 10, 64)
-	if err != nil {
-		writeJSONError(w, errors.New("error parsing node id"), http.StatusBadRequest)
+	n, ok := r.getNodeFromPath(w, req)
+	if !ok {
 		return
 	}
+	writeJSON(w, req, http.StatusOK, newNode(n))
+}
 
-	log.Printf("getting node by id %d", nodeID)
+// getNodeFromPath looks up the node referenced by the {id} path value.
+// On failure an error response is written and false is returned.
+func (r *RestAPI) getNodeFromPath(w http.ResponseWriter, req *http.Request) (*node.Node, bool) {
+	nodeID, err := strconv.ParseUint(req.PathValue("id"), 10, 64)
+	if err != nil {
+		writeJSONError(w, errors.New("error parsing node id"), http.StatusBadRequest)
+		return nil, false
+	}
 
 	n, err := r.store.GetNodeByID(nodeID)
 	if err != nil {
@@ -73,26 +266,536 @@ func (r *RestAPI) handleGetNodeByID(w http.ResponseWriter, req *http.Request) {
 		} else {
 			writeJSONError(w, err, http.StatusInternalServerError)
 		}
+		return nil, false
+	}
+	return n, true
+}
+
+// updateNode applies mutate to the node referenced by the request path, saves it,
+// records an audit event for action and writes the updated node as the response.
+// An error from mutate is written as a bad request and the node is not saved.
+func (r *RestAPI) updateNode(
+	w http.ResponseWriter,
+	req *http.Request,
+	action audit.Action,
+	event events.Type,
+	mutate func(n *node.Node) error,
+) {
+	n, ok := r.getNodeFromPath(w, req)
+	if !ok {
 		return
 	}
 
-	nodeResp := Node{
-		ID:        n.ID,
-		NodeKey:   n.NodeKey,
-		KeyExpiry: n.KeyExpiry,
-		IP:        n.IP,
-		NetPrefix: n.Prefix,
-		LastSeen:  n.LastConnected,
-		CreatedAt: n.CreatedAt,
-		UpdatedAt: n.UpdatedAt,
-		User:      n.User,
-		Disabled:  n.Disabled,
+	before := *n
+	if err := mutate(n); err != nil {
+		writeJSONError(w, err, http.StatusBadRequest)
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	err := r.store.UpdateNode(n)
+	if err != nil {
+		writeJSONError(w, err, http.StatusInternalServerError)
+		return
+	}
+	r.audit(req, audit.NewEvent(action, "", "", n.ID, before, n))
+	r.bus.Publish(events.New(event, n))
+
+	writeJSON(w, req, http.StatusOK, newNode(n))
+}
+
+func (r *RestAPI) handleDisableNode(w http.ResponseWriter, req *http.Request) {
+	r.updateNode(w, req, audit.ActionNodeDisable, events.NodeDisabled, func(n *node.Node) error {
+		n.Disabled = true
+		return nil
+	})
+}
+
+func (r *RestAPI) handleEnableNode(w http.ResponseWriter, req *http.Request) {
+	r.updateNode(w, req, audit.ActionNodeEnable, events.NodeEnabled, func(n *node.Node) error {
+		n.Disabled = false
+		return nil
+	})
+}
+
+func (r *RestAPI) handleExpireNode(w http.ResponseWriter, req *http.Request) {
+	r.updateNode(w, req, audit.ActionNodeExpire, events.NodeKeyExpired, func(n *node.Node) error {
+		n.KeyExpiry = time.Now()
+		return nil
+	})
+}
+
+// validNodeName reports whether name can be used as a DNS label
+func validNodeName(name string) bool {
+	if name == "" || len(name) > 63 || name[0] == '-' || name[len(name)-1] == '-' {
+		return false
+	}
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *RestAPI) handleRenameNode(w http.ResponseWriter, req *http.Request) {
+	renameReq := adminapi.RenameNodeRequest{}
+	if !decodeJSON(w, req, &renameReq) {
+		return
+	}
+	name := strings.ToLower(renameReq.Name)
+	if !validNodeName(name) {
+		writeJSONError(
+			w,
+			errors.New(
+				"node name must be 1-63 letters, digits or hyphens and not start or end with a hyphen",
+			),
+			http.StatusBadRequest,
+		)
+		return
+	}
+
+	r.updateNode(w, req, audit.ActionNodeRename, events.NodeUpdated, func(n *node.Node) error {
+		n.Name = name
+		return nil
+	})
+}
+
+func (r *RestAPI) handleApproveRoutes(w http.ResponseWriter, req *http.Request) {
+	routesReq := adminapi.ApproveRoutesRequest{}
+	if !decodeJSON(w, req, &routesReq) {
+		return
+	}
+
+	action := audit.ActionNodeApproveRoutes
+	r.updateNode(w, req, action, events.NodeUpdated, func(n *node.Node) error {
+		approved := make([]netip.Prefix, 0, len(routesReq.Routes))
+		for _, p := range routesReq.Routes {
+			p = p.Masked()
+			if !slices.Contains(n.AdvertisedRoutes(), p) {
+				return fmt.Errorf("route %s is not advertised by node", p)
+			}
+			if !slices.Contains(approved, p) {
+				approved = append(approved, p)
+			}
+		}
+		n.ApprovedRoutes = approved
+		return nil
+	})
+}
+
+// handleGetUsers lists the users nodes are registered to with their node count
+func (r *RestAPI) handleGetUsers(w http.ResponseWriter, req *http.Request) {
+	nodes, err := r.store.GetNodes()
+	if err != nil {
+		writeJSONError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	users := make(map[string]*adminapi.User)
+	for _, n := range nodes {
+		if n.User == "" {
+			continue
+		}
+		u, ok := users[n.User]
+		if !ok {
+			u = &adminapi.User{Name: n.User}
+			users[n.User] = u
+		}
+		u.Nodes++
+		if n.LastConnected.After(u.LastSeen) {
+			u.LastSeen = n.LastConnected
+		}
+	}
+
+	resp := adminapi.Users{Users: make([]adminapi.User, 0, len(users))}
+	for _, u := range users {
+		resp.Users = append(resp.Users, *u)
+	}
+	slices.SortFunc(resp.Users, func(a, b adminapi.User) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	writeJSON(w, req, http.StatusOK, resp)
+}
+
+func (r *RestAPI) handleDeleteNode(w http.ResponseWriter, req *http.Request) {
+	n, ok := r.getNodeFromPath(w, req)
+	if !ok {
+		return
+	}
+
+	err := r.store.DeleteNode(n.ID)
+	if err != nil {
+		writeJSONError(w, err, http.StatusInternalServerError)
+		return
+	}
+	r.audit(req, audit.NewEvent(audit.ActionNodeDelete, "", "", n.ID, n, nil))
+	r.bus.Publish(events.New(events.NodeDeleted, n))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// audit fills in the actor and source IP of event from the request and appends it to the audit log
+func (r *RestAPI) audit(req *http.Request, event *audit.Event) {
+	event.Actor = actorFromContext(req.Context())
+	event.SourceIP = ratelimit.SourceIP(req)
+	if err := r.store.AppendAuditEvent(event); err != nil {
+		logger.Error("error appending audit event", "action", event.Action, logging.Err(err))
+	}
+}
+
+func parseAuditFilter(req *http.Request) (audit.Filter, error) {
+	q := req.URL.Query()
+	filter := audit.Filter{
+		Action: audit.Action(q.Get("action")),
+		Actor:  q.Get("actor"),
+	}
+
+	var err error
+	if v := q.Get("node_id"); v != "" {
+		if filter.NodeID, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return filter, errors.New("error parsing node_id")
+		}
+	}
+	if v := q.Get("after"); v != "" {
+		if filter.AfterID, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return filter, errors.New("error parsing after cursor")
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if filter.Limit, err = strconv.Atoi(v); err != nil {
+			return filter, errors.New("error parsing limit")
+		}
+	}
+	if v := q.Get("since"); v != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			return filter, errors.New("error parsing since, must be RFC3339")
+		}
+	}
+	if v := q.Get("until"); v != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			return filter, errors.New("error parsing until, must be RFC3339")
+		}
+	}
+	return filter, nil
+}
+
+func newAuditEvent(e *audit.Event) adminapi.AuditEvent {
+	return adminapi.AuditEvent{
+		ID:       e.ID,
+		Time:     e.Time,
+		Action:   string(e.Action),
+		Actor:    e.Actor,
+		SourceIP: e.SourceIP,
+		NodeID:   e.NodeID,
+		Before:   e.Before,
+		After:    e.After,
+	}
+}
+
+func (r *RestAPI) handleGetAuditEvents(w http.ResponseWriter, req *http.Request) {
+	filter, err := parseAuditFilter(req)
+	if err != nil {
+		writeJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	events, err := r.store.GetAuditEvents(filter)
+	if err != nil {
+		writeJSONError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := adminapi.AuditEvents{Events: make([]adminapi.AuditEvent, 0, len(events))}
+	for _, e := range events {
+		resp.Events = append(resp.Events, newAuditEvent(&e))
+	}
+	// A full page means there may be more events after the last one returned
+	if len(events) > 0 && len(events) == filter.PageSize() {
+		resp.Next = events[len(events)-1].ID
+	}
+
+	writeJSON(w, req, http.StatusOK, resp)
+}
+
+// handleExportAuditEvents streams every event matching the filter as JSON lines
+func (r *RestAPI) handleExportAuditEvents(w http.ResponseWriter, req *http.Request) {
+	filter, err := parseAuditFilter(req)
+	if err != nil {
+		writeJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+	filter.Limit = audit.MaxPageSize
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
 	w.WriteHeader(http.StatusOK)
-	err = json.NewEncoder(w).Encode(nodeResp)
+
+	enc := json.NewEncoder(w)
+	for {
+		events, err := r.store.GetAuditEvents(filter)
+		if err != nil {
+			logger.Error("error reading audit events for export", logging.Err(err))
+			return
+		}
+		for _, e := range events {
+			if err := enc.Encode(newAuditEvent(&e)); err != nil {
+				logger.Warn("error encoding audit export json line", logging.Err(err))
+				return
+			}
+		}
+		if len(events) < filter.Limit {
+			return
+		}
+		filter.AfterID = events[len(events)-1].ID
+	}
+}
+
+func newEventTypes(types []events.Type) []adminapi.EventType {
+	converted := make([]adminapi.EventType, len(types))
+	for i, t := range types {
+		converted[i] = adminapi.EventType(t)
+	}
+	return converted
+}
+
+func newWebhook(sub *webhook.Subscription) adminapi.Webhook {
+	return adminapi.Webhook{
+		ID:        sub.ID,
+		URL:       sub.URL,
+		Events:    newEventTypes(sub.Events),
+		Disabled:  sub.Disabled,
+		CreatedAt: sub.CreatedAt,
+	}
+}
+
+func (r *RestAPI) handleGetWebhooks(w http.ResponseWriter, req *http.Request) {
+	subs, err := r.store.GetWebhooks()
+	if err != nil {
+		writeJSONError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := adminapi.Webhooks{Webhooks: []adminapi.Webhook{}}
+	for _, sub := range subs {
+		resp.Webhooks = append(resp.Webhooks, newWebhook(&sub))
+	}
+
+	writeJSON(w, req, http.StatusOK, resp)
+}
+
+func (r *RestAPI) handleCreateWebhook(w http.ResponseWriter, req *http.Request) {
+	createReq := adminapi.CreateWebhookRequest{}
+	if !decodeJSON(w, req, &createReq) {
+		return
+	}
+
+	u, err := url.Parse(createReq.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		writeJSONError(
+			w,
+			errors.New("webhook url must be an absolute http or https url"),
+			http.StatusBadRequest,
+		)
+		return
+	}
+	types := make([]events.Type, 0, len(createReq.Events))
+	for _, t := range createReq.Events {
+		if !events.Type(t).Valid() {
+			writeJSONError(w, errors.New("invalid event type: "+string(t)), http.StatusBadRequest)
+			return
+		}
+		types = append(types, events.Type(t))
+	}
+
+	sub := &webhook.Subscription{
+		URL:    u.String(),
+		Events: types,
+		Secret: createReq.Secret,
+	}
+	if sub.Secret == "" {
+		sub.Secret = webhook.GenerateSecret()
+	}
+
+	err = r.store.CreateWebhook(sub)
+	if err != nil {
+		writeJSONError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := newWebhook(sub)
+	r.audit(req, audit.NewEvent(audit.ActionWebhookCreate, "", "", 0, nil, resp))
+
+	// The secret is only returned when the webhook is created
+	resp.Secret = sub.Secret
+
+	writeJSON(w, req, http.StatusCreated, resp)
+}
+
+// getWebhookFromPath looks up the webhook referenced by the {id} path value.
+// On failure an error response is written and false is returned.
+func (r *RestAPI) getWebhookFromPath(
+	w http.ResponseWriter,
+	req *http.Request,
+) (*webhook.Subscription, bool) {
+	id, err := strconv.ParseUint(req.PathValue("id"), 10, 64)
+	if err != nil {
+		writeJSONError(w, errors.New("error parsing webhook id"), http.StatusBadRequest)
+		return nil, false
+	}
+
+	sub, err := r.store.GetWebhookByID(id)
+	if err != nil {
+		if errors.Is(err, store.ErrWebhookNotFound) {
+			writeJSONError(w, err, http.StatusNotFound)
+		} else {
+			writeJSONError(w, err, http.StatusInternalServerError)
+		}
+		return nil, false
+	}
+	return sub, true
+}
+
+func (r *RestAPI) handleDeleteWebhook(w http.ResponseWriter, req *http.Request) {
+	sub, ok := r.getWebhookFromPath(w, req)
+	if !ok {
+		return
+	}
+
+	err := r.store.DeleteWebhook(sub.ID)
 	if err != nil {
-		log.Println("handleGetNodeByID: error encoding json response:", err)
+		writeJSONError(w, err, http.StatusInternalServerError)
+		return
 	}
+	r.audit(req, audit.NewEvent(audit.ActionWebhookDelete, "", "", 0, newWebhook(sub), nil))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (r *RestAPI) handleGetWebhookDeliveries(w http.ResponseWriter, req *http.Request) {
+	sub, ok := r.getWebhookFromPath(w, req)
+	if !ok {
+		return
+	}
+
+	limit := webhook.DefaultDeliveryLimit
+	if v := req.URL.Query().Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil {
+			writeJSONError(w, errors.New("error parsing limit"), http.StatusBadRequest)
+			return
+		}
+		if limit <= 0 {
+			writeJSONError(w, errors.New("limit must be positive"), http.StatusBadRequest)
+			return
+		}
+		limit = min(limit, webhook.MaxDeliveryLimit)
+	}
+
+	deliveries, err := r.store.GetWebhookDeliveries(sub.ID, limit)
+	if err != nil {
+		writeJSONError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := adminapi.WebhookDeliveries{
+		Deliveries: make([]adminapi.WebhookDelivery, 0, len(deliveries)),
+	}
+	for _, d := range deliveries {
+		resp.Deliveries = append(resp.Deliveries, adminapi.WebhookDelivery{
+			ID:             d.ID,
+			SubscriptionID: d.SubscriptionID,
+			EventID:        d.EventID,
+			EventType:      adminapi.EventType(d.EventType),
+			Attempt:        d.Attempt,
+			StatusCode:     d.StatusCode,
+			Error:          d.Error,
+			Success:        d.Success,
+			Time:           d.Time,
+			Duration:       d.Duration,
+		})
+	}
+
+	writeJSON(w, req, http.StatusOK, resp)
+}
+
+func (r *RestAPI) handleGetProvisionKeys(w http.ResponseWriter, req *http.Request) {
+	pks, err := r.store.GetProvisionKeys()
+	if err != nil {
+		writeJSONError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := adminapi.ProvisionKeys{Keys: []adminapi.ProvisionKey{}}
+	for _, pk := range pks {
+		resp.Keys = append(resp.Keys, pk.Redacted())
+	}
+
+	writeJSON(w, req, http.StatusOK, resp)
+}
+
+func (r *RestAPI) handleCreateProvisionKey(w http.ResponseWriter, req *http.Request) {
+	createReq := adminapi.CreateProvisionKeyRequest{}
+	if !decodeJSON(w, req, &createReq) {
+		return
+	}
+	if !createReq.Expiry.IsZero() && createReq.Expiry.Before(time.Now()) {
+		writeJSONError(w, errors.New("provisioning key expiry is in the past"), http.StatusBadRequest)
+		return
+	}
+
+	key, hash := provision.Generate()
+	pk := &provision.Key{
+		Hash:        hash,
+		Description: createReq.Description,
+		User:        createReq.User,
+		Tags:        createReq.Tags,
+		Reusable:    createReq.Reusable,
+		Expiry:      createReq.Expiry,
+	}
+
+	err := r.store.CreateProvisionKey(pk)
+	if err != nil {
+		writeJSONError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := pk.Redacted()
+	r.audit(req, audit.NewEvent(audit.ActionProvisionKeyCreate, "", "", 0, nil, resp))
+
+	// The key is only returned when it is created
+	resp.Key = key
+
+	writeJSON(w, req, http.StatusCreated, resp)
+}
+
+func (r *RestAPI) handleRevokeProvisionKey(w http.ResponseWriter, req *http.Request) {
+	id, err := strconv.ParseUint(req.PathValue("id"), 10, 64)
+	if err != nil {
+		writeJSONError(w, errors.New("error parsing provisioning key id"), http.StatusBadRequest)
+		return
+	}
+
+	pk, err := r.store.GetProvisionKeyByID(id)
+	if err != nil {
+		if errors.Is(err, store.ErrProvisionKeyNotFound) {
+			writeJSONError(w, err, http.StatusNotFound)
+		} else {
+			writeJSONError(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	before := pk.Redacted()
+	pk.Revoked = true
+	err = r.store.UpdateProvisionKey(pk)
+	if err != nil {
+		writeJSONError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := pk.Redacted()
+	r.audit(req, audit.NewEvent(audit.ActionProvisionKeyRevoke, "", "", 0, before, resp))
+
+	writeJSON(w, req, http.StatusOK, resp)
 }
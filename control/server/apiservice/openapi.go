@@ -0,0 +1,281 @@
+package apiservice
+
+import (
+	"encoding"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/netip"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caldog20/calnet/control/server/events"
+	"github.com/caldog20/calnet/pkg/adminapi"
+)
+
+const (
+	openAPIVersion = "3.0.3"
+	apiVersion     = "v1"
+)
+
+type schema = map[string]any
+
+// typeSchemas are schemas of types that are not encoded as their Go structure
+var typeSchemas = map[reflect.Type]schema{
+	reflect.TypeFor[time.Time]():       {"type": "string", "format": "date-time"},
+	reflect.TypeFor[netip.Addr]():      {"type": "string", "format": "ip"},
+	reflect.TypeFor[netip.Prefix]():    {"type": "string", "format": "cidr"},
+	reflect.TypeFor[json.RawMessage](): {},
+	reflect.TypeFor[[]byte]():          {"type": "string", "format": "binary"},
+}
+
+var textMarshalerType = reflect.TypeFor[encoding.TextMarshaler]()
+
+// schemaBuilder generates JSON schemas of API models from their types.
+// Named structs are added to the components and referenced.
+type schemaBuilder struct {
+	components map[string]schema
+}
+
+func (b *schemaBuilder) schema(t reflect.Type) schema {
+	if s, ok := typeSchemas[t]; ok {
+		return s
+	}
+	if t == reflect.TypeFor[adminapi.EventType]() {
+		enum := make([]string, len(events.AllTypes))
+		for i, et := range events.AllTypes {
+			enum[i] = string(et)
+		}
+		return schema{"type": "string", "enum": enum}
+	}
+	if t.Implements(textMarshalerType) {
+		return schema{"type": "string"}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		s := b.schema(t.Elem())
+		if _, ok := s["$ref"]; ok {
+			return schema{"allOf": []any{s}, "nullable": true}
+		}
+		// Copy so the shared type schemas are not modified
+		s = maps.Clone(s)
+		s["nullable"] = true
+		return s
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.object(t)
+		}
+		if _, ok := b.components[t.Name()]; !ok {
+			// Reserve the name first in case the struct refers to itself
+			b.components[t.Name()] = nil
+			b.components[t.Name()] = b.object(t)
+		}
+		return schema{"$ref": "#/components/schemas/" + t.Name()}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return schema{"type": "string", "format": "byte"}
+		}
+		return schema{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return schema{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Bool:
+		return schema{"type": "boolean"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64:
+		return schema{"type": "integer", "format": "int64"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return schema{"type": "integer", "format": "int32"}
+	case reflect.Float32, reflect.Float64:
+		return schema{"type": "number"}
+	case reflect.String:
+		return schema{"type": "string"}
+	}
+	// Interfaces can hold any value
+	return schema{}
+}
+
+// object returns the schema of a struct from its exported JSON fields.
+// Fields without omitempty are required.
+func (b *schemaBuilder) object(t reflect.Type) schema {
+	props := schema{}
+	var required []string
+	for i := range t.NumField() {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = b.schema(f.Type)
+		if !slices.Contains(strings.Split(opts, ","), "omitempty") {
+			required = append(required, name)
+		}
+	}
+	s := schema{"type": "object", "properties": props}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+// pathParams returns the names of the {name} wildcards in a route path
+func pathParams(path string) []string {
+	var params []string
+	for _, seg := range strings.Split(path, "/") {
+		if name, ok := strings.CutPrefix(seg, "{"); ok {
+			params = append(params, strings.TrimSuffix(name, "}"))
+		}
+	}
+	return params
+}
+
+func errorResponse(code int) schema {
+	return schema{"$ref": "#/components/responses/" + strconv.Itoa(code)}
+}
+
+// buildOpenAPI returns the OpenAPI document of the routes as JSON.
+// Error responses documented for a route are derived from what it accepts:
+// path and query parameters or a body can be rejected with 400,
+// paths with an id with 404 and authenticated routes with 401 and 403.
+func buildOpenAPI(routes []route) ([]byte, error) {
+	b := &schemaBuilder{components: map[string]schema{}}
+	errorSchema := b.schema(reflect.TypeFor[adminapi.ErrorResponse]())
+
+	errorCodes := []int{
+		http.StatusBadRequest,
+		http.StatusUnauthorized,
+		http.StatusForbidden,
+		http.StatusNotFound,
+		http.StatusConflict,
+		http.StatusRequestEntityTooLarge,
+		http.StatusUnsupportedMediaType,
+		http.StatusUnprocessableEntity,
+		http.StatusInternalServerError,
+		http.StatusNotImplemented,
+	}
+	responses := schema{}
+	for _, code := range errorCodes {
+		responses[strconv.Itoa(code)] = schema{
+			"description": http.StatusText(code),
+			"content":     schema{"application/json": schema{"schema": errorSchema}},
+		}
+	}
+
+	paths := map[string]schema{}
+	for _, rt := range routes {
+		var params []any
+		for _, name := range pathParams(rt.path) {
+			params = append(params, schema{
+				"name":     name,
+				"in":       "path",
+				"required": true,
+				"schema":   schema{"type": "integer", "format": "int64"},
+			})
+		}
+		for _, q := range rt.query {
+			s := schema{"type": q.typ}
+			if q.enum != nil {
+				s["enum"] = q.enum
+			}
+			params = append(params, schema{
+				"name":        q.name,
+				"in":          "query",
+				"description": q.description,
+				"schema":      s,
+			})
+		}
+
+		op := schema{
+			"operationId": rt.operationID,
+			"summary":     rt.summary,
+			"tags":        []string{rt.tag},
+		}
+		if params != nil {
+			op["parameters"] = params
+		}
+		if rt.request != nil {
+			op["requestBody"] = schema{
+				"required": true,
+				"content": schema{
+					"application/json": schema{"schema": b.schema(reflect.TypeOf(rt.request))},
+				},
+			}
+		}
+
+		success := schema{"description": http.StatusText(rt.status)}
+		if rt.response != nil {
+			contentType := rt.contentType
+			if contentType == "" {
+				contentType = "application/json"
+			}
+			success["content"] = schema{
+				contentType: schema{"schema": b.schema(reflect.TypeOf(rt.response))},
+			}
+		}
+		resps := schema{strconv.Itoa(rt.status): success}
+		if params != nil || rt.request != nil {
+			resps["400"] = errorResponse(http.StatusBadRequest)
+		}
+		if rt.request != nil {
+			resps["413"] = errorResponse(http.StatusRequestEntityTooLarge)
+		}
+		if slices.Contains(pathParams(rt.path), "id") {
+			resps["404"] = errorResponse(http.StatusNotFound)
+		}
+		if rt.public {
+			op["security"] = []any{}
+		} else {
+			resps["401"] = errorResponse(http.StatusUnauthorized)
+			resps["403"] = errorResponse(http.StatusForbidden)
+		}
+		for _, code := range rt.errors {
+			resps[strconv.Itoa(code)] = errorResponse(code)
+		}
+		resps["500"] = errorResponse(http.StatusInternalServerError)
+		op["responses"] = resps
+
+		if paths[rt.path] == nil {
+			paths[rt.path] = schema{}
+		}
+		paths[rt.path][strings.ToLower(rt.method)] = op
+	}
+
+	doc := schema{
+		"openapi": openAPIVersion,
+		"info": schema{
+			"title":   "calnet control server API",
+			"version": apiVersion,
+			"description": "Manage the nodes, provisioning keys, audit log and webhooks " +
+				"of a calnet control server. Every error response has the ErrorResponse body. " +
+				"Requests authenticated by a session cookie other than GET " +
+				"must send the session CSRF token in the X-CSRF-Token header.",
+		},
+		"paths": paths,
+		"components": schema{
+			"schemas":   b.components,
+			"responses": responses,
+			"securitySchemes": schema{
+				"bearerAuth": schema{"type": "http", "scheme": "bearer"},
+				"sessionCookie": schema{
+					"type": "apiKey",
+					"in":   "cookie",
+					"name": sessionCookie,
+				},
+			},
+		},
+		"security": []any{
+			schema{"bearerAuth": []string{}},
+			schema{"sessionCookie": []string{}},
+		},
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
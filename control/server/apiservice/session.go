@@ -0,0 +1,170 @@
+package apiservice
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/caldog20/calnet/pkg/adminapi"
+)
+
+const (
+	sessionCookie   = "calnet_session"
+	csrfHeader      = "X-CSRF-Token"
+	sessionLifetime = time.Hour * 12
+)
+
+// session is a browser login created from an API token. The session ID is only
+// sent in an HttpOnly cookie, unsafe requests must also carry the CSRF token
+// in the X-CSRF-Token header, which a cross-site page cannot read or set.
+type session struct {
+	tokenName string
+	csrfToken string
+	expires   time.Time
+}
+
+type sessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+func newSessionStore() *sessionStore {
+	return &sessionStore{sessions: make(map[string]*session)}
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (s *sessionStore) create(tokenName string) (string, *session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for id, sess := range s.sessions {
+		if now.After(sess.expires) {
+			delete(s.sessions, id)
+		}
+	}
+
+	id := randomToken()
+	sess := &session{
+		tokenName: tokenName,
+		csrfToken: randomToken(),
+		expires:   now.Add(sessionLifetime),
+	}
+	s.sessions[id] = sess
+	return id, sess
+}
+
+func (s *sessionStore) get(id string) (*session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.sessions[id]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(sess.expires) {
+		delete(s.sessions, id)
+		return nil, false
+	}
+	return sess, true
+}
+
+func (s *sessionStore) delete(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+}
+
+// safeMethod reports whether method does not change state and needs no CSRF token
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+var errCSRF = errors.New("missing or invalid csrf token")
+
+// sessionFromRequest returns the token name of a valid session cookie.
+// For unsafe methods the CSRF header must match the session.
+func (r *RestAPI) sessionFromRequest(req *http.Request) (string, error) {
+	cookie, err := req.Cookie(sessionCookie)
+	if err != nil {
+		return "", errors.New("missing bearer token")
+	}
+	sess, ok := r.sessions.get(cookie.Value)
+	if !ok {
+		return "", errors.New("session expired")
+	}
+	if !safeMethod(req.Method) {
+		token := req.Header.Get(csrfHeader)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(sess.csrfToken)) != 1 {
+			return "", errCSRF
+		}
+	}
+	return sess.tokenName, nil
+}
+
+// handleCreateSession exchanges an API token for a session cookie and CSRF token
+func (r *RestAPI) handleCreateSession(w http.ResponseWriter, req *http.Request) {
+	// Requiring JSON stops cross-site forms from logging a browser in,
+	// they can only send form or plain text bodies without a preflight
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		writeJSONError(
+			w,
+			errors.New("content type must be application/json"),
+			http.StatusUnsupportedMediaType,
+		)
+		return
+	}
+
+	createReq := adminapi.CreateSessionRequest{}
+	if !decodeJSON(w, req, &createReq) {
+		return
+	}
+	name, ok := r.lookupToken(createReq.Token)
+	if !ok {
+		writeJSONError(w, errors.New("invalid api token"), http.StatusUnauthorized)
+		return
+	}
+
+	id, sess := r.sessions.create(name)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/api/",
+		Expires:  sess.expires,
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	logger.Info("api session created", "token", name)
+
+	writeJSON(w, req, http.StatusCreated, adminapi.Session{
+		CSRFToken: sess.csrfToken,
+		Expires:   sess.expires,
+	})
+}
+
+func (r *RestAPI) handleDeleteSession(w http.ResponseWriter, req *http.Request) {
+	if cookie, err := req.Cookie(sessionCookie); err == nil {
+		r.sessions.delete(cookie.Value)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Path:     "/api/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,97 @@
+package apiservice
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/caldog20/calnet/pkg/adminapi"
+)
+
+func TestSession(t *testing.T) {
+	api, srv := newTestAPI(t)
+	n := createNode(t, api.store, "alice")
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Jar: jar}
+	send := func(method, path, body, csrf string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if csrf != "" {
+			req.Header.Set(csrfHeader, csrf)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := send(http.MethodPost, "/api/v1/session", `{"token":"wrong"}`, "")
+	expectJSONError(t, resp, http.StatusUnauthorized)
+
+	resp = send(http.MethodPost, "/api/v1/session", `{"token":"token"}`, "")
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("got status %d creating session, expected 201", resp.StatusCode)
+	}
+	sess := adminapi.Session{}
+	if err = json.NewDecoder(resp.Body).Decode(&sess); err != nil {
+		t.Fatal(err)
+	}
+	cookie := resp.Cookies()[0]
+	if !cookie.HttpOnly || cookie.SameSite != http.SameSiteStrictMode {
+		t.Errorf("session cookie %v must be HttpOnly and SameSite=Strict", cookie)
+	}
+
+	// Reads only need the cookie
+	resp = send(http.MethodGet, "/api/v1/nodes", "", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d listing nodes with session, expected 200", resp.StatusCode)
+	}
+
+	disable := "/api/v1/node/" + strconv.FormatUint(n.ID, 10) + "/disable"
+	resp = send(http.MethodPost, disable, "", "")
+	expectJSONError(t, resp, http.StatusForbidden)
+	resp = send(http.MethodPost, disable, "", "wrong")
+	expectJSONError(t, resp, http.StatusForbidden)
+
+	resp = send(http.MethodPost, disable, "", sess.CSRFToken)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d disabling node with csrf token, expected 200", resp.StatusCode)
+	}
+
+	resp = send(http.MethodDelete, "/api/v1/session", "", "")
+	resp.Body.Close()
+	resp = send(http.MethodGet, "/api/v1/nodes", "", "")
+	expectJSONError(t, resp, http.StatusUnauthorized)
+}
+
+func TestSessionRequiresJSON(t *testing.T) {
+	_, srv := newTestAPI(t)
+
+	// A cross-site form can post the token but not as JSON
+	resp, err := http.Post(
+		srv.URL+"/api/v1/session",
+		"application/x-www-form-urlencoded",
+		strings.NewReader(`{"token":"token"}`),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectJSONError(t, resp, http.StatusUnsupportedMediaType)
+}
@@ -1,12 +1,18 @@
 package config
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"log"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/netip"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 var ConfigFilePath string
@@ -17,13 +23,169 @@ const (
 )
 
 type Config struct {
-	NetworkPrefix  netip.Prefix `json:"network_prefix"`
-	StorePath      string       `json:"store_path"`
-	HTTPPort       int          `json:"http_port"`
-	StunPort       int          `json:"stun_port"`
-	AutoCertDomain string       `json:"autocert_domain"`
-	Debug          bool         `json:"debug_mode"`
+	NetworkPrefix netip.Prefix `json:"network_prefix"`
+	// StoreDriver selects the store backend: bolt, sqlite, memory or raft
+	StoreDriver string `json:"store_driver"`
+	StorePath   string `json:"store_path"`
+	HTTPPort    int    `json:"http_port"`
+	// Address the HTTP server listens on, such as :8443 or 10.0.0.1:443. Defaults to
+	// :http_port, or :443 when autocert_domain is set.
+	ListenAddr string `json:"listen_addr"`
+	StunPort   int    `json:"stun_port"`
+	// Port for a separate Prometheus /metrics listener on the admin listen host, 0
+	// disables it. Metrics are always served on the admin listener.
+	//
+	// Deprecated: scrape /metrics on the admin listener instead.
+	MetricsPort    int    `json:"metrics_port"`
+	AutoCertDomain string `json:"autocert_domain"`
+	Debug          bool   `json:"debug_mode"`
+	// Days a node key is valid for after the node registers
+	KeyExpiryDays int `json:"key_expiry_days"`
 	// Auth Stuff
+	// Bearer tokens for the REST API keyed by name.
+	// The name is recorded as the actor in the audit log.
+	APITokens map[string]string `json:"api_tokens"`
+
+	// TLS for the HTTP server from certificate files or autocert_domain
+	TLS TLSConfig `json:"tls"`
+	// Admin configures the listener for the REST API, web UI, metrics and debug
+	// handlers, which are not served on the node facing HTTP listener
+	Admin AdminConfig `json:"admin"`
+
+	RateLimit RateLimitConfig `json:"rate_limit"`
+	Log       LogConfig       `json:"log"`
+	Shutdown  ShutdownConfig  `json:"shutdown"`
+	// Raft configures the replicated store used when StoreDriver is raft
+	Raft RaftConfig `json:"raft"`
+}
+
+// RaftConfig configures a control server as one member of a raft cluster. Every
+// member is configured with the same Peers and its own NodeID.
+type RaftConfig struct {
+	// NodeID identifies this server in the cluster and must be one of Peers
+	NodeID string `json:"node_id"`
+	// Address the raft transport listens on, defaults to this server's address in Peers.
+	// Raft traffic is not encrypted, so it must only be reachable by the cluster.
+	Address string `json:"address"`
+	// Secret shared by every member. Connections to the raft address must prove they
+	// know it before raft messages or forwarded writes are accepted.
+	Secret string `json:"secret"`
+	// Directory for the raft log and snapshots
+	Dir string `json:"dir"`
+	// Peers maps the node ID of every member, including this one, to the host:port
+	// the other members reach its raft transport at.
+	// A cluster is bootstrapped with these members the first time it starts.
+	Peers map[string]string `json:"peers"`
+}
+
+// TLSConfig configures TLS for the HTTP server. Certificate files and autocert
+// are exclusive, without either the server serves plain HTTP.
+type TLSConfig struct {
+	// PEM certificate chain and key files. Changes to the files are picked up
+	// without a restart.
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// ACME directory URL autocert requests certificates from, defaults to Let's Encrypt
+	ACMEDirectory string `json:"acme_directory"`
+	// Directory autocert caches accounts and certificates in, defaults to
+	// golang-autocert in the user cache directory
+	ACMECacheDir string `json:"acme_cache_dir"`
+	// PEM CA certificates trusted for the ACME directory in addition to the system
+	// roots, for a test CA such as Pebble
+	ACMECAFile string `json:"acme_ca_file"`
+	// PEM CA certificates that sign client certificates. When set, requests to the
+	// admin API must present a client certificate signed by one of them.
+	ClientCAFile string `json:"client_ca_file"`
+}
+
+// AdminConfig configures the admin listener
+type AdminConfig struct {
+	// Address the admin server listens on: host:port for TCP, or unix:/path for a
+	// Unix socket. Over TCP it serves TLS when the HTTP server does.
+	ListenAddr string `json:"listen_addr"`
+	// Permissions of the Unix socket file in octal, such as 0660
+	SocketMode string `json:"socket_mode"`
+	// Serve the net/http/pprof profiles under /debug/pprof/
+	Pprof bool `json:"pprof"`
+}
+
+// ShutdownConfig controls how the server drains connections when it is stopped
+type ShutdownConfig struct {
+	// Seconds to wait for polls, relay conns and other requests to finish before
+	// they are closed
+	TimeoutSeconds int `json:"timeout_seconds"`
+	// URL of the control server nodes are told to reconnect to, such as another
+	// member of the raft cluster. Nodes only follow it to a server they are
+	// configured with.
+	ReconnectURL string `json:"reconnect_url"`
+}
+
+// LogConfig controls server logging
+type LogConfig struct {
+	// Minimum level to log: debug, info, warn or error
+	Level string `json:"level"`
+	// Output format: text or json
+	Format string `json:"format"`
+	// Per-subsystem level overrides keyed by subsystem name (control, relay, stun, api, store, etc)
+	Subsystems map[string]string `json:"subsystems,omitempty"`
+}
+
+// RateLimitConfig controls request limiting on the node facing endpoints
+// (/login, /poll and /relay). A zero value for any limit disables it.
+type RateLimitConfig struct {
+	// Requests allowed per minute from a single source IP
+	PerIPPerMinute int `json:"per_ip_per_minute"`
+	PerIPBurst     int `json:"per_ip_burst"`
+	// Requests allowed per minute for a single control or node key
+	PerKeyPerMinute int `json:"per_key_per_minute"`
+	PerKeyBurst     int `json:"per_key_burst"`
+	// Failed registrations allowed before a source is locked out
+	MaxFailedRegistrations int `json:"max_failed_registrations"`
+	LockoutSeconds         int `json:"lockout_seconds"`
+}
+
+// HTTPListenAddr returns the address the HTTP server listens on
+func (c *Config) HTTPListenAddr() string {
+	switch {
+	case c.ListenAddr != "":
+		return c.ListenAddr
+	case c.AutoCertDomain != "":
+		return ":443"
+	default:
+		return fmt.Sprintf(":%d", uint16(c.HTTPPort))
+	}
+}
+
+// MetricsListenAddr returns the address of the separate /metrics listener. It
+// listens on the host of the admin listener, or on loopback when that is a Unix
+// socket, so metrics are never exposed wider than the admin server.
+func (c *Config) MetricsListenAddr() string {
+	host := "127.0.0.1"
+	if c.AdminUnixSocket() == "" {
+		host, _, _ = net.SplitHostPort(c.Admin.ListenAddr)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(c.MetricsPort))
+}
+
+// AdminUnixSocket returns the path of the admin Unix socket, or "" if the admin
+// server listens on TCP
+func (c *Config) AdminUnixSocket() string {
+	path, ok := strings.CutPrefix(c.Admin.ListenAddr, "unix:")
+	if !ok {
+		return ""
+	}
+	return path
+}
+
+// AdminSocketMode returns the permissions of the admin Unix socket file
+func (c *Config) AdminSocketMode() os.FileMode {
+	mode, _ := strconv.ParseUint(c.Admin.SocketMode, 8, 32)
+	return os.FileMode(mode)
+}
+
+// TLSEnabled reports whether the HTTP server serves TLS
+func (c *Config) TLSEnabled() bool {
+	return c.AutoCertDomain != "" || c.TLS.CertFile != ""
 }
 
 func SetConfigPath(path string) {
@@ -53,7 +215,7 @@ func (c *Config) WriteConfigFile() error {
 	f, err := os.Open(configPath)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
-			log.Printf("config file doesn't exist, creating %s", ConfigPath())
+			slog.Info("config file doesn't exist, creating", "path", ConfigPath())
 			os.MkdirAll(ConfigPath(), 0700)
 			if f, err = os.OpenFile(configPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666); err != nil {
 				return err
@@ -69,15 +231,55 @@ func (c *Config) WriteConfigFile() error {
 	return enc.Encode(c)
 }
 
+// SetDefaults sets c to the default config with a new admin API token, for
+// writing a new config file
 func (c *Config) SetDefaults() {
-	*c = Config{
+	*c = Defaults()
+	c.APITokens = map[string]string{
+		"admin": generateToken(),
+	}
+}
+
+// Defaults returns the default config. It has no API tokens, those are generated
+// when the config file is created.
+func Defaults() Config {
+	return Config{
 		NetworkPrefix:  netip.MustParsePrefix("100.70.0.0/24"),
+		StoreDriver:    "bolt",
 		StorePath:      filepath.Join(ConfigPath(), StoreFileName),
 		HTTPPort:       8080,
 		StunPort:       3478,
 		AutoCertDomain: "",
 		Debug:          false,
+		KeyExpiryDays:  180,
+		RateLimit: RateLimitConfig{
+			PerIPPerMinute:         120,
+			PerIPBurst:             60,
+			PerKeyPerMinute:        60,
+			PerKeyBurst:            20,
+			MaxFailedRegistrations: 5,
+			LockoutSeconds:         900,
+		},
+		Admin: AdminConfig{
+			ListenAddr: "127.0.0.1:8081",
+			SocketMode: "0660",
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "text",
+		},
+		Shutdown: ShutdownConfig{
+			TimeoutSeconds: 30,
+		},
+	}
+}
+
+func generateToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic("error generating random bytes for api token: " + err.Error())
 	}
+	return hex.EncodeToString(b)
 }
 
 func ConfigPath() string {
@@ -2,7 +2,11 @@ package config
 
 import (
 	"errors"
+	"net/netip"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 )
 
@@ -24,3 +28,356 @@ func TestOpenOrCreateConfigFile(t *testing.T) {
 		}
 	}
 }
+
+func useConfigDir(t *testing.T) string {
+	t.Helper()
+	old := ConfigFilePath
+	SetConfigPath(t.TempDir())
+	t.Cleanup(func() { SetConfigPath(old) })
+	if err := os.MkdirAll(ConfigPath(), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return ConfigPath()
+}
+
+func TestLoad(t *testing.T) {
+	dir := useConfigDir(t)
+	yamlConfig := `
+http_port: 8443
+rate_limit:
+  per_ip_burst: 10
+  per_key_burst: 5
+log:
+  subsystems:
+    relay: debug
+api_tokens:
+  ops: secret
+`
+	err := os.WriteFile(filepath.Join(dir, "config.yaml"), []byte(yamlConfig), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := Load(Overrides{
+		Env: []string{
+			"CALNET_RATE_LIMIT_PER_IP_BURST=20",
+			"CALNET_LOG_SUBSYSTEMS=stun=warn, api=error",
+			"CALNET_UNKNOWN=1",
+			"HTTP_PORT=1",
+		},
+		Flags: map[string]string{"rate_limit.per_key_burst": "30", "debug_mode": "true"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := loaded.Config
+	if c.HTTPPort != 8443 || c.StunPort != 3478 {
+		t.Errorf("got ports %d and %d, expected 8443 from the file and the default 3478",
+			c.HTTPPort, c.StunPort)
+	}
+	if c.RateLimit.PerIPBurst != 20 || c.RateLimit.PerKeyBurst != 30 || !c.Debug {
+		t.Errorf("environment and flags were not applied over the file: %+v", c.RateLimit)
+	}
+	if len(c.APITokens) != 1 || c.APITokens["ops"] != "secret" {
+		t.Errorf("got api tokens %v", c.APITokens)
+	}
+	if len(c.Log.Subsystems) != 2 || c.Log.Subsystems["api"] != "error" {
+		t.Errorf("got log subsystems %v, expected the environment to replace the file", c.Log.Subsystems)
+	}
+
+	for key, source := range map[string]Source{
+		"network_prefix":           SourceDefault,
+		"http_port":                SourceFile,
+		"api_tokens":               SourceFile,
+		"rate_limit.per_ip_burst":  SourceEnv,
+		"log.subsystems":           SourceEnv,
+		"rate_limit.per_key_burst": SourceFlag,
+		"debug_mode":               SourceFlag,
+	} {
+		if loaded.Sources[key] != source {
+			t.Errorf("%s has source %s, expected %s", key, loaded.Sources[key], source)
+		}
+	}
+	if loaded.File != filepath.Join(dir, "config.yaml") {
+		t.Errorf("got config file %s", loaded.File)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	for name, tc := range map[string]struct {
+		file      string
+		overrides Overrides
+	}{
+		"unknown file key":  {file: `{"http_port": 8080, "rate_limit": {"burst": 1}}`},
+		"invalid file":      {file: `{"http_port": "eighty"}`},
+		"invalid env value": {overrides: Overrides{Env: []string{"CALNET_DEBUG_MODE=maybe"}}},
+		"invalid map value": {overrides: Overrides{Env: []string{"CALNET_RAFT_PEERS=a"}}},
+		"unknown flag key":  {overrides: Overrides{Flags: map[string]string{"port": "1"}}},
+		"invalid config":    {overrides: Overrides{Flags: map[string]string{"http_port": "70000"}}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := useConfigDir(t)
+			if tc.file != "" {
+				err := os.WriteFile(filepath.Join(dir, ConfigFileName), []byte(tc.file), 0600)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := Load(tc.overrides); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for name, tc := range map[string]struct {
+		modify func(c *Config)
+		errMsg string
+	}{
+		"defaults": {modify: func(c *Config) {}},
+		"small prefix": {
+			modify: func(c *Config) { c.NetworkPrefix = netip.MustParsePrefix("100.70.0.0/31") },
+			errMsg: "too small",
+		},
+		"smallest prefix": {
+			modify: func(c *Config) { c.NetworkPrefix = netip.MustParsePrefix("100.70.0.0/30") },
+		},
+		"unmasked prefix": {
+			modify: func(c *Config) { c.NetworkPrefix = netip.MustParsePrefix("100.70.0.1/24") },
+			errMsg: "host bits",
+		},
+		"port conflict": {
+			modify: func(c *Config) { c.MetricsPort = c.HTTPPort },
+			errMsg: "metrics_port 8080 conflicts with http_port",
+		},
+		"metrics disabled": {modify: func(c *Config) { c.MetricsPort = 0 }},
+		"raft port conflict": {
+			modify: func(c *Config) {
+				c.StoreDriver = "raft"
+				c.Raft = RaftConfig{
+					NodeID: "a",
+					Dir:    "raft",
+					Secret: "0123456789abcdef",
+					Peers:  map[string]string{"a": "10.0.0.1:8081", "b": "10.0.0.2:8081"},
+				}
+			},
+			errMsg: "raft.address 8081 conflicts with admin.listen_addr",
+		},
+		"raft secret": {
+			modify: func(c *Config) {
+				c.StoreDriver = "raft"
+				c.Raft = RaftConfig{
+					NodeID: "a",
+					Dir:    "raft",
+					Secret: "short",
+					Peers:  map[string]string{"a": "10.0.0.1:9000"},
+				}
+			},
+			errMsg: "raft.secret must be at least 16 characters",
+		},
+		"admin unix socket": {
+			modify: func(c *Config) { c.Admin.ListenAddr = "unix:/run/calnet/admin.sock" },
+		},
+		"admin socket path": {
+			modify: func(c *Config) { c.Admin.ListenAddr = "unix:" },
+			errMsg: "has no socket path",
+		},
+		"admin socket mode": {
+			modify: func(c *Config) { c.Admin.SocketMode = "rw-rw----" },
+			errMsg: "invalid admin.socket_mode",
+		},
+		"admin port conflict": {
+			modify: func(c *Config) { c.MetricsPort = 8081 },
+			errMsg: "metrics_port 8081 conflicts with admin.listen_addr",
+		},
+		"autocert and debug": {
+			modify: func(c *Config) {
+				c.AutoCertDomain = "control.example.com"
+				c.Debug = true
+			},
+			errMsg: "autocert_domain and debug_mode",
+		},
+		"store driver": {
+			modify: func(c *Config) { c.StoreDriver = "postgres" },
+			errMsg: "unknown store_driver",
+		},
+		"log level": {
+			modify: func(c *Config) { c.Log.Subsystems = map[string]string{"relay": "loud"} },
+			errMsg: "log.subsystems.relay",
+		},
+		"rate limit": {
+			modify: func(c *Config) { c.RateLimit.LockoutSeconds = -1 },
+			errMsg: "rate_limit.lockout_seconds",
+		},
+		"shutdown timeout": {
+			modify: func(c *Config) { c.Shutdown.TimeoutSeconds = 0 },
+			errMsg: "shutdown.timeout_seconds",
+		},
+		"shutdown reconnect url": {
+			modify: func(c *Config) { c.Shutdown.ReconnectURL = "control2:8080" },
+			errMsg: "shutdown.reconnect_url",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := Defaults()
+			tc.modify(&c)
+			err := c.Validate()
+			if tc.errMsg == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.errMsg) {
+				t.Fatalf("got error %v, expected %q", err, tc.errMsg)
+			}
+		})
+	}
+}
+
+func TestCheckReload(t *testing.T) {
+	old := Defaults()
+	new := Defaults()
+	new.Log.Level = "debug"
+	new.Log.Subsystems = map[string]string{"relay": "warn"}
+	new.RateLimit.PerIPBurst = 1
+	new.KeyExpiryDays = 30
+
+	changed, err := CheckReload(&old, &new)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"key_expiry_days", "rate_limit.per_ip_burst", "log.level", "log.subsystems",
+	}
+	if !slices.Equal(changed, expected) {
+		t.Errorf("got changed keys %v, expected %v", changed, expected)
+	}
+
+	// A missing map is the same as an empty one
+	old.APITokens = map[string]string{}
+	defaults := Defaults()
+	if changed, err = CheckReload(&old, &defaults); err != nil || len(changed) != 0 {
+		t.Errorf("got changed keys %v and error %v for the same config", changed, err)
+	}
+
+	new.HTTPPort = 8081
+	new.NetworkPrefix = netip.MustParsePrefix("100.71.0.0/24")
+	_, err = CheckReload(&old, &new)
+	if !errors.Is(err, ErrRestartRequired) {
+		t.Fatalf("got error %v, expected ErrRestartRequired", err)
+	}
+	if !strings.Contains(err.Error(), "network_prefix, http_port") {
+		t.Errorf("error %q doesn't name the changed keys", err)
+	}
+}
+
+func TestMetricsListener(t *testing.T) {
+	c := Defaults()
+	if warnings := c.Deprecations(); len(warnings) != 0 {
+		t.Errorf("got deprecation warnings %v for the defaults", warnings)
+	}
+
+	c.MetricsPort = 9090
+	for _, tc := range []struct {
+		admin    string
+		expected string
+	}{
+		{"127.0.0.1:8081", "127.0.0.1:9090"},
+		{"10.0.0.1:8081", "10.0.0.1:9090"},
+		{"[::1]:8081", "[::1]:9090"},
+		{"unix:/run/calnet/admin.sock", "127.0.0.1:9090"},
+	} {
+		c.Admin.ListenAddr = tc.admin
+		if addr := c.MetricsListenAddr(); addr != tc.expected {
+			t.Errorf("admin.listen_addr %s: got metrics address %s, expected %s",
+				tc.admin, addr, tc.expected)
+		}
+	}
+
+	warnings := c.Deprecations()
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "metrics_port is deprecated") {
+		t.Errorf("got deprecation warnings %v, expected one for metrics_port", warnings)
+	}
+}
+
+func TestValidateTLS(t *testing.T) {
+	for name, tc := range map[string]struct {
+		modify func(c *Config)
+		errMsg string
+	}{
+		"cert files": {modify: func(c *Config) {
+			c.TLS.CertFile, c.TLS.KeyFile = "cert.pem", "key.pem"
+			c.TLS.ClientCAFile = "ca.pem"
+		}},
+		"missing key file": {
+			modify: func(c *Config) { c.TLS.CertFile = "cert.pem" },
+			errMsg: "must be set together",
+		},
+		"cert files and autocert": {
+			modify: func(c *Config) {
+				c.TLS.CertFile, c.TLS.KeyFile = "cert.pem", "key.pem"
+				c.AutoCertDomain = "control.example.com"
+			},
+			errMsg: "tls.cert_file and autocert_domain",
+		},
+		"cert files and debug": {
+			modify: func(c *Config) {
+				c.TLS.CertFile, c.TLS.KeyFile = "cert.pem", "key.pem"
+				c.Debug = true
+			},
+			errMsg: "tls.cert_file and debug_mode",
+		},
+		"acme without autocert": {
+			modify: func(c *Config) { c.TLS.ACMECacheDir = "cache" },
+			errMsg: "tls.acme_cache_dir is only used with autocert_domain",
+		},
+		"acme directory": {
+			modify: func(c *Config) {
+				c.AutoCertDomain = "control.example.com"
+				c.TLS.ACMEDirectory = "pebble:14000"
+			},
+			errMsg: "must be an http or https URL",
+		},
+		"client ca without tls": {
+			modify: func(c *Config) { c.TLS.ClientCAFile = "ca.pem" },
+			errMsg: "tls.client_ca_file needs TLS",
+		},
+		"autocert listen addr": {
+			modify: func(c *Config) {
+				c.AutoCertDomain = "control.example.com"
+				c.ListenAddr = "127.0.0.1:8081"
+			},
+			errMsg: "admin.listen_addr 8081 conflicts with listen_addr",
+		},
+		"client ca with admin socket": {
+			modify: func(c *Config) {
+				c.TLS.CertFile, c.TLS.KeyFile = "cert.pem", "key.pem"
+				c.TLS.ClientCAFile = "ca.pem"
+				c.Admin.ListenAddr = "unix:/run/calnet/admin.sock"
+			},
+			errMsg: "tls.client_ca_file can't be used with a unix admin.listen_addr",
+		},
+		"invalid listen addr": {
+			modify: func(c *Config) { c.ListenAddr = "8443" },
+			errMsg: "invalid listen_addr",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := Defaults()
+			tc.modify(&c)
+			err := c.Validate()
+			if tc.errMsg == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.errMsg) {
+				t.Fatalf("got error %v, expected %q", err, tc.errMsg)
+			}
+		})
+	}
+}
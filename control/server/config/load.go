@@ -0,0 +1,297 @@
+package config
+
+import (
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Source is where a config value was set
+type Source string
+
+// Config layers in increasing priority
+const (
+	SourceDefault Source = "default"
+	SourceFile    Source = "file"
+	SourceEnv     Source = "env"
+	SourceFlag    Source = "flag"
+)
+
+// EnvPrefix prefixes the environment variables that set config values
+const EnvPrefix = "CALNET_"
+
+// Config file names looked for in the config path, in order
+var configFileNames = []string{ConfigFileName, "config.yaml", "config.yml"}
+
+// Overrides are the config values set outside of the config file
+type Overrides struct {
+	// Environment in the form returned by os.Environ
+	Env []string
+	// Values set by command line flags keyed by config key
+	Flags map[string]string
+}
+
+// Loaded is the effective config and where each value came from
+type Loaded struct {
+	Config
+	// The config file that was read, empty if there is none
+	File string
+	// Source of every config value keyed by config key
+	Sources map[string]Source
+}
+
+// field is a config value that is set as a whole, a struct field of Config that
+// is not itself a struct of config values
+type field struct {
+	// Dotted path of JSON names, such as rate_limit.per_ip_burst
+	key   string
+	index []int
+}
+
+var textUnmarshaler = reflect.TypeFor[encoding.TextUnmarshaler]()
+
+// fields returns the config values of t with keys prefixed by prefix
+func fields(t reflect.Type, prefix string, index []int) []field {
+	var fs []field
+	for i := range t.NumField() {
+		sf := t.Field(i)
+		name, _, _ := strings.Cut(sf.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		key := prefix + name
+		idx := append(slices.Clone(index), i)
+		if sf.Type.Kind() == reflect.Struct && !reflect.PointerTo(sf.Type).Implements(textUnmarshaler) {
+			fs = append(fs, fields(sf.Type, key+".", idx)...)
+			continue
+		}
+		fs = append(fs, field{key: key, index: idx})
+	}
+	return fs
+}
+
+var configFields = fields(reflect.TypeFor[Config](), "", nil)
+
+// Keys returns the keys of every config value
+func Keys() []string {
+	keys := make([]string, len(configFields))
+	for i, f := range configFields {
+		keys[i] = f.key
+	}
+	return keys
+}
+
+// EnvName returns the environment variable that sets the config value key, such
+// as CALNET_RATE_LIMIT_PER_IP_BURST for rate_limit.per_ip_burst
+func EnvName(key string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// Value returns the value of key in c
+func (c *Config) Value(key string) (any, bool) {
+	for _, f := range configFields {
+		if f.key == key {
+			return reflect.ValueOf(c).Elem().FieldByIndex(f.index).Interface(), true
+		}
+	}
+	return nil, false
+}
+
+// FindConfigFile returns the path of the config file in the config path, or an
+// empty path if there is none
+func FindConfigFile() (string, error) {
+	for _, name := range configFileNames {
+		path := filepath.Join(ConfigPath(), name)
+		_, err := os.Stat(path)
+		if err == nil {
+			return path, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// Load builds the config from the defaults, the config file, then the environment
+// and then flags, each overriding the values set before it, and validates it
+func Load(o Overrides) (*Loaded, error) {
+	l := &Loaded{
+		Config:  Defaults(),
+		Sources: make(map[string]Source, len(configFields)),
+	}
+	for _, f := range configFields {
+		l.Sources[f.key] = SourceDefault
+	}
+
+	file, err := FindConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	if file != "" {
+		if err = l.loadFile(file); err != nil {
+			return nil, fmt.Errorf("error reading config file %s: %w", file, err)
+		}
+	}
+
+	env := make(map[string]string)
+	for _, kv := range o.Env {
+		if k, v, ok := strings.Cut(kv, "="); ok && strings.HasPrefix(k, EnvPrefix) {
+			env[k] = v
+		}
+	}
+	for _, f := range configFields {
+		if v, ok := env[EnvName(f.key)]; ok {
+			if err = l.set(f, v, SourceEnv); err != nil {
+				return nil, fmt.Errorf("%s: %w", EnvName(f.key), err)
+			}
+		}
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(o.Flags)) {
+		i := slices.IndexFunc(configFields, func(f field) bool { return f.key == key })
+		if i < 0 {
+			return nil, fmt.Errorf("flag for unknown config key %q", key)
+		}
+		if err = l.set(configFields[i], o.Flags[key], SourceFlag); err != nil {
+			return nil, fmt.Errorf("flag for %s: %w", key, err)
+		}
+	}
+
+	if err = l.Validate(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// loadFile sets the values in the JSON or YAML config file at path
+func (l *Loaded) loadFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	values := make(map[string]any)
+	if ext := filepath.Ext(path); ext == ".yaml" || ext == ".yml" {
+		err = yaml.Unmarshal(b, &values)
+	} else {
+		err = json.Unmarshal(b, &values)
+	}
+	if err != nil {
+		return err
+	}
+	if err = checkKeys(values, ""); err != nil {
+		return err
+	}
+
+	v := reflect.ValueOf(&l.Config).Elem()
+	for _, f := range configFields {
+		if _, ok := lookup(values, f.key); ok {
+			// Maps are replaced rather than merged with the defaults
+			fv := v.FieldByIndex(f.index)
+			fv.SetZero()
+			l.Sources[f.key] = SourceFile
+		}
+	}
+	// The values are decoded as JSON so YAML files use the same names and formats
+	b, err = json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(b, &l.Config); err != nil {
+		return err
+	}
+	l.File = path
+	return nil
+}
+
+// checkKeys returns an error for keys in values that are not config keys
+func checkKeys(values map[string]any, prefix string) error {
+	for k, v := range values {
+		key := prefix + k
+		if slices.ContainsFunc(configFields, func(f field) bool { return f.key == key }) {
+			continue
+		}
+		nested, ok := v.(map[string]any)
+		isParent := slices.ContainsFunc(configFields, func(f field) bool {
+			return strings.HasPrefix(f.key, key+".")
+		})
+		if !ok || !isParent {
+			return fmt.Errorf("unknown config key %q", key)
+		}
+		if err := checkKeys(nested, key+"."); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookup returns the value at the dotted key in nested maps
+func lookup(values map[string]any, key string) (any, bool) {
+	first, rest, nested := strings.Cut(key, ".")
+	v, ok := values[first]
+	if !ok || !nested {
+		return v, ok
+	}
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil, false
+	}
+	return lookup(m, rest)
+}
+
+// set parses s into the config value f. Maps are written as name=value pairs
+// separated by commas.
+func (l *Loaded) set(f field, s string, source Source) error {
+	v := reflect.ValueOf(&l.Config).Elem().FieldByIndex(f.index)
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		if err := u.UnmarshalText([]byte(s)); err != nil {
+			return err
+		}
+		l.Sources[f.key] = source
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", s)
+		}
+		v.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("invalid bool %q", s)
+		}
+		v.SetBool(b)
+	case reflect.Map:
+		m := make(map[string]string)
+		for _, pair := range strings.Split(s, ",") {
+			if pair = strings.TrimSpace(pair); pair == "" {
+				continue
+			}
+			name, value, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("invalid map entry %q: must be name=value", pair)
+			}
+			m[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		}
+		v.Set(reflect.ValueOf(m))
+	default:
+		return fmt.Errorf("can't set %s values", v.Kind())
+	}
+	l.Sources[f.key] = source
+	return nil
+}
@@ -0,0 +1,58 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// ErrRestartRequired is returned reloading a config that changes values which are
+// only read when the server starts
+var ErrRestartRequired = errors.New("config changes require a restart")
+
+// Keys of the values that can be changed while the server runs, a key ending in a
+// dot covers every value under it
+var reloadableKeys = []string{"log.", "rate_limit.", "key_expiry_days"}
+
+// Reloadable reports whether the config value key can be changed while the
+// server runs
+func Reloadable(key string) bool {
+	return slices.ContainsFunc(reloadableKeys, func(k string) bool {
+		return k == key || strings.HasSuffix(k, ".") && strings.HasPrefix(key, k)
+	})
+}
+
+// Changed returns the keys of the values that differ between old and new
+func Changed(old, new *Config) []string {
+	var changed []string
+	o, n := reflect.ValueOf(old).Elem(), reflect.ValueOf(new).Elem()
+	for _, f := range configFields {
+		ov, nv := o.FieldByIndex(f.index), n.FieldByIndex(f.index)
+		// A missing map is the same as an empty one
+		if ov.Kind() == reflect.Map && ov.Len() == 0 && nv.Len() == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(ov.Interface(), nv.Interface()) {
+			changed = append(changed, f.key)
+		}
+	}
+	return changed
+}
+
+// CheckReload returns the keys of the values new changes from old, or an error
+// wrapping ErrRestartRequired if any of them can't be changed while the server runs
+func CheckReload(old, new *Config) ([]string, error) {
+	changed := Changed(old, new)
+	var restart []string
+	for _, key := range changed {
+		if !Reloadable(key) {
+			restart = append(restart, key)
+		}
+	}
+	if len(restart) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrRestartRequired, strings.Join(restart, ", "))
+	}
+	return changed, nil
+}
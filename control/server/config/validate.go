@@ -0,0 +1,274 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Store drivers the server can be configured with
+var storeDrivers = []string{"bolt", "sqlite", "memory", "raft"}
+
+// minRaftSecretLength is the shortest raft.secret accepted
+const minRaftSecretLength = 16
+
+// Addresses in the network prefix that are never allocated to nodes
+const reservedAddresses = 1
+
+// Smallest number of node addresses a network prefix must have
+const minNodeAddresses = 2
+
+// Validate checks that the config can be used to run a server and returns every
+// problem found
+func (c *Config) Validate() error {
+	var errs []error
+	add := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	p := c.NetworkPrefix
+	switch {
+	case !p.IsValid():
+		add("network_prefix must be set")
+	case !p.Addr().Is4():
+		add("network_prefix %s must be an IPv4 prefix", p)
+	case p.Masked() != p:
+		add("network_prefix %s has host bits set, use %s", p, p.Masked())
+	case 1<<(32-p.Bits())-reservedAddresses < minNodeAddresses:
+		add("network_prefix %s is too small: %d address is reserved and %d are needed for nodes",
+			p, reservedAddresses, minNodeAddresses)
+	}
+
+	ports := map[int]string{}
+	checkPort := func(key string, port int, optional bool) {
+		if optional && port == 0 {
+			return
+		}
+		if port < 1 || port > 65535 {
+			add("%s %d is not a valid port", key, port)
+			return
+		}
+		if other, ok := ports[port]; ok {
+			add("%s %d conflicts with %s", key, port, other)
+			return
+		}
+		ports[port] = key
+	}
+	// STUN listens on UDP, so only the TCP listeners can conflict
+	switch port, err := addrPort(c.HTTPListenAddr()); {
+	case c.ListenAddr == "" && c.AutoCertDomain == "":
+		checkPort("http_port", c.HTTPPort, false)
+	case err != nil:
+		add("invalid listen_addr %q: %w", c.ListenAddr, err)
+	default:
+		checkPort("listen_addr", port, false)
+	}
+	errs = append(errs, c.validateAdmin(checkPort))
+	checkPort("metrics_port", c.MetricsPort, true)
+	if c.StunPort < 1 || c.StunPort > 65535 {
+		add("stun_port %d is not a valid port", c.StunPort)
+	}
+
+	if c.KeyExpiryDays < 1 {
+		add("key_expiry_days must be at least 1")
+	}
+
+	if c.AutoCertDomain != "" && c.Debug {
+		add("autocert_domain and debug_mode can't both be set, debug mode disables TLS")
+	}
+	errs = append(errs, c.validateTLS())
+
+	switch {
+	case !slices.Contains(storeDrivers, c.StoreDriver):
+		add("unknown store_driver %q: must be one of %s",
+			c.StoreDriver, strings.Join(storeDrivers, ", "))
+	case c.StoreDriver == "raft":
+		errs = append(errs, c.Raft.validate(checkPort))
+	case c.StoreDriver != "memory" && c.StorePath == "":
+		add("store_path must be set for the %s store", c.StoreDriver)
+	}
+
+	errs = append(errs, c.Log.validate(), c.RateLimit.validate(), c.Shutdown.validate())
+	return errors.Join(errs...)
+}
+
+// Deprecations returns a warning for each deprecated config value that is set
+func (c *Config) Deprecations() []string {
+	var warnings []string
+	if c.MetricsPort != 0 {
+		warnings = append(warnings, fmt.Sprintf(
+			"metrics_port is deprecated, scrape /metrics on admin.listen_addr %s instead",
+			c.Admin.ListenAddr))
+	}
+	return warnings
+}
+
+func (c *Config) validateTLS() error {
+	var errs []error
+	add := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	t := c.TLS
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		add("tls.cert_file and tls.key_file must be set together")
+	}
+	if t.CertFile != "" && c.AutoCertDomain != "" {
+		add("tls.cert_file and autocert_domain can't both be set")
+	}
+	if t.CertFile != "" && c.Debug {
+		add("tls.cert_file and debug_mode can't both be set, debug mode disables TLS")
+	}
+	if c.AutoCertDomain == "" {
+		for _, key := range []string{"acme_directory", "acme_cache_dir", "acme_ca_file"} {
+			if v, _ := c.Value("tls." + key); v != "" {
+				add("tls.%s is only used with autocert_domain", key)
+			}
+		}
+	}
+	if t.ACMEDirectory != "" {
+		u, err := url.Parse(t.ACMEDirectory)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			add("tls.acme_directory %q must be an http or https URL", t.ACMEDirectory)
+		}
+	}
+	if t.ClientCAFile != "" && !c.TLSEnabled() {
+		add("tls.client_ca_file needs TLS from tls.cert_file or autocert_domain")
+	}
+	if t.ClientCAFile != "" && c.AdminUnixSocket() != "" {
+		add("tls.client_ca_file can't be used with a unix admin.listen_addr, " +
+			"the socket permissions control access")
+	}
+	return errors.Join(errs...)
+}
+
+func (c *Config) validateAdmin(checkPort func(key string, port int, optional bool)) error {
+	var errs []error
+	add := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	switch port, err := addrPort(c.Admin.ListenAddr); {
+	case c.Admin.ListenAddr == "":
+		add("admin.listen_addr must be set")
+	case c.AdminUnixSocket() != "":
+	case strings.HasPrefix(c.Admin.ListenAddr, "unix:"):
+		add("admin.listen_addr %q has no socket path", c.Admin.ListenAddr)
+	case err != nil:
+		add("invalid admin.listen_addr %q: %w", c.Admin.ListenAddr, err)
+	default:
+		checkPort("admin.listen_addr", port, false)
+	}
+	if mode, err := strconv.ParseUint(c.Admin.SocketMode, 8, 32); err != nil || mode > 0o777 {
+		add("invalid admin.socket_mode %q: must be octal permissions such as 0660",
+			c.Admin.SocketMode)
+	}
+	return errors.Join(errs...)
+}
+
+// addrPort returns the port of a host:port address
+func addrPort(addr string) (int, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(port)
+}
+
+func (r *RaftConfig) validate(checkPort func(key string, port int, optional bool)) error {
+	var errs []error
+	advertise, ok := r.Peers[r.NodeID]
+	if r.NodeID == "" || !ok {
+		errs = append(errs, fmt.Errorf("raft.node_id %q must be one of raft.peers", r.NodeID))
+	}
+	if r.Dir == "" {
+		errs = append(errs, errors.New("raft.dir must be set"))
+	}
+	if len(r.Secret) < minRaftSecretLength {
+		errs = append(
+			errs,
+			fmt.Errorf("raft.secret must be at least %d characters", minRaftSecretLength),
+		)
+	}
+	for _, id := range slices.Sorted(maps.Keys(r.Peers)) {
+		if _, _, err := net.SplitHostPort(r.Peers[id]); err != nil {
+			errs = append(errs, fmt.Errorf("invalid raft.peers address for %s: %w", id, err))
+		}
+	}
+
+	bind := r.Address
+	if bind == "" {
+		bind = advertise
+	}
+	if bind != "" {
+		port, err := addrPort(bind)
+		if err == nil {
+			checkPort("raft.address", port, false)
+		}
+		if err != nil && r.Address != "" {
+			errs = append(errs, fmt.Errorf("invalid raft.address %q: %w", r.Address, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (l *LogConfig) validate() error {
+	var errs []error
+	checkLevel := func(key, s string) {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(s)); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s %q", key, s))
+		}
+	}
+	if l.Level != "" {
+		checkLevel("log.level", l.Level)
+	}
+	for name, level := range l.Subsystems {
+		checkLevel("log.subsystems."+name, level)
+	}
+	if f := strings.ToLower(l.Format); f != "" && f != "text" && f != "json" {
+		errs = append(errs, fmt.Errorf("invalid log.format %q: must be text or json", l.Format))
+	}
+	return errors.Join(errs...)
+}
+
+func (s *ShutdownConfig) validate() error {
+	var errs []error
+	if s.TimeoutSeconds < 1 {
+		errs = append(errs, errors.New("shutdown.timeout_seconds must be at least 1"))
+	}
+	if s.ReconnectURL != "" {
+		u, err := url.Parse(s.ReconnectURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			errs = append(errs, fmt.Errorf(
+				"shutdown.reconnect_url %q must be an http or https URL", s.ReconnectURL))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r *RateLimitConfig) validate() error {
+	var errs []error
+	for _, limit := range []struct {
+		key   string
+		value int
+	}{
+		{"per_ip_per_minute", r.PerIPPerMinute},
+		{"per_ip_burst", r.PerIPBurst},
+		{"per_key_per_minute", r.PerKeyPerMinute},
+		{"per_key_burst", r.PerKeyBurst},
+		{"max_failed_registrations", r.MaxFailedRegistrations},
+		{"lockout_seconds", r.LockoutSeconds},
+	} {
+		if limit.value < 0 {
+			errs = append(errs, fmt.Errorf("rate_limit.%s can't be negative", limit.key))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -3,44 +3,74 @@ package controlservice
 import (
 	"encoding/json"
 	"errors"
-	"log"
 	"net/http"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/caldog20/calnet/control/server/config"
+	"github.com/caldog20/calnet/control/server/events"
+	"github.com/caldog20/calnet/control/server/internal/audit"
 	"github.com/caldog20/calnet/control/server/internal/ipam"
 	"github.com/caldog20/calnet/control/server/internal/node"
-	"github.com/caldog20/calnet/control/server/internal/store"
+	"github.com/caldog20/calnet/control/server/internal/provision"
+	"github.com/caldog20/calnet/control/server/internal/ratelimit"
+	internalstore "github.com/caldog20/calnet/control/server/internal/store"
+	"github.com/caldog20/calnet/control/server/logging"
+	"github.com/caldog20/calnet/control/server/store"
 	"github.com/caldog20/calnet/pkg/controlapi"
 	"github.com/caldog20/calnet/pkg/keys"
 )
 
 const (
 	// TODO: Make configurable
-	CleanupRoutineTicker = time.Minute * 5
+	CleanupRoutineTicker = time.Minute
+	// Nodes that haven't polled within this duration are considered offline
+	PollerTimeout = time.Minute * 2
+	// Accepted in debug mode so development nodes can register without creating a provisioning key
+	debugProvisionKey = "please"
 )
 
+var logger = logging.Logger(logging.SubsystemControl)
+
 type Control struct {
-	store              store.Store
+	store              internalstore.Store
 	privateKey         keys.PrivateKey
 	publicKey          keys.PublicKey
 	ipam               *ipam.IPAM
 	disableControlNacl bool
+	allowDebugKey      bool
+
+	ipLimiter  *ratelimit.Limiter
+	keyLimiter *ratelimit.Limiter
+	regLockout *ratelimit.Lockout
+	// How long the keys of newly registered nodes are valid for, guarded by mu
+	keyExpiry time.Duration
+
+	bus *events.Bus
+	// Stops dispatching store node changes to pollers
+	stopWatch func()
 
 	mu           sync.Mutex
 	pollingNodes map[uint64]*pollingNode
 	closed       chan bool
+	// Closed by Drain, polls are answered with a going away response from then on
+	goingAway chan struct{}
+	// Control server URL going away responses point nodes at, guarded by mu
+	reconnectURL string
 }
 
 type pollingNode struct {
 	lastPoll time.Time
-	ch       chan struct{}
+	// Number of in-flight polls for the node
+	active int
+	ch     chan struct{}
 }
 
-func New(conf config.Config, store store.Store) *Control {
+func New(conf config.Config, store internalstore.Store) *Control {
 	privKey, err := readKeyFromFile(config.ConfigPath())
 	if err != nil {
 		privKey = generateKey(config.ConfigPath())
@@ -48,20 +78,69 @@ func New(conf config.Config, store store.Store) *Control {
 
 	allocatedIps, err := store.GetAllocatedNodeIPs()
 	if err != nil {
-		log.Println("error getting allocated node IPs from store:", err)
+		logger.Error("error getting allocated node IPs from store", logging.Err(err))
 	}
 
 	ipam := ipam.NewIPAM(conf.NetworkPrefix, allocatedIps)
 
-	return &Control{
+	c := &Control{
 		store:              store,
 		ipam:               ipam,
 		pollingNodes:       make(map[uint64]*pollingNode),
 		closed:             make(chan bool),
+		goingAway:          make(chan struct{}),
 		disableControlNacl: conf.Debug,
+		allowDebugKey:      conf.Debug,
 		privateKey:         privKey,
 		publicKey:          privKey.PublicKey(),
+		ipLimiter:          ratelimit.New(conf.RateLimit.PerIPPerMinute, conf.RateLimit.PerIPBurst),
+		keyLimiter:         ratelimit.New(conf.RateLimit.PerKeyPerMinute, conf.RateLimit.PerKeyBurst),
+		regLockout: ratelimit.NewLockout(
+			conf.RateLimit.MaxFailedRegistrations,
+			time.Duration(conf.RateLimit.LockoutSeconds)*time.Second,
+		),
 	}
+	c.SetKeyExpiry(conf.KeyExpiryDays)
+
+	c.resetPresence()
+	c.stopWatch = store.WatchNodes(c.dispatch)
+	c.registerMetrics()
+	go c.cleanupPollingNodes()
+
+	return c
+}
+
+// SetEventBus sets the bus that node events are published to
+func (c *Control) SetEventBus(bus *events.Bus) {
+	c.bus = bus
+}
+
+func (c *Control) publish(t events.Type, n *node.Node) {
+	c.bus.Publish(events.New(t, n))
+}
+
+// SetRateLimits changes the limits for login and poll requests. Buckets and
+// lockouts already tracked are kept.
+func (c *Control) SetRateLimits(conf config.RateLimitConfig) {
+	c.ipLimiter.SetLimit(conf.PerIPPerMinute, conf.PerIPBurst)
+	c.keyLimiter.SetLimit(conf.PerKeyPerMinute, conf.PerKeyBurst)
+	c.regLockout.SetLimit(
+		conf.MaxFailedRegistrations,
+		time.Duration(conf.LockoutSeconds)*time.Second,
+	)
+}
+
+// SetKeyExpiry sets how many days the keys of newly registered nodes are valid for.
+// Nodes that are already registered keep their key expiry. A value below 1 uses
+// the default.
+func (c *Control) SetKeyExpiry(days int) {
+	d := node.DefaultKeyExpiryDuration
+	if days > 0 {
+		d = time.Duration(days) * 24 * time.Hour
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.keyExpiry = d
 }
 
 func (c *Control) RegisterRoutes(mux *http.ServeMux) {
@@ -84,28 +163,145 @@ func (c *Control) VerifyKeyForRelay(key keys.PublicKey) bool {
 	return true
 }
 
+// allowSource checks the source IP of a request against the rate limiter and
+// registration lockouts. If the request is not allowed a 429 response is written
+// and false is returned.
+func (c *Control) allowSource(w http.ResponseWriter, src string) bool {
+	if locked, retry := c.regLockout.Locked(src); locked {
+		ratelimit.WriteTooManyRequests(w, retry)
+		return false
+	}
+	if ok, retry := c.ipLimiter.Allow(src); !ok {
+		ratelimit.WriteTooManyRequests(w, retry)
+		return false
+	}
+	return true
+}
+
+// allowKey checks the control key of a request against the rate limiter and
+// registration lockouts like allowSource. It must only be called once the body
+// has been decrypted with the key, so only the holder of the private key can use
+// up its requests or lock it out.
+func (c *Control) allowKey(w http.ResponseWriter, controlKey string) bool {
+	if locked, retry := c.regLockout.Locked(controlKey); locked {
+		ratelimit.WriteTooManyRequests(w, retry)
+		return false
+	}
+	if ok, retry := c.keyLimiter.Allow(controlKey); !ok {
+		ratelimit.WriteTooManyRequests(w, retry)
+		return false
+	}
+	return true
+}
+
+// failedRegistration records a failed registration attempt for the source IP and control key
+func (c *Control) failedRegistration(src string, controlKey string) {
+	if c.regLockout.Fail(src) {
+		logger.Warn("registration lockout triggered", logging.SourceIP(src))
+	}
+	if c.regLockout.Fail(controlKey) {
+		logger.Warn("registration lockout triggered", "control_key", controlKey)
+	}
+}
+
+// audit appends an event to the audit log. Failures are logged but do not fail the request.
+func (c *Control) audit(event *audit.Event) {
+	if err := c.store.AppendAuditEvent(event); err != nil {
+		logger.Error("error appending audit event", "action", event.Action, logging.Err(err))
+	}
+}
+
 func (c *Control) cleanupPollingNodes() {
 	t := time.NewTicker(CleanupRoutineTicker)
+	defer t.Stop()
+	lastExpiryCheck := time.Now()
 	for {
 		select {
 		case <-t.C:
+			var offline []uint64
 			c.mu.Lock()
 			for id, nn := range c.pollingNodes {
-				if nn.lastPoll.Minute() > 5 {
+				if nn.active == 0 && time.Since(nn.lastPoll) > PollerTimeout {
 					close(nn.ch)
 					delete(c.pollingNodes, id)
+					offline = append(offline, id)
 				}
 			}
 			c.mu.Unlock()
+
+			for _, id := range offline {
+				c.setPresence(id, false)
+			}
+
+			now := time.Now()
+			c.checkKeyExpiry(lastExpiryCheck, now)
+			lastExpiryCheck = now
 		case <-c.closed:
 			return
 		}
 	}
 }
 
-func (c *Control) getNodePollChan(id uint64) chan struct{} {
+// leaderStore is implemented by stores replicated between servers, which run jobs
+// for the whole cluster, such as the key expiry check, on the leader only
+type leaderStore interface {
+	IsLeader() bool
+}
+
+// checkKeyExpiry publishes a key expired event for every node whose key expired in (from, to].
+// On a replicated store only the leader checks, so the event is published once.
+func (c *Control) checkKeyExpiry(from, to time.Time) {
+	if ls, ok := c.store.(leaderStore); ok && !ls.IsLeader() {
+		return
+	}
+	nodes, err := c.store.GetNodes()
+	if err != nil {
+		logger.Error("error getting nodes to check key expiry", logging.Err(err))
+		return
+	}
+	for _, n := range nodes {
+		if n.KeyExpiry.After(from) && !n.KeyExpiry.After(to) {
+			c.publish(events.NodeKeyExpired, &n)
+		}
+	}
+}
+
+// resetPresence marks offline the nodes left polling this server by a previous
+// run. They can't still be polling and will be marked online again when they poll.
+func (c *Control) resetPresence() {
+	if err := c.store.ResetPresence(); err != nil {
+		logger.Error("error resetting node presence", logging.Err(err))
+	}
+}
+
+// setPresence records the node as having connected or disconnected and publishes the change
+func (c *Control) setPresence(id uint64, online bool) {
+	n, err := c.store.SetNodePresence(id, online)
+	if err != nil {
+		logger.Error("error updating node presence", logging.NodeID(id), logging.Err(err))
+		return
+	}
+
+	if online {
+		c.publish(events.NodeOnline, n)
+	} else if !n.Online {
+		// A node still polling another server of a raft cluster stays online
+		c.publish(events.NodeOffline, n)
+	}
+}
+
+// IsOnline reports whether the node is currently polling
+func (c *Control) IsOnline(id uint64) bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	_, ok := c.pollingNodes[id]
+	return ok
+}
+
+// getNodePollChan returns the notification channel for the node and marks a poll as in-flight.
+// Every call must be paired with a call to releaseNodePollChan.
+func (c *Control) getNodePollChan(id uint64) chan struct{} {
+	c.mu.Lock()
 	pn, ok := c.pollingNodes[id]
 	if !ok {
 		pn = &pollingNode{
@@ -116,41 +312,138 @@ func (c *Control) getNodePollChan(id uint64) chan struct{} {
 	}
 
 	pn.lastPoll = time.Now()
+	pn.active++
+	c.mu.Unlock()
+
+	if !ok {
+		c.setPresence(id, true)
+	}
 
 	return pn.ch
 }
 
-func (c *Control) closeAll() {
+func (c *Control) releaseNodePollChan(id uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if pn, ok := c.pollingNodes[id]; ok {
+		pn.active--
+		pn.lastPoll = time.Now()
+	}
+}
+
+// Drain answers every waiting poll, and every poll that arrives after it, with
+// a going away response that points the node at reconnectURL, which may be
+// empty. It is called when the server shuts down so long polls don't hold the
+// HTTP server open.
+func (c *Control) Drain(reconnectURL string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if c.Closed() {
+	if c.draining() {
 		return
 	}
-	for _, nn := range c.pollingNodes {
-		close(nn.ch)
+	c.reconnectURL = reconnectURL
+	close(c.goingAway)
+	logger.Info("draining pollers", "pollers", len(c.pollingNodes), "reconnect_url", reconnectURL)
+}
+
+func (c *Control) draining() bool {
+	select {
+	case <-c.goingAway:
+		return true
+	default:
+		return false
 	}
 }
 
-func (c *Control) createNode(nodeKey keys.PublicKey) (*node.Node, error) {
-	nodeIP, err := c.ipam.Allocate()
-	if err != nil {
-		return nil, err
+// writeGoingAway writes the response to a poll while the server is draining. It is a
+// 503 so nodes fail over to another control server.
+func (c *Control) writeGoingAway(w http.ResponseWriter) {
+	c.mu.Lock()
+	reconnectURL := c.reconnectURL
+	c.mu.Unlock()
+
+	msg := "server going away"
+	if reconnectURL != "" {
+		w.Header().Set(controlapi.ReconnectHeader, reconnectURL)
+		msg += ", reconnect to " + reconnectURL
 	}
+	w.Header().Set("Retry-After", "0")
+	http.Error(w, msg, http.StatusServiceUnavailable)
+}
+
+// useProvisionKey validates a provisioning key from a login request and records its use.
+// A nil key is returned for the debug key, which assigns no user or tags.
+func (c *Control) useProvisionKey(key string) (*provision.Key, error) {
+	if c.allowDebugKey && key == debugProvisionKey {
+		return nil, nil
+	}
+	if key == "" {
+		return nil, errors.New("missing provisioning key")
+	}
+	return c.store.UseProvisionKey(provision.Hash(key))
+}
+
+func (c *Control) createNode(
+	nodeKey keys.PublicKey,
+	pk *provision.Key,
+	hostinfo *controlapi.Hostinfo,
+) (*node.Node, error) {
+	c.mu.Lock()
+	keyExpiry := c.keyExpiry
+	c.mu.Unlock()
 
 	n := &node.Node{
 		NodeKey:   nodeKey,
-		KeyExpiry: time.Now().Add(node.DefaultKeyExpiryDuration),
-		IP:        nodeIP,
+		Hostinfo:  hostinfo,
+		KeyExpiry: time.Now().Add(keyExpiry),
 		Prefix:    c.ipam.GetPrefix(),
 	}
+	if hostinfo != nil {
+		n.Name = hostinfo.Hostname
+	}
+	if pk != nil {
+		n.User = pk.User
+		n.Tags = pk.Tags
+	}
 
-	err = c.store.CreateNode(n)
-	if err != nil {
-		c.ipam.Release(nodeIP)
-		return nil, err
+	for {
+		nodeIP, err := c.ipam.Allocate()
+		if err != nil {
+			return nil, err
+		}
+		n.IP = nodeIP
+		err = c.store.CreateNode(n)
+		// Another server of the cluster assigned the IP first, it stays allocated
+		// and the next free IP is tried
+		if errors.Is(err, store.ErrIPInUse) {
+			logger.Debug("node ip is already in use, allocating another", "ip", nodeIP)
+			continue
+		}
+		if err != nil {
+			c.ipam.Release(nodeIP)
+			return nil, err
+		}
+		return n, nil
 	}
+}
 
-	return n, nil
+// updateHostinfo saves a changed Hostinfo for n. Approved routes the node
+// no longer advertises are dropped.
+func (c *Control) updateHostinfo(n *node.Node, hostinfo *controlapi.Hostinfo) error {
+	n.Hostinfo = hostinfo
+	if n.Name == "" {
+		n.Name = hostinfo.Hostname
+	}
+	n.ApprovedRoutes = slices.DeleteFunc(n.ApprovedRoutes, func(p netip.Prefix) bool {
+		return !slices.Contains(hostinfo.Routes, p)
+	})
+
+	err := c.store.UpdateNode(n)
+	if err != nil {
+		return err
+	}
+	c.publish(events.NodeUpdated, n)
+	return nil
 }
 
 func (c *Control) getUpdate(n *node.Node) (*controlapi.PollResponse, error) {
@@ -162,15 +455,22 @@ func (c *Control) getUpdate(n *node.Node) (*controlapi.PollResponse, error) {
 	config := c.getNodeConfig(n)
 
 	resp := &controlapi.PollResponse{
-		Peers:  make([]controlapi.Peer, len(peers)),
+		Peers:  make([]controlapi.Peer, 0, len(peers)),
 		Config: config,
 	}
 
 	for _, p := range peers {
+		// Disabled nodes are refused by the control server and relay, so they are
+		// left out of the netmap until they are enabled again
+		if p.IsDisabled() {
+			continue
+		}
 		resp.Peers = append(resp.Peers, controlapi.Peer{
 			ID:        p.ID,
+			Name:      p.Name,
 			PublicKey: p.NodeKey,
 			IP:        p.IP,
+			Routes:    p.ApprovedRoutes,
 		})
 	}
 	return resp, nil
@@ -195,10 +495,14 @@ func (c *Control) notifyOne(id uint64) {
 	}
 }
 
-func (c *Control) notifyAll() {
+// notifyPeers notifies every polling node except id
+func (c *Control) notifyPeers(id uint64) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	for _, nn := range c.pollingNodes {
+	for peerID, nn := range c.pollingNodes {
+		if peerID == id {
+			continue
+		}
 		select {
 		case nn.ch <- struct{}{}:
 		default:
@@ -208,6 +512,7 @@ func (c *Control) notifyAll() {
 
 func (c *Control) Close() {
 	if !c.Closed() {
+		c.stopWatch()
 		close(c.closed)
 	}
 }
@@ -248,9 +553,9 @@ func generateKey(path string) keys.PrivateKey {
 	keyPath := filepath.Join(path, "private_key")
 	f, err := os.OpenFile(keyPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
 	if err != nil {
-		log.Printf(
-			"error opening file to write private key to disk - key will be ephemeral - %s",
-			err,
+		logger.Warn(
+			"error opening file to write private key to disk - key will be ephemeral",
+			logging.Err(err),
 		)
 		return p
 	}
@@ -263,7 +568,7 @@ func generateKey(path string) keys.PrivateKey {
 	}
 
 	if err = json.NewEncoder(f).Encode(jsonKey); err != nil {
-		log.Printf("error encoding json for private key storage: %s", err)
+		logger.Error("error encoding json for private key storage", logging.Err(err))
 	}
 	return p
 }
@@ -0,0 +1,384 @@
+package controlservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caldog20/calnet/control/server/config"
+	"github.com/caldog20/calnet/control/server/events"
+	"github.com/caldog20/calnet/control/server/internal/audit"
+	"github.com/caldog20/calnet/control/server/internal/node"
+	"github.com/caldog20/calnet/control/server/internal/provision"
+	"github.com/caldog20/calnet/control/server/store"
+	"github.com/caldog20/calnet/pkg/adminapi"
+	"github.com/caldog20/calnet/pkg/controlapi"
+	"github.com/caldog20/calnet/pkg/keys"
+)
+
+func newTestControl(t *testing.T) (*Control, *store.MemoryStore) {
+	t.Helper()
+	config.SetConfigPath(t.TempDir())
+	t.Cleanup(func() { config.SetConfigPath("") })
+
+	db := store.NewMemoryStore()
+	c := New(config.Config{NetworkPrefix: netip.MustParsePrefix("100.70.0.0/24")}, db)
+	c.SetEventBus(events.NewBus())
+	t.Cleanup(c.Close)
+	return c, db
+}
+
+func TestVerifyKeyForRelay(t *testing.T) {
+	c, db := newTestControl(t)
+
+	valid, err := c.createNode(keys.NewPrivateKey().PublicKey(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := c.createNode(keys.NewPrivateKey().PublicKey(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired.KeyExpiry = time.Now().Add(-time.Minute)
+	disabled, err := c.createNode(keys.NewPrivateKey().PublicKey(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	disabled.Disabled = true
+	for _, n := range []*node.Node{expired, disabled} {
+		if err = db.UpdateNode(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		key  keys.PublicKey
+		want bool
+	}{
+		{"valid", valid.NodeKey, true},
+		{"expired", expired.NodeKey, false},
+		{"disabled", disabled.NodeKey, false},
+		{"unknown", keys.NewPrivateKey().PublicKey(), false},
+	}
+	for _, tt := range tests {
+		if got := c.VerifyKeyForRelay(tt.key); got != tt.want {
+			t.Errorf("%s key: got %v, expected %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGetUpdate(t *testing.T) {
+	c, db := newTestControl(t)
+	lan := netip.MustParsePrefix("192.168.1.0/24")
+
+	var nodes []*node.Node
+	for range 3 {
+		hostinfo := &controlapi.Hostinfo{Hostname: "host", Routes: []netip.Prefix{lan}}
+		n, err := c.createNode(keys.NewPrivateKey().PublicKey(), nil, hostinfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, n)
+	}
+	nodes[2].ApprovedRoutes = []netip.Prefix{lan}
+	if err := db.UpdateNode(nodes[2]); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := c.getUpdate(nodes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Config.ID != nodes[0].ID || resp.Config.IP != nodes[0].IP {
+		t.Errorf("got config %+v for node %d", resp.Config, nodes[0].ID)
+	}
+	if len(resp.Peers) != 2 {
+		t.Fatalf("got %d peers, expected 2", len(resp.Peers))
+	}
+	for i, p := range resp.Peers {
+		want := nodes[i+1]
+		if p.ID != want.ID || p.PublicKey != want.NodeKey || p.IP != want.IP {
+			t.Errorf("got peer %+v, expected node %d", p, want.ID)
+		}
+	}
+	// Only approved routes are sent to peers
+	if len(resp.Peers[0].Routes) != 0 || len(resp.Peers[1].Routes) != 1 {
+		t.Errorf("got peer routes %v and %v", resp.Peers[0].Routes, resp.Peers[1].Routes)
+	}
+}
+
+func TestCreateNodeSharedStore(t *testing.T) {
+	c, db := newTestControl(t)
+	// Another server sharing the store, which allocates IPs on its own
+	other := New(config.Config{NetworkPrefix: netip.MustParsePrefix("100.70.0.0/24")}, db)
+	other.SetEventBus(events.NewBus())
+	t.Cleanup(other.Close)
+
+	ips := make(map[netip.Addr]bool)
+	for i := range 6 {
+		server := c
+		if i%2 == 1 {
+			server = other
+		}
+		n, err := server.createNode(keys.NewPrivateKey().PublicKey(), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ips[n.IP] {
+			t.Fatalf("ip %s was assigned twice", n.IP)
+		}
+		ips[n.IP] = true
+	}
+
+	// An IP assigned before this server saw the write is skipped
+	c.stopWatch()
+	taken, err := other.createNode(keys.NewPrivateKey().PublicKey(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := c.createNode(keys.NewPrivateKey().PublicKey(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.IP == taken.IP {
+		t.Fatalf("ip %s was assigned twice", n.IP)
+	}
+}
+
+func TestSetKeyExpiry(t *testing.T) {
+	c, _ := newTestControl(t)
+
+	n, err := c.createNode(keys.NewPrivateKey().PublicKey(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Until(n.KeyExpiry); d < node.DefaultKeyExpiryDuration-time.Minute {
+		t.Errorf("got key expiry in %s, expected the default %s", d, node.DefaultKeyExpiryDuration)
+	}
+
+	c.SetKeyExpiry(7)
+	n, err = c.createNode(keys.NewPrivateKey().PublicKey(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Until(n.KeyExpiry); d > 7*24*time.Hour || d < 7*24*time.Hour-time.Minute {
+		t.Errorf("got key expiry in %s, expected 7 days", d)
+	}
+}
+
+func TestKeyRateLimitAfterDecrypt(t *testing.T) {
+	c, _ := newTestControl(t)
+	c.SetRateLimits(config.RateLimitConfig{PerKeyPerMinute: 1, PerKeyBurst: 1})
+	n, err := c.createNode(keys.NewPrivateKey().PublicKey(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	controlKey := keys.NewPrivateKey()
+
+	login := func(body []byte) int {
+		req := httptest.NewRequest("POST", "/login", bytes.NewReader(body))
+		req.Header.Set("x-control-key", controlKey.PublicKey().EncodeToString())
+		w := httptest.NewRecorder()
+		c.handleLogin(w, req)
+		return w.Code
+	}
+
+	// Requests that only claim the key don't use up its requests
+	for range 3 {
+		if code := login([]byte("forged")); code != http.StatusBadRequest {
+			t.Fatalf("got status %d for a forged login, expected 400", code)
+		}
+	}
+	body, _ := json.Marshal(&controlapi.LoginRequest{NodeKey: n.NodeKey})
+	if code := login(controlKey.EncryptBox(body, c.publicKey)); code != http.StatusOK {
+		t.Fatalf("got status %d logging in after forged logins, expected 200", code)
+	}
+	if code := login(controlKey.EncryptBox(body, c.publicKey)); code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d for a login over the key limit, expected 429", code)
+	}
+}
+
+func TestDisabledNode(t *testing.T) {
+	c, db := newTestControl(t)
+	var nodes []*node.Node
+	for range 3 {
+		n, err := c.createNode(keys.NewPrivateKey().PublicKey(), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, n)
+	}
+	disabled := nodes[1]
+	disabled.Disabled = true
+	if err := db.UpdateNode(disabled); err != nil {
+		t.Fatal(err)
+	}
+
+	controlKey := keys.NewPrivateKey()
+	request := func(path string, handler http.HandlerFunc, body any) int {
+		data, _ := json.Marshal(body)
+		data = controlKey.EncryptBox(data, c.publicKey)
+		req := httptest.NewRequest("POST", path, bytes.NewReader(data))
+		req.Header.Set("x-control-key", controlKey.PublicKey().EncodeToString())
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w.Code
+	}
+	login := &controlapi.LoginRequest{NodeKey: disabled.NodeKey}
+	if code := request("/login", c.handleLogin, login); code != http.StatusForbidden {
+		t.Errorf("got status %d logging in a disabled node, expected 403", code)
+	}
+	poll := &controlapi.PollRequest{NodeKey: disabled.NodeKey}
+	if code := request("/poll", c.handlePoll, poll); code != http.StatusForbidden {
+		t.Errorf("got status %d polling as a disabled node, expected 403", code)
+	}
+
+	resp, err := c.getUpdate(nodes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Peers) != 1 || resp.Peers[0].ID != nodes[2].ID {
+		t.Errorf("got peers %+v, expected only node %d", resp.Peers, nodes[2].ID)
+	}
+}
+
+func TestRegisterAuditRedactsProvisionKey(t *testing.T) {
+	c, db := newTestControl(t)
+	key, hash := provision.Generate()
+	if err := db.CreateProvisionKey(&provision.Key{Hash: hash, User: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	controlKey := keys.NewPrivateKey()
+	body, _ := json.Marshal(&controlapi.LoginRequest{
+		NodeKey:      keys.NewPrivateKey().PublicKey(),
+		ProvisionKey: key,
+	})
+	req := httptest.NewRequest(
+		"POST",
+		"/login",
+		bytes.NewReader(controlKey.EncryptBox(body, c.publicKey)),
+	)
+	req.Header.Set("x-control-key", controlKey.PublicKey().EncodeToString())
+	w := httptest.NewRecorder()
+	c.handleLogin(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d registering, expected 200", w.Code)
+	}
+
+	events, err := db.GetAuditEvents(audit.Filter{Action: audit.ActionProvisionKeyUse})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("got %d provisioning key use events, expected 1", len(events))
+	}
+	used := adminapi.ProvisionKey{}
+	if err = json.Unmarshal(events[0].After, &used); err != nil {
+		t.Fatal(err)
+	}
+	if used.User != "alice" || used.Uses != 1 {
+		t.Errorf("got provisioning key %+v in the audit log, expected alice with 1 use", used)
+	}
+	if strings.Contains(string(events[0].After), hash) {
+		t.Error("audit event contains the provisioning key hash")
+	}
+}
+
+// followerStore is a store that reports whether this server is the raft leader
+type followerStore struct {
+	*store.MemoryStore
+	leader bool
+}
+
+func (s *followerStore) IsLeader() bool {
+	return s.leader
+}
+
+func TestCheckKeyExpiryOnLeader(t *testing.T) {
+	c, db := newTestControl(t)
+	n, err := c.createNode(keys.NewPrivateKey().PublicKey(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.KeyExpiry = time.Now().Add(-time.Second)
+	if err = db.UpdateNode(n); err != nil {
+		t.Fatal(err)
+	}
+
+	expired := func() int {
+		published, _ := c.bus.Since(0)
+		count := 0
+		for _, e := range published {
+			if e.Type == events.NodeKeyExpired {
+				count++
+			}
+		}
+		return count
+	}
+	from := time.Now().Add(-time.Minute)
+	rs := &followerStore{MemoryStore: db}
+	c.store = rs
+	c.checkKeyExpiry(from, time.Now())
+	if got := expired(); got != 0 {
+		t.Fatalf("follower published %d key expired events", got)
+	}
+	rs.leader = true
+	c.checkKeyExpiry(from, time.Now())
+	if got := expired(); got != 1 {
+		t.Fatalf("leader published %d key expired events, expected 1", got)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	c, _ := newTestControl(t)
+	c.disableControlNacl = true
+	n, err := c.createNode(keys.NewPrivateKey().PublicKey(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	poll := func() *httptest.ResponseRecorder {
+		body, _ := json.Marshal(&controlapi.PollRequest{NodeKey: n.NodeKey})
+		req := httptest.NewRequest("POST", "/poll", bytes.NewReader(body))
+		req.Header.Set("x-control-key", keys.NewPrivateKey().PublicKey().EncodeToString())
+		w := httptest.NewRecorder()
+		c.handlePoll(w, req)
+		return w
+	}
+	// The first poll of a node gets an update right away
+	if w := poll(); w.Code != http.StatusOK {
+		t.Fatalf("got status %d for the first poll, expected 200", w.Code)
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- poll() }()
+	waiting := func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		pn, ok := c.pollingNodes[n.ID]
+		return ok && pn.active > 0
+	}
+	for !waiting() {
+		time.Sleep(time.Millisecond)
+	}
+
+	c.Drain("https://control2.example.com")
+	for _, w := range []*httptest.ResponseRecorder{<-done, poll()} {
+		if w.Code != http.StatusServiceUnavailable {
+			t.Fatalf("got status %d while draining, expected 503", w.Code)
+		}
+		if got := w.Header().Get(controlapi.ReconnectHeader); got != "https://control2.example.com" {
+			t.Errorf("got reconnect header %q", got)
+		}
+		if body := w.Body.String(); !strings.Contains(body, "reconnect to https://control2.example.com") {
+			t.Errorf("got body %q", body)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package controlservice
+
+import (
+	"slices"
+
+	"github.com/caldog20/calnet/control/server/internal/node"
+	"github.com/caldog20/calnet/control/server/internal/store"
+	"github.com/caldog20/calnet/control/server/logging"
+)
+
+// dispatch notifies the pollers affected by a node change. Every write to a node
+// goes through the store, so logins, the REST API and offline tools all reach
+// the pollers the same way. Changes that only touch fields no netmap contains,
+// such as presence, notify nobody.
+func (c *Control) dispatch(change store.NodeChange) {
+	// Servers sharing a raft store each allocate IPs, so the IPs of nodes registered
+	// by the others are reserved here as their writes are applied
+	if change.New != nil {
+		c.ipam.Reserve(change.New.IP)
+	}
+
+	id := change.ID()
+	switch change.Type {
+	case store.NodeCreated, store.NodeDeleted:
+		c.notifyPeers(id)
+		// A deleted node that is still polling is told to log in again
+		c.notifyOne(id)
+	case store.NodeUpdated:
+		peers := peerChanged(change.Old, change.New)
+		self := configChanged(change.Old, change.New)
+		if peers {
+			c.notifyPeers(id)
+		}
+		if self {
+			c.notifyOne(id)
+		}
+		if peers || self {
+			logger.Debug(
+				"dispatched node update",
+				logging.NodeID(id),
+				"peers",
+				peers,
+				"self",
+				self,
+			)
+		}
+	}
+}
+
+// peerChanged reports whether a node changed in a way its peers can see,
+// it must compare every node field getUpdate sends in a Peer and whether the
+// node is left out of the peers for being disabled
+func peerChanged(old, new *node.Node) bool {
+	return old.Disabled != new.Disabled ||
+		old.Name != new.Name ||
+		old.NodeKey != new.NodeKey ||
+		old.IP != new.IP ||
+		!slices.Equal(old.ApprovedRoutes, new.ApprovedRoutes)
+}
+
+// configChanged reports whether a node changed in a way the node itself can see,
+// its own config, whether its key has expired or whether it is disabled
+func configChanged(old, new *node.Node) bool {
+	return old.Disabled != new.Disabled ||
+		old.IP != new.IP ||
+		old.Prefix != new.Prefix ||
+		!old.KeyExpiry.Equal(new.KeyExpiry)
+}
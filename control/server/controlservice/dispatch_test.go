@@ -0,0 +1,109 @@
+package controlservice
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caldog20/calnet/control/server/internal/node"
+	"github.com/caldog20/calnet/pkg/keys"
+)
+
+// notified reports whether ch has a pending notification and consumes it
+func notified(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	c, db := newTestControl(t)
+
+	var nodes []*node.Node
+	var chans []chan struct{}
+	for range 3 {
+		n, err := c.createNode(keys.NewPrivateKey().PublicKey(), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, n)
+	}
+	for _, n := range nodes[:2] {
+		ch := c.getNodePollChan(n.ID)
+		t.Cleanup(func() { c.releaseNodePollChan(n.ID) })
+		// The first poll always gets an update
+		if !notified(ch) {
+			t.Fatalf("node %d was not notified on its first poll", n.ID)
+		}
+		chans = append(chans, ch)
+	}
+
+	expect := func(step string, want ...bool) {
+		t.Helper()
+		for i, ch := range chans {
+			if got := notified(ch); got != want[i] {
+				t.Errorf("%s: node %d notified %v, expected %v", step, nodes[i].ID, got, want[i])
+			}
+		}
+	}
+
+	// Going online is a presence change no netmap contains
+	expect("presence", false, false)
+
+	nodes[2].LastConnected = time.Now()
+	nodes[2].Online = true
+	if err := db.UpdateNode(nodes[2]); err != nil {
+		t.Fatal(err)
+	}
+	expect("last connected", false, false)
+
+	nodes[2].Name = "renamed"
+	if err := db.UpdateNode(nodes[2]); err != nil {
+		t.Fatal(err)
+	}
+	expect("rename", true, true)
+
+	// Disabling a node drops it from the netmaps of its peers and ends its own poll
+	nodes[1].Disabled = true
+	if err := db.UpdateNode(nodes[1]); err != nil {
+		t.Fatal(err)
+	}
+	expect("disable", true, true)
+	nodes[1].Disabled = false
+	if err := db.UpdateNode(nodes[1]); err != nil {
+		t.Fatal(err)
+	}
+	expect("enable", true, true)
+
+	nodes[0].KeyExpiry = time.Now()
+	if err := db.UpdateNode(nodes[0]); err != nil {
+		t.Fatal(err)
+	}
+	expect("expire", true, false)
+
+	if err := db.DeleteNode(nodes[2].ID); err != nil {
+		t.Fatal(err)
+	}
+	expect("delete", true, true)
+
+	n, err := c.createNode(keys.NewPrivateKey().PublicKey(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect("register", true, true)
+
+	if err = db.DeleteNode(nodes[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	// The deleted node is notified so its poll can end
+	expect("delete polling node", true, true)
+
+	c.Close()
+	n.Name = "closed"
+	if err = db.UpdateNode(n); err != nil {
+		t.Fatal(err)
+	}
+	expect("after close", false, false)
+}
@@ -4,10 +4,13 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
-	"log"
 	"net/http"
 	"time"
 
+	"github.com/caldog20/calnet/control/server/events"
+	"github.com/caldog20/calnet/control/server/internal/audit"
+	"github.com/caldog20/calnet/control/server/internal/ratelimit"
+	"github.com/caldog20/calnet/control/server/logging"
 	"github.com/caldog20/calnet/control/server/store"
 	"github.com/caldog20/calnet/pkg/controlapi"
 	"github.com/caldog20/calnet/pkg/keys"
@@ -26,11 +29,16 @@ func (c *Control) handleControlKey(w http.ResponseWriter, _ *http.Request) {
 
 	err := json.NewEncoder(w).Encode(resp)
 	if err != nil {
-		log.Printf("error encoding server key response: %s", err)
+		logger.Error("error encoding server key response", logging.Err(err))
 	}
 }
 
 func (c *Control) handleLogin(w http.ResponseWriter, r *http.Request) {
+	result := loginResultBadRequest
+	defer func() {
+		loginsTotal.Inc(result)
+	}()
+
 	controlKeyStr := r.Header.Get("x-control-key")
 	controlKey := keys.PublicKey{}
 	err := controlKey.DecodeFromString(controlKeyStr)
@@ -39,6 +47,12 @@ func (c *Control) handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	src := ratelimit.SourceIP(r)
+	if !c.allowSource(w, src) {
+		result = loginResultRateLimited
+		return
+	}
+
 	data, err := io.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "error reading request body", http.StatusBadRequest)
@@ -53,6 +67,10 @@ func (c *Control) handleLogin(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
+	if !c.allowKey(w, controlKey.EncodeToString()) {
+		result = loginResultRateLimited
+		return
+	}
 
 	login := controlapi.LoginRequest{}
 	err = json.Unmarshal(data, &login)
@@ -64,28 +82,77 @@ func (c *Control) handleLogin(w http.ResponseWriter, r *http.Request) {
 	loggedIn := true
 	expired := false
 
-	log.Printf("processing login for node key: %s", login.NodeKey.EncodeToString())
+	logger.Info("processing login", logging.NodeKey(login.NodeKey), logging.SourceIP(src))
+	actor := audit.NodeActor(controlKey)
 	n, err := c.store.GetNodeByKey(login.NodeKey)
 	if err != nil {
 		if !errors.Is(err, store.ErrNodeNotFound) {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		} else {
+			if login.Logout {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
 			// Node not found, try to create
-			if login.ProvisionKey != "please" {
+			pk, err := c.useProvisionKey(login.ProvisionKey)
+			if err != nil {
+				result = loginResultInvalidProvisionKey
+				logger.Info("rejected registration", logging.SourceIP(src), logging.Err(err))
+				c.failedRegistration(src, controlKey.EncodeToString())
 				http.Error(w, "invalid provision key to register", http.StatusUnauthorized)
 				return
 			}
-			n, err = c.createNode(login.NodeKey)
+			n, err = c.createNode(login.NodeKey, pk, login.Hostinfo)
 			if err != nil {
+				result = loginResultError
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
+			result = loginResultRegistered
+			c.regLockout.Reset(src)
+			c.regLockout.Reset(controlKey.EncodeToString())
+			// The audit log gets the redacted key, it must never contain the hash
+			var used any
+			if pk != nil {
+				used = pk.Redacted()
+			}
+			c.audit(audit.NewEvent(audit.ActionProvisionKeyUse, actor, src, n.ID, nil, used))
+			c.audit(audit.NewEvent(audit.ActionNodeRegister, actor, src, n.ID, nil, n))
+			c.publish(events.NodeRegistered, n)
 		}
+	} else if login.Logout {
+		// Logging out expires the node key so the node must log in again to be used
+		before := *n
+		n.KeyExpiry = time.Now()
+		err = c.store.UpdateNode(n)
+		if err != nil {
+			result = loginResultError
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		loggedIn = false
+		result = loginResultLogout
+		c.audit(audit.NewEvent(audit.ActionNodeLogout, actor, src, n.ID, before, n))
+		c.publish(events.NodeUpdated, n)
+	} else if n.IsDisabled() {
+		result = loginResultDisabled
+		http.Error(w, "node is disabled", http.StatusForbidden)
+		return
+	} else if n.IsExpired() {
+		loggedIn = false
+		expired = true
+		result = loginResultExpired
+		c.audit(audit.NewEvent(audit.ActionNodeKeyExpired, actor, src, n.ID, nil, nil))
 	} else {
-		if n.IsExpired() {
-			loggedIn = false
-			expired = true
+		result = loginResultSuccess
+		c.audit(audit.NewEvent(audit.ActionNodeLogin, actor, src, n.ID, nil, nil))
+		if login.Hostinfo != nil && !login.Hostinfo.Equal(n.Hostinfo) {
+			if err = c.updateHostinfo(n, login.Hostinfo); err != nil {
+				result = loginResultError
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
 		}
 	}
 
@@ -96,6 +163,7 @@ func (c *Control) handleLogin(w http.ResponseWriter, r *http.Request) {
 
 	data, err = json.Marshal(resp)
 	if err != nil {
+		result = loginResultError
 		http.Error(w, "error marshalling response", http.StatusInternalServerError)
 		return
 	}
@@ -107,9 +175,11 @@ func (c *Control) handleLogin(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	_, err = w.Write(data)
 	if err != nil {
-		log.Printf("error writing login response: %s", err)
+		logger.Warn("error writing login response", logging.NodeID(n.ID), logging.Err(err))
 	}
-	c.notifyAll()
+	// Peers are notified of any change the login made by the store dispatcher, the
+	// node itself always gets a full update on its next poll
+	c.notifyOne(n.ID)
 }
 
 func (c *Control) handlePoll(w http.ResponseWriter, r *http.Request) {
@@ -121,6 +191,10 @@ func (c *Control) handlePoll(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !c.allowSource(w, ratelimit.SourceIP(r)) {
+		return
+	}
+
 	data, err := io.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "error reading request body", http.StatusBadRequest)
@@ -135,6 +209,9 @@ func (c *Control) handlePoll(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
+	if !c.allowKey(w, controlKey.EncodeToString()) {
+		return
+	}
 
 	pollRequest := controlapi.PollRequest{}
 	err = json.Unmarshal(data, &pollRequest)
@@ -162,33 +239,79 @@ func (c *Control) handlePoll(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		_, err = w.Write(data)
 		if err != nil {
-			log.Printf("error writing poll response: %s", err)
+			logger.Warn("error writing poll response", logging.NodeID(n.ID), logging.Err(err))
 			return
 		}
 	}
 
+	start := time.Now()
+	outcome := pollOutcomeError
+	defer func() {
+		pollDuration.Observe(outcome, time.Since(start).Seconds())
+	}()
+
+	if n.IsDisabled() {
+		outcome = pollOutcomeDisabled
+		http.Error(w, "node is disabled", http.StatusForbidden)
+		return
+	}
 	if n.IsExpired() {
+		outcome = pollOutcomeExpired
 		resp.KeyExpired = true
 		writeResponse()
 		return
 	}
+	if c.draining() {
+		outcome = pollOutcomeGoingAway
+		c.writeGoingAway(w)
+		return
+	}
 
 	timeout := time.NewTimer(time.Second * 50)
+	defer timeout.Stop()
 
 	notifyCh := c.getNodePollChan(n.ID)
+	defer c.releaseNodePollChan(n.ID)
+
+	activePollers.Inc()
+	defer activePollers.Dec()
 
 	select {
 	case <-r.Context().Done():
+		outcome = pollOutcomeCancelled
 		return
 	case <-timeout.C:
+		outcome = pollOutcomeTimeout
 		w.WriteHeader(http.StatusNoContent)
 		return
+	case <-c.goingAway:
+		outcome = pollOutcomeGoingAway
+		c.writeGoingAway(w)
+		return
 	case <-notifyCh:
-		resp, err = c.getUpdate(n)
+		// The node may have been changed or deleted while the poll was waiting
+		current, err := c.store.GetNodeByID(n.ID)
+		if errors.Is(err, store.ErrNodeNotFound) || (err == nil && current.IsExpired()) {
+			outcome = pollOutcomeExpired
+			resp.KeyExpired = true
+			writeResponse()
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if current.IsDisabled() {
+			outcome = pollOutcomeDisabled
+			http.Error(w, "node is disabled", http.StatusForbidden)
+			return
+		}
+		resp, err = c.getUpdate(current)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		outcome = pollOutcomeUpdate
 		writeResponse()
 		return
 	}
@@ -0,0 +1,90 @@
+package controlservice
+
+import (
+	"github.com/caldog20/calnet/control/server/metrics"
+)
+
+const (
+	pollOutcomeUpdate    = "update"
+	pollOutcomeTimeout   = "timeout"
+	pollOutcomeCancelled = "cancelled"
+	pollOutcomeExpired   = "expired"
+	pollOutcomeDisabled  = "disabled"
+	pollOutcomeGoingAway = "going_away"
+	pollOutcomeError     = "error"
+
+	loginResultSuccess             = "success"
+	loginResultRegistered          = "registered"
+	loginResultExpired             = "expired"
+	loginResultDisabled            = "disabled"
+	loginResultLogout              = "logout"
+	loginResultInvalidProvisionKey = "invalid_provision_key"
+	loginResultBadRequest          = "bad_request"
+	loginResultRateLimited         = "rate_limited"
+	loginResultError               = "error"
+)
+
+var (
+	activePollers = metrics.NewGauge(
+		"calnet_control_active_pollers",
+		"Number of in-flight long-poll requests",
+	)
+	pollDuration = metrics.NewHistogramVec(
+		"calnet_control_poll_duration_seconds",
+		"Duration of long-poll requests by outcome",
+		"outcome",
+		metrics.DefaultBuckets,
+	)
+	loginsTotal = metrics.NewCounterVec(
+		"calnet_control_logins_total",
+		"Login requests by result",
+		"result",
+		loginResultSuccess,
+		loginResultRegistered,
+		loginResultExpired,
+		loginResultDisabled,
+		loginResultLogout,
+		loginResultInvalidProvisionKey,
+		loginResultBadRequest,
+		loginResultRateLimited,
+		loginResultError,
+	)
+)
+
+// registerMetrics registers the gauges computed from the state of c
+func (c *Control) registerMetrics() {
+	metrics.NewGaugeFunc(
+		"calnet_nodes_registered",
+		"Number of nodes registered in the store",
+		func() float64 {
+			nodes, err := c.store.GetNodes()
+			if err != nil {
+				return 0
+			}
+			return float64(len(nodes))
+		},
+	)
+	metrics.NewGaugeFunc(
+		"calnet_nodes_online",
+		"Number of nodes currently polling the control server",
+		func() float64 {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return float64(len(c.pollingNodes))
+		},
+	)
+	metrics.NewGaugeFunc(
+		"calnet_ipam_addresses_allocated",
+		"Number of addresses allocated from the network prefix",
+		func() float64 {
+			return float64(c.ipam.Allocated())
+		},
+	)
+	metrics.NewGaugeFunc(
+		"calnet_ipam_addresses_total",
+		"Number of allocatable addresses in the network prefix",
+		func() float64 {
+			return float64(c.ipam.Size())
+		},
+	)
+}
@@ -0,0 +1,184 @@
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/caldog20/calnet/control/server/internal/node"
+	"github.com/caldog20/calnet/control/server/logging"
+)
+
+type Type string
+
+const (
+	NodeRegistered Type = "node.registered"
+	NodeUpdated    Type = "node.updated"
+	NodeDeleted    Type = "node.deleted"
+	NodeOnline     Type = "node.online"
+	NodeOffline    Type = "node.offline"
+	NodeKeyExpired Type = "node.key_expired"
+	NodeDisabled   Type = "node.disabled"
+	NodeEnabled    Type = "node.enabled"
+)
+
+// AllTypes lists every event type that can be published
+var AllTypes = []Type{
+	NodeRegistered,
+	NodeUpdated,
+	NodeDeleted,
+	NodeOnline,
+	NodeOffline,
+	NodeKeyExpired,
+	NodeDisabled,
+	NodeEnabled,
+}
+
+func (t Type) Valid() bool {
+	for _, v := range AllTypes {
+		if t == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Event describes a change to a node in the network.
+// ID is assigned by the Bus when the event is published.
+type Event struct {
+	ID     uint64     `json:"id"`
+	Type   Type       `json:"type"`
+	Time   time.Time  `json:"time"`
+	NodeID uint64     `json:"node_id"`
+	Node   *node.Node `json:"node,omitempty"`
+}
+
+// New returns an event of type t for n. The node is copied so later changes
+// to n are not visible to subscribers.
+func New(t Type, n *node.Node) Event {
+	e := Event{
+		Type: t,
+		Time: time.Now(),
+	}
+	if n != nil {
+		copied := *n
+		e.NodeID = n.ID
+		e.Node = &copied
+	}
+	return e
+}
+
+var logger = logging.Logger(logging.SubsystemControl)
+
+// Number of recent events kept by the Bus for subscribers to catch up from
+const HistorySize = 1024
+
+// Bus fans out published events to all subscribers.
+// Publishing never blocks, events are dropped for subscribers that fall behind.
+// Subscribers can recover dropped events from the recent history with Since.
+type Bus struct {
+	mu      sync.Mutex
+	seq     uint64
+	subs    map[chan Event]struct{}
+	history []Event
+	// Index in history the next event is written to
+	next int
+}
+
+func NewBus() *Bus {
+	return &Bus{
+		subs:    make(map[chan Event]struct{}),
+		history: make([]Event, 0, HistorySize),
+	}
+}
+
+// Publish assigns the next event ID to e and sends it to every subscriber.
+// Publishing to a nil Bus is a no-op.
+func (b *Bus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	e.ID = b.seq
+
+	if len(b.history) < HistorySize {
+		b.history = append(b.history, e)
+	} else {
+		b.history[b.next] = e
+	}
+	b.next = (b.next + 1) % HistorySize
+
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			logger.Warn("event bus subscriber is full, dropping event", "event_id", e.ID, "type", e.Type)
+		}
+	}
+}
+
+// Subscribe returns a channel receiving published events and a function to unsubscribe.
+// The channel is closed when unsubscribed.
+func (b *Bus) Subscribe(buffer int) (<-chan Event, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.subscribe(buffer)
+}
+
+func (b *Bus) subscribe(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+	b.subs[ch] = struct{}{}
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, ch)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// Since returns the events in history published after the event with ID id, oldest first.
+// It returns false if events after id are no longer in history and the caller
+// needs to resynchronize from the current state instead.
+func (b *Bus) Since(id uint64) ([]Event, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.since(id)
+}
+
+func (b *Bus) since(id uint64) ([]Event, bool) {
+	if id == b.seq {
+		return nil, true
+	}
+	// An ID from the future means the bus was restarted since the caller last saw it
+	if id > b.seq {
+		return nil, false
+	}
+	missing := b.seq - id
+	if missing > uint64(len(b.history)) {
+		return nil, false
+	}
+
+	events := make([]Event, 0, missing)
+	start := (b.next - int(missing) + len(b.history)) % len(b.history)
+	for i := 0; i < int(missing); i++ {
+		events = append(events, b.history[(start+i)%len(b.history)])
+	}
+	return events, true
+}
+
+// SubscribeSince is like Subscribe but also returns the events published after id.
+// The history and subscription are taken atomically so no events are missed between them.
+func (b *Bus) SubscribeSince(id uint64, buffer int) ([]Event, bool, <-chan Event, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	backlog, ok := b.since(id)
+	ch, unsubscribe := b.subscribe(buffer)
+	return backlog, ok, ch, unsubscribe
+}
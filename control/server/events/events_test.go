@@ -0,0 +1,59 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/caldog20/calnet/control/server/internal/node"
+)
+
+func TestBusSince(t *testing.T) {
+	b := NewBus()
+	for i := 0; i < HistorySize+10; i++ {
+		b.Publish(New(NodeUpdated, &node.Node{ID: uint64(i)}))
+	}
+
+	last := uint64(HistorySize + 10)
+	missed, ok := b.Since(last - 5)
+	if !ok {
+		t.Fatal("got not ok, expected recent events to be in history")
+	}
+	if len(missed) != 5 {
+		t.Fatalf("got %d events, expected 5", len(missed))
+	}
+	for i, e := range missed {
+		if e.ID != last-4+uint64(i) {
+			t.Fatalf("got event id %d at index %d, expected %d", e.ID, i, last-4+uint64(i))
+		}
+	}
+
+	if _, ok := b.Since(5); ok {
+		t.Fatal("got ok, expected events older than history to require resync")
+	}
+	if _, ok := b.Since(last + 1); ok {
+		t.Fatal("got ok, expected id from the future to require resync")
+	}
+	if missed, ok := b.Since(last); !ok || len(missed) != 0 {
+		t.Fatalf("got %d events ok %t, expected none", len(missed), ok)
+	}
+}
+
+func TestBusSubscribe(t *testing.T) {
+	b := NewBus()
+	b.Publish(New(NodeOnline, &node.Node{ID: 1}))
+
+	backlog, ok, ch, unsubscribe := b.SubscribeSince(0, 1)
+	if !ok || len(backlog) != 1 || backlog[0].NodeID != 1 {
+		t.Fatalf("got backlog %v ok %t, expected node 1 online event", backlog, ok)
+	}
+
+	b.Publish(New(NodeOffline, &node.Node{ID: 1}))
+	e := <-ch
+	if e.ID != 2 || e.Type != NodeOffline {
+		t.Fatalf("got event %d %s, expected 2 %s", e.ID, e.Type, NodeOffline)
+	}
+
+	unsubscribe()
+	if _, open := <-ch; open {
+		t.Fatal("got open channel, expected closed after unsubscribe")
+	}
+}
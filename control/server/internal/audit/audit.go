@@ -0,0 +1,134 @@
+package audit
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/caldog20/calnet/control/server/logging"
+	"github.com/caldog20/calnet/pkg/keys"
+)
+
+var logger = logging.Logger(logging.SubsystemControl)
+
+type Action string
+
+const (
+	ActionNodeRegister       Action = "node.register"
+	ActionNodeLogin          Action = "node.login"
+	ActionNodeKeyExpired     Action = "node.key_expired"
+	ActionNodeLogout         Action = "node.logout"
+	ActionNodeDisable        Action = "node.disable"
+	ActionNodeEnable         Action = "node.enable"
+	ActionNodeExpire         Action = "node.expire"
+	ActionNodeDelete         Action = "node.delete"
+	ActionNodeRename         Action = "node.rename"
+	ActionNodeApproveRoutes  Action = "node.approve_routes"
+	ActionProvisionKeyCreate Action = "provision_key.create"
+	ActionProvisionKeyUse    Action = "provision_key.use"
+	ActionProvisionKeyRevoke Action = "provision_key.revoke"
+	ActionWebhookCreate      Action = "webhook.create"
+	ActionWebhookDelete      Action = "webhook.delete"
+	ActionStoreBackup        Action = "store.backup"
+	ActionStoreExport        Action = "store.export"
+	ActionConfigReload       Action = "config.reload"
+)
+
+const (
+	DefaultPageSize = 100
+	MaxPageSize     = 1000
+)
+
+// Event is a single entry in the audit log. Events are append-only and are
+// assigned a monotonically increasing ID by the store when appended.
+type Event struct {
+	ID       uint64          `json:"id"`
+	Time     time.Time       `json:"time"`
+	Action   Action          `json:"action"`
+	Actor    string          `json:"actor"`
+	SourceIP string          `json:"source_ip"`
+	NodeID   uint64          `json:"node_id,omitempty"`
+	Before   json.RawMessage `json:"before,omitempty"`
+	After    json.RawMessage `json:"after,omitempty"`
+}
+
+// NewEvent returns an event for action with before and after encoded as JSON.
+// A nil before or after value is omitted from the event.
+func NewEvent(action Action, actor, sourceIP string, nodeID uint64, before, after any) *Event {
+	return &Event{
+		Time:     time.Now(),
+		Action:   action,
+		Actor:    actor,
+		SourceIP: sourceIP,
+		NodeID:   nodeID,
+		Before:   marshal(before),
+		After:    marshal(after),
+	}
+}
+
+func marshal(v any) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		logger.Error("error marshalling audit event value", logging.Err(err))
+		return nil
+	}
+	return b
+}
+
+// NodeActor returns the actor name for requests made by a node using its control key
+func NodeActor(controlKey keys.PublicKey) string {
+	return "node:" + controlKey.EncodeToString()
+}
+
+// APIActor returns the actor name for requests made through the REST API with a named token
+func APIActor(tokenName string) string {
+	return "api:" + tokenName
+}
+
+// Filter selects events from the audit log. Zero value fields match everything.
+type Filter struct {
+	Action Action
+	Actor  string
+	NodeID uint64
+	Since  time.Time
+	Until  time.Time
+	// Only return events with an ID greater than AfterID, used as a pagination cursor
+	AfterID uint64
+	// Maximum number of events to return
+	Limit int
+}
+
+func (f Filter) Match(e *Event) bool {
+	if e.ID <= f.AfterID {
+		return false
+	}
+	if f.Action != "" && e.Action != f.Action {
+		return false
+	}
+	if f.Actor != "" && e.Actor != f.Actor {
+		return false
+	}
+	if f.NodeID != 0 && e.NodeID != f.NodeID {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && e.Time.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// PageSize returns the effective limit for the filter
+func (f Filter) PageSize() int {
+	if f.Limit <= 0 {
+		return DefaultPageSize
+	}
+	if f.Limit > MaxPageSize {
+		return MaxPageSize
+	}
+	return f.Limit
+}
@@ -1,7 +1,9 @@
 package ipam
 
 import (
+	"encoding/binary"
 	"errors"
+	"math"
 	"net/netip"
 	"sync"
 
@@ -60,6 +62,17 @@ func (i *IPAM) Allocate() (netip.Addr, error) {
 	return next, nil
 }
 
+// Reserve marks ip as allocated without allocating it, for the IP of a node
+// registered by another control server sharing the store
+func (i *IPAM) Reserve(ip netip.Addr) {
+	if !ip.IsValid() {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.allocatedIPs.Add(ip)
+}
+
 func (i *IPAM) Release(ip netip.Addr) {
 	i.mu.Lock()
 	defer i.mu.Unlock()
@@ -79,3 +92,46 @@ func (i *IPAM) isReservedIP(ip netip.Addr) bool {
 	}
 	return false
 }
+
+// Size returns the number of allocatable addresses in the prefix
+func (i *IPAM) Size() uint64 {
+	bits := i.prefix.Addr().BitLen() - i.prefix.Bits()
+	if bits >= 64 {
+		return math.MaxUint64
+	}
+	size := uint64(1) << bits
+	// The network address is never allocated
+	if size > 0 {
+		size--
+	}
+	return size
+}
+
+// Allocated returns the number of addresses currently allocated
+func (i *IPAM) Allocated() uint64 {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	ipset, err := i.allocatedIPs.IPSet()
+	if err != nil {
+		return 0
+	}
+
+	var count uint64
+	for _, r := range ipset.Ranges() {
+		if !i.prefix.Contains(r.From()) {
+			continue
+		}
+		count += rangeSize(r)
+	}
+	return count
+}
+
+func rangeSize(r netipx.IPRange) uint64 {
+	from := r.From().As16()
+	to := r.To().As16()
+	// Only the low 64 bits can differ for any prefix we would realistically allocate from
+	lo := binary.BigEndian.Uint64(from[8:])
+	hi := binary.BigEndian.Uint64(to[8:])
+	return hi - lo + 1
+}
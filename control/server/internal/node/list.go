@@ -0,0 +1,225 @@
+package node
+
+import (
+	"cmp"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+)
+
+type SortField string
+
+const (
+	SortByID       SortField = "id"
+	SortByCreated  SortField = "created"
+	SortByLastSeen SortField = "last_seen"
+	SortByExpiry   SortField = "expiry"
+)
+
+func (s SortField) Valid() bool {
+	switch s {
+	case SortByID, SortByCreated, SortByLastSeen, SortByExpiry:
+		return true
+	}
+	return false
+}
+
+const (
+	DefaultPageSize = 100
+	MaxPageSize     = 1000
+)
+
+// Filter selects nodes. Zero values match every node.
+type Filter struct {
+	User     string
+	Tag      string
+	Disabled *bool
+	Expired  *bool
+	Online   *bool
+	// Only nodes with an IP inside the prefix
+	Prefix netip.Prefix
+	// Case-insensitive substring of the node name or hostname
+	Hostname string
+}
+
+// Match reports whether n matches every field set in the filter
+func (f *Filter) Match(n *Node, now time.Time) bool {
+	if f.User != "" && n.User != f.User {
+		return false
+	}
+	if f.Tag != "" && !slices.Contains(n.Tags, f.Tag) {
+		return false
+	}
+	if f.Disabled != nil && n.Disabled != *f.Disabled {
+		return false
+	}
+	if f.Expired != nil && now.After(n.KeyExpiry) != *f.Expired {
+		return false
+	}
+	if f.Online != nil && n.Online != *f.Online {
+		return false
+	}
+	if f.Prefix.IsValid() && !f.Prefix.Contains(n.IP) {
+		return false
+	}
+	if f.Hostname != "" {
+		sub := strings.ToLower(f.Hostname)
+		hostname := ""
+		if n.Hostinfo != nil {
+			hostname = n.Hostinfo.Hostname
+		}
+		if !strings.Contains(strings.ToLower(n.Name), sub) &&
+			!strings.Contains(strings.ToLower(hostname), sub) {
+			return false
+		}
+	}
+	return true
+}
+
+// ListOptions selects a page of nodes matching the filter in sort order
+type ListOptions struct {
+	Filter
+	Sort       SortField
+	Descending bool
+	// Return nodes after the cursor, nil starts from the first node
+	After *Cursor
+	Limit int
+}
+
+// Validate checks the sort field and that the cursor was created for the same sort order
+func (o *ListOptions) Validate() error {
+	if !o.sortField().Valid() {
+		return fmt.Errorf("invalid sort field %q", o.Sort)
+	}
+	if o.After != nil && (o.After.Sort != o.sortField() || o.After.Descending != o.Descending) {
+		return errors.New("cursor does not match sort order")
+	}
+	return nil
+}
+
+func (o *ListOptions) PageSize() int {
+	if o.Limit <= 0 {
+		return DefaultPageSize
+	}
+	return min(o.Limit, MaxPageSize)
+}
+
+func (o *ListOptions) sortField() SortField {
+	if o.Sort == "" {
+		return SortByID
+	}
+	return o.Sort
+}
+
+// sortKey returns the value nodes are ordered by before their ID
+func (o *ListOptions) sortKey(n *Node) int64 {
+	switch o.sortField() {
+	case SortByCreated:
+		return timeKey(n.CreatedAt)
+	case SortByLastSeen:
+		return timeKey(n.LastConnected)
+	case SortByExpiry:
+		return timeKey(n.KeyExpiry)
+	}
+	return 0
+}
+
+// timeKey orders zero times before any other time
+func timeKey(t time.Time) int64 {
+	if t.IsZero() {
+		return math.MinInt64
+	}
+	return t.UnixNano()
+}
+
+func (o *ListOptions) compareKeys(aKey int64, aID uint64, bKey int64, bID uint64) int {
+	c := cmp.Or(cmp.Compare(aKey, bKey), cmp.Compare(aID, bID))
+	if o.Descending {
+		return -c
+	}
+	return c
+}
+
+// Compare orders nodes by the sort field then ID
+func (o *ListOptions) Compare(a, b *Node) int {
+	return o.compareKeys(o.sortKey(a), a.ID, o.sortKey(b), b.ID)
+}
+
+// CursorFor returns the cursor to continue listing after n
+func (o *ListOptions) CursorFor(n *Node) *Cursor {
+	return &Cursor{
+		Sort:       o.sortField(),
+		Descending: o.Descending,
+		Key:        o.sortKey(n),
+		ID:         n.ID,
+	}
+}
+
+// IsAfterCursor reports whether n sorts after the After cursor
+func (o *ListOptions) IsAfterCursor(n *Node) bool {
+	if o.After == nil {
+		return true
+	}
+	return o.compareKeys(o.sortKey(n), n.ID, o.After.Key, o.After.ID) > 0
+}
+
+// Page sorts nodes and returns the page selected by the cursor and limit.
+// Nodes must already match the filter.
+func (o *ListOptions) Page(nodes []Node) []Node {
+	slices.SortFunc(nodes, func(a, b Node) int {
+		return o.Compare(&a, &b)
+	})
+	start := slices.IndexFunc(nodes, func(n Node) bool {
+		return o.IsAfterCursor(&n)
+	})
+	if start < 0 {
+		return nil
+	}
+	nodes = nodes[start:]
+	if len(nodes) > o.PageSize() {
+		nodes = nodes[:o.PageSize()]
+	}
+	return nodes
+}
+
+// Cursor is the position of the last node of a page in a sort order
+type Cursor struct {
+	Sort       SortField
+	Descending bool
+	Key        int64
+	ID         uint64
+}
+
+func (c *Cursor) Encode() string {
+	s := fmt.Sprintf("%s:%t:%d:%d", c.Sort, c.Descending, c.Key, c.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+func ParseCursor(s string) (*Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	c := &Cursor{}
+	var sort string
+	_, err = fmt.Sscanf(
+		strings.ReplaceAll(string(b), ":", " "),
+		"%s %t %d %d",
+		&sort,
+		&c.Descending,
+		&c.Key,
+		&c.ID,
+	)
+	c.Sort = SortField(sort)
+	if err != nil || !c.Sort.Valid() {
+		return nil, ErrInvalidCursor
+	}
+	return c, nil
+}
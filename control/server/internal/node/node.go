@@ -4,6 +4,7 @@ import (
 	"net/netip"
 	"time"
 
+	"github.com/caldog20/calnet/pkg/controlapi"
 	"github.com/caldog20/calnet/pkg/keys"
 )
 
@@ -18,14 +19,23 @@ type Node struct {
 	// Implement control plane encryption later
 	// ControlKey keys.PublicKey
 	NodeKey keys.PublicKey
-	// Hostname string
-	IP     netip.Addr
-	Prefix netip.Prefix
+	// Name is set from the hostname at registration and can be changed by an admin
+	Name     string
+	Hostinfo *controlapi.Hostinfo
+	IP       netip.Addr
+	Prefix   netip.Prefix
 	// For Node Key
 	KeyExpiry time.Time
 
-	User          string
-	Disabled      bool
+	User string
+	// Tags are copied from the provisioning key used to register the node
+	Tags []string
+	// Subset of the advertised routes an admin has approved
+	ApprovedRoutes []netip.Prefix
+
+	Disabled bool
+	// Online is set while the node is polling the control server
+	Online        bool
 	LastConnected time.Time
 
 	CreatedAt time.Time
@@ -39,3 +49,11 @@ func (n *Node) IsExpired() bool {
 func (n *Node) IsDisabled() bool {
 	return n.Disabled
 }
+
+// AdvertisedRoutes returns the routes the node advertised in its Hostinfo
+func (n *Node) AdvertisedRoutes() []netip.Prefix {
+	if n.Hostinfo == nil {
+		return nil
+	}
+	return n.Hostinfo.Routes
+}
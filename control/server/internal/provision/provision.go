@@ -0,0 +1,88 @@
+package provision
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/caldog20/calnet/pkg/adminapi"
+)
+
+// Prefix of every generated key so they are recognizable in config files and scripts
+const KeyPrefix = "calnet-pk-"
+
+var (
+	ErrRevoked = errors.New("provisioning key has been revoked")
+	ErrExpired = errors.New("provisioning key has expired")
+	ErrUsed    = errors.New("provisioning key has already been used")
+)
+
+// Key is a provisioning key used by nodes to register with the control server.
+// Only a hash of the key is stored, the key itself is returned once when it is created.
+type Key struct {
+	ID          uint64 `json:"id"`
+	Hash        string `json:"hash"`
+	Description string `json:"description"`
+	// User and Tags are assigned to nodes registered with the key
+	User string   `json:"user"`
+	Tags []string `json:"tags,omitempty"`
+	// Reusable keys can register any number of nodes, otherwise a key can only be used once
+	Reusable bool `json:"reusable"`
+	// Zero means the key does not expire
+	Expiry    time.Time `json:"expiry"`
+	Uses      int       `json:"uses"`
+	Revoked   bool      `json:"revoked"`
+	LastUsed  time.Time `json:"last_used"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Usable returns an error describing why the key can't be used to register a node, or nil
+func (k *Key) Usable(now time.Time) error {
+	switch {
+	case k.Revoked:
+		return ErrRevoked
+	case !k.Expiry.IsZero() && now.After(k.Expiry):
+		return ErrExpired
+	case !k.Reusable && k.Uses > 0:
+		return ErrUsed
+	}
+	return nil
+}
+
+// Redacted returns the key as the admin API and audit log show it, without its hash
+func (k *Key) Redacted() adminapi.ProvisionKey {
+	tags := k.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	return adminapi.ProvisionKey{
+		ID:          k.ID,
+		Description: k.Description,
+		User:        k.User,
+		Tags:        tags,
+		Reusable:    k.Reusable,
+		Expiry:      k.Expiry,
+		Uses:        k.Uses,
+		Revoked:     k.Revoked,
+		LastUsed:    k.LastUsed,
+		CreatedAt:   k.CreatedAt,
+	}
+}
+
+// Generate returns a new random key and the hash to store for it
+func Generate() (key string, hash string) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		panic("error generating random bytes for provisioning key: " + err.Error())
+	}
+	key = KeyPrefix + hex.EncodeToString(b)
+	return key, Hash(key)
+}
+
+// Hash returns the hex encoded SHA-256 hash of key
+func Hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,244 @@
+package ratelimit
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Buckets and lockouts that haven't been touched in this long are dropped
+	pruneInterval = time.Minute * 10
+)
+
+// Limiter is a keyed token bucket rate limiter. Each key (source IP, control key, etc)
+// gets its own bucket that refills at perMinute tokens per minute up to burst tokens.
+type Limiter struct {
+	mu        sync.Mutex
+	rate      float64 // tokens per second
+	burst     float64
+	buckets   map[string]*bucket
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// New returns a Limiter allowing perMinute requests per key with the given burst.
+// A perMinute value <= 0 returns a Limiter that allows everything.
+func New(perMinute, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Allow consumes a token for key. If no token is available it returns false
+// and how long the caller should wait before retrying.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return true, 0
+	}
+
+	now := l.now()
+	l.prune(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+
+	b.tokens--
+	return true, 0
+}
+
+// SetLimit changes the limit to perMinute requests per key with the given burst.
+// Existing buckets are kept, with no more tokens than the new burst.
+func (l *Limiter) SetLimit(perMinute, burst int) {
+	if burst < 1 {
+		burst = 1
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = float64(perMinute) / 60
+	l.burst = float64(burst)
+	for _, b := range l.buckets {
+		b.tokens = math.Min(l.burst, b.tokens)
+	}
+}
+
+func (l *Limiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < pruneInterval {
+		return
+	}
+	l.lastPrune = now
+	for k, b := range l.buckets {
+		if now.Sub(b.last) > pruneInterval {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// Lockout tracks failures per key and locks a key out for a fixed duration
+// once it reaches the maximum number of failures.
+type Lockout struct {
+	mu        sync.Mutex
+	max       int
+	duration  time.Duration
+	entries   map[string]*lockoutEntry
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+type lockoutEntry struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// NewLockout returns a Lockout that locks a key for duration after max failures.
+// A max value <= 0 returns a Lockout that never locks.
+func NewLockout(max int, duration time.Duration) *Lockout {
+	return &Lockout{
+		max:      max,
+		duration: duration,
+		entries:  make(map[string]*lockoutEntry),
+		now:      time.Now,
+	}
+}
+
+// Locked reports whether key is currently locked out and the time remaining.
+func (l *Lockout) Locked(key string) (bool, time.Duration) {
+	if l == nil {
+		return false, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max <= 0 {
+		return false, 0
+	}
+
+	e, ok := l.entries[key]
+	if !ok {
+		return false, 0
+	}
+	remaining := e.lockedUntil.Sub(l.now())
+	if remaining <= 0 {
+		return false, 0
+	}
+	return true, remaining
+}
+
+// Fail records a failure for key and reports whether the key is now locked out.
+func (l *Lockout) Fail(key string) bool {
+	if l == nil {
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max <= 0 {
+		return false
+	}
+
+	now := l.now()
+	l.prune(now)
+
+	e, ok := l.entries[key]
+	if !ok {
+		e = &lockoutEntry{}
+		l.entries[key] = e
+	}
+
+	// Failures older than the lockout window don't count against the key
+	if now.Sub(e.lastFailure) > l.duration {
+		e.failures = 0
+	}
+
+	e.failures++
+	e.lastFailure = now
+	if e.failures >= l.max {
+		e.failures = 0
+		e.lockedUntil = now.Add(l.duration)
+		return true
+	}
+	return false
+}
+
+// SetLimit changes the failures that lock a key out and the lockout duration.
+// Keys that are already locked out stay locked until their lockout ends.
+func (l *Lockout) SetLimit(max int, duration time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.max = max
+	l.duration = duration
+}
+
+// Reset clears any failures recorded for key.
+func (l *Lockout) Reset(key string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.entries, key)
+}
+
+func (l *Lockout) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < pruneInterval {
+		return
+	}
+	l.lastPrune = now
+	for k, e := range l.entries {
+		if now.After(e.lockedUntil) && now.Sub(e.lastFailure) > l.duration {
+			delete(l.entries, k)
+		}
+	}
+}
+
+// SourceIP returns the IP address of the remote end of the request without the port.
+func SourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// WriteTooManyRequests writes a 429 response with a Retry-After header
+// rounded up to the next second.
+func WriteTooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	secs := int(math.Ceil(retryAfter.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	http.Error(w, "too many requests", http.StatusTooManyRequests)
+}
@@ -0,0 +1,110 @@
+package ratelimit
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLimiterBurstAndRefill(t *testing.T) {
+	now := time.Now()
+	l := New(60, 3)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("1.2.3.4"); !ok {
+			t.Fatalf("request %d denied, expected burst of 3 to be allowed", i)
+		}
+	}
+
+	ok, retry := l.Allow("1.2.3.4")
+	if ok {
+		t.Fatal("got allowed, expected request over burst to be denied")
+	}
+	if retry <= 0 || retry > time.Second {
+		t.Fatalf("got retry after %s, expected (0, 1s]", retry)
+	}
+
+	// Other keys have their own bucket
+	if ok, _ := l.Allow("5.6.7.8"); !ok {
+		t.Fatal("got denied for separate key, expected allowed")
+	}
+
+	now = now.Add(time.Second)
+	if ok, _ := l.Allow("1.2.3.4"); !ok {
+		t.Fatal("got denied after refill, expected allowed")
+	}
+}
+
+func TestLimiterDisabled(t *testing.T) {
+	l := New(0, 0)
+	for i := 0; i < 1000; i++ {
+		if ok, _ := l.Allow("key"); !ok {
+			t.Fatal("got denied, expected disabled limiter to allow everything")
+		}
+	}
+}
+
+func TestLockout(t *testing.T) {
+	now := time.Now()
+	l := NewLockout(3, time.Minute)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if l.Fail("key") {
+			t.Fatalf("got locked after %d failures, expected 3", i+1)
+		}
+	}
+	if locked, _ := l.Locked("key"); locked {
+		t.Fatal("got locked, expected unlocked before max failures")
+	}
+
+	if !l.Fail("key") {
+		t.Fatal("got unlocked, expected lockout after max failures")
+	}
+	locked, remaining := l.Locked("key")
+	if !locked || remaining != time.Minute {
+		t.Fatalf("got locked %t remaining %s, expected locked for 1m", locked, remaining)
+	}
+
+	now = now.Add(time.Minute + time.Second)
+	if locked, _ := l.Locked("key"); locked {
+		t.Fatal("got locked, expected lockout to expire")
+	}
+}
+
+func TestWriteTooManyRequests(t *testing.T) {
+	w := httptest.NewRecorder()
+	WriteTooManyRequests(w, time.Millisecond*1500)
+	if w.Code != 429 {
+		t.Fatalf("got status %d, expected 429", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "2" {
+		t.Fatalf("got Retry-After %s, expected 2", got)
+	}
+}
+
+func TestLimiterSetLimit(t *testing.T) {
+	now := time.Now()
+	l := New(60, 5)
+	l.now = func() time.Time { return now }
+
+	if ok, _ := l.Allow("key"); !ok {
+		t.Fatal("got denied, expected allowed")
+	}
+	// The bucket keeps its tokens up to the new burst
+	l.SetLimit(60, 2)
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("key"); !ok {
+			t.Fatalf("request %d denied, expected new burst of 2 to be allowed", i)
+		}
+	}
+	if ok, _ := l.Allow("key"); ok {
+		t.Fatal("got allowed, expected request over the new burst to be denied")
+	}
+
+	l.SetLimit(0, 0)
+	if ok, _ := l.Allow("key"); !ok {
+		t.Fatal("got denied, expected disabled limiter to allow everything")
+	}
+}
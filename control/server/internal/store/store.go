@@ -3,17 +3,106 @@ package store
 import (
 	"net/netip"
 
+	"github.com/caldog20/calnet/control/server/internal/audit"
 	"github.com/caldog20/calnet/control/server/internal/node"
+	"github.com/caldog20/calnet/control/server/internal/provision"
+	"github.com/caldog20/calnet/control/server/internal/webhook"
 	"github.com/caldog20/calnet/pkg/keys"
 )
 
+// Store persists the control server state. Lookups of a node that doesn't exist
+// return store.ErrNodeNotFound, deleting one that doesn't exist is not an error.
+// The storetest package checks an implementation against these semantics.
 type Store interface {
 	GetNodes() ([]node.Node, error)
+	// ListNodes returns a page of nodes matching the options
+	ListNodes(opts node.ListOptions) ([]node.Node, error)
 	GetPeersOfNode(id uint64) ([]*node.Node, error)
 	GetNodeByKey(key keys.PublicKey) (*node.Node, error)
 	GetNodeByID(id uint64) (*node.Node, error)
+	GetNodeByIP(ip netip.Addr) (*node.Node, error)
 	CreateNode(node *node.Node) error
 	DeleteNode(id uint64) error
 	UpdateNode(node *node.Node) error
+	// SetNodePresence records whether the node is polling this server and returns
+	// the updated node. It writes only Online, and LastConnected when the node comes
+	// online, in a single write so it can't overwrite a concurrent update of the node.
+	// A replicated store keeps the node online while it polls any of its servers.
+	SetNodePresence(id uint64, online bool) (*node.Node, error)
+	// ResetPresence marks offline the nodes recorded as polling this server, which
+	// can't still be polling it after a restart
+	ResetPresence() error
+	// GetAllocatedNodeIPs returns the IP of every node that has one assigned
 	GetAllocatedNodeIPs() ([]netip.Addr, error)
+
+	AppendAuditEvent(event *audit.Event) error
+	GetAuditEvents(filter audit.Filter) ([]audit.Event, error)
+
+	CreateWebhook(sub *webhook.Subscription) error
+	GetWebhooks() ([]webhook.Subscription, error)
+	GetWebhookByID(id uint64) (*webhook.Subscription, error)
+	DeleteWebhook(id uint64) error
+	AppendWebhookDelivery(delivery *webhook.Delivery) error
+	GetWebhookDeliveries(subscriptionID uint64, limit int) ([]webhook.Delivery, error)
+
+	CreateProvisionKey(key *provision.Key) error
+	GetProvisionKeys() ([]provision.Key, error)
+	GetProvisionKeyByID(id uint64) (*provision.Key, error)
+	UpdateProvisionKey(key *provision.Key) error
+	// UseProvisionKey looks up the key with hash, checks it is usable and records the use
+	// in a single transaction so a single-use key can't register more than one node.
+	UseProvisionKey(hash string) (*provision.Key, error)
+
+	// Import creates the nodes, provisioning keys and webhooks of batch in a single
+	// transaction, so either all of them are created or none are. The store assigns
+	// their IDs, a zero CreatedAt is set to the time of the import and others are kept.
+	Import(batch *ImportBatch) error
+
+	// WatchNodes calls fn with every node change committed until stop is called.
+	// Calls are made after the write has committed and outside of any store lock,
+	// so fn may read from the store, but it must not block or modify the nodes.
+	WatchNodes(fn func(NodeChange)) (stop func())
+}
+
+// ImportBatch is the objects created together by Store.Import
+type ImportBatch struct {
+	Nodes         []node.Node            `json:"nodes,omitempty"`
+	ProvisionKeys []provision.Key        `json:"provision_keys,omitempty"`
+	Webhooks      []webhook.Subscription `json:"webhooks,omitempty"`
+}
+
+type ChangeType int
+
+const (
+	NodeCreated ChangeType = iota + 1
+	NodeUpdated
+	NodeDeleted
+)
+
+func (t ChangeType) String() string {
+	switch t {
+	case NodeCreated:
+		return "created"
+	case NodeUpdated:
+		return "updated"
+	case NodeDeleted:
+		return "deleted"
+	}
+	return "unknown"
+}
+
+// NodeChange is a committed write to a node. Old is nil for a created node and
+// New is nil for a deleted node.
+type NodeChange struct {
+	Type ChangeType
+	Old  *node.Node
+	New  *node.Node
+}
+
+// ID returns the ID of the changed node
+func (c NodeChange) ID() uint64 {
+	if c.New != nil {
+		return c.New.ID
+	}
+	return c.Old.ID
 }
@@ -0,0 +1,89 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/caldog20/calnet/control/server/events"
+)
+
+const (
+	SignatureHeader = "X-Calnet-Signature"
+	TimestampHeader = "X-Calnet-Timestamp"
+	EventHeader     = "X-Calnet-Event"
+	DeliveryHeader  = "X-Calnet-Delivery"
+)
+
+const (
+	// DefaultDeliveryLimit is the number of deliveries returned when no limit is requested
+	DefaultDeliveryLimit = 100
+	// MaxDeliveryLimit caps the number of deliveries returned in a single request
+	MaxDeliveryLimit = 1000
+)
+
+// Subscription is a webhook endpoint that receives events matching its filter
+type Subscription struct {
+	ID  uint64 `json:"id"`
+	URL string `json:"url"`
+	// Event types to deliver, an empty list delivers every event
+	Events []events.Type `json:"events"`
+	// Secret used to sign payloads with HMAC-SHA256
+	Secret    string    `json:"secret"`
+	Disabled  bool      `json:"disabled"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (s *Subscription) Matches(t events.Type) bool {
+	if s.Disabled {
+		return false
+	}
+	return len(s.Events) == 0 || slices.Contains(s.Events, t)
+}
+
+// Delivery records a single attempt to deliver an event to a subscription
+type Delivery struct {
+	ID             uint64      `json:"id"`
+	SubscriptionID uint64      `json:"subscription_id"`
+	EventID        uint64      `json:"event_id"`
+	EventType      events.Type `json:"event_type"`
+	Attempt        int         `json:"attempt"`
+	StatusCode     int         `json:"status_code,omitempty"`
+	Error          string      `json:"error,omitempty"`
+	Success        bool        `json:"success"`
+	Time           time.Time   `json:"time"`
+	Duration       string      `json:"duration"`
+}
+
+// GenerateSecret returns a random hex encoded secret for signing payloads
+func GenerateSecret() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic("error generating random bytes for webhook secret: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
+// Sign returns the signature header value for body sent at timestamp.
+// The signature is HMAC-SHA256 over "<unix timestamp>.<body>".
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp.Unix(), 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a signature produced by Sign. Receivers should also reject stale timestamps.
+func Verify(secret string, timestamp string, body []byte, signature string) bool {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	expected := Sign(secret, time.Unix(ts, 0), body)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
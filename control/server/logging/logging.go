@@ -0,0 +1,191 @@
+// Package logging provides structured, leveled loggers for each subsystem of the control server.
+//
+// Loggers returned by Logger can be created at package init time, before Setup is called.
+// They always write through the handler and levels most recently configured with Setup.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/caldog20/calnet/control/server/config"
+	"github.com/caldog20/calnet/pkg/keys"
+)
+
+// Subsystem names used by the control server packages
+const (
+	SubsystemControl = "control"
+	SubsystemRelay   = "relay"
+	SubsystemStun    = "stun"
+	SubsystemAPI     = "api"
+	SubsystemStore   = "store"
+	SubsystemWebhook = "webhook"
+	SubsystemServer  = "server"
+	SubsystemTLS     = "tls"
+)
+
+const redacted = "[REDACTED]"
+
+// Attribute keys containing any of these are redacted from log output
+var secretKeys = []string{"secret", "token", "password", "private", "provision_key", "authorization"}
+
+type state struct {
+	handler    slog.Handler
+	level      slog.Level
+	subsystems map[string]slog.Level
+}
+
+var current atomic.Pointer[state]
+
+func init() {
+	current.Store(&state{
+		handler: newHandler(os.Stderr, "text"),
+		level:   slog.LevelInfo,
+	})
+	slog.SetDefault(slog.New(&subsystemHandler{}))
+}
+
+// Setup configures the output format and levels for every logger.
+// It can be called again at runtime to change levels or format.
+func Setup(conf config.LogConfig, w io.Writer) error {
+	level, err := ParseLevel(conf.Level)
+	if err != nil {
+		return err
+	}
+
+	format := strings.ToLower(conf.Format)
+	switch format {
+	case "", "text", "json":
+	default:
+		return fmt.Errorf("invalid log format %q: must be text or json", conf.Format)
+	}
+
+	subsystems := make(map[string]slog.Level, len(conf.Subsystems))
+	for name, l := range conf.Subsystems {
+		subsystems[name], err = ParseLevel(l)
+		if err != nil {
+			return fmt.Errorf("subsystem %s: %w", name, err)
+		}
+	}
+
+	current.Store(&state{
+		handler:    newHandler(w, format),
+		level:      level,
+		subsystems: subsystems,
+	})
+	return nil
+}
+
+// ParseLevel parses a level name. An empty name is the info level.
+func ParseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if s == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return level, fmt.Errorf("invalid log level %q", s)
+	}
+	return level, nil
+}
+
+func newHandler(w io.Writer, format string) slog.Handler {
+	opts := &slog.HandlerOptions{
+		// Levels are filtered per subsystem before records reach the handler
+		Level:       slog.LevelDebug,
+		ReplaceAttr: redact,
+	}
+	if format == "json" {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+func redact(_ []string, a slog.Attr) slog.Attr {
+	key := strings.ToLower(a.Key)
+	for _, s := range secretKeys {
+		if strings.Contains(key, s) {
+			return slog.String(a.Key, redacted)
+		}
+	}
+	return a
+}
+
+// Logger returns a logger for subsystem. Every record is tagged with the subsystem name.
+func Logger(subsystem string) *slog.Logger {
+	return slog.New(&subsystemHandler{subsystem: subsystem})
+}
+
+// subsystemHandler applies the subsystem level and forwards records to the current handler.
+// Attributes and groups are recorded so they can be replayed onto whichever handler is current.
+type subsystemHandler struct {
+	subsystem string
+	ops       []func(slog.Handler) slog.Handler
+}
+
+func (h *subsystemHandler) Enabled(_ context.Context, level slog.Level) bool {
+	s := current.Load()
+	minLevel := s.level
+	if l, ok := s.subsystems[h.subsystem]; ok {
+		minLevel = l
+	}
+	return level >= minLevel
+}
+
+func (h *subsystemHandler) Handle(ctx context.Context, r slog.Record) error {
+	handler := current.Load().handler
+	if h.subsystem != "" {
+		handler = handler.WithAttrs([]slog.Attr{slog.String("subsystem", h.subsystem)})
+	}
+	for _, op := range h.ops {
+		handler = op(handler)
+	}
+	return handler.Handle(ctx, r)
+}
+
+func (h *subsystemHandler) with(op func(slog.Handler) slog.Handler) *subsystemHandler {
+	ops := make([]func(slog.Handler) slog.Handler, len(h.ops), len(h.ops)+1)
+	copy(ops, h.ops)
+	return &subsystemHandler{
+		subsystem: h.subsystem,
+		ops:       append(ops, op),
+	}
+}
+
+func (h *subsystemHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler {
+		return handler.WithAttrs(attrs)
+	})
+}
+
+func (h *subsystemHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler {
+		return handler.WithGroup(name)
+	})
+}
+
+// Common attributes so the same values are logged under the same keys across packages
+
+func NodeID(id uint64) slog.Attr {
+	return slog.Uint64("node_id", id)
+}
+
+func NodeKey(key keys.PublicKey) slog.Attr {
+	return slog.String("node_key", key.EncodeToString())
+}
+
+func ControlKey(key keys.PublicKey) slog.Attr {
+	return slog.String("control_key", key.EncodeToString())
+}
+
+func SourceIP(ip string) slog.Attr {
+	return slog.String("source_ip", ip)
+}
+
+func Err(err error) slog.Attr {
+	return slog.Any("error", err)
+}
@@ -0,0 +1,88 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/caldog20/calnet/control/server/config"
+	"github.com/caldog20/calnet/pkg/keys"
+)
+
+func setup(t *testing.T, conf config.LogConfig) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := Setup(conf, &buf); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		Setup(config.LogConfig{}, &bytes.Buffer{})
+	})
+	return &buf
+}
+
+func TestSubsystemLevels(t *testing.T) {
+	buf := setup(t, config.LogConfig{
+		Level:      "warn",
+		Subsystems: map[string]string{SubsystemRelay: "debug"},
+	})
+
+	Logger(SubsystemControl).Info("control info")
+	Logger(SubsystemRelay).Debug("relay debug")
+
+	out := buf.String()
+	if strings.Contains(out, "control info") {
+		t.Errorf("control info logged below global level: %s", out)
+	}
+	if !strings.Contains(out, "relay debug") || !strings.Contains(out, "subsystem=relay") {
+		t.Errorf("relay debug not logged with subsystem: %s", out)
+	}
+}
+
+func TestLoggerCreatedBeforeSetup(t *testing.T) {
+	logger := Logger(SubsystemStore).With("path", "/tmp/db")
+	buf := setup(t, config.LogConfig{Format: "json"})
+
+	logger.Info("opened")
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("expected json output: %s", err)
+	}
+	if record["subsystem"] != SubsystemStore || record["path"] != "/tmp/db" {
+		t.Errorf("unexpected record: %v", record)
+	}
+}
+
+func TestRedaction(t *testing.T) {
+	buf := setup(t, config.LogConfig{})
+	key := keys.NewPrivateKey()
+	encoded, _ := key.MarshalText()
+
+	Logger(SubsystemAPI).Info("secrets",
+		"provision_key", "please",
+		"api_token", "abc123",
+		slog.Any("key", key),
+	)
+
+	out := buf.String()
+	for _, leaked := range []string{"please", "abc123", string(encoded)} {
+		if strings.Contains(out, leaked) {
+			t.Errorf("secret %q leaked in log output: %s", leaked, out)
+		}
+	}
+}
+
+func TestSetupInvalid(t *testing.T) {
+	for _, conf := range []config.LogConfig{
+		{Level: "loud"},
+		{Format: "xml"},
+		{Subsystems: map[string]string{SubsystemRelay: "quiet"}},
+	} {
+		if err := Setup(conf, &bytes.Buffer{}); err == nil {
+			t.Errorf("expected error for %+v", conf)
+		}
+	}
+}
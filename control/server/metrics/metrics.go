@@ -0,0 +1,332 @@
+// Package metrics is a minimal implementation of Prometheus style metrics
+// exposed in the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBuckets are histogram buckets in seconds suited to request latencies
+// up to the long poll timeout.
+var DefaultBuckets = []float64{0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+// Registry holds a set of named metrics and writes them in the text exposition format
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+// DefaultRegistry is the registry metrics constructors register with
+var DefaultRegistry = NewRegistry()
+
+// register adds m to the registry under name, replacing any metric with the same name
+func (r *Registry) register(name string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics[name] = m
+}
+
+// Write writes every registered metric sorted by name
+func (r *Registry) Write(w io.Writer) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	ms := make([]metric, 0, len(names))
+	for _, name := range names {
+		ms = append(ms, r.metrics[name])
+	}
+	r.mu.Unlock()
+
+	for _, m := range ms {
+		m.write(w)
+	}
+}
+
+// Handler returns an http.Handler serving the metrics in the default registry
+func Handler() http.Handler {
+	return DefaultRegistry
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.Write(w)
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(pairs ...string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pairs[i])
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(pairs[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// Counter is a monotonically increasing value
+type Counter struct {
+	name string
+	help string
+	v    atomic.Uint64
+}
+
+func NewCounter(name, help string) *Counter {
+	c := &Counter{name: name, help: help}
+	DefaultRegistry.register(name, c)
+	return c
+}
+
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+func (c *Counter) Add(n uint64) {
+	c.v.Add(n)
+}
+
+func (c *Counter) Value() uint64 {
+	return c.v.Load()
+}
+
+func (c *Counter) write(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	fmt.Fprintf(w, "%s %d\n", c.name, c.v.Load())
+}
+
+// CounterVec is a set of counters partitioned by the value of a single label
+type CounterVec struct {
+	name  string
+	help  string
+	label string
+
+	mu     sync.Mutex
+	values map[string]*atomic.Uint64
+}
+
+// NewCounterVec returns a CounterVec. Any labelValues given are initialized to zero
+// so they are exported before they are first incremented.
+func NewCounterVec(name, help, label string, labelValues ...string) *CounterVec {
+	c := &CounterVec{
+		name:   name,
+		help:   help,
+		label:  label,
+		values: make(map[string]*atomic.Uint64),
+	}
+	for _, v := range labelValues {
+		c.get(v)
+	}
+	DefaultRegistry.register(name, c)
+	return c
+}
+
+func (c *CounterVec) get(labelValue string) *atomic.Uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.values[labelValue]
+	if !ok {
+		v = &atomic.Uint64{}
+		c.values[labelValue] = v
+	}
+	return v
+}
+
+func (c *CounterVec) Inc(labelValue string) {
+	c.get(labelValue).Add(1)
+}
+
+func (c *CounterVec) Add(labelValue string, n uint64) {
+	c.get(labelValue).Add(n)
+}
+
+func (c *CounterVec) Value(labelValue string) uint64 {
+	return c.get(labelValue).Load()
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.Lock()
+	labels := make([]string, 0, len(c.values))
+	for l := range c.values {
+		labels = append(labels, l)
+	}
+	c.mu.Unlock()
+	slices.Sort(labels)
+
+	writeHeader(w, c.name, c.help, "counter")
+	for _, l := range labels {
+		fmt.Fprintf(w, "%s%s %d\n", c.name, formatLabels(c.label, l), c.get(l).Load())
+	}
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	name string
+	help string
+	v    atomic.Int64
+}
+
+func NewGauge(name, help string) *Gauge {
+	g := &Gauge{name: name, help: help}
+	DefaultRegistry.register(name, g)
+	return g
+}
+
+func (g *Gauge) Set(v int64) {
+	g.v.Store(v)
+}
+
+func (g *Gauge) Inc() {
+	g.v.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.v.Add(-1)
+}
+
+func (g *Gauge) Value() int64 {
+	return g.v.Load()
+}
+
+func (g *Gauge) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %d\n", g.name, g.v.Load())
+}
+
+// GaugeFunc is a gauge whose value is computed by calling a function at collection time
+type GaugeFunc struct {
+	name string
+	help string
+	f    func() float64
+}
+
+// NewGaugeFunc registers a GaugeFunc. Registering a name again replaces the previous function.
+func NewGaugeFunc(name, help string, f func() float64) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, f: f}
+	DefaultRegistry.register(name, g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.f()))
+}
+
+// HistogramVec is a set of histograms partitioned by the value of a single label
+type HistogramVec struct {
+	name    string
+	help    string
+	label   string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // cumulative counts are computed at write time
+	count  uint64
+	sum    float64
+}
+
+func NewHistogramVec(name, help, label string, buckets []float64) *HistogramVec {
+	h := &HistogramVec{
+		name:    name,
+		help:    help,
+		label:   label,
+		buckets: slices.Sorted(slices.Values(buckets)),
+		series:  make(map[string]*histogram),
+	}
+	DefaultRegistry.register(name, h)
+	return h
+}
+
+func (h *HistogramVec) Observe(labelValue string, v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[labelValue]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[labelValue] = s
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+			break
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	labels := make([]string, 0, len(h.series))
+	for l := range h.series {
+		labels = append(labels, l)
+	}
+	slices.Sort(labels)
+
+	writeHeader(w, h.name, h.help, "histogram")
+	for _, l := range labels {
+		s := h.series[l]
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(
+				w,
+				"%s_bucket%s %d\n",
+				h.name,
+				formatLabels(h.label, l, "le", formatFloat(upper)),
+				cumulative,
+			)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.label, l, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.label, l), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.label, l), s.count)
+	}
+}
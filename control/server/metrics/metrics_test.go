@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	// Swap the default registry so the test only sees its own metrics
+	old := DefaultRegistry
+	DefaultRegistry = NewRegistry()
+	defer func() { DefaultRegistry = old }()
+
+	c := NewCounter("test_requests_total", "Requests")
+	c.Add(3)
+
+	cv := NewCounterVec("test_drops_total", "Drops", "cause", "a")
+	cv.Inc("b")
+
+	g := NewGauge("test_connections", "Connections")
+	g.Inc()
+	g.Inc()
+	g.Dec()
+
+	NewGaugeFunc("test_ratio", "Ratio", func() float64 { return 0.5 })
+
+	h := NewHistogramVec("test_duration_seconds", "Duration", "outcome", []float64{1, 0.1})
+	h.Observe("ok", 0.05)
+	h.Observe("ok", 0.5)
+	h.Observe("ok", 2)
+
+	var buf bytes.Buffer
+	DefaultRegistry.Write(&buf)
+	out := buf.String()
+
+	expected := []string{
+		"# TYPE test_requests_total counter\ntest_requests_total 3\n",
+		"test_drops_total{cause=\"a\"} 0\ntest_drops_total{cause=\"b\"} 1\n",
+		"# TYPE test_connections gauge\ntest_connections 1\n",
+		"test_ratio 0.5\n",
+		"# TYPE test_duration_seconds histogram\n",
+		"test_duration_seconds_bucket{outcome=\"ok\",le=\"0.1\"} 1\n",
+		"test_duration_seconds_bucket{outcome=\"ok\",le=\"1\"} 2\n",
+		"test_duration_seconds_bucket{outcome=\"ok\",le=\"+Inf\"} 3\n",
+		"test_duration_seconds_sum{outcome=\"ok\"} 2.55\n",
+		"test_duration_seconds_count{outcome=\"ok\"} 3\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(out, e) {
+			t.Errorf("output missing %q\n%s", e, out)
+		}
+	}
+
+	// Metrics are written sorted by name
+	if strings.Index(out, "test_connections") > strings.Index(out, "test_drops_total") {
+		t.Errorf("metrics not sorted by name\n%s", out)
+	}
+}
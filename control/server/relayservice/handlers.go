@@ -1,9 +1,10 @@
 package relayservice
 
 import (
-	"log"
 	"net/http"
 
+	"github.com/caldog20/calnet/control/server/internal/ratelimit"
+	"github.com/caldog20/calnet/control/server/logging"
 	"github.com/caldog20/calnet/pkg/keys"
 	"github.com/gorilla/websocket"
 )
@@ -21,6 +22,11 @@ func (r *Relay) handleRelay(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if r.isDraining() {
+		http.Error(w, "server going away", http.StatusServiceUnavailable)
+		return
+	}
+
 	nodeKeyStr := req.Header.Get("x-node-key")
 	nodeKey := keys.PublicKey{}
 	err := nodeKey.DecodeFromString(nodeKeyStr)
@@ -29,16 +35,28 @@ func (r *Relay) handleRelay(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if ok, retry := r.ipLimiter.Allow(ratelimit.SourceIP(req)); !ok {
+		ratelimit.WriteTooManyRequests(w, retry)
+		return
+	}
 	if verified := r.verifyKey(nodeKey); !verified {
 		http.Error(w, "error validating node key", http.StatusUnauthorized)
 		return
 	}
+	// The key is only charged once it is verified, so requests with a key that
+	// fails verification can't use up the limit of the node it belongs to
+	if ok, retry := r.keyLimiter.Allow(nodeKeyStr); !ok {
+		ratelimit.WriteTooManyRequests(w, retry)
+		return
+	}
 
 	conn, err := upgrader.Upgrade(w, req, nil)
 	if err != nil {
-		log.Println("error upgrading websocket conn:", err)
+		logger.Warn("error upgrading websocket conn", logging.NodeKey(nodeKey), logging.Err(err))
 		return
 	}
 
-	go r.handleRelayConn(nodeKey, conn)
+	if r.registerRelayConn(nodeKey, conn) {
+		go r.handleRelayConn(nodeKey, conn)
+	}
 }
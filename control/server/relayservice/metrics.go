@@ -0,0 +1,34 @@
+package relayservice
+
+import (
+	"github.com/caldog20/calnet/control/server/metrics"
+)
+
+const (
+	dropInvalidLength      = "invalid_length"
+	dropUnknownDestination = "unknown_destination"
+	dropWriteError         = "write_error"
+)
+
+var (
+	relayConnections = metrics.NewGauge(
+		"calnet_relay_connections",
+		"Number of connected relay websockets",
+	)
+	relayedPackets = metrics.NewCounter(
+		"calnet_relay_packets_total",
+		"Number of packets relayed between nodes",
+	)
+	relayedBytes = metrics.NewCounter(
+		"calnet_relay_bytes_total",
+		"Number of payload bytes relayed between nodes",
+	)
+	relayDrops = metrics.NewCounterVec(
+		"calnet_relay_drops_total",
+		"Number of packets dropped by the relay by cause",
+		"cause",
+		dropInvalidLength,
+		dropUnknownDestination,
+		dropWriteError,
+	)
+)
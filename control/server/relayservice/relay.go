@@ -1,26 +1,46 @@
 package relayservice
 
 import (
+	"context"
 	"errors"
-	"log"
 	"net/http"
 	"sync"
+	"time"
 
+	"github.com/caldog20/calnet/control/server/config"
+	"github.com/caldog20/calnet/control/server/internal/ratelimit"
+	"github.com/caldog20/calnet/control/server/logging"
 	"github.com/caldog20/calnet/pkg/keys"
 	"github.com/gorilla/websocket"
 )
 
+var logger = logging.Logger(logging.SubsystemRelay)
+
+// How long writing a close frame to a relay conn may block
+const closeWriteTimeout = time.Second
+
 type Relay struct {
 	closed    chan bool
 	verifyKey func(keys.PublicKey) bool
-	mu        sync.Mutex
-	conns     map[keys.PublicKey]*websocket.Conn
+	// Limits for relay connection attempts
+	ipLimiter  *ratelimit.Limiter
+	keyLimiter *ratelimit.Limiter
+	mu         sync.Mutex
+	conns      map[keys.PublicKey]*websocket.Conn
+	// Closed by Drain, new relay connections are refused from then on
+	draining    chan struct{}
+	drainReason string
+	// Tracks the goroutines serving relay conns, which outlive their HTTP handlers
+	wg sync.WaitGroup
 }
 
 func New() *Relay {
 	return &Relay{
-		closed: make(chan bool),
-		conns:  make(map[keys.PublicKey]*websocket.Conn),
+		closed:     make(chan bool),
+		conns:      make(map[keys.PublicKey]*websocket.Conn),
+		draining:   make(chan struct{}),
+		ipLimiter:  ratelimit.New(0, 0),
+		keyLimiter: ratelimit.New(0, 0),
 	}
 }
 
@@ -32,22 +52,42 @@ func (r *Relay) SetKeyVerifier(f func(keys.PublicKey) bool) {
 	r.verifyKey = f
 }
 
-func (r *Relay) registerRelayConn(node keys.PublicKey, conn *websocket.Conn) {
-	log.Println("registering websocket conn for key:", node.EncodeToString())
+// SetRateLimits configures the limits for relay connection attempts by source IP and node key.
+// It can be called again while the relay is serving to change the limits.
+func (r *Relay) SetRateLimits(conf config.RateLimitConfig) {
+	r.ipLimiter.SetLimit(conf.PerIPPerMinute, conf.PerIPBurst)
+	r.keyLimiter.SetLimit(conf.PerKeyPerMinute, conf.PerKeyBurst)
+}
+
+// registerRelayConn adds conn as the relay conn of node and reports whether it
+// was added. Conns are refused with a close frame while the relay is draining.
+// Every added conn must be deregistered and released from wg.
+func (r *Relay) registerRelayConn(node keys.PublicKey, conn *websocket.Conn) bool {
+	logger.Debug("registering relay conn", logging.NodeKey(node))
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	if r.isDraining() {
+		r.sendClose(node, conn)
+		conn.Close()
+		return false
+	}
+
 	existing, ok := r.conns[node]
 	if ok {
-		log.Println("closing existing websocket conn for key:", node.EncodeToString())
+		logger.Debug("closing existing relay conn", logging.NodeKey(node))
 		existing.Close()
+	} else {
+		relayConnections.Inc()
 	}
 
 	r.conns[node] = conn
+	r.wg.Add(1)
+	return true
 }
 
 func (r *Relay) deregisterRelayConn(node keys.PublicKey) {
-	log.Println("de-registering websocket conn for key:", node.EncodeToString())
+	logger.Debug("de-registering relay conn", logging.NodeKey(node))
 
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -55,11 +95,12 @@ func (r *Relay) deregisterRelayConn(node keys.PublicKey) {
 	if ok {
 		c.Close()
 		delete(r.conns, node)
+		relayConnections.Dec()
 	}
 }
 
 func (r *Relay) handleRelayConn(node keys.PublicKey, conn *websocket.Conn) {
-	r.registerRelayConn(node, conn)
+	defer r.wg.Done()
 	defer r.deregisterRelayConn(node)
 
 	for {
@@ -75,26 +116,22 @@ func (r *Relay) handleRelayConn(node keys.PublicKey, conn *websocket.Conn) {
 				websocket.CloseGoingAway,
 				websocket.CloseAbnormalClosure,
 			) {
-				log.Printf(
-					"error reading from relay conn for key: %s - %s",
-					node.EncodeToString(),
-					err,
-				)
+				logger.Warn("error reading from relay conn", logging.NodeKey(node), logging.Err(err))
 			}
 			return
 		}
 		if err = r.relayPacket(packet, node); err != nil {
-			log.Printf("error relaying packet: %s", err)
+			logger.Debug("error relaying packet", logging.NodeKey(node), logging.Err(err))
 		}
 	}
 }
 
-// TODO: Add metrics for relayed packets and failures
 func (r *Relay) relayPacket(data []byte, src keys.PublicKey) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
 	if len(data) < keys.PublicKeyLen {
+		relayDrops.Inc(dropInvalidLength)
 		return errors.New("invalid packet length")
 	}
 
@@ -102,6 +139,7 @@ func (r *Relay) relayPacket(data []byte, src keys.PublicKey) error {
 
 	dstConn, ok := r.conns[dstKey]
 	if !ok {
+		relayDrops.Inc(dropUnknownDestination)
 		return errors.New("invalid destination key")
 	}
 
@@ -109,12 +147,77 @@ func (r *Relay) relayPacket(data []byte, src keys.PublicKey) error {
 	packet := append(header, data[keys.PublicKeyLen:]...)
 	err := dstConn.WriteMessage(websocket.BinaryMessage, packet)
 	if err != nil {
+		relayDrops.Inc(dropWriteError)
 		return err
 	}
 
+	relayedPackets.Inc()
+	relayedBytes.Add(uint64(len(data) - keys.PublicKeyLen))
 	return nil
 }
 
+// Drain refuses new relay connections and sends every connected node a websocket
+// close frame with reason, so the nodes close their connections and reconnect
+// elsewhere. Wait returns once they have.
+func (r *Relay) Drain(reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.isDraining() {
+		return
+	}
+	r.drainReason = reason
+	close(r.draining)
+
+	logger.Info("draining relay conns", "conns", len(r.conns))
+	for node, conn := range r.conns {
+		r.sendClose(node, conn)
+	}
+}
+
+// sendClose sends conn a close frame with the drain reason, closing it if the
+// frame can't be sent. r.mu must be held.
+func (r *Relay) sendClose(node keys.PublicKey, conn *websocket.Conn) {
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, r.drainReason)
+	err := conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(closeWriteTimeout))
+	if err != nil {
+		logger.Debug("error sending relay close frame", logging.NodeKey(node), logging.Err(err))
+		conn.Close()
+	}
+}
+
+func (r *Relay) isDraining() bool {
+	select {
+	case <-r.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// Wait waits until every relay conn is closed after Drain. When ctx is done the
+// remaining conns are closed without waiting for the nodes.
+func (r *Relay) Wait(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+	}
+
+	r.mu.Lock()
+	logger.Warn("closing relay conns that didn't close in time", "conns", len(r.conns))
+	for _, conn := range r.conns {
+		conn.Close()
+	}
+	r.mu.Unlock()
+	<-done
+}
+
 func (r *Relay) Close() {
 	if !r.Closed() {
 		close(r.closed)
@@ -0,0 +1,102 @@
+package relayservice
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caldog20/calnet/control/server/config"
+	"github.com/caldog20/calnet/pkg/keys"
+	"github.com/gorilla/websocket"
+)
+
+func TestDrain(t *testing.T) {
+	r := New()
+	r.SetKeyVerifier(func(keys.PublicKey) bool { return true })
+	mux := http.NewServeMux()
+	r.RegisterRoutes(mux)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/relay"
+	dial := func() (*websocket.Conn, *http.Response, error) {
+		header := http.Header{}
+		header.Set("x-node-key", keys.NewPrivateKey().PublicKey().EncodeToString())
+		return websocket.DefaultDialer.Dial(url, header)
+	}
+	conn, _, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for {
+		r.mu.Lock()
+		n := len(r.conns)
+		r.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	r.Drain("server going away")
+	// The client answers the close frame, which ends the relay conn
+	_, _, err = conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseGoingAway ||
+		closeErr.Text != "server going away" {
+		t.Fatalf("got error %v, expected a going away close frame", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	r.Wait(ctx)
+	if ctx.Err() != nil {
+		t.Fatal("relay conn wasn't closed by the client before the timeout")
+	}
+
+	_, resp, err := dial()
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("got error %v connecting while draining, expected 503", err)
+	}
+}
+
+func TestKeyRateLimitAfterVerify(t *testing.T) {
+	nodeKey := keys.NewPrivateKey().PublicKey()
+	var valid atomic.Bool
+	r := New()
+	r.SetKeyVerifier(func(k keys.PublicKey) bool { return k == nodeKey && valid.Load() })
+	r.SetRateLimits(config.RateLimitConfig{PerKeyPerMinute: 1, PerKeyBurst: 1})
+	mux := http.NewServeMux()
+	r.RegisterRoutes(mux)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/relay"
+	header := http.Header{}
+	header.Set("x-node-key", nodeKey.EncodeToString())
+
+	// Requests that fail verification don't use up the limit of the key
+	for range 3 {
+		_, resp, err := websocket.DefaultDialer.Dial(url, header)
+		if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("got error %v for an unverified key, expected 401", err)
+		}
+	}
+
+	valid.Store(true)
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	_, resp, err := websocket.DefaultDialer.Dial(url, header)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("got error %v over the key limit, expected 429", err)
+	}
+}
@@ -0,0 +1,118 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/netip"
+
+	"github.com/caldog20/calnet/control/server/internal/node"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Index buckets let node lookups by key, IP and user find the node ID without
+// unmarshalling every node. They are only written in the same transaction as
+// the node itself, so they are always consistent with the nodes bucket.
+var (
+	// raw node key -> id
+	nodeKeyIndex = []byte("nodes_by_key")
+	// IP address bytes -> id, nodes without an IP are not indexed
+	nodeIPIndex = []byte("nodes_by_ip")
+	// user, 0x00, id -> empty
+	nodeUserIndex = []byte("nodes_by_user")
+
+	nodeIndexes = [][]byte{nodeKeyIndex, nodeIPIndex, nodeUserIndex}
+)
+
+func userIndexPrefix(user string) []byte {
+	return append([]byte(user), 0)
+}
+
+func userIndexKey(user string, id uint64) []byte {
+	return append(userIndexPrefix(user), itob(id)...)
+}
+
+func indexNode(tx *bolt.Tx, n *node.Node) error {
+	id := itob(n.ID)
+	if err := tx.Bucket(nodeKeyIndex).Put(n.NodeKey.Raw(), id); err != nil {
+		return err
+	}
+	if n.IP.IsValid() {
+		if err := tx.Bucket(nodeIPIndex).Put(n.IP.AsSlice(), id); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(nodeUserIndex).Put(userIndexKey(n.User, n.ID), []byte{})
+}
+
+func unindexNode(tx *bolt.Tx, n *node.Node) error {
+	id := itob(n.ID)
+	if err := deleteIndexEntry(tx.Bucket(nodeKeyIndex), n.NodeKey.Raw(), id); err != nil {
+		return err
+	}
+	if n.IP.IsValid() {
+		if err := deleteIndexEntry(tx.Bucket(nodeIPIndex), n.IP.AsSlice(), id); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(nodeUserIndex).Delete(userIndexKey(n.User, n.ID))
+}
+
+// deleteIndexEntry deletes key from a unique index if it still points at id,
+// so removing one node can't drop the entry of another node with the same key
+func deleteIndexEntry(b *bolt.Bucket, key, id []byte) error {
+	if bytes.Equal(b.Get(key), id) {
+		return b.Delete(key)
+	}
+	return nil
+}
+
+// rebuildNodeIndexes recreates every index bucket from the nodes bucket
+func rebuildNodeIndexes(tx *bolt.Tx) (int, error) {
+	for _, name := range nodeIndexes {
+		if tx.Bucket(name) != nil {
+			if err := tx.DeleteBucket(name); err != nil {
+				return 0, err
+			}
+		}
+		if _, err := tx.CreateBucket(name); err != nil {
+			return 0, err
+		}
+	}
+
+	count := 0
+	err := tx.Bucket([]byte("nodes")).ForEach(func(k, v []byte) error {
+		n := &node.Node{}
+		if err := json.Unmarshal(v, n); err != nil {
+			return err
+		}
+		count++
+		return indexNode(tx, n)
+	})
+	return count, err
+}
+
+// ipInUse reports whether the IP index assigns ip to a node other than id
+func ipInUse(tx *bolt.Tx, ip netip.Addr, id uint64) bool {
+	if !ip.IsValid() {
+		return false
+	}
+	v := tx.Bucket(nodeIPIndex).Get(ip.AsSlice())
+	return v != nil && !bytes.Equal(v, itob(id))
+}
+
+// getIndexedNode returns the node an index entry points at
+func getIndexedNode(tx *bolt.Tx, index, key []byte) (*node.Node, error) {
+	id := tx.Bucket(index).Get(key)
+	if id == nil {
+		return nil, ErrNodeNotFound
+	}
+	v := tx.Bucket([]byte("nodes")).Get(id)
+	if v == nil {
+		return nil, ErrNodeNotFound
+	}
+	n := &node.Node{}
+	if err := json.Unmarshal(v, n); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
@@ -0,0 +1,135 @@
+package store
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	metaBucket       = []byte("meta")
+	schemaVersionKey = []byte("schema_version")
+)
+
+type boltMigration struct {
+	description string
+	migrate     func(tx *bolt.Tx) error
+}
+
+// boltMigrations are applied in order to bring a database up to date, the schema
+// version is the number applied. Databases from before versioning are version 0.
+// Existing migrations must never be changed, only appended to, and any change to
+// how a stored type is encoded needs a migration that rewrites the old values.
+var boltMigrations = []boltMigration{
+	{
+		description: "create the nodes, audit, webhook and provisioning key buckets",
+		migrate: func(tx *bolt.Tx) error {
+			for _, name := range []string{
+				"nodes",
+				"audit",
+				"webhooks",
+				"webhook_deliveries",
+				"provision_keys",
+			} {
+				if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		description: "build the node key, IP and user indexes",
+		migrate: func(tx *bolt.Tx) error {
+			count, err := rebuildNodeIndexes(tx)
+			if err != nil {
+				return err
+			}
+			if count > 0 {
+				logger.Info("rebuilt node indexes", "nodes", count)
+			}
+			return nil
+		},
+	},
+}
+
+func boltSchemaVersion(tx *bolt.Tx) (int, error) {
+	b := tx.Bucket(metaBucket)
+	if b == nil {
+		return 0, nil
+	}
+	v := b.Get(schemaVersionKey)
+	if v == nil {
+		return 0, nil
+	}
+	if len(v) != 8 {
+		return 0, fmt.Errorf("invalid schema version %x", v)
+	}
+	return int(binary.BigEndian.Uint64(v)), nil
+}
+
+// boltMigrationStatus returns the schema version of the database in tx and the
+// migrations pending for it
+func boltMigrationStatus(tx *bolt.Tx) (*MigrationStatus, error) {
+	current, err := boltSchemaVersion(tx)
+	if err != nil {
+		return nil, err
+	}
+	descriptions := make([]string, len(boltMigrations))
+	for i, m := range boltMigrations {
+		descriptions[i] = m.description
+	}
+	return newMigrationStatus(current, descriptions)
+}
+
+// migrateBolt applies every pending migration in tx and records the new schema version
+func migrateBolt(tx *bolt.Tx) (*MigrationStatus, error) {
+	status, err := boltMigrationStatus(tx)
+	if err != nil {
+		return nil, err
+	}
+	if len(status.Pending) == 0 {
+		return status, nil
+	}
+
+	for _, m := range status.Pending {
+		if err = boltMigrations[m.Version-1].migrate(tx); err != nil {
+			return nil, fmt.Errorf("error applying bolt migration %d: %w", m.Version, err)
+		}
+	}
+	b, err := tx.CreateBucketIfNotExists(metaBucket)
+	if err != nil {
+		return nil, err
+	}
+	return status, b.Put(schemaVersionKey, itob(uint64(status.Latest)))
+}
+
+func migrateBoltFile(path string, dryRun bool) (*MigrationStatus, error) {
+	// A dry run opens the database read-only and only reads its schema version
+	db, err := openBolt(path, dryRun)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	if dryRun {
+		var status *MigrationStatus
+		err = db.View(func(tx *bolt.Tx) error {
+			status, err = boltMigrationStatus(tx)
+			return err
+		})
+		return status, err
+	}
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		return nil, err
+	}
+	status, err := migrateBolt(tx)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return status, tx.Commit()
+}
@@ -1,18 +1,30 @@
 package store
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/netip"
 	"time"
 
+	"github.com/caldog20/calnet/control/server/internal/audit"
 	"github.com/caldog20/calnet/control/server/internal/node"
+	"github.com/caldog20/calnet/control/server/internal/provision"
+	"github.com/caldog20/calnet/control/server/internal/store"
+	"github.com/caldog20/calnet/control/server/internal/webhook"
+	"github.com/caldog20/calnet/control/server/logging"
 	"github.com/caldog20/calnet/pkg/keys"
 	bolt "go.etcd.io/bbolt"
 )
 
+var logger = logging.Logger(logging.SubsystemStore)
+
 type BoltStore struct {
 	db *bolt.DB
+	nodeWatchers
 }
 
 func (b *BoltStore) GetNodes() ([]node.Node, error) {
@@ -36,15 +48,54 @@ func (b *BoltStore) GetNodes() ([]node.Node, error) {
 	return nodes, nil
 }
 
-func (b *BoltStore) GetPeersOfNode(id uint64) ([]*node.Node, error) {
-	var peers []*node.Node
-	_, err := b.GetNodeByID(id)
+// ListNodes uses the user index to read only that user's nodes when filtering by user
+func (b *BoltStore) ListNodes(opts node.ListOptions) ([]node.Node, error) {
+	var nodes []node.Node
+	now := time.Now()
+	add := func(v []byte) error {
+		n := node.Node{}
+		err := json.Unmarshal(v, &n)
+		if err != nil {
+			return err
+		}
+		if opts.Match(&n, now) && opts.IsAfterCursor(&n) {
+			nodes = append(nodes, n)
+		}
+		return nil
+	}
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("nodes"))
+		if opts.User == "" {
+			return b.ForEach(func(k, v []byte) error {
+				return add(v)
+			})
+		}
+
+		prefix := userIndexPrefix(opts.User)
+		c := tx.Bucket(nodeUserIndex).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			if v := b.Get(k[len(prefix):]); v != nil {
+				if err := add(v); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
+	return opts.Page(nodes), nil
+}
 
-	err = b.db.View(func(tx *bolt.Tx) error {
+func (b *BoltStore) GetPeersOfNode(id uint64) ([]*node.Node, error) {
+	var peers []*node.Node
+	err := b.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("nodes"))
+		if b.Get(itob(id)) == nil {
+			return ErrNodeNotFound
+		}
 		c := b.Cursor()
 		for k, v := c.First(); k != nil; k, v = c.Next() {
 			nodeId := binary.BigEndian.Uint64(k)
@@ -69,19 +120,9 @@ func (b *BoltStore) GetPeersOfNode(id uint64) ([]*node.Node, error) {
 func (b *BoltStore) GetNodeByKey(key keys.PublicKey) (*node.Node, error) {
 	var n *node.Node
 	err := b.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("nodes"))
-		c := b.Cursor()
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			n = &node.Node{}
-			err := json.Unmarshal(v, n)
-			if err != nil {
-				return err
-			}
-			if n.NodeKey == key {
-				return nil
-			}
-		}
-		return ErrNodeNotFound
+		var err error
+		n, err = getIndexedNode(tx, nodeKeyIndex, key.Raw())
+		return err
 	})
 	if err != nil {
 		return nil, err
@@ -110,20 +151,52 @@ func (b *BoltStore) GetNodeByID(id uint64) (*node.Node, error) {
 	return n, nil
 }
 
+func (b *BoltStore) GetNodeByIP(ip netip.Addr) (*node.Node, error) {
+	if !ip.IsValid() {
+		return nil, ErrNodeNotFound
+	}
+	var n *node.Node
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		n, err = getIndexedNode(tx, nodeIPIndex, ip.AsSlice())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
 func (b *BoltStore) CreateNode(node *node.Node) error {
-	return b.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("nodes"))
+	node.CreatedAt = time.Now()
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		return putNewNode(tx, node)
+	})
+	if err != nil {
+		return err
+	}
+	b.notify(store.NodeCreated, nil, node)
+	return nil
+}
 
-		id, _ := b.NextSequence()
-		node.ID = id
-		node.CreatedAt = time.Now()
-		data, err := json.Marshal(node)
-		if err != nil {
-			return err
-		}
+// putNewNode assigns n the next node ID and stores it with its index entries
+func putNewNode(tx *bolt.Tx, n *node.Node) error {
+	b := tx.Bucket([]byte("nodes"))
+	if ipInUse(tx, n.IP, 0) {
+		return ErrIPInUse
+	}
 
-		return b.Put(itob(id), data)
-	})
+	id, _ := b.NextSequence()
+	n.ID = id
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	if err = b.Put(itob(id), data); err != nil {
+		return err
+	}
+	return indexNode(tx, n)
 }
 
 // itob returns an 8-byte big endian representation of v.
@@ -134,44 +207,493 @@ func itob(v uint64) []byte {
 }
 
 func (b *BoltStore) DeleteNode(id uint64) error {
-	return b.db.Update(func(tx *bolt.Tx) error {
+	var old *node.Node
+	err := b.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("nodes"))
-		b.Delete(itob(id))
-		return nil
+		v := b.Get(itob(id))
+		if v == nil {
+			return nil
+		}
+		old = &node.Node{}
+		if err := json.Unmarshal(v, old); err != nil {
+			return err
+		}
+		if err := unindexNode(tx, old); err != nil {
+			return err
+		}
+		return b.Delete(itob(id))
 	})
+	if err != nil || old == nil {
+		return err
+	}
+	b.notify(store.NodeDeleted, old, nil)
+	return nil
 }
 
-func (b *BoltStore) UpdateNode(node *node.Node) error {
-	return b.db.Update(func(tx *bolt.Tx) error {
+func (b *BoltStore) UpdateNode(n *node.Node) error {
+	old := &node.Node{}
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("nodes"))
+		v := b.Get(itob(n.ID))
+		if v == nil {
+			return ErrNodeNotFound
+		}
+		if err := json.Unmarshal(v, old); err != nil {
+			return err
+		}
+		if ipInUse(tx, n.IP, n.ID) {
+			return ErrIPInUse
+		}
+		if err := unindexNode(tx, old); err != nil {
+			return err
+		}
+
+		n.UpdatedAt = time.Now()
+		data, err := json.Marshal(n)
+		if err != nil {
+			return err
+		}
+		if err = b.Put(itob(n.ID), data); err != nil {
+			return err
+		}
+		return indexNode(tx, n)
+	})
+	if err != nil {
+		return err
+	}
+	b.notify(store.NodeUpdated, old, n)
+	return nil
+}
+
+// SetNodePresence changes the stored node in one transaction, presence isn't
+// indexed so the indexes are left as they are
+func (b *BoltStore) SetNodePresence(id uint64, online bool) (*node.Node, error) {
+	old, n := &node.Node{}, &node.Node{}
+	err := b.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("nodes"))
-		node.UpdatedAt = time.Now()
-		data, err := json.Marshal(node)
+		v := b.Get(itob(id))
+		if v == nil {
+			return ErrNodeNotFound
+		}
+		if err := json.Unmarshal(v, old); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(v, n); err != nil {
+			return err
+		}
+
+		n.Online = online
+		n.UpdatedAt = time.Now()
+		if online {
+			n.LastConnected = n.UpdatedAt
+		}
+		data, err := json.Marshal(n)
 		if err != nil {
 			return err
 		}
-		return b.Put(itob(node.ID), data)
+		return b.Put(itob(id), data)
 	})
+	if err != nil {
+		return nil, err
+	}
+	b.notify(store.NodeUpdated, old, n)
+	return n, nil
 }
 
+func (b *BoltStore) ResetPresence() error {
+	var changes []store.NodeChange
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("nodes"))
+		// The bucket can't be written while ForEach iterates it
+		err := b.ForEach(func(k, v []byte) error {
+			old, n := &node.Node{}, &node.Node{}
+			if err := json.Unmarshal(v, old); err != nil {
+				return err
+			}
+			if !old.Online {
+				return nil
+			}
+			if err := json.Unmarshal(v, n); err != nil {
+				return err
+			}
+			n.Online = false
+			n.UpdatedAt = time.Now()
+			changes = append(changes, store.NodeChange{Type: store.NodeUpdated, Old: old, New: n})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, c := range changes {
+			data, err := json.Marshal(c.New)
+			if err != nil {
+				return err
+			}
+			if err = b.Put(itob(c.New.ID), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, c := range changes {
+		b.notify(c.Type, c.Old, c.New)
+	}
+	return nil
+}
+
+// GetAllocatedNodeIPs reads the IPs from the keys of the IP index
 func (b *BoltStore) GetAllocatedNodeIPs() ([]netip.Addr, error) {
 	var allocatedNodeIPs []netip.Addr
 	err := b.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("nodes"))
-		err := b.ForEach(func(k, v []byte) error {
-			n := &node.Node{}
-			err := json.Unmarshal(v, n)
+		return tx.Bucket(nodeIPIndex).ForEach(func(k, v []byte) error {
+			ip, ok := netip.AddrFromSlice(k)
+			if !ok {
+				return fmt.Errorf("invalid ip index key %x", k)
+			}
+			allocatedNodeIPs = append(allocatedNodeIPs, ip)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return allocatedNodeIPs, nil
+}
+
+func (b *BoltStore) AppendAuditEvent(event *audit.Event) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("audit"))
+
+		id, _ := b.NextSequence()
+		event.ID = id
+		if event.Time.IsZero() {
+			event.Time = time.Now()
+		}
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+
+		return b.Put(itob(id), data)
+	})
+}
+
+func (b *BoltStore) GetAuditEvents(filter audit.Filter) ([]audit.Event, error) {
+	var events []audit.Event
+	limit := filter.PageSize()
+	err := b.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("audit"))
+		c := b.Cursor()
+		// Keys are big endian sequence IDs so we can seek directly past the cursor
+		for k, v := c.Seek(itob(filter.AfterID + 1)); k != nil; k, v = c.Next() {
+			e := audit.Event{}
+			err := json.Unmarshal(v, &e)
 			if err != nil {
 				return err
 			}
-			allocatedNodeIPs = append(allocatedNodeIPs, n.IP)
+			if !filter.Match(&e) {
+				continue
+			}
+			events = append(events, e)
+			if len(events) >= limit {
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// Only the most recent deliveries are kept in the delivery log
+const maxWebhookDeliveries = 10000
+
+func (b *BoltStore) CreateWebhook(sub *webhook.Subscription) error {
+	sub.CreatedAt = time.Now()
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return putNewWebhook(tx, sub)
+	})
+}
+
+func putNewWebhook(tx *bolt.Tx, sub *webhook.Subscription) error {
+	b := tx.Bucket([]byte("webhooks"))
+
+	id, _ := b.NextSequence()
+	sub.ID = id
+	data, err := json.Marshal(sub)
+	if err != nil {
+		return err
+	}
+
+	return b.Put(itob(id), data)
+}
+
+func (b *BoltStore) GetWebhooks() ([]webhook.Subscription, error) {
+	var subs []webhook.Subscription
+	err := b.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("webhooks"))
+		return b.ForEach(func(k, v []byte) error {
+			sub := webhook.Subscription{}
+			err := json.Unmarshal(v, &sub)
+			if err != nil {
+				return err
+			}
+			subs = append(subs, sub)
 			return nil
 		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return subs, nil
+}
+
+func (b *BoltStore) GetWebhookByID(id uint64) (*webhook.Subscription, error) {
+	var sub *webhook.Subscription
+	err := b.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("webhooks"))
+		v := b.Get(itob(id))
+		if v == nil {
+			return ErrWebhookNotFound
+		}
+		sub = &webhook.Subscription{}
+		return json.Unmarshal(v, sub)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+func (b *BoltStore) DeleteWebhook(id uint64) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("webhooks"))
+		if b.Get(itob(id)) == nil {
+			return ErrWebhookNotFound
+		}
+		return b.Delete(itob(id))
+	})
+}
+
+func (b *BoltStore) AppendWebhookDelivery(delivery *webhook.Delivery) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("webhook_deliveries"))
+
+		id, _ := b.NextSequence()
+		delivery.ID = id
+		data, err := json.Marshal(delivery)
+		if err != nil {
+			return err
+		}
+		if err = b.Put(itob(id), data); err != nil {
+			return err
+		}
+
+		// IDs are sequential so dropping the entry maxWebhookDeliveries behind keeps a fixed window
+		if id > maxWebhookDeliveries {
+			return b.Delete(itob(id - maxWebhookDeliveries))
+		}
+		return nil
+	})
+}
+
+// GetWebhookDeliveries returns up to limit deliveries for a subscription, newest first
+func (b *BoltStore) GetWebhookDeliveries(
+	subscriptionID uint64,
+	limit int,
+) ([]webhook.Delivery, error) {
+	var deliveries []webhook.Delivery
+	err := b.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("webhook_deliveries"))
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			d := webhook.Delivery{}
+			err := json.Unmarshal(v, &d)
+			if err != nil {
+				return err
+			}
+			if d.SubscriptionID != subscriptionID {
+				continue
+			}
+			deliveries = append(deliveries, d)
+			if limit > 0 && len(deliveries) >= limit {
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func (b *BoltStore) CreateProvisionKey(key *provision.Key) error {
+	key.CreatedAt = time.Now()
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return putNewProvisionKey(tx, key)
+	})
+}
+
+func putNewProvisionKey(tx *bolt.Tx, key *provision.Key) error {
+	b := tx.Bucket([]byte("provision_keys"))
+
+	id, _ := b.NextSequence()
+	key.ID = id
+	data, err := json.Marshal(key)
+	if err != nil {
 		return err
+	}
+
+	return b.Put(itob(id), data)
+}
+
+func (b *BoltStore) GetProvisionKeys() ([]provision.Key, error) {
+	var pks []provision.Key
+	err := b.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("provision_keys"))
+		return b.ForEach(func(k, v []byte) error {
+			pk := provision.Key{}
+			err := json.Unmarshal(v, &pk)
+			if err != nil {
+				return err
+			}
+			pks = append(pks, pk)
+			return nil
+		})
 	})
 	if err != nil {
 		return nil, err
 	}
-	return allocatedNodeIPs, nil
+	return pks, nil
+}
+
+func (b *BoltStore) GetProvisionKeyByID(id uint64) (*provision.Key, error) {
+	var pk *provision.Key
+	err := b.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("provision_keys"))
+		v := b.Get(itob(id))
+		if v == nil {
+			return ErrProvisionKeyNotFound
+		}
+		pk = &provision.Key{}
+		return json.Unmarshal(v, pk)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pk, nil
+}
+
+func (b *BoltStore) UpdateProvisionKey(key *provision.Key) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("provision_keys"))
+		if b.Get(itob(key.ID)) == nil {
+			return ErrProvisionKeyNotFound
+		}
+		data, err := json.Marshal(key)
+		if err != nil {
+			return err
+		}
+		return b.Put(itob(key.ID), data)
+	})
+}
+
+func (b *BoltStore) UseProvisionKey(hash string) (*provision.Key, error) {
+	var pk *provision.Key
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("provision_keys"))
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			key := &provision.Key{}
+			err := json.Unmarshal(v, key)
+			if err != nil {
+				return err
+			}
+			if key.Hash == hash {
+				pk = key
+				break
+			}
+		}
+		if pk == nil {
+			return ErrProvisionKeyNotFound
+		}
+
+		now := time.Now()
+		if err := pk.Usable(now); err != nil {
+			return err
+		}
+		pk.Uses++
+		pk.LastUsed = now
+
+		data, err := json.Marshal(pk)
+		if err != nil {
+			return err
+		}
+		return b.Put(itob(pk.ID), data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pk, nil
+}
+
+// Import creates everything in one update transaction, which bolt rolls back
+// if any write fails
+func (b *BoltStore) Import(batch *store.ImportBatch) error {
+	now := time.Now()
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		for i := range batch.Nodes {
+			n := &batch.Nodes[i]
+			if n.CreatedAt.IsZero() {
+				n.CreatedAt = now
+			}
+			if err := putNewNode(tx, n); err != nil {
+				return err
+			}
+		}
+		for i := range batch.ProvisionKeys {
+			key := &batch.ProvisionKeys[i]
+			if key.CreatedAt.IsZero() {
+				key.CreatedAt = now
+			}
+			if err := putNewProvisionKey(tx, key); err != nil {
+				return err
+			}
+		}
+		for i := range batch.Webhooks {
+			sub := &batch.Webhooks[i]
+			if sub.CreatedAt.IsZero() {
+				sub.CreatedAt = now
+			}
+			if err := putNewWebhook(tx, sub); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := range batch.Nodes {
+		b.notify(store.NodeCreated, nil, &batch.Nodes[i])
+	}
+	return nil
+}
+
+// openBolt opens the bolt database at path, waiting up to a second for the file
+// lock so a store already opened by another process is an error instead of a hang
+func openBolt(path string, readOnly bool) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: readOnly, Timeout: time.Second})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("%w: %s", ErrStoreInUse, path)
+	}
+	return db, err
 }
 
 func NewBoltStore(path string) (*BoltStore, error) {
@@ -181,24 +703,45 @@ func NewBoltStore(path string) (*BoltStore, error) {
 	// 	os.Remove(path)
 	// }
 
-	db, err := bolt.Open(path, 0600, nil)
+	db, err := openBolt(path, false)
 	if err != nil {
 		return nil, err
 	}
 
+	var status *MigrationStatus
 	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte("nodes"))
-		if err != nil {
-			return err
-		}
-		return nil
+		status, err = migrateBolt(tx)
+		return err
 	})
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
+	for _, m := range status.Pending {
+		logger.Info(
+			"applied bolt store migration",
+			"version",
+			m.Version,
+			"description",
+			m.Description,
+		)
+	}
+	logger.Info("opened bolt store", "path", path)
 	return &BoltStore{db: db}, nil
 }
 
+// Backup writes a copy of the database from a read transaction,
+// so it is consistent and doesn't block writes while it is written
+func (b *BoltStore) Backup(w io.Writer) (int64, error) {
+	var n int64
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
 func (b *BoltStore) Close() error {
 	return b.db.Close()
 }
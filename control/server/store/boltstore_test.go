@@ -0,0 +1,130 @@
+package store
+
+import (
+	"fmt"
+	"net/netip"
+	"path/filepath"
+	"testing"
+
+	"github.com/caldog20/calnet/control/server/internal/node"
+	"github.com/caldog20/calnet/pkg/keys"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBoltIndexRebuild(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.db")
+	s, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &node.Node{
+		NodeKey: keys.NewPrivateKey().PublicKey(),
+		IP:      netip.MustParseAddr("100.70.0.1"),
+		User:    "alice",
+	}
+	if err = s.CreateNode(n); err != nil {
+		t.Fatal(err)
+	}
+
+	// Drop the indexes and the migration that built them to look like a
+	// database written before they existed
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range nodeIndexes {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(metaBucket).Put(schemaVersionKey, itob(1))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s, err = NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if got, err := s.GetNodeByKey(n.NodeKey); err != nil || got.ID != n.ID {
+		t.Errorf("got node %v error %v by key after rebuild, expected node %d", got, err, n.ID)
+	}
+	if got, err := s.GetNodeByIP(n.IP); err != nil || got.ID != n.ID {
+		t.Errorf("got node %v error %v by ip after rebuild, expected node %d", got, err, n.ID)
+	}
+	nodes, err := s.ListNodes(node.ListOptions{Filter: node.Filter{User: "alice"}})
+	if err != nil || len(nodes) != 1 {
+		t.Errorf("got nodes %v error %v for user after rebuild, expected 1 node", nodes, err)
+	}
+}
+
+// newBenchBoltStore returns a bolt store holding count nodes split between ten users
+func newBenchBoltStore(b *testing.B, count int) (*BoltStore, []*node.Node) {
+	b.Helper()
+	s, err := NewBoltStore(filepath.Join(b.TempDir(), "store.db"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { s.Close() })
+	// Only the lookups are measured, so skip syncing while filling the store
+	s.db.NoSync = true
+
+	nodes := make([]*node.Node, count)
+	for i := range nodes {
+		nodes[i] = &node.Node{
+			NodeKey: keys.NewPrivateKey().PublicKey(),
+			IP:      netip.AddrFrom4([4]byte{100, 64 + byte(i>>16), byte(i >> 8), byte(i)}),
+			User:    fmt.Sprintf("user-%d", i%10),
+		}
+		if err = s.CreateNode(nodes[i]); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return s, nodes
+}
+
+var benchNodeCounts = []int{100, 1000, 10000}
+
+func BenchmarkBoltGetNodeByKey(b *testing.B) {
+	for _, count := range benchNodeCounts {
+		b.Run(fmt.Sprintf("nodes=%d", count), func(b *testing.B) {
+			s, nodes := newBenchBoltStore(b, count)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := s.GetNodeByKey(nodes[i%count].NodeKey); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkBoltGetNodeByIP(b *testing.B) {
+	for _, count := range benchNodeCounts {
+		b.Run(fmt.Sprintf("nodes=%d", count), func(b *testing.B) {
+			s, nodes := newBenchBoltStore(b, count)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := s.GetNodeByIP(nodes[i%count].IP); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkBoltUpdateNode(b *testing.B) {
+	for _, count := range benchNodeCounts {
+		b.Run(fmt.Sprintf("nodes=%d", count), func(b *testing.B) {
+			s, nodes := newBenchBoltStore(b, count)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				n := nodes[i%count]
+				n.Online = !n.Online
+				if err := s.UpdateNode(n); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
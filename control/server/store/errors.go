@@ -2,4 +2,10 @@ package store
 
 import "errors"
 
-var ErrNodeNotFound = errors.New("node was not found in store")
+var (
+	ErrNodeNotFound         = errors.New("node was not found in store")
+	ErrIPInUse              = errors.New("ip address is already assigned to another node")
+	ErrWebhookNotFound      = errors.New("webhook was not found in store")
+	ErrProvisionKeyNotFound = errors.New("provisioning key was not found in store")
+	ErrStoreInUse           = errors.New("store is in use by another process")
+)
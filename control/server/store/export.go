@@ -0,0 +1,199 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/caldog20/calnet/control/server/config"
+	"github.com/caldog20/calnet/control/server/internal/node"
+	"github.com/caldog20/calnet/control/server/internal/provision"
+	"github.com/caldog20/calnet/control/server/internal/store"
+	"github.com/caldog20/calnet/control/server/internal/webhook"
+)
+
+// ExportVersion is the version of the export format written by ExportStore.
+// Version 2 added the settings.
+const ExportVersion = 2
+
+// Export is a backend-neutral copy of a store, used to move between store
+// drivers or servers. The audit log and webhook deliveries are history and
+// are not exported.
+type Export struct {
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`
+	// NetworkPrefix the node IPs were allocated from
+	NetworkPrefix netip.Prefix `json:"network_prefix"`
+	Nodes         []node.Node  `json:"nodes"`
+	// Users assigned to nodes and provisioning keys. Users only exist as a
+	// name on those, so the list is informational and is not imported.
+	Users         []string               `json:"users"`
+	ProvisionKeys []provision.Key        `json:"provision_keys"`
+	Webhooks      []webhook.Subscription `json:"webhooks"`
+	// Settings of the server the export was taken from, nil before version 2
+	Settings *Settings `json:"settings,omitempty"`
+}
+
+// Settings are the server settings that apply to the exported nodes and keys.
+// They live in the server config rather than the store, so they are not imported.
+type Settings struct {
+	// Days a node key is valid for after the node registers
+	KeyExpiryDays int                    `json:"key_expiry_days"`
+	RateLimit     config.RateLimitConfig `json:"rate_limit"`
+}
+
+// ExportSettings returns the settings of conf recorded in an export
+func ExportSettings(conf *config.Config) *Settings {
+	return &Settings{KeyExpiryDays: conf.KeyExpiryDays, RateLimit: conf.RateLimit}
+}
+
+// ImportResult counts the objects created by an import
+type ImportResult struct {
+	Nodes         int
+	ProvisionKeys int
+	Webhooks      int
+}
+
+// ExportStore reads every node, provisioning key and webhook from s and records the
+// network prefix and settings of conf
+func ExportStore(s store.Store, conf *config.Config) (*Export, error) {
+	e := &Export{
+		Version:       ExportVersion,
+		Time:          time.Now().UTC(),
+		NetworkPrefix: conf.NetworkPrefix,
+		Settings:      ExportSettings(conf),
+	}
+
+	var err error
+	if e.Nodes, err = s.GetNodes(); err != nil {
+		return nil, err
+	}
+	if e.ProvisionKeys, err = s.GetProvisionKeys(); err != nil {
+		return nil, err
+	}
+	if e.Webhooks, err = s.GetWebhooks(); err != nil {
+		return nil, err
+	}
+
+	for _, n := range e.Nodes {
+		e.Users = append(e.Users, n.User)
+	}
+	for _, pk := range e.ProvisionKeys {
+		e.Users = append(e.Users, pk.User)
+	}
+	slices.Sort(e.Users)
+	e.Users = slices.Compact(slices.DeleteFunc(e.Users, func(u string) bool { return u == "" }))
+	return e, nil
+}
+
+// Validate checks that e can be imported into s with nodes allocated from prefix.
+// Every node IP must be inside prefix and not already be used, in the export or
+// in s, and node keys and provisioning keys must not already exist.
+// All problems are returned joined so they can be fixed at once.
+func (e *Export) Validate(s store.Store, prefix netip.Prefix) error {
+	if e.Version < 1 || e.Version > ExportVersion {
+		return fmt.Errorf(
+			"unsupported export version %d, this server supports version %d",
+			e.Version,
+			ExportVersion,
+		)
+	}
+
+	allocated, err := s.GetAllocatedNodeIPs()
+	if err != nil {
+		return err
+	}
+	ips := make(map[netip.Addr]string)
+	for _, ip := range allocated {
+		ips[ip] = "an existing node"
+	}
+
+	var errs []error
+	nodeKeys := make(map[string]bool)
+	for _, n := range e.Nodes {
+		name := fmt.Sprintf("node %d (%s)", n.ID, n.Name)
+		key := n.NodeKey.EncodeToString()
+		if n.NodeKey.IsZero() {
+			errs = append(errs, fmt.Errorf("%s has no node key", name))
+		} else if nodeKeys[key] {
+			errs = append(errs, fmt.Errorf("%s has the same node key as another node", name))
+		} else if _, err := s.GetNodeByKey(n.NodeKey); err == nil {
+			errs = append(errs, fmt.Errorf("%s is already registered", name))
+		} else if !errors.Is(err, ErrNodeNotFound) {
+			return err
+		}
+		nodeKeys[key] = true
+
+		switch {
+		case !n.IP.IsValid():
+			errs = append(errs, fmt.Errorf("%s has no ip", name))
+		case !prefix.Contains(n.IP) || n.IP == prefix.Addr():
+			errs = append(
+				errs,
+				fmt.Errorf("%s ip %s is not in network prefix %s", name, n.IP, prefix),
+			)
+		case ips[n.IP] != "":
+			errs = append(
+				errs,
+				fmt.Errorf("%s ip %s is already used by %s", name, n.IP, ips[n.IP]),
+			)
+		default:
+			ips[n.IP] = name
+		}
+	}
+
+	existing, err := s.GetProvisionKeys()
+	if err != nil {
+		return err
+	}
+	hashes := make(map[string]bool)
+	for _, pk := range existing {
+		hashes[pk.Hash] = true
+	}
+	for _, pk := range e.ProvisionKeys {
+		if pk.Hash == "" {
+			errs = append(errs, fmt.Errorf("provisioning key %d has no hash", pk.ID))
+		} else if hashes[pk.Hash] {
+			errs = append(errs, fmt.Errorf("provisioning key %d already exists", pk.ID))
+		}
+		hashes[pk.Hash] = true
+	}
+
+	for _, sub := range e.Webhooks {
+		if sub.URL == "" || sub.Secret == "" {
+			errs = append(errs, fmt.Errorf("webhook %d is missing its url or secret", sub.ID))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Import validates e and then creates its nodes, provisioning keys and webhooks in s
+// in a single transaction, so a failed import leaves s unchanged. Objects are assigned
+// new IDs by s and keep their CreatedAt, nodes are imported offline with their prefix
+// set to prefix. The control server allocates IPs from the nodes in the store when it
+// starts, so imports must be made while it is stopped.
+func Import(s store.Store, e *Export, prefix netip.Prefix) (*ImportResult, error) {
+	if err := e.Validate(s, prefix); err != nil {
+		return nil, err
+	}
+
+	batch := &store.ImportBatch{
+		Nodes:         slices.Clone(e.Nodes),
+		ProvisionKeys: slices.Clone(e.ProvisionKeys),
+		Webhooks:      slices.Clone(e.Webhooks),
+	}
+	for i := range batch.Nodes {
+		batch.Nodes[i].Prefix = prefix
+		batch.Nodes[i].Online = false
+	}
+	if err := s.Import(batch); err != nil {
+		return nil, fmt.Errorf("error importing: %w", err)
+	}
+	return &ImportResult{
+		Nodes:         len(batch.Nodes),
+		ProvisionKeys: len(batch.ProvisionKeys),
+		Webhooks:      len(batch.Webhooks),
+	}, nil
+}
@@ -0,0 +1,280 @@
+package store_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caldog20/calnet/control/server/config"
+	"github.com/caldog20/calnet/control/server/internal/node"
+	"github.com/caldog20/calnet/control/server/internal/provision"
+	"github.com/caldog20/calnet/control/server/internal/webhook"
+	"github.com/caldog20/calnet/control/server/store"
+	"github.com/caldog20/calnet/pkg/keys"
+)
+
+var testPrefix = netip.MustParsePrefix("100.70.0.0/24")
+
+func newTestNode(i int) *node.Node {
+	return &node.Node{
+		NodeKey: keys.NewPrivateKey().PublicKey(),
+		Name:    fmt.Sprintf("node-%d", i),
+		IP:      netip.AddrFrom4([4]byte{100, 70, 0, byte(i)}),
+		Prefix:  testPrefix,
+		User:    "alice",
+		Tags:    []string{"tag:web"},
+		Online:  true,
+	}
+}
+
+// fillStore creates count nodes, a provisioning key and a webhook in s
+func fillStore(t *testing.T, s store.Store, count int) []*node.Node {
+	t.Helper()
+	var nodes []*node.Node
+	for i := 1; i <= count; i++ {
+		n := newTestNode(i)
+		if err := s.CreateNode(n); err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, n)
+	}
+	_, hash := provision.Generate()
+	if err := s.CreateProvisionKey(&provision.Key{Hash: hash, User: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	sub := &webhook.Subscription{URL: "https://example.com/hook", Secret: "secret"}
+	if err := s.CreateWebhook(sub); err != nil {
+		t.Fatal(err)
+	}
+	return nodes
+}
+
+func TestExportImport(t *testing.T) {
+	for _, tc := range []struct{ from, to string }{
+		{store.DriverBolt, store.DriverSQLite},
+		{store.DriverSQLite, store.DriverMemory},
+		{store.DriverMemory, store.DriverBolt},
+	} {
+		t.Run(tc.from+"-"+tc.to, func(t *testing.T) {
+			src := openTestStore(tc.from)(t)
+			nodes := fillStore(t, src, 3)
+
+			conf := &config.Config{
+				NetworkPrefix: testPrefix,
+				KeyExpiryDays: 30,
+				RateLimit:     config.RateLimitConfig{PerIPPerMinute: 60, PerIPBurst: 10},
+			}
+			e, err := store.ExportStore(src, conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(e.Users) != 2 || e.Users[0] != "alice" || e.Users[1] != "bob" {
+				t.Errorf("got users %v, expected [alice bob]", e.Users)
+			}
+
+			// Imports are read from a file
+			b, err := json.Marshal(e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e = &store.Export{}
+			if err = json.Unmarshal(b, e); err != nil {
+				t.Fatal(err)
+			}
+
+			if e.NetworkPrefix != testPrefix || *e.Settings != *store.ExportSettings(conf) {
+				t.Errorf("got prefix %s and settings %+v", e.NetworkPrefix, e.Settings)
+			}
+
+			dst := openTestStore(tc.to)(t)
+			result, err := store.Import(dst, e, testPrefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *result != (store.ImportResult{Nodes: 3, ProvisionKeys: 1, Webhooks: 1}) {
+				t.Errorf("got result %+v", result)
+			}
+
+			for _, want := range nodes {
+				got, err := dst.GetNodeByKey(want.NodeKey)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got.Name != want.Name || got.IP != want.IP || got.User != want.User {
+					t.Errorf("got node %+v, expected %+v", got, want)
+				}
+				if !got.CreatedAt.Equal(want.CreatedAt) {
+					t.Errorf("got created at %v, expected %v", got.CreatedAt, want.CreatedAt)
+				}
+				if got.Online {
+					t.Errorf("node %s was imported online", got.Name)
+				}
+			}
+			pks, err := dst.GetProvisionKeys()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(pks) != 1 || pks[0].Hash != e.ProvisionKeys[0].Hash {
+				t.Errorf("got provisioning keys %+v", pks)
+			}
+
+			// Importing again conflicts with everything already imported
+			if _, err = store.Import(dst, e, testPrefix); err == nil {
+				t.Error("expected error importing twice")
+			}
+		})
+	}
+}
+
+func TestImportValidate(t *testing.T) {
+	s := openTestStore(store.DriverMemory)(t)
+	existing := newTestNode(1)
+	if err := s.CreateNode(existing); err != nil {
+		t.Fatal(err)
+	}
+
+	dup := newTestNode(3)
+	dupKey := newTestNode(4)
+	dupKey.NodeKey = dup.NodeKey
+	tests := []struct {
+		name  string
+		nodes []*node.Node
+	}{
+		{"used ip", []*node.Node{newTestNode(1)}},
+		{"registered", []*node.Node{{NodeKey: existing.NodeKey, IP: newTestNode(2).IP}}},
+		{"outside prefix", []*node.Node{{
+			NodeKey: keys.NewPrivateKey().PublicKey(),
+			IP:      netip.MustParseAddr("100.71.0.1"),
+		}}},
+		{"network address", []*node.Node{{
+			NodeKey: keys.NewPrivateKey().PublicKey(),
+			IP:      testPrefix.Addr(),
+		}}},
+		{"duplicate ip", []*node.Node{newTestNode(2), newTestNode(2)}},
+		{"duplicate key", []*node.Node{dup, dupKey}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &store.Export{Version: store.ExportVersion}
+			for _, n := range tt.nodes {
+				e.Nodes = append(e.Nodes, *n)
+			}
+			if _, err := store.Import(s, e, testPrefix); err == nil {
+				t.Fatal("expected validation error")
+			}
+			nodes, err := s.GetNodes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(nodes) != 1 {
+				t.Errorf("got %d nodes after a failed import, expected 1", len(nodes))
+			}
+		})
+	}
+
+	// Every problem is reported together
+	e := &store.Export{Version: store.ExportVersion, Nodes: []node.Node{*newTestNode(1), {}}}
+	err := e.Validate(s, testPrefix)
+	if err == nil {
+		t.Fatal("expected validation error")
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); !ok || len(joined.Unwrap()) != 3 {
+		t.Errorf("got error %q, expected 3 problems", err)
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	for _, driver := range []string{store.DriverBolt, store.DriverSQLite} {
+		t.Run(driver, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "store.db")
+			s, err := store.Open(driver, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nodes := fillStore(t, s, 2)
+
+			f, err := os.Create(filepath.Join(dir, "backup.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			n, err := s.(store.Backuper).Backup(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = f.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if n == 0 {
+				t.Error("backup wrote no bytes")
+			}
+
+			// Changes after the backup are lost on restore
+			if err = s.CreateNode(newTestNode(10)); err != nil {
+				t.Fatal(err)
+			}
+			err = store.Restore(driver, f.Name(), path)
+			if !errors.Is(err, store.ErrStoreInUse) {
+				t.Errorf("got error %v restoring an open store, expected ErrStoreInUse", err)
+			}
+			if err = s.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if err = store.Restore(driver, f.Name(), path); err != nil {
+				t.Fatal(err)
+			}
+			s, err = store.Open(driver, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			got, err := s.GetNodes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(nodes) {
+				t.Errorf("got %d nodes after restore, expected %d", len(got), len(nodes))
+			}
+		})
+	}
+}
+
+func TestRestoreInvalidBackup(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "store.db")
+	s, err := store.Open(store.DriverBolt, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillStore(t, s, 1)
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	backup := filepath.Join(dir, "backup.db")
+	if err = os.WriteFile(backup, []byte("not a database"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Restore(store.DriverBolt, backup, path); err == nil {
+		t.Fatal("expected error restoring an invalid backup")
+	}
+
+	// The store is untouched
+	s, err = store.Open(store.DriverBolt, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	nodes, err := s.GetNodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 1 {
+		t.Errorf("got %d nodes, expected 1", len(nodes))
+	}
+}
@@ -0,0 +1,573 @@
+package store
+
+import (
+	"bytes"
+	"maps"
+	"net/netip"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/caldog20/calnet/control/server/internal/audit"
+	"github.com/caldog20/calnet/control/server/internal/node"
+	"github.com/caldog20/calnet/control/server/internal/provision"
+	"github.com/caldog20/calnet/control/server/internal/store"
+	"github.com/caldog20/calnet/control/server/internal/webhook"
+	"github.com/caldog20/calnet/pkg/keys"
+)
+
+// MemoryStore keeps everything in memory and loses it when the process exits.
+// It is used by tests and for ephemeral deployments. Objects are copied going in
+// and out of the store so callers can't modify stored state without an update.
+type MemoryStore struct {
+	mu sync.RWMutex
+	nodeWatchers
+	// now returns the time recorded by writes. The raft store replaces it so every
+	// replica records the time of the command instead of when it was applied.
+	now func() time.Time
+
+	nodes   map[uint64]*node.Node
+	nodeSeq uint64
+
+	auditEvents []audit.Event
+
+	webhooks   map[uint64]*webhook.Subscription
+	webhookSeq uint64
+	// The most recent maxWebhookDeliveries deliveries, oldest first
+	deliveries  []webhook.Delivery
+	deliverySeq uint64
+
+	provisionKeys   map[uint64]*provision.Key
+	provisionKeySeq uint64
+}
+
+func NewMemoryStore() *MemoryStore {
+	logger.Info("opened memory store")
+	return &MemoryStore{
+		now:           time.Now,
+		nodes:         make(map[uint64]*node.Node),
+		webhooks:      make(map[uint64]*webhook.Subscription),
+		provisionKeys: make(map[uint64]*provision.Key),
+	}
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+func cloneNode(n *node.Node) *node.Node {
+	c := *n
+	if n.Hostinfo != nil {
+		hi := *n.Hostinfo
+		hi.Routes = slices.Clone(n.Hostinfo.Routes)
+		c.Hostinfo = &hi
+	}
+	c.Tags = slices.Clone(n.Tags)
+	c.ApprovedRoutes = slices.Clone(n.ApprovedRoutes)
+	return &c
+}
+
+// sortedNodes returns copies of the stored nodes in ID order
+func (m *MemoryStore) sortedNodes() []node.Node {
+	nodes := make([]node.Node, 0, len(m.nodes))
+	for _, id := range slices.Sorted(maps.Keys(m.nodes)) {
+		nodes = append(nodes, *cloneNode(m.nodes[id]))
+	}
+	return nodes
+}
+
+func (m *MemoryStore) GetNodes() ([]node.Node, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.sortedNodes(), nil
+}
+
+func (m *MemoryStore) ListNodes(opts node.ListOptions) ([]node.Node, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var nodes []node.Node
+	now := time.Now()
+	for _, n := range m.sortedNodes() {
+		if opts.Match(&n, now) && opts.IsAfterCursor(&n) {
+			nodes = append(nodes, n)
+		}
+	}
+	return opts.Page(nodes), nil
+}
+
+func (m *MemoryStore) GetPeersOfNode(id uint64) ([]*node.Node, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if _, ok := m.nodes[id]; !ok {
+		return nil, ErrNodeNotFound
+	}
+	var peers []*node.Node
+	for _, n := range m.sortedNodes() {
+		if n.ID != id {
+			peers = append(peers, &n)
+		}
+	}
+	return peers, nil
+}
+
+// findNode returns a copy of the first node matching fn
+func (m *MemoryStore) findNode(fn func(n *node.Node) bool) (*node.Node, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, n := range m.nodes {
+		if fn(n) {
+			return cloneNode(n), nil
+		}
+	}
+	return nil, ErrNodeNotFound
+}
+
+func (m *MemoryStore) GetNodeByKey(key keys.PublicKey) (*node.Node, error) {
+	return m.findNode(func(n *node.Node) bool {
+		return n.NodeKey == key
+	})
+}
+
+func (m *MemoryStore) GetNodeByID(id uint64) (*node.Node, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	n, ok := m.nodes[id]
+	if !ok {
+		return nil, ErrNodeNotFound
+	}
+	return cloneNode(n), nil
+}
+
+func (m *MemoryStore) GetNodeByIP(ip netip.Addr) (*node.Node, error) {
+	return m.findNode(func(n *node.Node) bool {
+		return n.IP.IsValid() && n.IP == ip
+	})
+}
+
+// ipInUse reports whether ip is assigned to a node other than id
+func (m *MemoryStore) ipInUse(ip netip.Addr, id uint64) bool {
+	if !ip.IsValid() {
+		return false
+	}
+	for _, n := range m.nodes {
+		if n.ID != id && n.IP == ip {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MemoryStore) CreateNode(n *node.Node) error {
+	m.mu.Lock()
+	if m.ipInUse(n.IP, 0) {
+		m.mu.Unlock()
+		return ErrIPInUse
+	}
+	m.nodeSeq++
+	n.ID = m.nodeSeq
+	n.CreatedAt = m.now()
+	m.nodes[n.ID] = cloneNode(n)
+	m.mu.Unlock()
+
+	m.notify(store.NodeCreated, nil, n)
+	return nil
+}
+
+func (m *MemoryStore) DeleteNode(id uint64) error {
+	m.mu.Lock()
+	old, ok := m.nodes[id]
+	delete(m.nodes, id)
+	m.mu.Unlock()
+
+	if ok {
+		m.notify(store.NodeDeleted, old, nil)
+	}
+	return nil
+}
+
+func (m *MemoryStore) UpdateNode(n *node.Node) error {
+	m.mu.Lock()
+	old, ok := m.nodes[n.ID]
+	if !ok {
+		m.mu.Unlock()
+		return ErrNodeNotFound
+	}
+	if m.ipInUse(n.IP, n.ID) {
+		m.mu.Unlock()
+		return ErrIPInUse
+	}
+	n.UpdatedAt = m.now()
+	m.nodes[n.ID] = cloneNode(n)
+	m.mu.Unlock()
+
+	m.notify(store.NodeUpdated, old, n)
+	return nil
+}
+
+func (m *MemoryStore) SetNodePresence(id uint64, online bool) (*node.Node, error) {
+	m.mu.Lock()
+	old, ok := m.nodes[id]
+	if !ok {
+		m.mu.Unlock()
+		return nil, ErrNodeNotFound
+	}
+	n := cloneNode(old)
+	n.Online = online
+	n.UpdatedAt = m.now()
+	if online {
+		n.LastConnected = n.UpdatedAt
+	}
+	m.nodes[id] = n
+	m.mu.Unlock()
+
+	m.notify(store.NodeUpdated, old, n)
+	return cloneNode(n), nil
+}
+
+func (m *MemoryStore) ResetPresence() error {
+	m.mu.Lock()
+	var changes []store.NodeChange
+	for _, id := range slices.Sorted(maps.Keys(m.nodes)) {
+		old := m.nodes[id]
+		if !old.Online {
+			continue
+		}
+		n := cloneNode(old)
+		n.Online = false
+		n.UpdatedAt = m.now()
+		m.nodes[id] = n
+		changes = append(changes, store.NodeChange{Type: store.NodeUpdated, Old: old, New: n})
+	}
+	m.mu.Unlock()
+
+	for _, c := range changes {
+		m.notify(c.Type, c.Old, c.New)
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetAllocatedNodeIPs() ([]netip.Addr, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var ips []netip.Addr
+	for _, n := range m.nodes {
+		if n.IP.IsValid() {
+			ips = append(ips, n.IP)
+		}
+	}
+	return ips, nil
+}
+
+func cloneAuditEvent(e audit.Event) audit.Event {
+	e.Before = bytes.Clone(e.Before)
+	e.After = bytes.Clone(e.After)
+	return e
+}
+
+func (m *MemoryStore) AppendAuditEvent(event *audit.Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	event.ID = uint64(len(m.auditEvents)) + 1
+	if event.Time.IsZero() {
+		event.Time = m.now()
+	}
+	m.auditEvents = append(m.auditEvents, cloneAuditEvent(*event))
+	return nil
+}
+
+func (m *MemoryStore) GetAuditEvents(filter audit.Filter) ([]audit.Event, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var events []audit.Event
+	limit := filter.PageSize()
+	// Events are stored at index ID-1 so we can start directly after the cursor
+	start := min(filter.AfterID, uint64(len(m.auditEvents)))
+	for _, e := range m.auditEvents[start:] {
+		if !filter.Match(&e) {
+			continue
+		}
+		events = append(events, cloneAuditEvent(e))
+		if len(events) >= limit {
+			break
+		}
+	}
+	return events, nil
+}
+
+func cloneWebhook(sub *webhook.Subscription) *webhook.Subscription {
+	c := *sub
+	c.Events = slices.Clone(sub.Events)
+	return &c
+}
+
+func (m *MemoryStore) CreateWebhook(sub *webhook.Subscription) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.webhookSeq++
+	sub.ID = m.webhookSeq
+	sub.CreatedAt = m.now()
+	m.webhooks[sub.ID] = cloneWebhook(sub)
+	return nil
+}
+
+func (m *MemoryStore) GetWebhooks() ([]webhook.Subscription, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var subs []webhook.Subscription
+	for _, id := range slices.Sorted(maps.Keys(m.webhooks)) {
+		subs = append(subs, *cloneWebhook(m.webhooks[id]))
+	}
+	return subs, nil
+}
+
+func (m *MemoryStore) GetWebhookByID(id uint64) (*webhook.Subscription, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	sub, ok := m.webhooks[id]
+	if !ok {
+		return nil, ErrWebhookNotFound
+	}
+	return cloneWebhook(sub), nil
+}
+
+func (m *MemoryStore) DeleteWebhook(id uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.webhooks[id]; !ok {
+		return ErrWebhookNotFound
+	}
+	delete(m.webhooks, id)
+	return nil
+}
+
+func (m *MemoryStore) AppendWebhookDelivery(delivery *webhook.Delivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deliverySeq++
+	delivery.ID = m.deliverySeq
+	m.deliveries = append(m.deliveries, *delivery)
+	if len(m.deliveries) > maxWebhookDeliveries {
+		m.deliveries = slices.Delete(m.deliveries, 0, len(m.deliveries)-maxWebhookDeliveries)
+	}
+	return nil
+}
+
+// GetWebhookDeliveries returns up to limit deliveries for a subscription, newest first
+func (m *MemoryStore) GetWebhookDeliveries(
+	subscriptionID uint64,
+	limit int,
+) ([]webhook.Delivery, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var deliveries []webhook.Delivery
+	for _, d := range slices.Backward(m.deliveries) {
+		if d.SubscriptionID != subscriptionID {
+			continue
+		}
+		deliveries = append(deliveries, d)
+		if limit > 0 && len(deliveries) >= limit {
+			break
+		}
+	}
+	return deliveries, nil
+}
+
+func cloneProvisionKey(key *provision.Key) *provision.Key {
+	c := *key
+	c.Tags = slices.Clone(key.Tags)
+	return &c
+}
+
+func (m *MemoryStore) CreateProvisionKey(key *provision.Key) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.provisionKeySeq++
+	key.ID = m.provisionKeySeq
+	key.CreatedAt = m.now()
+	m.provisionKeys[key.ID] = cloneProvisionKey(key)
+	return nil
+}
+
+func (m *MemoryStore) GetProvisionKeys() ([]provision.Key, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var pks []provision.Key
+	for _, id := range slices.Sorted(maps.Keys(m.provisionKeys)) {
+		pks = append(pks, *cloneProvisionKey(m.provisionKeys[id]))
+	}
+	return pks, nil
+}
+
+func (m *MemoryStore) GetProvisionKeyByID(id uint64) (*provision.Key, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	pk, ok := m.provisionKeys[id]
+	if !ok {
+		return nil, ErrProvisionKeyNotFound
+	}
+	return cloneProvisionKey(pk), nil
+}
+
+func (m *MemoryStore) UpdateProvisionKey(key *provision.Key) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.provisionKeys[key.ID]; !ok {
+		return ErrProvisionKeyNotFound
+	}
+	m.provisionKeys[key.ID] = cloneProvisionKey(key)
+	return nil
+}
+
+func (m *MemoryStore) UseProvisionKey(hash string) (*provision.Key, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, pk := range m.provisionKeys {
+		if pk.Hash != hash {
+			continue
+		}
+		now := m.now()
+		if err := pk.Usable(now); err != nil {
+			return nil, err
+		}
+		pk.Uses++
+		pk.LastUsed = now
+		return cloneProvisionKey(pk), nil
+	}
+	return nil, ErrProvisionKeyNotFound
+}
+
+// Import checks every node IP before creating anything, so a failed import leaves
+// the store unchanged
+func (m *MemoryStore) Import(batch *store.ImportBatch) error {
+	m.mu.Lock()
+	ips := make(map[netip.Addr]bool)
+	for _, n := range batch.Nodes {
+		if m.ipInUse(n.IP, 0) || ips[n.IP] {
+			m.mu.Unlock()
+			return ErrIPInUse
+		}
+		if n.IP.IsValid() {
+			ips[n.IP] = true
+		}
+	}
+
+	now := m.now()
+	for i := range batch.Nodes {
+		n := &batch.Nodes[i]
+		m.nodeSeq++
+		n.ID = m.nodeSeq
+		if n.CreatedAt.IsZero() {
+			n.CreatedAt = now
+		}
+		m.nodes[n.ID] = cloneNode(n)
+	}
+	for i := range batch.ProvisionKeys {
+		key := &batch.ProvisionKeys[i]
+		m.provisionKeySeq++
+		key.ID = m.provisionKeySeq
+		if key.CreatedAt.IsZero() {
+			key.CreatedAt = now
+		}
+		m.provisionKeys[key.ID] = cloneProvisionKey(key)
+	}
+	for i := range batch.Webhooks {
+		sub := &batch.Webhooks[i]
+		m.webhookSeq++
+		sub.ID = m.webhookSeq
+		if sub.CreatedAt.IsZero() {
+			sub.CreatedAt = now
+		}
+		m.webhooks[sub.ID] = cloneWebhook(sub)
+	}
+	m.mu.Unlock()
+
+	for i := range batch.Nodes {
+		m.notify(store.NodeCreated, nil, &batch.Nodes[i])
+	}
+	return nil
+}
+
+// memoryState is a copy of everything in a MemoryStore, used for raft snapshots
+type memoryState struct {
+	Nodes           []node.Node            `json:"nodes"`
+	NodeSeq         uint64                 `json:"node_seq"`
+	AuditEvents     []audit.Event          `json:"audit_events"`
+	Webhooks        []webhook.Subscription `json:"webhooks"`
+	WebhookSeq      uint64                 `json:"webhook_seq"`
+	Deliveries      []webhook.Delivery     `json:"deliveries"`
+	DeliverySeq     uint64                 `json:"delivery_seq"`
+	ProvisionKeys   []provision.Key        `json:"provision_keys"`
+	ProvisionKeySeq uint64                 `json:"provision_key_seq"`
+}
+
+func (m *MemoryStore) state() *memoryState {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s := &memoryState{
+		Nodes:           m.sortedNodes(),
+		NodeSeq:         m.nodeSeq,
+		AuditEvents:     make([]audit.Event, len(m.auditEvents)),
+		WebhookSeq:      m.webhookSeq,
+		Deliveries:      slices.Clone(m.deliveries),
+		DeliverySeq:     m.deliverySeq,
+		ProvisionKeySeq: m.provisionKeySeq,
+	}
+	for i, e := range m.auditEvents {
+		s.AuditEvents[i] = cloneAuditEvent(e)
+	}
+	for _, id := range slices.Sorted(maps.Keys(m.webhooks)) {
+		s.Webhooks = append(s.Webhooks, *cloneWebhook(m.webhooks[id]))
+	}
+	for _, id := range slices.Sorted(maps.Keys(m.provisionKeys)) {
+		s.ProvisionKeys = append(s.ProvisionKeys, *cloneProvisionKey(m.provisionKeys[id]))
+	}
+	return s
+}
+
+// restore replaces everything in the store with s. Watchers are notified of
+// the difference between the old and new nodes as if each had been written.
+func (m *MemoryStore) restore(s *memoryState) {
+	nodes := make(map[uint64]*node.Node, len(s.Nodes))
+	for _, n := range s.Nodes {
+		nodes[n.ID] = cloneNode(&n)
+	}
+	webhooks := make(map[uint64]*webhook.Subscription, len(s.Webhooks))
+	for _, sub := range s.Webhooks {
+		webhooks[sub.ID] = cloneWebhook(&sub)
+	}
+	provisionKeys := make(map[uint64]*provision.Key, len(s.ProvisionKeys))
+	for _, pk := range s.ProvisionKeys {
+		provisionKeys[pk.ID] = cloneProvisionKey(&pk)
+	}
+
+	m.mu.Lock()
+	old := m.nodes
+	m.nodes = nodes
+	m.nodeSeq = s.NodeSeq
+	m.auditEvents = slices.Clone(s.AuditEvents)
+	m.webhooks = webhooks
+	m.webhookSeq = s.WebhookSeq
+	m.deliveries = slices.Clone(s.Deliveries)
+	m.deliverySeq = s.DeliverySeq
+	m.provisionKeys = provisionKeys
+	m.provisionKeySeq = s.ProvisionKeySeq
+	m.mu.Unlock()
+
+	for _, id := range slices.Sorted(maps.Keys(nodes)) {
+		switch before, ok := old[id]; {
+		case !ok:
+			m.notify(store.NodeCreated, nil, nodes[id])
+		case !reflect.DeepEqual(before, nodes[id]):
+			m.notify(store.NodeUpdated, before, nodes[id])
+		}
+	}
+	for _, id := range slices.Sorted(maps.Keys(old)) {
+		if _, ok := nodes[id]; !ok {
+			m.notify(store.NodeDeleted, old[id], nil)
+		}
+	}
+}
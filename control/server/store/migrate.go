@@ -0,0 +1,90 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrNewerSchema is returned when opening a database written by a newer server
+var ErrNewerSchema = errors.New("store schema is newer than this server supports")
+
+// Migration is an ordered schema change applied when a store is opened
+type Migration struct {
+	// Version is the schema version after the migration is applied
+	Version     int
+	Description string
+}
+
+// MigrationStatus describes the schema version of a store and the migrations
+// that were, or for a dry run would be, applied to bring it up to date
+type MigrationStatus struct {
+	Driver  string
+	Path    string
+	Current int
+	Latest  int
+	Pending []Migration
+}
+
+// newMigrationStatus returns the status of a database at version current, or
+// ErrNewerSchema if it is newer than the last of descriptions
+func newMigrationStatus(current int, descriptions []string) (*MigrationStatus, error) {
+	status := &MigrationStatus{Current: current, Latest: len(descriptions)}
+	if current > status.Latest {
+		return nil, fmt.Errorf(
+			"%w: database is version %d, the latest supported version is %d",
+			ErrNewerSchema,
+			current,
+			status.Latest,
+		)
+	}
+	for i := current; i < len(descriptions); i++ {
+		status.Pending = append(status.Pending, Migration{
+			Version:     i + 1,
+			Description: descriptions[i],
+		})
+	}
+	return status, nil
+}
+
+// Migrate brings the store at path up to date without starting the server. The
+// store must already exist. A dry run opens it read-only and reports the pending
+// migrations without writing anything.
+func Migrate(driver, path string, dryRun bool) (*MigrationStatus, error) {
+	var status *MigrationStatus
+	var err error
+	switch driver {
+	case DriverBolt, "":
+		driver = DriverBolt
+		if err = checkStoreExists(path); err != nil {
+			return nil, err
+		}
+		status, err = migrateBoltFile(path, dryRun)
+	case DriverSQLite:
+		if err = checkStoreExists(path); err != nil {
+			return nil, err
+		}
+		status, err = migrateSQLiteFile(path, dryRun)
+	case DriverMemory:
+		return nil, errors.New("memory store has no schema to migrate")
+	case DriverRaft:
+		return nil, errors.New("raft store is kept in the raft log and has no schema to migrate")
+	default:
+		return nil, fmt.Errorf("unknown store driver %q", driver)
+	}
+	if err != nil {
+		return nil, err
+	}
+	status.Driver = driver
+	status.Path = path
+	return status, nil
+}
+
+// checkStoreExists returns an error if there is no store file at path, opening
+// one would create it
+func checkStoreExists(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("error opening store: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caldog20/calnet/control/server/internal/node"
+	"github.com/caldog20/calnet/pkg/keys"
+	bolt "go.etcd.io/bbolt"
+)
+
+// newUnversionedBoltFile writes a database as created before schema versioning,
+// with a single node in the nodes bucket
+func newUnversionedBoltFile(t *testing.T) (string, *node.Node) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "store.db")
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	n := &node.Node{ID: 1, NodeKey: keys.NewPrivateKey().PublicKey()}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("nodes"))
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(n)
+		if err != nil {
+			return err
+		}
+		if _, err = b.NextSequence(); err != nil {
+			return err
+		}
+		return b.Put(itob(n.ID), data)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, n
+}
+
+func TestBoltMigrate(t *testing.T) {
+	path, n := newUnversionedBoltFile(t)
+
+	status, err := Migrate(DriverBolt, path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Current != 0 || status.Latest != len(boltMigrations) {
+		t.Errorf("got version %d latest %d, expected 0 and %d",
+			status.Current, status.Latest, len(boltMigrations))
+	}
+	if len(status.Pending) != len(boltMigrations) {
+		t.Errorf("got %d pending migrations, expected %d", len(status.Pending), len(boltMigrations))
+	}
+
+	// The dry run must not have changed anything
+	status, err = Migrate(DriverBolt, path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Current != 0 {
+		t.Errorf("got version %d after a dry run, expected 0", status.Current)
+	}
+
+	s, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.GetNodeByKey(n.NodeKey); err != nil || got.ID != n.ID {
+		t.Errorf("got node %v error %v after migrating, expected node %d", got, err, n.ID)
+	}
+	s.Close()
+
+	status, err = Migrate(DriverBolt, path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Current != status.Latest || len(status.Pending) != 0 {
+		t.Errorf("got status %+v after opening, expected no pending migrations", status)
+	}
+}
+
+func TestRefuseNewerSchema(t *testing.T) {
+	dir := t.TempDir()
+
+	boltPath := filepath.Join(dir, "store.db")
+	s, err := NewBoltStore(boltPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		version := itob(uint64(len(boltMigrations) + 1))
+		return tx.Bucket(metaBucket).Put(schemaVersionKey, version)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if _, err = NewBoltStore(boltPath); !errors.Is(err, ErrNewerSchema) {
+		t.Errorf("got error %v opening newer bolt store, expected ErrNewerSchema", err)
+	}
+
+	sqlitePath := filepath.Join(dir, "store.sqlite")
+	sq, err := NewSQLiteStore(sqlitePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = sq.db.Exec(`UPDATE schema_version SET version = ?`, len(sqliteMigrations)+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sq.Close()
+	if _, err = NewSQLiteStore(sqlitePath); !errors.Is(err, ErrNewerSchema) {
+		t.Errorf("got error %v opening newer sqlite store, expected ErrNewerSchema", err)
+	}
+	if _, err = Migrate(DriverSQLite, sqlitePath, true); !errors.Is(err, ErrNewerSchema) {
+		t.Errorf("got error %v migrating newer sqlite store, expected ErrNewerSchema", err)
+	}
+}
+
+func TestMigrateMissingStore(t *testing.T) {
+	for _, driver := range []string{DriverBolt, DriverSQLite} {
+		for _, dryRun := range []bool{true, false} {
+			path := filepath.Join(t.TempDir(), "store.db")
+			if _, err := Migrate(driver, path, dryRun); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("got error %v for missing %s store, expected ErrNotExist", err, driver)
+			}
+			if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("migrating a missing %s store left a file behind: %v", driver, err)
+			}
+		}
+	}
+}
+
+func TestSQLiteMigrateDryRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.sqlite")
+	db, err := openSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec(`CREATE TABLE unversioned (id INTEGER)`); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// The dry run reads the database without creating the schema_version table
+	for range 2 {
+		status, err := Migrate(DriverSQLite, path, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Current != 0 || len(status.Pending) != len(sqliteMigrations) {
+			t.Errorf("got status %+v, expected every migration pending", status)
+		}
+	}
+
+	status, err := Migrate(DriverSQLite, path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Pending) != len(sqliteMigrations) {
+		t.Errorf("got %d applied migrations, expected %d",
+			len(status.Pending), len(sqliteMigrations))
+	}
+	if status, err = Migrate(DriverSQLite, path, true); err != nil || len(status.Pending) != 0 {
+		t.Errorf("got status %+v error %v after migrating, expected none pending", status, err)
+	}
+}
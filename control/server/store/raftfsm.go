@@ -0,0 +1,298 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/caldog20/calnet/control/server/internal/audit"
+	"github.com/caldog20/calnet/control/server/internal/node"
+	"github.com/caldog20/calnet/control/server/internal/provision"
+	"github.com/caldog20/calnet/control/server/internal/store"
+	"github.com/caldog20/calnet/control/server/internal/webhook"
+	"github.com/hashicorp/raft"
+)
+
+type raftOp string
+
+const (
+	opCreateNode            raftOp = "create_node"
+	opUpdateNode            raftOp = "update_node"
+	opDeleteNode            raftOp = "delete_node"
+	opSetNodePresence       raftOp = "set_node_presence"
+	opResetPresence         raftOp = "reset_presence"
+	opAppendAuditEvent      raftOp = "append_audit_event"
+	opCreateWebhook         raftOp = "create_webhook"
+	opDeleteWebhook         raftOp = "delete_webhook"
+	opAppendWebhookDelivery raftOp = "append_webhook_delivery"
+	opCreateProvisionKey    raftOp = "create_provision_key"
+	opUpdateProvisionKey    raftOp = "update_provision_key"
+	opUseProvisionKey       raftOp = "use_provision_key"
+	opImport                raftOp = "import"
+)
+
+// raftCommand is a store write replicated in the raft log. Time is set when the
+// write is made so every replica records the same times. Server is the raft node
+// ID of the server a presence write is for.
+type raftCommand struct {
+	Op           raftOp                `json:"op"`
+	Time         time.Time             `json:"time"`
+	ID           uint64                `json:"id,omitempty"`
+	Hash         string                `json:"hash,omitempty"`
+	Online       bool                  `json:"online,omitempty"`
+	Server       string                `json:"server,omitempty"`
+	Node         *node.Node            `json:"node,omitempty"`
+	AuditEvent   *audit.Event          `json:"audit_event,omitempty"`
+	Webhook      *webhook.Subscription `json:"webhook,omitempty"`
+	Delivery     *webhook.Delivery     `json:"delivery,omitempty"`
+	ProvisionKey *provision.Key        `json:"provision_key,omitempty"`
+	Import       *store.ImportBatch    `json:"import,omitempty"`
+}
+
+// raftResult is the outcome of applying a command, the written object with the
+// fields the store sets, such as the ID, or the error
+type raftResult struct {
+	Node         *node.Node            `json:"node,omitempty"`
+	AuditEvent   *audit.Event          `json:"audit_event,omitempty"`
+	Webhook      *webhook.Subscription `json:"webhook,omitempty"`
+	Delivery     *webhook.Delivery     `json:"delivery,omitempty"`
+	ProvisionKey *provision.Key        `json:"provision_key,omitempty"`
+	Import       *store.ImportBatch    `json:"import,omitempty"`
+	Err          error                 `json:"-"`
+	// Err is sent to forwarding followers as its message
+	ErrMsg string `json:"error,omitempty"`
+}
+
+// raftErrors are the errors callers check for with errors.Is, so they are
+// restored from their message when they are forwarded from the leader
+var raftErrors = []error{
+	raft.ErrNotLeader,
+	ErrNodeNotFound,
+	ErrIPInUse,
+	ErrWebhookNotFound,
+	ErrProvisionKeyNotFound,
+	provision.ErrRevoked,
+	provision.ErrExpired,
+	provision.ErrUsed,
+}
+
+func decodeRaftError(msg string) error {
+	for _, err := range raftErrors {
+		if err.Error() == msg {
+			return err
+		}
+	}
+	return errors.New(msg)
+}
+
+// raftFSM applies committed commands to a memory store. Every replica applies
+// the same commands in the same order, so all of them hold the same state and
+// notify their own node watchers.
+type raftFSM struct {
+	mem *MemoryStore
+	// Time of the command being applied, the clock of mem
+	now time.Time
+	// Servers each node is polling, by node ID. Only used by Apply, Snapshot and
+	// Restore, which raft never calls concurrently.
+	presence map[uint64]map[string]struct{}
+
+	mu sync.Mutex
+	// Signalled when applied changes
+	cond    *sync.Cond
+	applied uint64
+}
+
+func newRaftFSM() *raftFSM {
+	f := &raftFSM{mem: NewMemoryStore(), presence: make(map[uint64]map[string]struct{})}
+	f.mem.now = func() time.Time { return f.now }
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+func (f *raftFSM) Apply(l *raft.Log) any {
+	defer f.setApplied(l.Index)
+
+	cmd := raftCommand{}
+	if err := json.Unmarshal(l.Data, &cmd); err != nil {
+		err = fmt.Errorf("error decoding raft command: %w", err)
+		return &raftResult{Err: err, ErrMsg: err.Error()}
+	}
+	f.now = cmd.Time
+
+	res := &raftResult{}
+	m := f.mem
+	switch cmd.Op {
+	case opCreateNode:
+		res.Node, res.Err = cmd.Node, m.CreateNode(cmd.Node)
+	case opUpdateNode:
+		res.Node, res.Err = cmd.Node, m.UpdateNode(cmd.Node)
+	case opDeleteNode:
+		res.Err = m.DeleteNode(cmd.ID)
+		delete(f.presence, cmd.ID)
+	case opSetNodePresence:
+		res.Node, res.Err = f.setPresence(cmd.ID, cmd.Server, cmd.Online)
+	case opResetPresence:
+		res.Err = f.resetPresence(cmd.Server)
+	case opAppendAuditEvent:
+		res.AuditEvent, res.Err = cmd.AuditEvent, m.AppendAuditEvent(cmd.AuditEvent)
+	case opCreateWebhook:
+		res.Webhook, res.Err = cmd.Webhook, m.CreateWebhook(cmd.Webhook)
+	case opDeleteWebhook:
+		res.Err = m.DeleteWebhook(cmd.ID)
+	case opAppendWebhookDelivery:
+		res.Delivery, res.Err = cmd.Delivery, m.AppendWebhookDelivery(cmd.Delivery)
+	case opCreateProvisionKey:
+		res.ProvisionKey, res.Err = cmd.ProvisionKey, m.CreateProvisionKey(cmd.ProvisionKey)
+	case opUpdateProvisionKey:
+		res.ProvisionKey, res.Err = cmd.ProvisionKey, m.UpdateProvisionKey(cmd.ProvisionKey)
+	case opUseProvisionKey:
+		res.ProvisionKey, res.Err = m.UseProvisionKey(cmd.Hash)
+	case opImport:
+		res.Import, res.Err = cmd.Import, m.Import(cmd.Import)
+	default:
+		res.Err = fmt.Errorf("unknown raft command %q", cmd.Op)
+	}
+	if res.Err != nil {
+		res.ErrMsg = res.Err.Error()
+	}
+	return res
+}
+
+// setPresence records whether the node is polling server. The node stays online
+// while it is polling any server, so a server it went away from doesn't mark it
+// offline while another server is still serving its polls.
+func (f *raftFSM) setPresence(id uint64, server string, online bool) (*node.Node, error) {
+	if _, err := f.mem.GetNodeByID(id); err != nil {
+		return nil, err
+	}
+	servers := f.presence[id]
+	if online {
+		if servers == nil {
+			servers = make(map[string]struct{})
+			f.presence[id] = servers
+		}
+		servers[server] = struct{}{}
+	} else {
+		delete(servers, server)
+		if len(servers) > 0 {
+			return f.mem.GetNodeByID(id)
+		}
+		delete(f.presence, id)
+	}
+	return f.mem.SetNodePresence(id, online)
+}
+
+// resetPresence removes server from the servers every node is polling. Nodes that
+// are online without any server recorded were left online by a release that
+// didn't track presence per server, and are marked offline too.
+func (f *raftFSM) resetPresence(server string) error {
+	nodes, err := f.mem.GetNodes()
+	if err != nil {
+		return err
+	}
+	for _, n := range nodes {
+		servers, tracked := f.presence[n.ID]
+		_, polling := servers[server]
+		if !polling && (tracked || !n.Online) {
+			continue
+		}
+		if _, err = f.setPresence(n.ID, server, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *raftFSM) setApplied(index uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.applied = index
+	f.cond.Broadcast()
+}
+
+// waitApplied waits until the log at index has been applied, so a follower can
+// read its own forwarded writes
+func (f *raftFSM) waitApplied(index uint64, timeout time.Duration) error {
+	timer := time.AfterFunc(timeout, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.cond.Broadcast()
+	})
+	defer timer.Stop()
+
+	deadline := time.Now().Add(timeout)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for f.applied < index {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for raft log %d to be applied", index)
+		}
+		f.cond.Wait()
+	}
+	return nil
+}
+
+// raftSnapshotState is written to raft snapshots. Index is the last log applied
+// to State, which a restored replica continues from.
+type raftSnapshotState struct {
+	Index uint64       `json:"index"`
+	State *memoryState `json:"state"`
+	// Raft node IDs of the servers each node is polling, by node ID
+	Presence map[uint64][]string `json:"presence,omitempty"`
+}
+
+type raftSnapshot struct {
+	state raftSnapshotState
+}
+
+// Snapshot is called between calls to Apply, so the state is consistent with applied
+func (f *raftFSM) Snapshot() (raft.FSMSnapshot, error) {
+	f.mu.Lock()
+	index := f.applied
+	f.mu.Unlock()
+	presence := make(map[uint64][]string, len(f.presence))
+	for id, servers := range f.presence {
+		presence[id] = slices.Sorted(maps.Keys(servers))
+	}
+	return &raftSnapshot{state: raftSnapshotState{
+		Index:    index,
+		State:    f.mem.state(),
+		Presence: presence,
+	}}, nil
+}
+
+func (f *raftFSM) Restore(r io.ReadCloser) error {
+	defer r.Close()
+	s := raftSnapshotState{}
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return fmt.Errorf("error decoding raft snapshot: %w", err)
+	}
+	if s.State == nil {
+		return errors.New("raft snapshot has no state")
+	}
+	f.presence = make(map[uint64]map[string]struct{}, len(s.Presence))
+	for id, servers := range s.Presence {
+		f.presence[id] = make(map[string]struct{}, len(servers))
+		for _, server := range servers {
+			f.presence[id][server] = struct{}{}
+		}
+	}
+	f.mem.restore(s.State)
+	f.setApplied(s.Index)
+	return nil
+}
+
+func (s *raftSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(s.state); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *raftSnapshot) Release() {}
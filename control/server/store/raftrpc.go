@@ -0,0 +1,254 @@
+package store
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/caldog20/calnet/control/server/logging"
+	"github.com/hashicorp/raft"
+)
+
+// Connections to the raft address start with a byte selecting the protocol, so
+// raft and forwarded writes share one listener
+const (
+	rpcRaft    byte = 1
+	rpcForward byte = 2
+)
+
+// raftRPCTimeout bounds reading the protocol byte, authenticating and a forwarded write
+const raftRPCTimeout = time.Second * 10
+
+// After the protocol byte the server sends a random challenge, and the client
+// answers with the HMAC-SHA256 of the protocol byte and the challenge keyed with
+// the cluster secret. The secret itself is never sent, and an answer can't be
+// replayed on another connection.
+const raftChallengeSize = 32
+
+// raftAuth returns the answer to challenge for a connection of protocol rpc
+func raftAuth(secret []byte, rpc byte, challenge []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte{rpc})
+	mac.Write(challenge)
+	return mac.Sum(nil)
+}
+
+// forwardRequest is a write sent by a follower to the leader
+type forwardRequest struct {
+	Command json.RawMessage `json:"command"`
+}
+
+// forwardResponse is the result of a forwarded write and the index of its log,
+// which the follower waits to apply before returning so it can read the write
+type forwardResponse struct {
+	Index  uint64      `json:"index"`
+	Result *raftResult `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// raftMux accepts connections on the raft address and hands raft connections to
+// the raft transport through its stream layer and forwarded writes to forward
+type raftMux struct {
+	ln        net.Listener
+	secret    []byte
+	raftConns chan net.Conn
+	forward   func(req *forwardRequest) *forwardResponse
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newRaftMux(
+	address, secret string,
+	forward func(*forwardRequest) *forwardResponse,
+) (*raftMux, error) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	m := &raftMux{
+		ln:        ln,
+		secret:    []byte(secret),
+		raftConns: make(chan net.Conn),
+		forward:   forward,
+		closed:    make(chan struct{}),
+	}
+	go m.serve()
+	return m, nil
+}
+
+func (m *raftMux) serve() {
+	for {
+		conn, err := m.ln.Accept()
+		if err != nil {
+			select {
+			case <-m.closed:
+			default:
+				logger.Error("error accepting raft connection", logging.Err(err))
+			}
+			return
+		}
+		go m.handle(conn)
+	}
+}
+
+func (m *raftMux) handle(conn net.Conn) {
+	b := make([]byte, 1)
+	conn.SetDeadline(time.Now().Add(raftRPCTimeout))
+	if _, err := conn.Read(b); err != nil {
+		conn.Close()
+		return
+	}
+	if !m.authenticate(conn, b[0]) {
+		logger.Warn("rejected unauthenticated raft connection", "remote", conn.RemoteAddr().String())
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	switch b[0] {
+	case rpcRaft:
+		select {
+		case m.raftConns <- conn:
+		case <-m.closed:
+			conn.Close()
+		}
+	case rpcForward:
+		m.handleForward(conn)
+	default:
+		logger.Warn("unknown raft rpc type", "type", b[0], "remote", conn.RemoteAddr().String())
+		conn.Close()
+	}
+}
+
+// authenticate challenges conn and reports whether it answered with the cluster secret
+func (m *raftMux) authenticate(conn net.Conn, rpc byte) bool {
+	challenge := make([]byte, raftChallengeSize)
+	if _, err := rand.Read(challenge); err != nil {
+		return false
+	}
+	if _, err := conn.Write(challenge); err != nil {
+		return false
+	}
+	answer := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		return false
+	}
+	return hmac.Equal(answer, raftAuth(m.secret, rpc, challenge))
+}
+
+// dialRaft connects to the raft address of another server and authenticates a
+// connection of protocol rpc with the cluster secret
+func dialRaft(
+	address raft.ServerAddress,
+	secret []byte,
+	rpc byte,
+	timeout time.Duration,
+) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", string(address), timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	challenge := make([]byte, raftChallengeSize)
+	if _, err = conn.Write([]byte{rpc}); err == nil {
+		if _, err = io.ReadFull(conn, challenge); err == nil {
+			_, err = conn.Write(raftAuth(secret, rpc, challenge))
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (m *raftMux) handleForward(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(raftRPCTimeout))
+	req := &forwardRequest{}
+	if err := json.NewDecoder(conn).Decode(req); err != nil {
+		logger.Warn("error decoding forwarded raft write", logging.Err(err))
+		return
+	}
+	if err := json.NewEncoder(conn).Encode(m.forward(req)); err != nil {
+		logger.Warn("error writing forwarded raft write response", logging.Err(err))
+	}
+}
+
+func (m *raftMux) Close() error {
+	var err error
+	m.closeOnce.Do(func() {
+		close(m.closed)
+		err = m.ln.Close()
+	})
+	return err
+}
+
+// forwardTo sends a write to the leader at address
+func forwardTo(
+	address raft.ServerAddress,
+	secret []byte,
+	req *forwardRequest,
+) (*forwardResponse, error) {
+	conn, err := dialRaft(address, secret, rpcForward, raftRPCTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(raftRPCTimeout))
+
+	if err = json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+	resp := &forwardResponse{}
+	if err = json.NewDecoder(conn).Decode(resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, decodeRaftError(resp.Error)
+	}
+	if resp.Result == nil {
+		return nil, errors.New("forwarded raft write returned no result")
+	}
+	resp.Result.Err = nil
+	if resp.Result.ErrMsg != "" {
+		resp.Result.Err = decodeRaftError(resp.Result.ErrMsg)
+	}
+	return resp, nil
+}
+
+// raftStreamLayer is the raft.StreamLayer of a raftMux. The listener may be bound
+// to every interface, so the address other servers reach it at is advertised.
+type raftStreamLayer struct {
+	mux       *raftMux
+	advertise net.Addr
+}
+
+func (s raftStreamLayer) Accept() (net.Conn, error) {
+	select {
+	case conn := <-s.mux.raftConns:
+		return conn, nil
+	case <-s.mux.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s raftStreamLayer) Close() error {
+	return s.mux.Close()
+}
+
+func (s raftStreamLayer) Addr() net.Addr {
+	return s.advertise
+}
+
+func (s raftStreamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	return dialRaft(address, s.mux.secret, rpcRaft, timeout)
+}
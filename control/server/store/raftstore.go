@@ -0,0 +1,444 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/caldog20/calnet/control/server/config"
+	"github.com/caldog20/calnet/control/server/internal/audit"
+	"github.com/caldog20/calnet/control/server/internal/node"
+	"github.com/caldog20/calnet/control/server/internal/provision"
+	"github.com/caldog20/calnet/control/server/internal/store"
+	"github.com/caldog20/calnet/control/server/internal/webhook"
+	"github.com/caldog20/calnet/pkg/keys"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+)
+
+const (
+	// How long a write waits for a leader and for its log to be applied
+	raftApplyTimeout = time.Second * 10
+	// How often a write retries while there is no leader to send it to
+	raftRetryInterval  = time.Millisecond * 100
+	raftSnapshotRetain = 2
+)
+
+// raftConfigHook adjusts the raft config before raft starts, tests use it to
+// shorten the timeouts
+var raftConfigHook func(*raft.Config)
+
+// ErrNoLeader is returned for a write made while the raft cluster has no leader
+var ErrNoLeader = errors.New("raft cluster has no leader")
+
+// RaftStore replicates the store between control servers with raft. Writes are
+// applied by the leader, a follower forwards its writes to the leader and waits
+// until it has applied them itself, so a server always reads its own writes.
+// Reads are served by every server from its own copy of the state, and every
+// server notifies its node watchers as changes are applied, so any of them can
+// serve /poll.
+type RaftStore struct {
+	// Raft node ID of this server
+	id        string
+	raft      *raft.Raft
+	fsm       *raftFSM
+	logs      *raftLogStore
+	mux       *raftMux
+	transport *raft.NetworkTransport
+}
+
+// NewRaftStore starts this server as the member conf.NodeID of a raft cluster,
+// bootstrapping the cluster from conf.Peers if it has no existing state
+func NewRaftStore(conf config.RaftConfig) (*RaftStore, error) {
+	advertise, ok := conf.Peers[conf.NodeID]
+	if conf.NodeID == "" || !ok {
+		return nil, fmt.Errorf("raft node id %q must be one of the raft peers", conf.NodeID)
+	}
+	advertiseAddr, err := net.ResolveTCPAddr("tcp", advertise)
+	if err != nil {
+		return nil, fmt.Errorf("invalid raft address for %s: %w", conf.NodeID, err)
+	}
+	if conf.Dir == "" {
+		return nil, errors.New("raft dir must be set")
+	}
+	if conf.Secret == "" {
+		return nil, errors.New("raft secret must be set")
+	}
+	if err = os.MkdirAll(conf.Dir, 0700); err != nil {
+		return nil, err
+	}
+	bind := conf.Address
+	if bind == "" {
+		bind = advertise
+	}
+
+	hlog := newRaftLogger()
+	s := &RaftStore{id: conf.NodeID, fsm: newRaftFSM()}
+	if s.logs, err = newRaftLogStore(filepath.Join(conf.Dir, "raft.db")); err != nil {
+		return nil, err
+	}
+	snaps, err := raft.NewFileSnapshotStoreWithLogger(conf.Dir, raftSnapshotRetain, hlog)
+	if err != nil {
+		s.logs.Close()
+		return nil, err
+	}
+	if s.mux, err = newRaftMux(bind, conf.Secret, s.handleForward); err != nil {
+		s.logs.Close()
+		return nil, err
+	}
+	s.transport = raft.NewNetworkTransportWithConfig(&raft.NetworkTransportConfig{
+		Stream:  raftStreamLayer{mux: s.mux, advertise: advertiseAddr},
+		MaxPool: 3,
+		Timeout: raftRPCTimeout,
+		Logger:  hlog,
+	})
+
+	rc := raft.DefaultConfig()
+	rc.LocalID = raft.ServerID(conf.NodeID)
+	rc.Logger = hlog
+	if raftConfigHook != nil {
+		raftConfigHook(rc)
+	}
+
+	existing, err := raft.HasExistingState(s.logs, s.logs, snaps)
+	if err == nil && !existing {
+		configuration := raft.Configuration{}
+		for _, id := range slices.Sorted(maps.Keys(conf.Peers)) {
+			configuration.Servers = append(configuration.Servers, raft.Server{
+				Suffrage: raft.Voter,
+				ID:       raft.ServerID(id),
+				Address:  raft.ServerAddress(conf.Peers[id]),
+			})
+		}
+		err = raft.BootstrapCluster(rc, s.logs, s.logs, snaps, s.transport, configuration)
+		if err == nil {
+			logger.Info("bootstrapped raft cluster", "servers", len(configuration.Servers))
+		}
+	}
+	if err == nil {
+		s.raft, err = raft.NewRaft(rc, s.fsm, s.logs, s.logs, snaps, s.transport)
+	}
+	if err != nil {
+		s.transport.Close()
+		s.logs.Close()
+		return nil, err
+	}
+
+	logger.Info("opened raft store", "node_id", conf.NodeID, "address", advertise, "dir", conf.Dir)
+	return s, nil
+}
+
+func (s *RaftStore) Close() error {
+	err := s.raft.Shutdown().Error()
+	return errors.Join(err, s.transport.Close(), s.logs.Close())
+}
+
+// IsLeader reports whether this server is the raft leader
+func (s *RaftStore) IsLeader() bool {
+	return s.raft.State() == raft.Leader
+}
+
+// Leader returns the node ID and raft address of the current leader, or empty
+// strings if there is none
+func (s *RaftStore) Leader() (id, address string) {
+	addr, leaderID := s.raft.LeaderWithID()
+	return string(leaderID), string(addr)
+}
+
+// apply writes cmd through the leader and returns the result once this server has
+// applied it. Writes are retried while there is no leader to accept them.
+func (s *RaftStore) apply(cmd *raftCommand) (*raftResult, error) {
+	cmd.Time = time.Now()
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(raftApplyTimeout)
+	for {
+		var res *raftResult
+		if s.IsLeader() {
+			res, _, err = s.applyLocal(data)
+		} else {
+			res, err = s.forward(data)
+		}
+		if err == nil {
+			return res, res.Err
+		}
+		if !retryRaftWrite(err) || time.Now().After(deadline) {
+			return nil, err
+		}
+		time.Sleep(raftRetryInterval)
+	}
+}
+
+// retryRaftWrite reports whether a write failed before it reached the raft log,
+// so it can't have been applied and is safe to send again
+func retryRaftWrite(err error) bool {
+	var opErr *net.OpError
+	return errors.Is(err, ErrNoLeader) ||
+		errors.Is(err, raft.ErrNotLeader) ||
+		(errors.As(err, &opErr) && opErr.Op == "dial")
+}
+
+func (s *RaftStore) applyLocal(data []byte) (*raftResult, uint64, error) {
+	f := s.raft.Apply(data, raftApplyTimeout)
+	if err := f.Error(); err != nil {
+		return nil, 0, err
+	}
+	return f.Response().(*raftResult), f.Index(), nil
+}
+
+func (s *RaftStore) forward(data []byte) (*raftResult, error) {
+	addr, _ := s.raft.LeaderWithID()
+	if addr == "" {
+		return nil, ErrNoLeader
+	}
+	resp, err := forwardTo(addr, s.mux.secret, &forwardRequest{Command: data})
+	if err != nil {
+		return nil, fmt.Errorf("error forwarding write to raft leader %s: %w", addr, err)
+	}
+	if err = s.fsm.waitApplied(resp.Index, raftApplyTimeout); err != nil {
+		return nil, err
+	}
+	return resp.Result, nil
+}
+
+// handleForward applies a write forwarded by a follower
+func (s *RaftStore) handleForward(req *forwardRequest) *forwardResponse {
+	res, index, err := s.applyLocal(req.Command)
+	if err != nil {
+		return &forwardResponse{Error: err.Error()}
+	}
+	return &forwardResponse{Index: index, Result: res}
+}
+
+func (s *RaftStore) GetNodes() ([]node.Node, error) {
+	return s.fsm.mem.GetNodes()
+}
+
+func (s *RaftStore) ListNodes(opts node.ListOptions) ([]node.Node, error) {
+	return s.fsm.mem.ListNodes(opts)
+}
+
+func (s *RaftStore) GetPeersOfNode(id uint64) ([]*node.Node, error) {
+	return s.fsm.mem.GetPeersOfNode(id)
+}
+
+func (s *RaftStore) GetNodeByKey(key keys.PublicKey) (*node.Node, error) {
+	return s.fsm.mem.GetNodeByKey(key)
+}
+
+func (s *RaftStore) GetNodeByID(id uint64) (*node.Node, error) {
+	return s.fsm.mem.GetNodeByID(id)
+}
+
+func (s *RaftStore) GetNodeByIP(ip netip.Addr) (*node.Node, error) {
+	return s.fsm.mem.GetNodeByIP(ip)
+}
+
+func (s *RaftStore) GetAllocatedNodeIPs() ([]netip.Addr, error) {
+	return s.fsm.mem.GetAllocatedNodeIPs()
+}
+
+func (s *RaftStore) CreateNode(n *node.Node) error {
+	res, err := s.apply(&raftCommand{Op: opCreateNode, Node: n})
+	if err != nil {
+		return err
+	}
+	*n = *res.Node
+	return nil
+}
+
+func (s *RaftStore) UpdateNode(n *node.Node) error {
+	res, err := s.apply(&raftCommand{Op: opUpdateNode, Node: n})
+	if err != nil {
+		return err
+	}
+	*n = *res.Node
+	return nil
+}
+
+func (s *RaftStore) DeleteNode(id uint64) error {
+	_, err := s.apply(&raftCommand{Op: opDeleteNode, ID: id})
+	return err
+}
+
+// SetNodePresence records presence for this server, the node stays online while
+// it is polling another server
+func (s *RaftStore) SetNodePresence(id uint64, online bool) (*node.Node, error) {
+	res, err := s.apply(
+		&raftCommand{Op: opSetNodePresence, ID: id, Online: online, Server: s.id},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return res.Node, nil
+}
+
+// ResetPresence only marks offline the nodes that were polling this server, so a
+// restarting server leaves the nodes polling the others online
+func (s *RaftStore) ResetPresence() error {
+	_, err := s.apply(&raftCommand{Op: opResetPresence, Server: s.id})
+	return err
+}
+
+func (s *RaftStore) WatchNodes(fn func(store.NodeChange)) (stop func()) {
+	return s.fsm.mem.WatchNodes(fn)
+}
+
+func (s *RaftStore) AppendAuditEvent(event *audit.Event) error {
+	res, err := s.apply(&raftCommand{Op: opAppendAuditEvent, AuditEvent: event})
+	if err != nil {
+		return err
+	}
+	*event = *res.AuditEvent
+	return nil
+}
+
+func (s *RaftStore) GetAuditEvents(filter audit.Filter) ([]audit.Event, error) {
+	return s.fsm.mem.GetAuditEvents(filter)
+}
+
+func (s *RaftStore) CreateWebhook(sub *webhook.Subscription) error {
+	res, err := s.apply(&raftCommand{Op: opCreateWebhook, Webhook: sub})
+	if err != nil {
+		return err
+	}
+	*sub = *res.Webhook
+	return nil
+}
+
+func (s *RaftStore) GetWebhooks() ([]webhook.Subscription, error) {
+	return s.fsm.mem.GetWebhooks()
+}
+
+func (s *RaftStore) GetWebhookByID(id uint64) (*webhook.Subscription, error) {
+	return s.fsm.mem.GetWebhookByID(id)
+}
+
+func (s *RaftStore) DeleteWebhook(id uint64) error {
+	_, err := s.apply(&raftCommand{Op: opDeleteWebhook, ID: id})
+	return err
+}
+
+func (s *RaftStore) AppendWebhookDelivery(delivery *webhook.Delivery) error {
+	res, err := s.apply(&raftCommand{Op: opAppendWebhookDelivery, Delivery: delivery})
+	if err != nil {
+		return err
+	}
+	*delivery = *res.Delivery
+	return nil
+}
+
+func (s *RaftStore) GetWebhookDeliveries(
+	subscriptionID uint64,
+	limit int,
+) ([]webhook.Delivery, error) {
+	return s.fsm.mem.GetWebhookDeliveries(subscriptionID, limit)
+}
+
+func (s *RaftStore) CreateProvisionKey(key *provision.Key) error {
+	res, err := s.apply(&raftCommand{Op: opCreateProvisionKey, ProvisionKey: key})
+	if err != nil {
+		return err
+	}
+	*key = *res.ProvisionKey
+	return nil
+}
+
+func (s *RaftStore) GetProvisionKeys() ([]provision.Key, error) {
+	return s.fsm.mem.GetProvisionKeys()
+}
+
+func (s *RaftStore) GetProvisionKeyByID(id uint64) (*provision.Key, error) {
+	return s.fsm.mem.GetProvisionKeyByID(id)
+}
+
+func (s *RaftStore) UpdateProvisionKey(key *provision.Key) error {
+	res, err := s.apply(&raftCommand{Op: opUpdateProvisionKey, ProvisionKey: key})
+	if err != nil {
+		return err
+	}
+	*key = *res.ProvisionKey
+	return nil
+}
+
+// UseProvisionKey checks and records the use in the leader's apply of the command,
+// so a single-use key can't register a node on two servers at once
+func (s *RaftStore) UseProvisionKey(hash string) (*provision.Key, error) {
+	res, err := s.apply(&raftCommand{Op: opUseProvisionKey, Hash: hash})
+	if err != nil {
+		return nil, err
+	}
+	return res.ProvisionKey, nil
+}
+
+// Import is applied as a single raft command, so every replica creates all of the
+// batch or none of it
+func (s *RaftStore) Import(batch *store.ImportBatch) error {
+	res, err := s.apply(&raftCommand{Op: opImport, Import: batch})
+	if err != nil {
+		return err
+	}
+	*batch = *res.Import
+	return nil
+}
+
+// newRaftLogger returns an hclog logger for raft that writes to the store logger
+func newRaftLogger() hclog.Logger {
+	level := hclog.Info
+	if logger.Enabled(context.Background(), slog.LevelDebug) {
+		level = hclog.Debug
+	}
+	return hclog.New(&hclog.LoggerOptions{
+		Name:       "raft",
+		Level:      level,
+		Output:     raftLogWriter{},
+		JSONFormat: true,
+	})
+}
+
+// raftLogWriter decodes the JSON lines written by hclog and logs them with slog
+type raftLogWriter struct{}
+
+func (raftLogWriter) Write(p []byte) (int, error) {
+	for _, line := range bytes.SplitAfter(p, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		fields := make(map[string]any)
+		if err := json.Unmarshal(line, &fields); err != nil {
+			logger.Info(string(bytes.TrimSpace(line)), "component", "raft")
+			continue
+		}
+		level := slog.LevelInfo
+		switch fields["@level"] {
+		case "trace", "debug":
+			level = slog.LevelDebug
+		case "warn":
+			level = slog.LevelWarn
+		case "error":
+			level = slog.LevelError
+		}
+		msg, _ := fields["@message"].(string)
+		args := []any{"component", "raft"}
+		for _, k := range slices.Sorted(maps.Keys(fields)) {
+			if k[0] != '@' {
+				args = append(args, k, fields[k])
+			}
+		}
+		logger.Log(context.Background(), level, msg, args...)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,360 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caldog20/calnet/control/server/config"
+	"github.com/caldog20/calnet/control/server/internal/node"
+	"github.com/caldog20/calnet/control/server/internal/provision"
+	internalstore "github.com/caldog20/calnet/control/server/internal/store"
+	"github.com/caldog20/calnet/pkg/keys"
+	"github.com/hashicorp/raft"
+)
+
+const testRaftSecret = "raft cluster test secret"
+
+func init() {
+	// Elect leaders in milliseconds instead of seconds
+	raftConfigHook = func(c *raft.Config) {
+		c.HeartbeatTimeout = time.Millisecond * 50
+		c.ElectionTimeout = time.Millisecond * 50
+		c.LeaderLeaseTimeout = time.Millisecond * 50
+		c.CommitTimeout = time.Millisecond * 5
+	}
+}
+
+// newTestRaftCluster starts a cluster of n raft stores on loopback addresses and
+// waits for it to elect a leader
+func newTestRaftCluster(t *testing.T, n int) []*RaftStore {
+	t.Helper()
+	peers := make(map[string]string)
+	for i := range n {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		peers[fmt.Sprintf("node%d", i)] = ln.Addr().String()
+		ln.Close()
+	}
+
+	stores := make([]*RaftStore, n)
+	for i := range n {
+		s, err := NewRaftStore(config.RaftConfig{
+			NodeID: fmt.Sprintf("node%d", i),
+			Dir:    filepath.Join(t.TempDir(), "raft"),
+			Secret: testRaftSecret,
+			Peers:  peers,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		stores[i] = s
+	}
+	waitRaftLeader(t, stores)
+	return stores
+}
+
+// waitRaftLeader waits until every store agrees on a leader and returns it
+func waitRaftLeader(t *testing.T, stores []*RaftStore) *RaftStore {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 10)
+	for time.Now().Before(deadline) {
+		var leader *RaftStore
+		_, first := stores[0].Leader()
+		agreed := first != ""
+		for _, s := range stores {
+			if _, addr := s.Leader(); addr != first {
+				agreed = false
+			}
+			if s.IsLeader() {
+				leader = s
+			}
+		}
+		if agreed && leader != nil {
+			return leader
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatal("raft cluster did not elect a leader")
+	return nil
+}
+
+func raftFollowers(stores []*RaftStore) []*RaftStore {
+	var followers []*RaftStore
+	for _, s := range stores {
+		if !s.IsLeader() {
+			followers = append(followers, s)
+		}
+	}
+	return followers
+}
+
+// waitFor polls cond until it's true or fails the test after a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 5)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestRaftCluster(t *testing.T) {
+	stores := newTestRaftCluster(t, 3)
+
+	var mu sync.Mutex
+	created := make(map[int]uint64)
+	for i, s := range stores {
+		s.WatchNodes(func(c internalstore.NodeChange) {
+			if c.Type == internalstore.NodeCreated {
+				mu.Lock()
+				defer mu.Unlock()
+				created[i] = c.ID()
+			}
+		})
+	}
+
+	// A write on a follower is forwarded to the leader and readable on the
+	// follower as soon as it returns
+	follower := raftFollowers(stores)[0]
+	n := &node.Node{
+		NodeKey: keys.NewPrivateKey().PublicKey(),
+		IP:      netip.MustParseAddr("100.70.0.1"),
+	}
+	if err := follower.CreateNode(n); err != nil {
+		t.Fatal(err)
+	}
+	if n.ID == 0 || n.CreatedAt.IsZero() {
+		t.Fatalf("forwarded create didn't return the stored node: %+v", n)
+	}
+	if _, err := follower.GetNodeByID(n.ID); err != nil {
+		t.Fatalf("follower can't read its own write: %v", err)
+	}
+
+	// Every replica notifies its own watchers
+	waitFor(t, "every replica to notify the new node", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(created) == len(stores)
+	})
+	for i, id := range created {
+		if id != n.ID {
+			t.Errorf("store %d notified node %d, expected %d", i, id, n.ID)
+		}
+	}
+
+	// Store errors survive forwarding
+	err := follower.UpdateNode(&node.Node{ID: 1000})
+	if !errors.Is(err, ErrNodeNotFound) {
+		t.Fatalf("got error %v updating missing node on a follower, expected ErrNodeNotFound", err)
+	}
+
+	// A single use key is only used once however many servers use it at once
+	key := &provision.Key{Hash: "hash"}
+	if err = follower.CreateProvisionKey(key); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	results := make([]error, len(stores))
+	for i, s := range stores {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, results[i] = s.UseProvisionKey("hash")
+		}()
+	}
+	wg.Wait()
+	used := 0
+	for _, err := range results {
+		switch {
+		case err == nil:
+			used++
+		case !errors.Is(err, provision.ErrUsed):
+			t.Errorf("got error %v using single use key, expected ErrUsed", err)
+		}
+	}
+	if used != 1 {
+		t.Errorf("single use key was used %d times", used)
+	}
+
+	// The remaining servers elect a new leader and keep accepting writes
+	leader := waitRaftLeader(t, stores)
+	if err = leader.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var remaining []*RaftStore
+	for _, s := range stores {
+		if s != leader {
+			remaining = append(remaining, s)
+		}
+	}
+	waitRaftLeader(t, remaining)
+	n.Name = "renamed"
+	if err = remaining[0].UpdateNode(n); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the rename to replicate", func() bool {
+		got, err := remaining[1].GetNodeByID(n.ID)
+		return err == nil && got.Name == "renamed"
+	})
+}
+
+func TestRaftRejectsUnauthenticated(t *testing.T) {
+	s := newTestRaftCluster(t, 1)[0]
+	_, addr := s.Leader()
+	cmd, err := json.Marshal(&raftCommand{
+		Op:   opCreateNode,
+		Time: time.Now(),
+		Node: &node.Node{NodeKey: keys.NewPrivateKey().PublicKey()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrong := []byte("wrong secret")
+	_, err = forwardTo(raft.ServerAddress(addr), wrong, &forwardRequest{Command: cmd})
+	if err == nil {
+		t.Fatal("forwarded write with the wrong secret was accepted")
+	}
+	if nodes, _ := s.GetNodes(); len(nodes) != 0 {
+		t.Fatalf("got %d nodes, expected the forwarded write to be rejected", len(nodes))
+	}
+
+	// Raft connections with the wrong secret are closed
+	conn, err := dialRaft(raft.ServerAddress(addr), wrong, rpcRaft, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err = conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("got error %v reading from a raft connection with the wrong secret, expected EOF", err)
+	}
+
+	// The same write with the secret is applied
+	_, err = forwardTo(raft.ServerAddress(addr), []byte(testRaftSecret), &forwardRequest{Command: cmd})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodes, _ := s.GetNodes(); len(nodes) != 1 {
+		t.Fatalf("got %d nodes after an authenticated write, expected 1", len(nodes))
+	}
+}
+
+func TestRaftPresence(t *testing.T) {
+	stores := newTestRaftCluster(t, 2)
+	n := &node.Node{NodeKey: keys.NewPrivateKey().PublicKey()}
+	if err := stores[0].CreateNode(n); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range stores {
+		if _, err := s.SetNodePresence(n.ID, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The node stays online while it polls the other server
+	got, err := stores[0].SetNodePresence(n.ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Online {
+		t.Error("node went offline while polling another server")
+	}
+	if err = stores[0].ResetPresence(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err = stores[0].GetNodeByID(n.ID); err != nil || !got.Online {
+		t.Errorf("got node %+v and error %v after resetting another server, expected online",
+			got, err)
+	}
+
+	// The presence of the servers is kept in snapshots
+	snap, err := stores[0].fsm.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsm := newRaftFSM()
+	var buf bytes.Buffer
+	if err = json.NewEncoder(&buf).Encode(snap.(*raftSnapshot).state); err != nil {
+		t.Fatal(err)
+	}
+	if err = fsm.Restore(io.NopCloser(&buf)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fsm.presence[n.ID]["node1"]; !ok || len(fsm.presence[n.ID]) != 1 {
+		t.Errorf("got presence %v from the snapshot, expected node1", fsm.presence[n.ID])
+	}
+
+	// Once the last server resets the node is offline
+	if err = stores[1].ResetPresence(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err = stores[1].GetNodeByID(n.ID); err != nil || got.Online {
+		t.Errorf("got node %+v and error %v after resetting every server, expected offline",
+			got, err)
+	}
+}
+
+func TestRaftRestart(t *testing.T) {
+	dir := t.TempDir()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := config.RaftConfig{
+		NodeID: "node0",
+		Dir:    dir,
+		Secret: testRaftSecret,
+		Peers:  map[string]string{"node0": ln.Addr().String()},
+	}
+	ln.Close()
+
+	s, err := NewRaftStore(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitRaftLeader(t, []*RaftStore{s})
+	n := &node.Node{
+		NodeKey: keys.NewPrivateKey().PublicKey(),
+		IP:      netip.MustParseAddr("100.70.0.1"),
+	}
+	if err = s.CreateNode(n); err != nil {
+		t.Fatal(err)
+	}
+	// Restored from a snapshot and the logs after it
+	if err = s.raft.Snapshot().Error(); err != nil {
+		t.Fatal(err)
+	}
+	n.Name = "renamed"
+	if err = s.UpdateNode(n); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = NewRaftStore(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	waitRaftLeader(t, []*RaftStore{s})
+	waitFor(t, "the raft log to be replayed", func() bool {
+		got, err := s.GetNodeByID(n.ID)
+		return err == nil && got.Name == "renamed"
+	})
+}
@@ -0,0 +1,120 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Restore replaces the store at path with a backup written by Backup. The backup
+// is copied next to the store and opened first, so a backup that is corrupt or
+// from a newer server is rejected without touching the store. The server must be
+// stopped, a store that is still open is refused.
+func Restore(driver, backupPath, path string) error {
+	switch driver {
+	case DriverBolt, "":
+		driver = DriverBolt
+		if err := checkBoltNotInUse(path); err != nil {
+			return err
+		}
+	case DriverSQLite:
+		if err := checkSQLiteNotInUse(path); err != nil {
+			return err
+		}
+	case DriverMemory:
+		return errors.New("memory store can't be restored from a backup")
+	case DriverRaft:
+		return errors.New("raft store can't be restored from a backup")
+	default:
+		return fmt.Errorf("unknown store driver %q", driver)
+	}
+
+	tmp := path + ".restore"
+	if err := copyFile(backupPath, tmp); err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	s, err := Open(driver, tmp)
+	if err != nil {
+		return fmt.Errorf("invalid backup: %w", err)
+	}
+	if err = s.Close(); err != nil {
+		return err
+	}
+
+	if driver == DriverSQLite {
+		// A write-ahead log left by the old database must not be applied to the backup
+		for _, suffix := range []string{"-wal", "-shm"} {
+			if err = os.Remove(path + suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	return os.Rename(tmp, path)
+}
+
+// checkBoltNotInUse returns an error if another process has the store open.
+// Bolt holds an exclusive file lock while a database is open for writing.
+func checkBoltNotInUse(path string) error {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	db, err := openBolt(path, true)
+	if errors.Is(err, ErrStoreInUse) {
+		return fmt.Errorf("%w, stop the server before restoring", err)
+	}
+	if err != nil {
+		return err
+	}
+	return db.Close()
+}
+
+// checkSQLiteNotInUse returns an error if another process has the store open.
+// Every connection to a database in WAL mode holds a shared lock on it for as
+// long as it is open, so an exclusive lock can only be taken when there are none.
+func checkSQLiteNotInUse(path string) error {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=locking_mode(EXCLUSIVE)")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(`BEGIN EXCLUSIVE; ROLLBACK`)
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.Code()&0xff == sqlite3.SQLITE_BUSY {
+		return fmt.Errorf("%w: %s, stop the server before restoring", ErrStoreInUse, path)
+	}
+	return err
+}
+
+func copyFile(from, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err = dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
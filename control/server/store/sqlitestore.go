@@ -0,0 +1,1224 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/caldog20/calnet/control/server/events"
+	"github.com/caldog20/calnet/control/server/internal/audit"
+	"github.com/caldog20/calnet/control/server/internal/node"
+	"github.com/caldog20/calnet/control/server/internal/provision"
+	"github.com/caldog20/calnet/control/server/internal/store"
+	"github.com/caldog20/calnet/control/server/internal/webhook"
+	"github.com/caldog20/calnet/pkg/controlapi"
+	"github.com/caldog20/calnet/pkg/keys"
+	"modernc.org/sqlite"
+)
+
+type sqliteMigration struct {
+	description string
+	sql         string
+}
+
+// sqliteMigrations are applied in order to bring the schema up to date.
+// The index of a migration plus one is the schema version it produces,
+// existing migrations must never be changed, only appended to.
+var sqliteMigrations = []sqliteMigration{
+	{
+		description: "create the nodes, audit, webhook and provisioning key tables",
+		sql: `CREATE TABLE nodes (
+		id              INTEGER PRIMARY KEY AUTOINCREMENT,
+		node_key        TEXT NOT NULL UNIQUE,
+		name            TEXT NOT NULL DEFAULT '',
+		hostinfo        TEXT,
+		ip              TEXT,
+		prefix          TEXT NOT NULL DEFAULT '',
+		key_expiry      INTEGER NOT NULL DEFAULT 0,
+		user            TEXT NOT NULL DEFAULT '',
+		tags            TEXT NOT NULL DEFAULT '[]',
+		approved_routes TEXT NOT NULL DEFAULT '[]',
+		disabled        INTEGER NOT NULL DEFAULT 0,
+		online          INTEGER NOT NULL DEFAULT 0,
+		last_connected  INTEGER NOT NULL DEFAULT 0,
+		created_at      INTEGER NOT NULL DEFAULT 0,
+		updated_at      INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX nodes_ip ON nodes (ip);
+	CREATE INDEX nodes_user ON nodes (user);
+
+	CREATE TABLE audit_events (
+		id        INTEGER PRIMARY KEY AUTOINCREMENT,
+		time      INTEGER NOT NULL,
+		action    TEXT NOT NULL,
+		actor     TEXT NOT NULL DEFAULT '',
+		source_ip TEXT NOT NULL DEFAULT '',
+		node_id   INTEGER NOT NULL DEFAULT 0,
+		before    TEXT,
+		after     TEXT
+	);
+	CREATE INDEX audit_events_node_id ON audit_events (node_id);
+
+	CREATE TABLE webhooks (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		url        TEXT NOT NULL,
+		events     TEXT NOT NULL DEFAULT '[]',
+		secret     TEXT NOT NULL,
+		disabled   INTEGER NOT NULL DEFAULT 0,
+		created_at INTEGER NOT NULL DEFAULT 0
+	);
+
+	CREATE TABLE webhook_deliveries (
+		id              INTEGER PRIMARY KEY AUTOINCREMENT,
+		subscription_id INTEGER NOT NULL,
+		event_id        INTEGER NOT NULL,
+		event_type      TEXT NOT NULL,
+		attempt         INTEGER NOT NULL,
+		status_code     INTEGER NOT NULL DEFAULT 0,
+		error           TEXT NOT NULL DEFAULT '',
+		success         INTEGER NOT NULL DEFAULT 0,
+		time            INTEGER NOT NULL,
+		duration        TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX webhook_deliveries_subscription ON webhook_deliveries (subscription_id, id);
+
+	CREATE TABLE provision_keys (
+		id          INTEGER PRIMARY KEY AUTOINCREMENT,
+		hash        TEXT NOT NULL UNIQUE,
+		description TEXT NOT NULL DEFAULT '',
+		user        TEXT NOT NULL DEFAULT '',
+		tags        TEXT NOT NULL DEFAULT '[]',
+		reusable    INTEGER NOT NULL DEFAULT 0,
+		expiry      INTEGER NOT NULL DEFAULT 0,
+		uses        INTEGER NOT NULL DEFAULT 0,
+		revoked     INTEGER NOT NULL DEFAULT 0,
+		last_used   INTEGER NOT NULL DEFAULT 0,
+		created_at  INTEGER NOT NULL DEFAULT 0
+	);`,
+	},
+}
+
+// SQLiteStore stores each object in its own table with indexes for the node lookups
+// by key, IP and user. The database is opened with a single connection so
+// transactions that read then write, like UseProvisionKey, can't interleave.
+type SQLiteStore struct {
+	db *sql.DB
+	nodeWatchers
+}
+
+func init() {
+	// ip_in_prefix(ip, prefix) reports whether the node IP column is inside
+	// prefix, it is false for unassigned IPs
+	err := sqlite.RegisterDeterministicScalarFunction(
+		"ip_in_prefix",
+		2,
+		func(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+			ip, ok := args[0].(string)
+			if !ok {
+				return false, nil
+			}
+			prefix, ok := args[1].(string)
+			if !ok {
+				return nil, errors.New("ip_in_prefix: prefix must be text")
+			}
+			addr, err := netip.ParseAddr(ip)
+			if err != nil {
+				return nil, err
+			}
+			p, err := netip.ParsePrefix(prefix)
+			if err != nil {
+				return nil, err
+			}
+			return p.Contains(addr), nil
+		},
+	)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func openSQLite(path string) (*sql.DB, error) {
+	dsn := "file:" + path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)" +
+		"&_pragma=foreign_keys(1)&_pragma=synchronous(NORMAL)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := openSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SQLiteStore{db: db}
+	var status *MigrationStatus
+	err = s.tx(func(tx *sql.Tx) error {
+		status, err = migrateSQLite(tx)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	for _, m := range status.Pending {
+		logger.Info(
+			"applied sqlite store migration",
+			"version",
+			m.Version,
+			"description",
+			m.Description,
+		)
+	}
+	logger.Info("opened sqlite store", "path", path)
+	return s, nil
+}
+
+// Backup writes a copy of the database made with VACUUM INTO, which reads
+// it in a single transaction so the copy is consistent
+func (s *SQLiteStore) Backup(w io.Writer) (int64, error) {
+	dir, err := os.MkdirTemp("", "calnet-backup")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "backup.db")
+	if _, err = s.db.Exec(`VACUUM INTO ?`, path); err != nil {
+		return 0, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(w, f)
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// migrateSQLite applies every migration newer than the schema version of the
+// database in tx. SQLite schema changes are transactional so a failed migration
+// leaves the database as it was.
+func migrateSQLite(tx *sql.Tx) (*MigrationStatus, error) {
+	status, err := sqliteMigrationStatus(tx)
+	if err != nil {
+		return nil, err
+	}
+	if len(status.Pending) == 0 {
+		return status, nil
+	}
+
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)`)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range status.Pending {
+		if _, err = tx.Exec(sqliteMigrations[m.Version-1].sql); err != nil {
+			return nil, fmt.Errorf("error applying sqlite migration %d: %w", m.Version, err)
+		}
+	}
+	if _, err = tx.Exec(`DELETE FROM schema_version`); err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(`INSERT INTO schema_version (version) VALUES (?)`, status.Latest)
+	return status, err
+}
+
+func migrateSQLiteFile(path string, dryRun bool) (*MigrationStatus, error) {
+	var db *sql.DB
+	var err error
+	if dryRun {
+		// A dry run opens the database read-only and only reads its schema version
+		db, err = sql.Open("sqlite", "file:"+path+"?mode=ro&_pragma=busy_timeout(5000)")
+	} else {
+		db, err = openSQLite(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	if dryRun {
+		defer tx.Rollback()
+		return sqliteMigrationStatus(tx)
+	}
+	status, err := migrateSQLite(tx)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return status, tx.Commit()
+}
+
+// sqliteMigrationStatus returns the schema version of the database in tx and the
+// migrations pending for it. A database without a schema_version table is version 0.
+func sqliteMigrationStatus(tx *sql.Tx) (*MigrationStatus, error) {
+	var tables int
+	err := tx.QueryRow(
+		`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'`,
+	).Scan(&tables)
+	if err != nil {
+		return nil, err
+	}
+	var current int
+	if tables > 0 {
+		err = tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&current)
+		if err != nil {
+			return nil, err
+		}
+	}
+	descriptions := make([]string, len(sqliteMigrations))
+	for i, m := range sqliteMigrations {
+		descriptions[i] = m.description
+	}
+	return newMigrationStatus(current, descriptions)
+}
+
+// tx runs fn in a transaction that is committed if fn returns nil
+func (s *SQLiteStore) tx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Times are stored as unix nanoseconds with 0 for the zero time
+func timeToDB(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func timeFromDB(v int64) time.Time {
+	if v == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, v)
+}
+
+func jsonToDB(v any) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// addrToDB stores an unassigned IP as NULL so it is left out of the index
+func addrToDB(a netip.Addr) any {
+	if !a.IsValid() {
+		return nil
+	}
+	return a.String()
+}
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+const nodeColumns = `id, node_key, name, hostinfo, ip, prefix, key_expiry, user, tags,
+	approved_routes, disabled, online, last_connected, created_at, updated_at`
+
+func scanNode(row rowScanner) (*node.Node, error) {
+	n := &node.Node{}
+	var nodeKey, prefix, tags, routes string
+	var hostinfo, ip sql.NullString
+	var keyExpiry, lastConnected, createdAt, updatedAt int64
+	err := row.Scan(
+		&n.ID,
+		&nodeKey,
+		&n.Name,
+		&hostinfo,
+		&ip,
+		&prefix,
+		&keyExpiry,
+		&n.User,
+		&tags,
+		&routes,
+		&n.Disabled,
+		&n.Online,
+		&lastConnected,
+		&createdAt,
+		&updatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = n.NodeKey.UnmarshalText([]byte(nodeKey)); err != nil {
+		return nil, err
+	}
+	if hostinfo.Valid {
+		n.Hostinfo = &controlapi.Hostinfo{}
+		if err = json.Unmarshal([]byte(hostinfo.String), n.Hostinfo); err != nil {
+			return nil, err
+		}
+	}
+	if ip.Valid {
+		if n.IP, err = netip.ParseAddr(ip.String); err != nil {
+			return nil, err
+		}
+	}
+	if prefix != "" {
+		if n.Prefix, err = netip.ParsePrefix(prefix); err != nil {
+			return nil, err
+		}
+	}
+	if err = json.Unmarshal([]byte(tags), &n.Tags); err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal([]byte(routes), &n.ApprovedRoutes); err != nil {
+		return nil, err
+	}
+	n.KeyExpiry = timeFromDB(keyExpiry)
+	n.LastConnected = timeFromDB(lastConnected)
+	n.CreatedAt = timeFromDB(createdAt)
+	n.UpdatedAt = timeFromDB(updatedAt)
+	return n, nil
+}
+
+// nodeValues returns the column values of n after id in nodeColumns order
+func nodeValues(n *node.Node) ([]any, error) {
+	nodeKey, err := n.NodeKey.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	var hostinfo any
+	if n.Hostinfo != nil {
+		if hostinfo, err = jsonToDB(n.Hostinfo); err != nil {
+			return nil, err
+		}
+	}
+	var prefix string
+	if n.Prefix.IsValid() {
+		prefix = n.Prefix.String()
+	}
+	tags, err := jsonToDB(n.Tags)
+	if err != nil {
+		return nil, err
+	}
+	routes, err := jsonToDB(n.ApprovedRoutes)
+	if err != nil {
+		return nil, err
+	}
+	return []any{
+		string(nodeKey),
+		n.Name,
+		hostinfo,
+		addrToDB(n.IP),
+		prefix,
+		timeToDB(n.KeyExpiry),
+		n.User,
+		tags,
+		routes,
+		n.Disabled,
+		n.Online,
+		timeToDB(n.LastConnected),
+		timeToDB(n.CreatedAt),
+		timeToDB(n.UpdatedAt),
+	}, nil
+}
+
+func (s *SQLiteStore) queryNodes(query string, args ...any) ([]node.Node, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var nodes []node.Node
+	for rows.Next() {
+		n, err := scanNode(rows)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, *n)
+	}
+	return nodes, rows.Err()
+}
+
+func (s *SQLiteStore) GetNodes() ([]node.Node, error) {
+	return s.queryNodes(`SELECT ` + nodeColumns + ` FROM nodes ORDER BY id`)
+}
+
+// nodeSortColumns maps sort fields to the column nodes are ordered by before their ID
+var nodeSortColumns = map[node.SortField]string{
+	node.SortByCreated:  "created_at",
+	node.SortByLastSeen: "last_connected",
+	node.SortByExpiry:   "key_expiry",
+}
+
+// nodeSortKey returns the SQL expression of the node sort key, matching the
+// cursor keys of node.ListOptions which order zero times before any other time.
+// Nodes sorted by ID have no key before their ID.
+func nodeSortKey(sort node.SortField) (string, bool) {
+	column, ok := nodeSortColumns[sort]
+	if !ok {
+		return "", false
+	}
+	key := fmt.Sprintf("(CASE WHEN %s = 0 THEN %d ELSE %s END)", column, math.MinInt64, column)
+	return key, true
+}
+
+// ListNodes applies the filter, the sort order, the cursor and the page size in SQL
+func (s *SQLiteStore) ListNodes(opts node.ListOptions) ([]node.Node, error) {
+	var where []string
+	var args []any
+	if opts.User != "" {
+		where = append(where, "user = ?")
+		args = append(args, opts.User)
+	}
+	if opts.Tag != "" {
+		where = append(where, "EXISTS (SELECT 1 FROM json_each(tags) WHERE value = ?)")
+		args = append(args, opts.Tag)
+	}
+	if opts.Disabled != nil {
+		where = append(where, "disabled = ?")
+		args = append(args, *opts.Disabled)
+	}
+	if opts.Expired != nil {
+		// A node is expired once now is after its key expiry,
+		// the zero expiry is stored as 0 so it is always expired
+		if *opts.Expired {
+			where = append(where, "key_expiry < ?")
+		} else {
+			where = append(where, "key_expiry >= ?")
+		}
+		args = append(args, time.Now().UnixNano())
+	}
+	if opts.Online != nil {
+		where = append(where, "online = ?")
+		args = append(args, *opts.Online)
+	}
+	if opts.Prefix.IsValid() {
+		where = append(where, "ip_in_prefix(ip, ?)")
+		args = append(args, opts.Prefix.String())
+	}
+	if opts.Hostname != "" {
+		// lower only folds ASCII, which hostnames are limited to
+		where = append(where, `(instr(lower(name), ?) > 0 OR
+			instr(lower(coalesce(json_extract(hostinfo, '$.hostname'), '')), ?) > 0)`)
+		sub := strings.ToLower(opts.Hostname)
+		args = append(args, sub, sub)
+	}
+
+	key, hasKey := nodeSortKey(opts.Sort)
+	order, op := "ASC", ">"
+	if opts.Descending {
+		order, op = "DESC", "<"
+	}
+	if opts.After != nil {
+		if hasKey {
+			where = append(where, "("+key+", id) "+op+" (?, ?)")
+			args = append(args, opts.After.Key, opts.After.ID)
+		} else {
+			where = append(where, "id "+op+" ?")
+			args = append(args, opts.After.ID)
+		}
+	}
+
+	query := `SELECT ` + nodeColumns + ` FROM nodes`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	query += ` ORDER BY `
+	if hasKey {
+		query += key + ` ` + order + `, `
+	}
+	query += `id ` + order + ` LIMIT ?`
+	args = append(args, opts.PageSize())
+	return s.queryNodes(query, args...)
+}
+
+func (s *SQLiteStore) GetPeersOfNode(id uint64) ([]*node.Node, error) {
+	if _, err := s.GetNodeByID(id); err != nil {
+		return nil, err
+	}
+	nodes, err := s.queryNodes(`SELECT `+nodeColumns+` FROM nodes WHERE id != ? ORDER BY id`, id)
+	if err != nil {
+		return nil, err
+	}
+	peers := make([]*node.Node, len(nodes))
+	for i := range nodes {
+		peers[i] = &nodes[i]
+	}
+	return peers, nil
+}
+
+func (s *SQLiteStore) getNode(query string, arg any) (*node.Node, error) {
+	n, err := scanNode(s.db.QueryRow(`SELECT `+nodeColumns+` FROM nodes WHERE `+query, arg))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNodeNotFound
+	}
+	return n, err
+}
+
+func (s *SQLiteStore) GetNodeByKey(key keys.PublicKey) (*node.Node, error) {
+	nodeKey, err := key.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	return s.getNode(`node_key = ?`, string(nodeKey))
+}
+
+func (s *SQLiteStore) GetNodeByID(id uint64) (*node.Node, error) {
+	return s.getNode(`id = ?`, id)
+}
+
+// GetNodeByIP returns the node assigned ip using the IP index
+func (s *SQLiteStore) GetNodeByIP(ip netip.Addr) (*node.Node, error) {
+	return s.getNode(`ip = ?`, addrToDB(ip))
+}
+
+// ipInUseTx reports whether ip is assigned to a node other than id
+func ipInUseTx(tx *sql.Tx, ip netip.Addr, id uint64) (bool, error) {
+	if !ip.IsValid() {
+		return false, nil
+	}
+	var count int
+	err := tx.QueryRow(`SELECT COUNT(*) FROM nodes WHERE ip = ? AND id != ?`, addrToDB(ip), id).
+		Scan(&count)
+	return count > 0, err
+}
+
+func (s *SQLiteStore) CreateNode(n *node.Node) error {
+	n.CreatedAt = time.Now()
+	err := s.tx(func(tx *sql.Tx) error {
+		return createNodeTx(tx, n)
+	})
+	if err != nil {
+		return err
+	}
+	s.notify(store.NodeCreated, nil, n)
+	return nil
+}
+
+// createNodeTx inserts n and sets its ID
+func createNodeTx(tx *sql.Tx, n *node.Node) error {
+	values, err := nodeValues(n)
+	if err != nil {
+		return err
+	}
+	inUse, err := ipInUseTx(tx, n.IP, 0)
+	if err != nil {
+		return err
+	}
+	if inUse {
+		return ErrIPInUse
+	}
+	res, err := tx.Exec(
+		`INSERT INTO nodes (`+nodeColumns[len("id, "):]+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		values...,
+	)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	n.ID = uint64(id)
+	return err
+}
+
+// getNodeTx reads a node in tx so a write can report the value it replaced
+func getNodeTx(tx *sql.Tx, id uint64) (*node.Node, error) {
+	n, err := scanNode(tx.QueryRow(`SELECT `+nodeColumns+` FROM nodes WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNodeNotFound
+	}
+	return n, err
+}
+
+func (s *SQLiteStore) DeleteNode(id uint64) error {
+	var old *node.Node
+	err := s.tx(func(tx *sql.Tx) error {
+		var err error
+		if old, err = getNodeTx(tx, id); err != nil {
+			return err
+		}
+		_, err = tx.Exec(`DELETE FROM nodes WHERE id = ?`, id)
+		return err
+	})
+	if errors.Is(err, ErrNodeNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.notify(store.NodeDeleted, old, nil)
+	return nil
+}
+
+func (s *SQLiteStore) UpdateNode(n *node.Node) error {
+	n.UpdatedAt = time.Now()
+	values, err := nodeValues(n)
+	if err != nil {
+		return err
+	}
+	var old *node.Node
+	err = s.tx(func(tx *sql.Tx) error {
+		if old, err = getNodeTx(tx, n.ID); err != nil {
+			return err
+		}
+		inUse, err := ipInUseTx(tx, n.IP, n.ID)
+		if err != nil {
+			return err
+		}
+		if inUse {
+			return ErrIPInUse
+		}
+		_, err = tx.Exec(
+			`UPDATE nodes SET node_key = ?, name = ?, hostinfo = ?, ip = ?, prefix = ?,
+			key_expiry = ?, user = ?, tags = ?, approved_routes = ?, disabled = ?, online = ?,
+			last_connected = ?, created_at = ?, updated_at = ? WHERE id = ?`,
+			append(values, n.ID)...,
+		)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.notify(store.NodeUpdated, old, n)
+	return nil
+}
+
+// SetNodePresence updates only the presence columns, last_connected is kept
+// when the node goes offline
+func (s *SQLiteStore) SetNodePresence(id uint64, online bool) (*node.Node, error) {
+	now := timeToDB(time.Now())
+	var old, n *node.Node
+	err := s.tx(func(tx *sql.Tx) error {
+		var err error
+		if old, err = getNodeTx(tx, id); err != nil {
+			return err
+		}
+		_, err = tx.Exec(
+			`UPDATE nodes SET online = ?, updated_at = ?,
+			last_connected = CASE WHEN ? THEN ? ELSE last_connected END WHERE id = ?`,
+			online, now, online, now, id,
+		)
+		if err != nil {
+			return err
+		}
+		n, err = getNodeTx(tx, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.notify(store.NodeUpdated, old, n)
+	return n, nil
+}
+
+func (s *SQLiteStore) ResetPresence() error {
+	online, err := s.queryNodes(`SELECT ` + nodeColumns + ` FROM nodes WHERE online ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	for _, n := range online {
+		if _, err = s.SetNodePresence(n.ID, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteStore) GetAllocatedNodeIPs() ([]netip.Addr, error) {
+	rows, err := s.db.Query(`SELECT ip FROM nodes WHERE ip IS NOT NULL`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ips []netip.Addr
+	for rows.Next() {
+		var ip string
+		if err = rows.Scan(&ip); err != nil {
+			return nil, err
+		}
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			return nil, err
+		}
+		ips = append(ips, addr)
+	}
+	return ips, rows.Err()
+}
+
+func (s *SQLiteStore) AppendAuditEvent(event *audit.Event) error {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	res, err := s.db.Exec(
+		`INSERT INTO audit_events (time, action, actor, source_ip, node_id, before, after)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		timeToDB(event.Time),
+		string(event.Action),
+		event.Actor,
+		event.SourceIP,
+		event.NodeID,
+		rawToDB(event.Before),
+		rawToDB(event.After),
+	)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	event.ID = uint64(id)
+	return nil
+}
+
+func rawToDB(raw json.RawMessage) any {
+	if raw == nil {
+		return nil
+	}
+	return string(raw)
+}
+
+func (s *SQLiteStore) GetAuditEvents(filter audit.Filter) ([]audit.Event, error) {
+	where := []string{"id > ?"}
+	args := []any{filter.AfterID}
+	if filter.Action != "" {
+		where = append(where, "action = ?")
+		args = append(args, string(filter.Action))
+	}
+	if filter.Actor != "" {
+		where = append(where, "actor = ?")
+		args = append(args, filter.Actor)
+	}
+	if filter.NodeID != 0 {
+		where = append(where, "node_id = ?")
+		args = append(args, filter.NodeID)
+	}
+	if !filter.Since.IsZero() {
+		where = append(where, "time >= ?")
+		args = append(args, filter.Since.UnixNano())
+	}
+	if !filter.Until.IsZero() {
+		where = append(where, "time <= ?")
+		args = append(args, filter.Until.UnixNano())
+	}
+	args = append(args, filter.PageSize())
+
+	rows, err := s.db.Query(
+		`SELECT id, time, action, actor, source_ip, node_id, before, after FROM audit_events
+		WHERE `+strings.Join(where, " AND ")+` ORDER BY id LIMIT ?`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []audit.Event
+	for rows.Next() {
+		e := audit.Event{}
+		var t int64
+		var before, after sql.NullString
+		err = rows.Scan(&e.ID, &t, &e.Action, &e.Actor, &e.SourceIP, &e.NodeID, &before, &after)
+		if err != nil {
+			return nil, err
+		}
+		e.Time = timeFromDB(t)
+		if before.Valid {
+			e.Before = json.RawMessage(before.String)
+		}
+		if after.Valid {
+			e.After = json.RawMessage(after.String)
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func (s *SQLiteStore) CreateWebhook(sub *webhook.Subscription) error {
+	sub.CreatedAt = time.Now()
+	return s.tx(func(tx *sql.Tx) error {
+		return createWebhookTx(tx, sub)
+	})
+}
+
+func createWebhookTx(tx *sql.Tx, sub *webhook.Subscription) error {
+	types, err := jsonToDB(sub.Events)
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec(
+		`INSERT INTO webhooks (url, events, secret, disabled, created_at) VALUES (?, ?, ?, ?, ?)`,
+		sub.URL,
+		types,
+		sub.Secret,
+		sub.Disabled,
+		timeToDB(sub.CreatedAt),
+	)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	sub.ID = uint64(id)
+	return nil
+}
+
+func scanWebhook(row rowScanner) (*webhook.Subscription, error) {
+	sub := &webhook.Subscription{}
+	var types string
+	var createdAt int64
+	err := row.Scan(&sub.ID, &sub.URL, &types, &sub.Secret, &sub.Disabled, &createdAt)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal([]byte(types), &sub.Events); err != nil {
+		return nil, err
+	}
+	sub.CreatedAt = timeFromDB(createdAt)
+	return sub, nil
+}
+
+const webhookColumns = `id, url, events, secret, disabled, created_at`
+
+func (s *SQLiteStore) GetWebhooks() ([]webhook.Subscription, error) {
+	rows, err := s.db.Query(`SELECT ` + webhookColumns + ` FROM webhooks ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subs []webhook.Subscription
+	for rows.Next() {
+		sub, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, *sub)
+	}
+	return subs, rows.Err()
+}
+
+func (s *SQLiteStore) GetWebhookByID(id uint64) (*webhook.Subscription, error) {
+	row := s.db.QueryRow(`SELECT `+webhookColumns+` FROM webhooks WHERE id = ?`, id)
+	sub, err := scanWebhook(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrWebhookNotFound
+	}
+	return sub, err
+}
+
+func (s *SQLiteStore) DeleteWebhook(id uint64) error {
+	res, err := s.db.Exec(`DELETE FROM webhooks WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return ErrWebhookNotFound
+	}
+	return err
+}
+
+func (s *SQLiteStore) AppendWebhookDelivery(d *webhook.Delivery) error {
+	return s.tx(func(tx *sql.Tx) error {
+		res, err := tx.Exec(
+			`INSERT INTO webhook_deliveries (subscription_id, event_id, event_type, attempt,
+			status_code, error, success, time, duration) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			d.SubscriptionID,
+			d.EventID,
+			string(d.EventType),
+			d.Attempt,
+			d.StatusCode,
+			d.Error,
+			d.Success,
+			timeToDB(d.Time),
+			d.Duration,
+		)
+		if err != nil {
+			return err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		d.ID = uint64(id)
+
+		// Keep the same fixed window of recent deliveries as the bolt store
+		_, err = tx.Exec(`DELETE FROM webhook_deliveries WHERE id <= ?`, id-maxWebhookDeliveries)
+		return err
+	})
+}
+
+// GetWebhookDeliveries returns up to limit deliveries for a subscription, newest first
+func (s *SQLiteStore) GetWebhookDeliveries(
+	subscriptionID uint64,
+	limit int,
+) ([]webhook.Delivery, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := s.db.Query(
+		`SELECT id, subscription_id, event_id, event_type, attempt, status_code, error,
+		success, time, duration FROM webhook_deliveries WHERE subscription_id = ?
+		ORDER BY id DESC LIMIT ?`,
+		subscriptionID,
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []webhook.Delivery
+	for rows.Next() {
+		d := webhook.Delivery{}
+		var eventType string
+		var t int64
+		err = rows.Scan(
+			&d.ID,
+			&d.SubscriptionID,
+			&d.EventID,
+			&eventType,
+			&d.Attempt,
+			&d.StatusCode,
+			&d.Error,
+			&d.Success,
+			&t,
+			&d.Duration,
+		)
+		if err != nil {
+			return nil, err
+		}
+		d.EventType = events.Type(eventType)
+		d.Time = timeFromDB(t)
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+const provisionKeyColumns = `id, hash, description, user, tags, reusable, expiry, uses,
+	revoked, last_used, created_at`
+
+func scanProvisionKey(row rowScanner) (*provision.Key, error) {
+	pk := &provision.Key{}
+	var tags string
+	var expiry, lastUsed, createdAt int64
+	err := row.Scan(
+		&pk.ID,
+		&pk.Hash,
+		&pk.Description,
+		&pk.User,
+		&tags,
+		&pk.Reusable,
+		&expiry,
+		&pk.Uses,
+		&pk.Revoked,
+		&lastUsed,
+		&createdAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal([]byte(tags), &pk.Tags); err != nil {
+		return nil, err
+	}
+	pk.Expiry = timeFromDB(expiry)
+	pk.LastUsed = timeFromDB(lastUsed)
+	pk.CreatedAt = timeFromDB(createdAt)
+	return pk, nil
+}
+
+func (s *SQLiteStore) CreateProvisionKey(key *provision.Key) error {
+	key.CreatedAt = time.Now()
+	return s.tx(func(tx *sql.Tx) error {
+		return createProvisionKeyTx(tx, key)
+	})
+}
+
+func createProvisionKeyTx(tx *sql.Tx, key *provision.Key) error {
+	tags, err := jsonToDB(key.Tags)
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec(
+		`INSERT INTO provision_keys (hash, description, user, tags, reusable, expiry, uses,
+		revoked, last_used, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		key.Hash,
+		key.Description,
+		key.User,
+		tags,
+		key.Reusable,
+		timeToDB(key.Expiry),
+		key.Uses,
+		key.Revoked,
+		timeToDB(key.LastUsed),
+		timeToDB(key.CreatedAt),
+	)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	key.ID = uint64(id)
+	return nil
+}
+
+func (s *SQLiteStore) GetProvisionKeys() ([]provision.Key, error) {
+	rows, err := s.db.Query(`SELECT ` + provisionKeyColumns + ` FROM provision_keys ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pks []provision.Key
+	for rows.Next() {
+		pk, err := scanProvisionKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		pks = append(pks, *pk)
+	}
+	return pks, rows.Err()
+}
+
+func (s *SQLiteStore) GetProvisionKeyByID(id uint64) (*provision.Key, error) {
+	row := s.db.QueryRow(`SELECT `+provisionKeyColumns+` FROM provision_keys WHERE id = ?`, id)
+	pk, err := scanProvisionKey(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrProvisionKeyNotFound
+	}
+	return pk, err
+}
+
+func updateProvisionKey(tx *sql.Tx, key *provision.Key) error {
+	tags, err := jsonToDB(key.Tags)
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec(
+		`UPDATE provision_keys SET hash = ?, description = ?, user = ?, tags = ?, reusable = ?,
+		expiry = ?, uses = ?, revoked = ?, last_used = ?, created_at = ? WHERE id = ?`,
+		key.Hash,
+		key.Description,
+		key.User,
+		tags,
+		key.Reusable,
+		timeToDB(key.Expiry),
+		key.Uses,
+		key.Revoked,
+		timeToDB(key.LastUsed),
+		timeToDB(key.CreatedAt),
+		key.ID,
+	)
+	if err != nil {
+		return err
+	}
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return ErrProvisionKeyNotFound
+	}
+	return err
+}
+
+func (s *SQLiteStore) UpdateProvisionKey(key *provision.Key) error {
+	return s.tx(func(tx *sql.Tx) error {
+		return updateProvisionKey(tx, key)
+	})
+}
+
+func (s *SQLiteStore) UseProvisionKey(hash string) (*provision.Key, error) {
+	var pk *provision.Key
+	err := s.tx(func(tx *sql.Tx) error {
+		row := tx.QueryRow(
+			`SELECT `+provisionKeyColumns+` FROM provision_keys WHERE hash = ?`,
+			hash,
+		)
+		var err error
+		pk, err = scanProvisionKey(row)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrProvisionKeyNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if err = pk.Usable(now); err != nil {
+			return err
+		}
+		pk.Uses++
+		pk.LastUsed = now
+		return updateProvisionKey(tx, pk)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pk, nil
+}
+
+// Import creates everything in one transaction
+func (s *SQLiteStore) Import(batch *store.ImportBatch) error {
+	now := time.Now()
+	err := s.tx(func(tx *sql.Tx) error {
+		for i := range batch.Nodes {
+			n := &batch.Nodes[i]
+			if n.CreatedAt.IsZero() {
+				n.CreatedAt = now
+			}
+			if err := createNodeTx(tx, n); err != nil {
+				return err
+			}
+		}
+		for i := range batch.ProvisionKeys {
+			key := &batch.ProvisionKeys[i]
+			if key.CreatedAt.IsZero() {
+				key.CreatedAt = now
+			}
+			if err := createProvisionKeyTx(tx, key); err != nil {
+				return err
+			}
+		}
+		for i := range batch.Webhooks {
+			sub := &batch.Webhooks[i]
+			if sub.CreatedAt.IsZero() {
+				sub.CreatedAt = now
+			}
+			if err := createWebhookTx(tx, sub); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := range batch.Nodes {
+		s.notify(store.NodeCreated, nil, &batch.Nodes[i])
+	}
+	return nil
+}
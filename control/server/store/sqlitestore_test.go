@@ -0,0 +1,35 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/caldog20/calnet/control/server/internal/node"
+	"github.com/caldog20/calnet/pkg/keys"
+)
+
+func TestSQLiteReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.db")
+	s, err := NewSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.CreateNode(&node.Node{NodeKey: keys.NewPrivateKey().PublicKey()}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// Migrations that were already applied must not run again
+	s, err = NewSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	nodes, err := s.GetNodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 1 {
+		t.Errorf("got %d nodes after reopening, expected 1", len(nodes))
+	}
+}
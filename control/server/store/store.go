@@ -0,0 +1,46 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/caldog20/calnet/control/server/internal/store"
+)
+
+// Store drivers selectable with the store_driver config option
+const (
+	DriverBolt   = "bolt"
+	DriverSQLite = "sqlite"
+	DriverMemory = "memory"
+	DriverRaft   = "raft"
+)
+
+// Store is a store backend that holds its database open until closed
+type Store interface {
+	store.Store
+	Close() error
+}
+
+// Backuper is implemented by stores that can write a consistent copy of their
+// database file while the server is running
+type Backuper interface {
+	Backup(w io.Writer) (int64, error)
+}
+
+// Open opens the store at path with the named driver, an empty driver opens a bolt store.
+// The memory driver ignores path and keeps nothing after the server exits.
+func Open(driver, path string) (Store, error) {
+	switch driver {
+	case DriverBolt, "":
+		return NewBoltStore(path)
+	case DriverSQLite:
+		return NewSQLiteStore(path)
+	case DriverMemory:
+		return NewMemoryStore(), nil
+	case DriverRaft:
+		return nil, errors.New("the raft store is opened from the raft config with NewRaftStore")
+	default:
+		return nil, fmt.Errorf("unknown store driver %q", driver)
+	}
+}
@@ -0,0 +1,59 @@
+package store_test
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caldog20/calnet/control/server/config"
+	"github.com/caldog20/calnet/control/server/store"
+	"github.com/caldog20/calnet/control/server/store/storetest"
+)
+
+func openTestStore(driver string) func(t *testing.T) store.Store {
+	return func(t *testing.T) store.Store {
+		s, err := store.Open(driver, filepath.Join(t.TempDir(), "store.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	}
+}
+
+func TestBoltStore(t *testing.T) {
+	storetest.Run(t, openTestStore(store.DriverBolt))
+}
+
+func TestSQLiteStore(t *testing.T) {
+	storetest.Run(t, openTestStore(store.DriverSQLite))
+}
+
+func TestMemoryStore(t *testing.T) {
+	storetest.Run(t, openTestStore(store.DriverMemory))
+}
+
+func TestRaftStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Store {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln.Close()
+		s, err := store.NewRaftStore(config.RaftConfig{
+			NodeID: "node0",
+			Dir:    t.TempDir(),
+			Secret: "raft cluster test secret",
+			Peers:  map[string]string{"node0": ln.Addr().String()},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		for !s.IsLeader() {
+			time.Sleep(time.Millisecond * 10)
+		}
+		return s
+	})
+}
@@ -0,0 +1,784 @@
+// Package storetest is a conformance suite for store implementations.
+// Every backend runs the same tests so the control server behaves the same
+// whichever store_driver is configured.
+package storetest
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"reflect"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caldog20/calnet/control/server/internal/audit"
+	"github.com/caldog20/calnet/control/server/internal/node"
+	"github.com/caldog20/calnet/control/server/internal/provision"
+	internalstore "github.com/caldog20/calnet/control/server/internal/store"
+	"github.com/caldog20/calnet/control/server/internal/webhook"
+	"github.com/caldog20/calnet/control/server/store"
+	"github.com/caldog20/calnet/pkg/controlapi"
+	"github.com/caldog20/calnet/pkg/keys"
+)
+
+// Run runs the conformance suite. newStore must return a new empty store for
+// each call, closing it when the test finishes is up to newStore.
+func Run(t *testing.T, newStore func(t *testing.T) store.Store) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s store.Store)
+	}{
+		{"NodeIDSequence", testNodeIDSequence},
+		{"NodeNotFound", testNodeNotFound},
+		{"NodeLookups", testNodeLookups},
+		{"UpdateNode", testUpdateNode},
+		{"ConcurrentUpdates", testConcurrentUpdates},
+		{"NodePresence", testNodePresence},
+		{"DuplicateIP", testDuplicateIP},
+		{"Peers", testPeers},
+		{"AllocatedIPs", testAllocatedIPs},
+		{"ListNodes", testListNodes},
+		{"Import", testImport},
+		{"AuditEvents", testAuditEvents},
+		{"Webhooks", testWebhooks},
+		{"ProvisionKeys", testProvisionKeys},
+		{"ProvisionKeySingleUse", testProvisionKeySingleUse},
+		{"WatchNodes", testWatchNodes},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newStore(t))
+		})
+	}
+}
+
+func newNode(i int) *node.Node {
+	return &node.Node{
+		NodeKey: keys.NewPrivateKey().PublicKey(),
+		Name:    fmt.Sprintf("node-%d", i),
+		Hostinfo: &controlapi.Hostinfo{
+			Hostname: fmt.Sprintf("host-%d", i),
+			OS:       "linux",
+			Arch:     "amd64",
+			Routes:   []netip.Prefix{netip.MustParsePrefix("192.168.1.0/24")},
+		},
+		IP:        netip.AddrFrom4([4]byte{100, 70, 0, byte(i)}),
+		Prefix:    netip.MustParsePrefix("100.70.0.0/24"),
+		KeyExpiry: time.Now().Add(time.Hour),
+		User:      "alice",
+		Tags:      []string{"tag:web"},
+	}
+}
+
+func createNodes(t *testing.T, s store.Store, count int) []*node.Node {
+	t.Helper()
+	nodes := make([]*node.Node, count)
+	for i := range nodes {
+		nodes[i] = newNode(i + 1)
+		if err := s.CreateNode(nodes[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return nodes
+}
+
+// normalize strips the monotonic clock and location from times,
+// which a store is not expected to keep
+func normalize(n node.Node) node.Node {
+	for _, t := range []*time.Time{&n.KeyExpiry, &n.LastConnected, &n.CreatedAt, &n.UpdatedAt} {
+		*t = t.Round(0).UTC()
+	}
+	return n
+}
+
+func expectNode(t *testing.T, got *node.Node, err error, want *node.Node) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(normalize(*got), normalize(*want)) {
+		t.Errorf("got node %+v, expected %+v", got, want)
+	}
+}
+
+func nodeIDs(nodes []node.Node) []uint64 {
+	ids := make([]uint64, len(nodes))
+	for i := range nodes {
+		ids[i] = nodes[i].ID
+	}
+	return ids
+}
+
+func nodePtrIDs(nodes []*node.Node) []uint64 {
+	ids := make([]uint64, len(nodes))
+	for i, n := range nodes {
+		ids[i] = n.ID
+	}
+	return ids
+}
+
+func testNodeIDSequence(t *testing.T, s store.Store) {
+	nodes := createNodes(t, s, 3)
+	if ids := nodePtrIDs(nodes); !slices.Equal(ids, []uint64{1, 2, 3}) {
+		t.Fatalf("got ids %v, expected [1 2 3]", ids)
+	}
+
+	// IDs of deleted nodes must not be reused
+	if err := s.DeleteNode(3); err != nil {
+		t.Fatal(err)
+	}
+	n := newNode(4)
+	if err := s.CreateNode(n); err != nil {
+		t.Fatal(err)
+	}
+	if n.ID != 4 {
+		t.Errorf("got id %d after deleting the last node, expected 4", n.ID)
+	}
+	if n.CreatedAt.IsZero() {
+		t.Error("CreatedAt was not set")
+	}
+}
+
+func testNodeNotFound(t *testing.T, s store.Store) {
+	createNodes(t, s, 1)
+
+	if _, err := s.GetNodeByID(2); !errors.Is(err, store.ErrNodeNotFound) {
+		t.Errorf("GetNodeByID: got error %v, expected ErrNodeNotFound", err)
+	}
+	_, err := s.GetNodeByKey(keys.NewPrivateKey().PublicKey())
+	if !errors.Is(err, store.ErrNodeNotFound) {
+		t.Errorf("GetNodeByKey: got error %v, expected ErrNodeNotFound", err)
+	}
+	_, err = s.GetNodeByIP(netip.MustParseAddr("100.70.0.200"))
+	if !errors.Is(err, store.ErrNodeNotFound) {
+		t.Errorf("GetNodeByIP: got error %v, expected ErrNodeNotFound", err)
+	}
+	if _, err = s.GetNodeByIP(netip.Addr{}); !errors.Is(err, store.ErrNodeNotFound) {
+		t.Errorf("GetNodeByIP of the zero address: got error %v, expected ErrNodeNotFound", err)
+	}
+	if _, err = s.GetPeersOfNode(2); !errors.Is(err, store.ErrNodeNotFound) {
+		t.Errorf("GetPeersOfNode: got error %v, expected ErrNodeNotFound", err)
+	}
+	missing := newNode(2)
+	missing.ID = 2
+	if err = s.UpdateNode(missing); !errors.Is(err, store.ErrNodeNotFound) {
+		t.Errorf("UpdateNode: got error %v, expected ErrNodeNotFound", err)
+	}
+	if _, err = s.GetNodeByID(2); !errors.Is(err, store.ErrNodeNotFound) {
+		t.Error("UpdateNode of a missing node created it")
+	}
+	if err = s.DeleteNode(2); err != nil {
+		t.Errorf("DeleteNode: got error %v deleting a missing node, expected nil", err)
+	}
+}
+
+func testNodeLookups(t *testing.T, s store.Store) {
+	nodes := createNodes(t, s, 3)
+	nodes[1].ApprovedRoutes = []netip.Prefix{netip.MustParsePrefix("192.168.1.0/24")}
+	nodes[1].Online = true
+	nodes[1].LastConnected = time.Now()
+	if err := s.UpdateNode(nodes[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range nodes {
+		got, err := s.GetNodeByID(want.ID)
+		expectNode(t, got, err, want)
+		got, err = s.GetNodeByKey(want.NodeKey)
+		expectNode(t, got, err, want)
+		got, err = s.GetNodeByIP(want.IP)
+		expectNode(t, got, err, want)
+	}
+
+	all, err := s.GetNodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := nodeIDs(all); !slices.Equal(ids, []uint64{1, 2, 3}) {
+		t.Errorf("GetNodes: got ids %v, expected [1 2 3]", ids)
+	}
+
+	// Changing a returned node must not change the stored node
+	got, err := s.GetNodeByID(nodes[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got.Name = "changed"
+	got.Tags[0] = "changed"
+	got.Hostinfo.Routes[0] = netip.MustParsePrefix("10.0.0.0/8")
+	got, err = s.GetNodeByID(nodes[0].ID)
+	expectNode(t, got, err, nodes[0])
+}
+
+func testUpdateNode(t *testing.T, s store.Store) {
+	n := createNodes(t, s, 1)[0]
+	n.Name = "renamed"
+	n.Disabled = true
+	n.IP = netip.MustParseAddr("100.70.0.50")
+	if err := s.UpdateNode(n); err != nil {
+		t.Fatal(err)
+	}
+	if n.UpdatedAt.IsZero() {
+		t.Error("UpdatedAt was not set")
+	}
+	got, err := s.GetNodeByID(n.ID)
+	expectNode(t, got, err, n)
+
+	// Lookups by the old IP must not find the node once it has changed
+	if _, err = s.GetNodeByIP(netip.MustParseAddr("100.70.0.1")); err == nil {
+		t.Error("node was found by its old IP")
+	}
+	got, err = s.GetNodeByIP(n.IP)
+	expectNode(t, got, err, n)
+}
+
+func testConcurrentUpdates(t *testing.T, s store.Store) {
+	const workers = 8
+	const updates = 20
+
+	var wg sync.WaitGroup
+	created := make([]*node.Node, workers)
+	for i := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n := newNode(i + 1)
+			if err := s.CreateNode(n); err != nil {
+				t.Error(err)
+				return
+			}
+			created[i] = n
+			for j := range updates {
+				n.Name = fmt.Sprintf("update-%d", j)
+				if err := s.UpdateNode(n); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := s.GetPeersOfNode(n.ID); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	ids := nodePtrIDs(created)
+	slices.Sort(ids)
+	if !slices.Equal(ids, []uint64{1, 2, 3, 4, 5, 6, 7, 8}) {
+		t.Errorf("got ids %v from concurrent creates, expected 1 to 8", ids)
+	}
+	for _, n := range created {
+		got, err := s.GetNodeByID(n.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("update-%d", updates-1); got.Name != want {
+			t.Errorf("node %d: got name %q, expected %q", n.ID, got.Name, want)
+		}
+	}
+}
+
+func testNodePresence(t *testing.T, s store.Store) {
+	n := createNodes(t, s, 1)[0]
+	if _, err := s.SetNodePresence(n.ID+1, true); !errors.Is(err, store.ErrNodeNotFound) {
+		t.Errorf("got error %v for a missing node, expected ErrNodeNotFound", err)
+	}
+
+	online, err := s.SetNodePresence(n.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !online.Online || online.LastConnected.IsZero() {
+		t.Fatalf("got online %t and last connected %s, expected the node online", online.Online,
+			online.LastConnected)
+	}
+	online.Name = "renamed"
+	if err = s.UpdateNode(online); err != nil {
+		t.Fatal(err)
+	}
+
+	// Going offline keeps the other fields and the time the node last connected
+	offline, err := s.SetNodePresence(n.ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offline.Online || offline.Name != "renamed" {
+		t.Errorf("got online %t and name %q, expected offline and renamed", offline.Online,
+			offline.Name)
+	}
+	if !offline.LastConnected.Equal(online.LastConnected) {
+		t.Errorf("got last connected %s going offline, expected %s", offline.LastConnected,
+			online.LastConnected)
+	}
+	got, err := s.GetNodeByID(n.ID)
+	expectNode(t, got, err, offline)
+
+	// Resetting marks every node offline
+	if _, err = s.SetNodePresence(n.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.ResetPresence(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err = s.GetNodeByID(n.ID); err != nil || got.Online || got.Name != "renamed" {
+		t.Errorf("got node %+v and error %v after resetting presence, expected offline", got, err)
+	}
+}
+
+func testDuplicateIP(t *testing.T, s store.Store) {
+	nodes := createNodes(t, s, 2)
+
+	dup := newNode(1)
+	if err := s.CreateNode(dup); !errors.Is(err, store.ErrIPInUse) {
+		t.Errorf("CreateNode: got error %v creating a node with a used IP, expected ErrIPInUse", err)
+	}
+	nodes[1].IP = nodes[0].IP
+	if err := s.UpdateNode(nodes[1]); !errors.Is(err, store.ErrIPInUse) {
+		t.Errorf("UpdateNode: got error %v moving a node to a used IP, expected ErrIPInUse", err)
+	}
+	got, err := s.GetNodeByIP(nodes[0].IP)
+	if err != nil || got.ID != nodes[0].ID {
+		t.Errorf("got node %+v and error %v by IP, expected node %d", got, err, nodes[0].ID)
+	}
+
+	// A node keeps its own IP when it's updated
+	nodes[0].Name = "renamed"
+	if err = s.UpdateNode(nodes[0]); err != nil {
+		t.Fatal(err)
+	}
+	all, err := s.GetNodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 {
+		t.Errorf("got %d nodes, expected the duplicate not to be created", len(all))
+	}
+}
+
+func testPeers(t *testing.T, s store.Store) {
+	createNodes(t, s, 3)
+	peers, err := s.GetPeersOfNode(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := nodePtrIDs(peers)
+	slices.Sort(ids)
+	if !slices.Equal(ids, []uint64{1, 3}) {
+		t.Errorf("got peers %v, expected [1 3]", ids)
+	}
+
+	if err = s.DeleteNode(3); err != nil {
+		t.Fatal(err)
+	}
+	if peers, err = s.GetPeersOfNode(2); err != nil {
+		t.Fatal(err)
+	}
+	if ids = nodePtrIDs(peers); !slices.Equal(ids, []uint64{1}) {
+		t.Errorf("got peers %v after deleting node 3, expected [1]", ids)
+	}
+}
+
+func testAllocatedIPs(t *testing.T, s store.Store) {
+	nodes := createNodes(t, s, 3)
+	unassigned := newNode(4)
+	unassigned.IP = netip.Addr{}
+	if err := s.CreateNode(unassigned); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteNode(nodes[1].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	ips, err := s.GetAllocatedNodeIPs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.SortFunc(ips, netip.Addr.Compare)
+	want := []netip.Addr{nodes[0].IP, nodes[2].IP}
+	if !slices.Equal(ips, want) {
+		t.Errorf("got allocated ips %v, expected %v", ips, want)
+	}
+}
+
+func testListNodes(t *testing.T, s store.Store) {
+	nodes := createNodes(t, s, 5)
+	nodes[3].User = "bob"
+	if err := s.UpdateNode(nodes[3]); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.ListNodes(node.ListOptions{Filter: node.Filter{User: "bob"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := nodeIDs(got); !slices.Equal(ids, []uint64{4}) {
+		t.Errorf("got nodes %v for user bob, expected [4]", ids)
+	}
+
+	opts := node.ListOptions{Filter: node.Filter{User: "alice"}, Limit: 2}
+	var ids []uint64
+	for {
+		page, err := s.ListNodes(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		ids = append(ids, nodeIDs(page)...)
+		opts.After = opts.CursorFor(&page[len(page)-1])
+	}
+	if !slices.Equal(ids, []uint64{1, 2, 3, 5}) {
+		t.Errorf("got nodes %v paging user alice, expected [1 2 3 5]", ids)
+	}
+
+	yes, no := true, false
+	nodes[0].Disabled = true
+	nodes[1].KeyExpiry = time.Now().Add(-time.Hour)
+	nodes[1].Tags = []string{"tag:db"}
+	nodes[2].Online = true
+	nodes[4].IP = netip.MustParseAddr("100.70.1.5")
+	nodes[4].Hostinfo.Hostname = "Backup-Server"
+	for _, n := range []*node.Node{nodes[0], nodes[1], nodes[2], nodes[4]} {
+		if err = s.UpdateNode(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	filters := []struct {
+		name   string
+		filter node.Filter
+		want   []uint64
+	}{
+		{"tag", node.Filter{Tag: "tag:db"}, []uint64{2}},
+		{"disabled", node.Filter{Disabled: &yes}, []uint64{1}},
+		{"expired", node.Filter{Expired: &yes}, []uint64{2}},
+		{"not expired", node.Filter{Expired: &no}, []uint64{1, 3, 4, 5}},
+		{"online", node.Filter{Online: &yes}, []uint64{3}},
+		{"prefix", node.Filter{Prefix: netip.MustParsePrefix("100.70.1.0/24")}, []uint64{5}},
+		{"hostname", node.Filter{Hostname: "backup"}, []uint64{5}},
+		{"name", node.Filter{Hostname: "NODE-4"}, []uint64{4}},
+		{"combined", node.Filter{User: "alice", Disabled: &no, Online: &no}, []uint64{2, 5}},
+	}
+	for _, tt := range filters {
+		got, err = s.ListNodes(node.ListOptions{Filter: tt.filter})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids := nodeIDs(got); !slices.Equal(ids, tt.want) {
+			t.Errorf("got nodes %v filtering by %s, expected %v", ids, tt.name, tt.want)
+		}
+	}
+
+	// Paging in descending expiry order, the expired node sorts last
+	opts = node.ListOptions{Sort: node.SortByExpiry, Descending: true, Limit: 2}
+	ids = nil
+	for {
+		page, err := s.ListNodes(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		ids = append(ids, nodeIDs(page)...)
+		opts.After = opts.CursorFor(&page[len(page)-1])
+	}
+	if !slices.Equal(ids, []uint64{5, 4, 3, 1, 2}) {
+		t.Errorf("got nodes %v paging by expiry descending, expected [5 4 3 1 2]", ids)
+	}
+}
+
+func testImport(t *testing.T, s store.Store) {
+	existing := createNodes(t, s, 1)[0]
+
+	created := time.Now().Add(-time.Hour).Round(0).UTC()
+	imported := newNode(2)
+	imported.CreatedAt = created
+	_, hash := provision.Generate()
+	batch := &internalstore.ImportBatch{
+		Nodes:         []node.Node{*imported, *newNode(3)},
+		ProvisionKeys: []provision.Key{{Hash: hash, User: "bob"}},
+		Webhooks:      []webhook.Subscription{{URL: "https://example.com", Secret: "secret"}},
+	}
+	if err := s.Import(batch); err != nil {
+		t.Fatal(err)
+	}
+	if ids := nodeIDs(batch.Nodes); !slices.Equal(ids, []uint64{2, 3}) {
+		t.Errorf("got imported node ids %v, expected [2 3]", ids)
+	}
+	if batch.ProvisionKeys[0].ID == 0 || batch.Webhooks[0].ID == 0 {
+		t.Error("imported provisioning key and webhook were not assigned IDs")
+	}
+	got, err := s.GetNodeByID(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.CreatedAt.Equal(created) {
+		t.Errorf("got created at %v, expected %v", got.CreatedAt, created)
+	}
+	if got, err = s.GetNodeByID(3); err != nil || got.CreatedAt.IsZero() {
+		t.Errorf("got node %+v and error %v, expected the import time as created at", got, err)
+	}
+
+	// A node with an IP in use fails the whole batch
+	conflict := newNode(4)
+	conflict.IP = existing.IP
+	_, hash = provision.Generate()
+	batch = &internalstore.ImportBatch{
+		Nodes:         []node.Node{*newNode(5), *conflict},
+		ProvisionKeys: []provision.Key{{Hash: hash}},
+		Webhooks:      []webhook.Subscription{{URL: "https://example.org", Secret: "secret"}},
+	}
+	if err = s.Import(batch); !errors.Is(err, store.ErrIPInUse) {
+		t.Fatalf("got error %v importing a used ip, expected ErrIPInUse", err)
+	}
+	nodes, err := s.GetNodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pks, err := s.GetProvisionKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	subs, err := s.GetWebhooks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 3 || len(pks) != 1 || len(subs) != 1 {
+		t.Errorf(
+			"got %d nodes, %d keys and %d webhooks after a failed import, expected 3, 1 and 1",
+			len(nodes),
+			len(pks),
+			len(subs),
+		)
+	}
+}
+
+func testAuditEvents(t *testing.T, s store.Store) {
+	for i := range 5 {
+		e := audit.NewEvent(audit.ActionNodeLogin, "node", "", uint64(i%2), nil, nil)
+		if i == 4 {
+			e = audit.NewEvent(audit.ActionNodeDisable, "admin", "", 1, map[string]bool{}, nil)
+		}
+		if err := s.AppendAuditEvent(e); err != nil {
+			t.Fatal(err)
+		}
+		if e.ID != uint64(i+1) {
+			t.Fatalf("got audit event id %d, expected %d", e.ID, i+1)
+		}
+	}
+
+	events, err := s.GetAuditEvents(audit.Filter{NodeID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 || events[0].ID != 2 || events[2].ID != 5 {
+		t.Errorf("got events %+v for node 1, expected 2, 4 and 5", events)
+	}
+	if string(events[2].Before) != "{}" || events[2].After != nil {
+		t.Errorf("got before %q after %q, expected {} and nil", events[2].Before, events[2].After)
+	}
+
+	events, err = s.GetAuditEvents(audit.Filter{AfterID: 1, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].ID != 2 || events[1].ID != 3 {
+		t.Errorf("got events %+v after 1, expected 2 and 3", events)
+	}
+
+	events, err = s.GetAuditEvents(audit.Filter{Action: audit.ActionNodeDisable, Actor: "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].ID != 5 {
+		t.Errorf("got events %+v filtering by action, expected 5", events)
+	}
+}
+
+func testWebhooks(t *testing.T, s store.Store) {
+	sub := &webhook.Subscription{URL: "https://example.com", Secret: "secret"}
+	if err := s.CreateWebhook(sub); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.GetWebhookByID(sub.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.URL != sub.URL || got.Secret != sub.Secret {
+		t.Errorf("got webhook %+v, expected %+v", got, sub)
+	}
+
+	for i := range 3 {
+		d := &webhook.Delivery{SubscriptionID: sub.ID, EventID: uint64(i), Time: time.Now()}
+		if err = s.AppendWebhookDelivery(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deliveries, err := s.GetWebhookDeliveries(sub.ID, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 2 || deliveries[0].EventID != 2 || deliveries[1].EventID != 1 {
+		t.Errorf("got deliveries %+v, expected the 2 newest first", deliveries)
+	}
+
+	if err = s.DeleteWebhook(sub.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.GetWebhookByID(sub.ID); !errors.Is(err, store.ErrWebhookNotFound) {
+		t.Errorf("got error %v for deleted webhook, expected ErrWebhookNotFound", err)
+	}
+	if err = s.DeleteWebhook(sub.ID); !errors.Is(err, store.ErrWebhookNotFound) {
+		t.Errorf("got error %v deleting missing webhook, expected ErrWebhookNotFound", err)
+	}
+}
+
+func testProvisionKeys(t *testing.T, s store.Store) {
+	_, hash := provision.Generate()
+	pk := &provision.Key{Hash: hash, User: "alice", Tags: []string{"tag:web"}, Reusable: true}
+	if err := s.CreateProvisionKey(pk); err != nil {
+		t.Fatal(err)
+	}
+
+	for range 2 {
+		used, err := s.UseProvisionKey(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if used.ID != pk.ID || used.User != "alice" {
+			t.Errorf("got key %+v, expected %+v", used, pk)
+		}
+	}
+
+	pk.Revoked = true
+	if err := s.UpdateProvisionKey(pk); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.UseProvisionKey(hash); !errors.Is(err, provision.ErrRevoked) {
+		t.Errorf("got error %v using revoked key, expected ErrRevoked", err)
+	}
+
+	// The update above was made with a stale use count
+	got, err := s.GetProvisionKeyByID(pk.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Revoked {
+		t.Error("key was not revoked")
+	}
+
+	if _, err = s.GetProvisionKeyByID(pk.ID + 1); !errors.Is(err, store.ErrProvisionKeyNotFound) {
+		t.Errorf("got error %v for missing key, expected ErrProvisionKeyNotFound", err)
+	}
+	if _, err = s.UseProvisionKey("missing"); !errors.Is(err, store.ErrProvisionKeyNotFound) {
+		t.Errorf("got error %v using missing key, expected ErrProvisionKeyNotFound", err)
+	}
+	missing := &provision.Key{ID: pk.ID + 1}
+	if err = s.UpdateProvisionKey(missing); !errors.Is(err, store.ErrProvisionKeyNotFound) {
+		t.Errorf("got error %v updating missing key, expected ErrProvisionKeyNotFound", err)
+	}
+}
+
+func testProvisionKeySingleUse(t *testing.T, s store.Store) {
+	_, hash := provision.Generate()
+	if err := s.CreateProvisionKey(&provision.Key{Hash: hash}); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	used := 0
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.UseProvisionKey(hash); err == nil {
+				mu.Lock()
+				used++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if used != 1 {
+		t.Errorf("single use key was used %d times", used)
+	}
+}
+
+func testWatchNodes(t *testing.T, s store.Store) {
+	var mu sync.Mutex
+	var changes []internalstore.NodeChange
+	stop := s.WatchNodes(func(c internalstore.NodeChange) {
+		// Watchers are called outside of the store locks
+		if _, err := s.GetNodeByID(c.ID()); err != nil && c.Type != internalstore.NodeDeleted {
+			t.Errorf("error reading node %d from watcher: %v", c.ID(), err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		changes = append(changes, c)
+	})
+
+	n := createNodes(t, s, 1)[0]
+	before := *n
+	n.Name = "renamed"
+	if err := s.UpdateNode(n); err != nil {
+		t.Fatal(err)
+	}
+	// Failed writes and deleting a missing node change nothing
+	if err := s.UpdateNode(&node.Node{ID: 1000}); !errors.Is(err, store.ErrNodeNotFound) {
+		t.Fatalf("got error %v updating missing node, expected ErrNodeNotFound", err)
+	}
+	if err := s.DeleteNode(1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteNode(n.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	got := slices.Clone(changes)
+	mu.Unlock()
+	types := make([]internalstore.ChangeType, len(got))
+	for i, c := range got {
+		types[i] = c.Type
+	}
+	want := []internalstore.ChangeType{
+		internalstore.NodeCreated,
+		internalstore.NodeUpdated,
+		internalstore.NodeDeleted,
+	}
+	if !slices.Equal(types, want) {
+		t.Fatalf("got changes %v, expected %v", types, want)
+	}
+
+	if got[0].Old != nil || got[0].New == nil || got[0].New.ID != n.ID {
+		t.Errorf("got created change %+v", got[0])
+	}
+	if got[1].Old == nil || got[1].Old.Name != before.Name || got[1].New.Name != "renamed" {
+		t.Errorf("got updated change old %+v new %+v", got[1].Old, got[1].New)
+	}
+	if got[2].Old == nil || got[2].Old.Name != "renamed" || got[2].New != nil {
+		t.Errorf("got deleted change %+v", got[2])
+	}
+
+	// Changes are copies
+	got[1].New.Name = "changed"
+	if n.Name != "renamed" {
+		t.Error("watcher change shares the node passed to UpdateNode")
+	}
+
+	stop()
+	createNodes(t, s, 1)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(changes) != len(want) {
+		t.Errorf("got %d changes after stop, expected %d", len(changes), len(want))
+	}
+}
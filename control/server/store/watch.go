@@ -0,0 +1,53 @@
+package store
+
+import (
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/caldog20/calnet/control/server/internal/node"
+	"github.com/caldog20/calnet/control/server/internal/store"
+)
+
+// nodeWatchers implements WatchNodes for the store backends. The zero value is
+// ready to use, backends embed it and call notify once a write has committed.
+type nodeWatchers struct {
+	mu  sync.RWMutex
+	seq uint64
+	fns map[uint64]func(store.NodeChange)
+}
+
+func (w *nodeWatchers) WatchNodes(fn func(store.NodeChange)) (stop func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.fns == nil {
+		w.fns = make(map[uint64]func(store.NodeChange))
+	}
+	w.seq++
+	id := w.seq
+	w.fns[id] = fn
+	return func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		delete(w.fns, id)
+	}
+}
+
+// notify calls every watcher with a copy of the change so a watcher can't
+// modify the nodes seen by another, or by the caller that made the write
+func (w *nodeWatchers) notify(t store.ChangeType, old, new *node.Node) {
+	w.mu.RLock()
+	fns := slices.Collect(maps.Values(w.fns))
+	w.mu.RUnlock()
+
+	for _, fn := range fns {
+		change := store.NodeChange{Type: t}
+		if old != nil {
+			change.Old = cloneNode(old)
+		}
+		if new != nil {
+			change.New = cloneNode(new)
+		}
+		fn(change)
+	}
+}
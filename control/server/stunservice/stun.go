@@ -4,12 +4,20 @@ import (
 	"context"
 	"errors"
 	"io"
-	"log"
 	"net"
 
+	"github.com/caldog20/calnet/control/server/logging"
+	"github.com/caldog20/calnet/control/server/metrics"
 	"github.com/pion/stun"
 )
 
+var logger = logging.Logger(logging.SubsystemStun)
+
+var stunRequests = metrics.NewCounter(
+	"calnet_stun_requests_total",
+	"Number of STUN binding requests served",
+)
+
 // TODO: Refactor this to hold some state and add some methods to match other implementations of controlserver
 
 func ListenAndServe(ctx context.Context, listenAddr string) error {
@@ -23,7 +31,7 @@ func ListenAndServe(ctx context.Context, listenAddr string) error {
 		return err
 	}
 
-	log.Printf("stun server listening on %s", conn.LocalAddr().String())
+	logger.Info("stun server listening", "addr", conn.LocalAddr().String())
 
 	go func() {
 		<-ctx.Done()
@@ -45,7 +53,7 @@ func ListenAndServe(ctx context.Context, listenAddr string) error {
 			msg.Raw = buf[:n]
 			err := msg.Decode()
 			if err != nil {
-				log.Println(err)
+				logger.Debug("error decoding stun message", logging.Err(err), "remote", raddr.String())
 				continue
 			}
 			if msg.Type == stun.BindingRequest {
@@ -54,7 +62,7 @@ func ListenAndServe(ctx context.Context, listenAddr string) error {
 				xor.Port = raddr.Port
 				err = xor.AddTo(msg)
 				if err != nil {
-					log.Println(err)
+					logger.Warn("error adding xor mapped address", logging.Err(err))
 					continue
 				}
 				msg.Type = stun.BindingSuccess
@@ -63,6 +71,7 @@ func ListenAndServe(ctx context.Context, listenAddr string) error {
 				if err != nil {
 					return err
 				}
+				stunRequests.Inc()
 			}
 		}
 
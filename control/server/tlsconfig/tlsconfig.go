@@ -0,0 +1,201 @@
+// Package tlsconfig builds the TLS configs of the control server HTTP and admin
+// listeners, with certificates from files that are reloaded when they change or
+// from an ACME CA with autocert.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/caldog20/calnet/control/server/config"
+	"github.com/caldog20/calnet/control/server/logging"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var logger = logging.Logger(logging.SubsystemTLS)
+
+// How often certificate files are checked for changes, at most once per interval
+// during handshakes
+var certCheckInterval = 10 * time.Second
+
+// New returns the TLS config for the HTTP server, or nil if conf has no TLS
+func New(conf config.Config) (*tls.Config, error) {
+	var tlsConf *tls.Config
+	switch {
+	case conf.TLS.CertFile != "":
+		c, err := newCertFile(conf.TLS.CertFile, conf.TLS.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConf = &tls.Config{GetCertificate: c.getCertificate}
+	case conf.AutoCertDomain != "":
+		m, err := newAutocert(conf)
+		if err != nil {
+			return nil, err
+		}
+		tlsConf = m.TLSConfig()
+	default:
+		return nil, nil
+	}
+	tlsConf.MinVersion = tls.VersionTLS12
+	return tlsConf, nil
+}
+
+// Admin returns the TLS config for a TCP admin listener from the HTTP server
+// config httpConf, sharing its certificates. With a client CA file every
+// connection must present a client certificate signed by it. Admin returns nil
+// if httpConf is nil.
+func Admin(httpConf *tls.Config, conf config.Config) (*tls.Config, error) {
+	if httpConf == nil {
+		return nil, nil
+	}
+	tlsConf := httpConf.Clone()
+	if conf.TLS.ClientCAFile != "" {
+		pool, err := loadCertPool(conf.TLS.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client CA file: %w", err)
+		}
+		tlsConf.ClientCAs = pool
+		tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConf, nil
+}
+
+// newAutocert returns an autocert manager for conf.AutoCertDomain using the
+// configured ACME directory and cache
+func newAutocert(conf config.Config) (*autocert.Manager, error) {
+	cacheDir := conf.TLS.ACMECacheDir
+	if cacheDir == "" {
+		// The directory autocert.NewListener uses, so certificates cached by
+		// earlier versions are kept
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			dir = "/.cache"
+		}
+		cacheDir = filepath.Join(dir, "golang-autocert")
+	}
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating acme cache dir: %w", err)
+	}
+
+	client := &acme.Client{DirectoryURL: conf.TLS.ACMEDirectory}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = autocert.DefaultACMEDirectory
+	}
+	if conf.TLS.ACMECAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if err = appendCerts(pool, conf.TLS.ACMECAFile); err != nil {
+			return nil, fmt.Errorf("error loading acme CA file: %w", err)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
+	logger.Info("using acme", "directory", client.DirectoryURL, "cache", cacheDir)
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(conf.AutoCertDomain),
+		Cache:      autocert.DirCache(cacheDir),
+		Client:     client,
+	}, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if err := appendCerts(pool, path); err != nil {
+		return nil, err
+	}
+	return pool, nil
+}
+
+func appendCerts(pool *x509.CertPool, path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !pool.AppendCertsFromPEM(b) {
+		return fmt.Errorf("no PEM certificates in %s", path)
+	}
+	return nil
+}
+
+// certFile is a certificate and key loaded from files, loaded again when either
+// file changes. A change that fails to load keeps the current certificate, so a
+// renewal writing the two files one after the other is picked up once both are
+// written.
+type certFile struct {
+	certPath string
+	keyPath  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modified  [2]fileVersion
+	lastCheck time.Time
+}
+
+// fileVersion identifies the contents of a file by its size and modification time
+type fileVersion struct {
+	size    int64
+	modTime time.Time
+}
+
+func newCertFile(certPath, keyPath string) (*certFile, error) {
+	c := &certFile{certPath: certPath, keyPath: keyPath}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	logger.Info("loaded tls certificate", "cert", certPath)
+	return c, nil
+}
+
+// load reads the files if they changed since they were last loaded
+func (c *certFile) load() error {
+	var versions [2]fileVersion
+	for i, path := range []string{c.certPath, c.keyPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		versions[i] = fileVersion{info.Size(), info.ModTime()}
+	}
+	if c.cert != nil && versions == c.modified {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return fmt.Errorf("error loading tls certificate: %w", err)
+	}
+	c.cert = &cert
+	c.modified = versions
+	return nil
+}
+
+func (c *certFile) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.lastCheck) >= certCheckInterval {
+		c.lastCheck = time.Now()
+		old := c.cert
+		if err := c.load(); err != nil {
+			logger.Error(
+				"error reloading tls certificate, keeping the current one",
+				logging.Err(err),
+			)
+		} else if c.cert != old {
+			logger.Info("reloaded tls certificate", "cert", c.certPath)
+		}
+	}
+	return c.cert, nil
+}
@@ -0,0 +1,263 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caldog20/calnet/control/server/config"
+)
+
+// testCA issues certificates for tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns the PEM certificate and key of a new certificate for name
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func writeFile(t *testing.T, path string, b []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serve starts a TLS server with tlsConf that answers with the common name of the
+// verified client certificate and returns its address
+func serve(t *testing.T, tlsConf *tls.Config) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.VerifiedChains) > 0 {
+			w.Write([]byte(r.TLS.VerifiedChains[0][0].Subject.CommonName))
+		}
+	})}
+	go srv.Serve(tls.NewListener(l, tlsConf))
+	t.Cleanup(func() { srv.Close() })
+	return l.Addr().String()
+}
+
+func TestCertFileReload(t *testing.T) {
+	old := certCheckInterval
+	certCheckInterval = 0
+	t.Cleanup(func() { certCheckInterval = old })
+
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	cert, key := ca.issue(t, "first", x509.ExtKeyUsageServerAuth)
+	writeFile(t, certPath, cert)
+	writeFile(t, keyPath, key)
+
+	conf := config.Defaults()
+	conf.TLS.CertFile = certPath
+	conf.TLS.KeyFile = keyPath
+	tlsConf, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serve(t, tlsConf)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	serverName := func() string {
+		t.Helper()
+		conn, err := tls.Dial("tcp", addr, &tls.Config{
+			RootCAs:    roots,
+			ServerName: "127.0.0.1",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	if name := serverName(); name != "first" {
+		t.Fatalf("got certificate %q, expected first", name)
+	}
+
+	// A half written renewal keeps the current certificate
+	cert, key = ca.issue(t, "second", x509.ExtKeyUsageServerAuth)
+	writeFile(t, certPath, cert)
+	if name := serverName(); name != "first" {
+		t.Fatalf("got certificate %q with a mismatched key, expected first", name)
+	}
+	writeFile(t, keyPath, key)
+	if name := serverName(); name != "second" {
+		t.Fatalf("got certificate %q, expected the reloaded second", name)
+	}
+}
+
+func TestClientCA(t *testing.T) {
+	dir := t.TempDir()
+	serverCA, clientCA := newTestCA(t), newTestCA(t)
+	cert, key := serverCA.issue(t, "server", x509.ExtKeyUsageServerAuth)
+	conf := config.Defaults()
+	conf.TLS.CertFile = filepath.Join(dir, "cert.pem")
+	conf.TLS.KeyFile = filepath.Join(dir, "key.pem")
+	conf.TLS.ClientCAFile = filepath.Join(dir, "client-ca.pem")
+	writeFile(t, conf.TLS.CertFile, cert)
+	writeFile(t, conf.TLS.KeyFile, key)
+	writeFile(t, conf.TLS.ClientCAFile, clientCA.pem)
+
+	httpConf, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminConf, err := Admin(httpConf, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpAddr, adminAddr := serve(t, httpConf), serve(t, adminConf)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCA.cert)
+	get := func(addr string, certs ...tls.Certificate) (string, error) {
+		transport := &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      roots,
+			Certificates: certs,
+		}}
+		defer transport.CloseIdleConnections()
+		resp, err := (&http.Client{Transport: transport}).Get("https://" + addr)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		var b [64]byte
+		n, _ := resp.Body.Read(b[:])
+		return string(b[:n]), nil
+	}
+
+	// Nodes connect to the HTTP listener without client certificates
+	if _, err := get(httpAddr); err != nil {
+		t.Fatalf("got error %v without a client certificate on the http listener", err)
+	}
+	if _, err := get(adminAddr); err == nil {
+		t.Fatal("expected the admin listener to refuse a client without a certificate")
+	}
+
+	clientCert, clientKey := clientCA.issue(t, "admin", x509.ExtKeyUsageClientAuth)
+	pair, err := tls.X509KeyPair(clientCert, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, err := get(adminAddr, pair); err != nil || name != "admin" {
+		t.Fatalf("got %q and error %v, expected the verified admin certificate", name, err)
+	}
+
+	// Certificates from other CAs are refused
+	otherCert, otherKey := newTestCA(t).issue(t, "other", x509.ExtKeyUsageClientAuth)
+	pair, err = tls.X509KeyPair(otherCert, otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := get(adminAddr, pair); err == nil {
+		t.Fatal("expected a client certificate from another CA to be refused")
+	}
+}
+
+func TestAutocert(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	conf := config.Defaults()
+	conf.AutoCertDomain = "control.example.com"
+	conf.TLS.ACMEDirectory = "https://127.0.0.1:14000/dir"
+	conf.TLS.ACMECacheDir = filepath.Join(dir, "cache")
+	conf.TLS.ACMECAFile = filepath.Join(dir, "acme-ca.pem")
+	writeFile(t, conf.TLS.ACMECAFile, ca.pem)
+
+	m, err := newAutocert(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Client.DirectoryURL != conf.TLS.ACMEDirectory {
+		t.Errorf("got acme directory %s, expected %s", m.Client.DirectoryURL, conf.TLS.ACMEDirectory)
+	}
+	if m.Client.HTTPClient == nil {
+		t.Error("acme client doesn't trust the acme CA file")
+	}
+	if info, err := os.Stat(conf.TLS.ACMECacheDir); err != nil || !info.IsDir() {
+		t.Errorf("acme cache dir was not created: %v", err)
+	}
+
+	tlsConf, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConf.GetCertificate == nil {
+		t.Error("autocert tls config has no GetCertificate")
+	}
+}
@@ -0,0 +1,187 @@
+package webhookservice
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caldog20/calnet/control/server/events"
+	"github.com/caldog20/calnet/control/server/internal/store"
+	"github.com/caldog20/calnet/control/server/internal/webhook"
+	"github.com/caldog20/calnet/control/server/logging"
+)
+
+const (
+	DefaultMaxAttempts = 5
+	DefaultBaseBackoff = time.Second
+	DefaultMaxBackoff  = time.Minute
+	DefaultTimeout     = time.Second * 10
+
+	eventBufferSize = 256
+)
+
+var logger = logging.Logger(logging.SubsystemWebhook)
+
+// Webhooks delivers events from the event bus to the webhook subscriptions in the store.
+// Failed deliveries are retried with exponential backoff and every attempt is recorded
+// in the delivery log.
+type Webhooks struct {
+	store  store.Store
+	client *http.Client
+
+	MaxAttempts int
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+
+	wg     sync.WaitGroup
+	cancel context.CancelFunc
+	ctx    context.Context
+}
+
+func New(store store.Store) *Webhooks {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Webhooks{
+		store:       store,
+		client:      &http.Client{Timeout: DefaultTimeout},
+		MaxAttempts: DefaultMaxAttempts,
+		BaseBackoff: DefaultBaseBackoff,
+		MaxBackoff:  DefaultMaxBackoff,
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
+
+// Start subscribes to bus and delivers events until Close is called
+func (w *Webhooks) Start(bus *events.Bus) {
+	ch, unsubscribe := bus.Subscribe(eventBufferSize)
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		defer unsubscribe()
+		for {
+			select {
+			case <-w.ctx.Done():
+				return
+			case e := <-ch:
+				w.dispatch(e)
+			}
+		}
+	}()
+}
+
+func (w *Webhooks) dispatch(e events.Event) {
+	subs, err := w.store.GetWebhooks()
+	if err != nil {
+		logger.Error("error getting webhook subscriptions", logging.Err(err))
+		return
+	}
+
+	var body []byte
+	for _, sub := range subs {
+		if !sub.Matches(e.Type) {
+			continue
+		}
+		if body == nil {
+			body, err = json.Marshal(e)
+			if err != nil {
+				logger.Error("error marshalling webhook payload", logging.Err(err))
+				return
+			}
+		}
+		w.wg.Add(1)
+		go func(sub webhook.Subscription) {
+			defer w.wg.Done()
+			w.deliver(sub, e, body)
+		}(sub)
+	}
+}
+
+// deliver sends body to the subscription, retrying with exponential backoff until it succeeds,
+// the maximum attempts are reached or the service is closed.
+func (w *Webhooks) deliver(sub webhook.Subscription, e events.Event, body []byte) {
+	backoff := w.BaseBackoff
+	for attempt := 1; attempt <= w.MaxAttempts; attempt++ {
+		d := w.send(sub, e, body, attempt)
+		if err := w.store.AppendWebhookDelivery(d); err != nil {
+			logger.Error("error recording webhook delivery", logging.Err(err))
+		}
+		if d.Success {
+			return
+		}
+
+		if attempt == w.MaxAttempts {
+			logger.Warn(
+				"giving up delivering webhook",
+				"webhook_id", sub.ID,
+				"event_id", e.ID,
+				"attempts", attempt,
+				"error", d.Error,
+			)
+			return
+		}
+
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, w.MaxBackoff)
+	}
+}
+
+func (w *Webhooks) send(
+	sub webhook.Subscription,
+	e events.Event,
+	body []byte,
+	attempt int,
+) *webhook.Delivery {
+	d := &webhook.Delivery{
+		SubscriptionID: sub.ID,
+		EventID:        e.ID,
+		EventType:      e.Type,
+		Attempt:        attempt,
+		Time:           time.Now(),
+	}
+	defer func() {
+		d.Duration = time.Since(d.Time).String()
+	}()
+
+	req, err := http.NewRequestWithContext(w.ctx, http.MethodPost, sub.URL, bytes.NewReader(body))
+	if err != nil {
+		d.Error = err.Error()
+		return d
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhook.EventHeader, string(e.Type))
+	req.Header.Set(webhook.DeliveryHeader, fmt.Sprintf("%d-%d", e.ID, sub.ID))
+	req.Header.Set(webhook.TimestampHeader, strconv.FormatInt(d.Time.Unix(), 10))
+	req.Header.Set(webhook.SignatureHeader, webhook.Sign(sub.Secret, d.Time, body))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		d.Error = err.Error()
+		return d
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	d.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		d.Error = "unexpected status: " + resp.Status
+		return d
+	}
+	d.Success = true
+	return d
+}
+
+// Close stops delivering events and waits for in-flight deliveries to finish
+func (w *Webhooks) Close() {
+	w.cancel()
+	w.wg.Wait()
+}
@@ -0,0 +1,132 @@
+package webhookservice
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caldog20/calnet/control/server/events"
+	"github.com/caldog20/calnet/control/server/internal/node"
+	"github.com/caldog20/calnet/control/server/internal/webhook"
+	"github.com/caldog20/calnet/control/server/store"
+)
+
+func newTestStore(t *testing.T) *store.BoltStore {
+	t.Helper()
+	db, err := store.NewBoltStore(filepath.Join(t.TempDir(), "store.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestWebhookDeliveryIsSigned(t *testing.T) {
+	db := newTestStore(t)
+	received := make(chan events.Event, 1)
+
+	sub := &webhook.Subscription{
+		Events: []events.Type{events.NodeRegistered},
+		Secret: "test-secret",
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !webhook.Verify(
+			sub.Secret,
+			r.Header.Get(webhook.TimestampHeader),
+			body,
+			r.Header.Get(webhook.SignatureHeader),
+		) {
+			t.Error("webhook signature did not verify")
+		}
+		e := events.Event{}
+		if err := json.Unmarshal(body, &e); err != nil {
+			t.Error(err)
+		}
+		received <- e
+	}))
+	defer srv.Close()
+
+	sub.URL = srv.URL
+	if err := db.CreateWebhook(sub); err != nil {
+		t.Fatal(err)
+	}
+
+	bus := events.NewBus()
+	w := New(db)
+	w.Start(bus)
+	defer w.Close()
+
+	// Filtered out by the subscription
+	bus.Publish(events.New(events.NodeOnline, &node.Node{ID: 1}))
+	bus.Publish(events.New(events.NodeRegistered, &node.Node{ID: 2}))
+
+	select {
+	case e := <-received:
+		if e.Type != events.NodeRegistered || e.NodeID != 2 {
+			t.Fatalf("got event %s for node %d, expected %s for node 2", e.Type, e.NodeID, events.NodeRegistered)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for webhook delivery")
+	}
+}
+
+func TestWebhookRetriesWithBackoff(t *testing.T) {
+	db := newTestStore(t)
+	var attempts atomic.Int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	sub := &webhook.Subscription{URL: srv.URL, Secret: "test-secret"}
+	if err := db.CreateWebhook(sub); err != nil {
+		t.Fatal(err)
+	}
+
+	bus := events.NewBus()
+	w := New(db)
+	w.BaseBackoff = time.Millisecond * 10
+	w.Start(bus)
+
+	bus.Publish(events.New(events.NodeOffline, &node.Node{ID: 1}))
+
+	deadline := time.Now().Add(time.Second * 5)
+	var deliveries []webhook.Delivery
+	for time.Now().Before(deadline) {
+		var err error
+		deliveries, err = db.GetWebhookDeliveries(sub.ID, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(deliveries) == 3 {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	w.Close()
+
+	if len(deliveries) != 3 {
+		t.Fatalf("got %d deliveries, expected 3", len(deliveries))
+	}
+	// Deliveries are returned newest first
+	if !deliveries[0].Success || deliveries[0].Attempt != 3 {
+		t.Fatalf("got final delivery success %t attempt %d, expected success on attempt 3",
+			deliveries[0].Success, deliveries[0].Attempt)
+	}
+	if deliveries[2].Success || deliveries[2].StatusCode != http.StatusInternalServerError {
+		t.Fatalf("got first delivery success %t status %d, expected failure with 500",
+			deliveries[2].Success, deliveries[2].StatusCode)
+	}
+}
@@ -0,0 +1,372 @@
+"use strict";
+
+// The UI logs in by exchanging an API token for an HttpOnly session cookie.
+// The CSRF token returned with the session is sent with every request that
+// changes state, it is kept in sessionStorage so it survives a reload.
+const csrfKey = "calnet_csrf";
+const auditLimit = 200;
+
+const $ = (id) => document.getElementById(id);
+
+let nodesCursor = "";
+let events = null;
+
+class APIError extends Error {
+  constructor(status, message) {
+    super(message);
+    this.status = status;
+  }
+}
+
+async function api(method, path, body) {
+  const headers = {};
+  if (method !== "GET") {
+    headers["X-CSRF-Token"] = sessionStorage.getItem(csrfKey) || "";
+  }
+  if (body !== undefined) {
+    headers["Content-Type"] = "application/json";
+  }
+  const resp = await fetch(path, {
+    method,
+    headers,
+    body: body === undefined ? undefined : JSON.stringify(body),
+    credentials: "same-origin",
+  });
+  if (resp.status === 401) {
+    showLogin();
+  }
+  if (!resp.ok) {
+    let message = resp.statusText;
+    try {
+      message = (await resp.json()).error || message;
+    } catch (e) {
+      // not a JSON error body
+    }
+    throw new APIError(resp.status, message);
+  }
+  if (resp.status === 204) {
+    return null;
+  }
+  return resp.json();
+}
+
+function showError(err) {
+  const el = $("error");
+  if (!err) {
+    el.hidden = true;
+    return;
+  }
+  if (err instanceof APIError && err.status === 401) {
+    return;
+  }
+  el.textContent = err.message;
+  el.hidden = false;
+}
+
+// run calls fn and shows any error it throws
+async function run(fn) {
+  showError(null);
+  try {
+    await fn();
+  } catch (err) {
+    showError(err);
+  }
+}
+
+function el(tag, text, className) {
+  const e = document.createElement(tag);
+  if (text !== undefined && text !== null) {
+    e.textContent = text;
+  }
+  if (className) {
+    e.className = className;
+  }
+  return e;
+}
+
+function cell(row, text, sub, className) {
+  const td = el("td", text, className);
+  if (sub) {
+    td.appendChild(el("span", sub, "sub"));
+  }
+  row.appendChild(td);
+  return td;
+}
+
+function button(text, onClick, danger) {
+  const b = el("button", text, danger ? "danger" : "");
+  b.type = "button";
+  b.addEventListener("click", () => run(onClick));
+  return b;
+}
+
+function isZero(time) {
+  return !time || time.startsWith("0001-01-01");
+}
+
+function formatTime(time) {
+  if (isZero(time)) {
+    return "-";
+  }
+  return new Date(time).toLocaleString();
+}
+
+function formatAgo(time) {
+  if (isZero(time)) {
+    return "never";
+  }
+  const secs = Math.round((new Date(time) - Date.now()) / 1000);
+  const abs = Math.abs(secs);
+  let value;
+  if (abs < 60) {
+    value = abs + "s";
+  } else if (abs < 3600) {
+    value = Math.round(abs / 60) + "m";
+  } else if (abs < 86400) {
+    value = Math.round(abs / 3600) + "h";
+  } else {
+    value = Math.round(abs / 86400) + "d";
+  }
+  return secs < 0 ? value + " ago" : "in " + value;
+}
+
+function nodeStatus(n) {
+  if (n.disabled) {
+    return "disabled";
+  }
+  if (new Date(n.key_expiry) < Date.now()) {
+    return "expired";
+  }
+  return n.online ? "online" : "offline";
+}
+
+function keyStatus(k) {
+  if (k.revoked) {
+    return "revoked";
+  }
+  if (!isZero(k.expiry) && new Date(k.expiry) < Date.now()) {
+    return "expired";
+  }
+  if (!k.reusable && k.uses > 0) {
+    return "used";
+  }
+  return "valid";
+}
+
+function nodeRow(n) {
+  const row = el("tr");
+  row.dataset.id = n.id;
+  cell(row, n.id);
+  cell(row, n.name || "-", (n.tags || []).join(", "));
+  const status = nodeStatus(n);
+  cell(row, status, null, "status-" + status);
+  cell(row, n.ip_address, n.approved_routes.join(", "));
+  cell(row, n.user || "-");
+  const hi = n.hostinfo;
+  cell(row, hi ? hi.hostname : "-", hi ? hi.os + "/" + hi.arch : "");
+  cell(row, formatAgo(n.key_expiry), formatTime(n.key_expiry));
+  cell(row, n.online ? "now" : formatAgo(n.last_seen));
+
+  const actions = cell(row, null, null, "actions");
+  const path = "/api/v1/node/" + n.id;
+  const update = async (action) => {
+    const updated = await api("POST", path + "/" + action);
+    row.replaceWith(nodeRow(updated));
+  };
+  if (n.disabled) {
+    actions.appendChild(button("Enable", () => update("enable")));
+  } else {
+    actions.appendChild(button("Disable", () => update("disable")));
+  }
+  actions.appendChild(button("Expire", () => update("expire")));
+  actions.appendChild(button("Delete", async () => {
+    if (!confirm("Delete node " + (n.name || n.id) + "?")) {
+      return;
+    }
+    await api("DELETE", path);
+    row.remove();
+  }, true));
+  return row;
+}
+
+async function loadNodes(more) {
+  const body = $("nodes-body");
+  const params = new URLSearchParams({ limit: "100" });
+  if (more && nodesCursor) {
+    params.set("cursor", nodesCursor);
+  }
+  const page = await api("GET", "/api/v1/nodes?" + params);
+  if (!more) {
+    body.replaceChildren();
+  }
+  for (const n of page.nodes) {
+    body.appendChild(nodeRow(n));
+  }
+  nodesCursor = page.next || "";
+  $("nodes-more").hidden = !nodesCursor;
+}
+
+function keyRow(k) {
+  const row = el("tr");
+  cell(row, k.id);
+  cell(row, k.description || "-");
+  cell(row, k.user || "-");
+  cell(row, k.tags.join(", ") || "-");
+  cell(row, k.reusable ? "yes" : "no");
+  cell(row, k.uses, isZero(k.last_used) ? "" : "last " + formatAgo(k.last_used));
+  const status = keyStatus(k);
+  cell(row, status, null, "status-" + status);
+  cell(row, isZero(k.expiry) ? "never" : formatAgo(k.expiry));
+  const actions = cell(row, null, null, "actions");
+  if (!k.revoked) {
+    actions.appendChild(button("Revoke", async () => {
+      if (!confirm("Revoke provisioning key " + k.id + "?")) {
+        return;
+      }
+      const revoked = await api("POST", "/api/v1/key/" + k.id + "/revoke");
+      row.replaceWith(keyRow(revoked));
+    }, true));
+  }
+  return row;
+}
+
+async function loadKeys() {
+  const resp = await api("GET", "/api/v1/keys");
+  $("keys-body").replaceChildren(...resp.keys.map(keyRow));
+}
+
+async function createKey(e) {
+  e.preventDefault();
+  const tags = $("key-tags").value.split(",").map((t) => t.trim()).filter((t) => t);
+  const req = {
+    description: $("key-description").value,
+    user: $("key-user").value,
+    tags,
+    reusable: $("key-reusable").checked,
+  };
+  const hours = Number($("key-expiry").value);
+  if (hours > 0) {
+    req.expiry = new Date(Date.now() + hours * 3600 * 1000).toISOString();
+  }
+  const key = await api("POST", "/api/v1/keys", req);
+  $("key-value").textContent = key.key;
+  $("key-created").hidden = false;
+  $("key-form").reset();
+  await loadKeys();
+}
+
+// loadAudit pages through the log, which is returned oldest first,
+// and shows the most recent events newest first
+async function loadAudit() {
+  let recent = [];
+  let after = 0;
+  for (;;) {
+    const params = new URLSearchParams({ limit: "1000" });
+    if (after) {
+      params.set("after", after);
+    }
+    const page = await api("GET", "/api/v1/audit?" + params);
+    recent = recent.concat(page.events).slice(-auditLimit);
+    if (!page.next) {
+      break;
+    }
+    after = page.next;
+  }
+
+  const rows = recent.reverse().map((e) => {
+    const row = el("tr");
+    cell(row, formatTime(e.time));
+    cell(row, e.action);
+    cell(row, e.actor || "-");
+    cell(row, e.node_id || "-");
+    cell(row, e.source_ip || "-");
+    return row;
+  });
+  $("audit-body").replaceChildren(...rows);
+}
+
+const loaders = { nodes: () => loadNodes(false), keys: loadKeys, audit: loadAudit };
+
+function showTab(name) {
+  for (const b of document.querySelectorAll("nav button[data-tab]")) {
+    b.classList.toggle("active", b.dataset.tab === name);
+    $(b.dataset.tab).hidden = b.dataset.tab !== name;
+  }
+  $("key-created").hidden = true;
+  run(loaders[name]);
+}
+
+// watchEvents reloads the node list when a node changes
+function watchEvents() {
+  if (events) {
+    return;
+  }
+  let pending = null;
+  events = new EventSource("/api/v1/events");
+  const reload = () => {
+    if ($("nodes").hidden || pending) {
+      return;
+    }
+    pending = setTimeout(() => {
+      pending = null;
+      run(() => loadNodes(false));
+    }, 500);
+  };
+  for (const type of ["node.registered", "node.updated", "node.deleted", "node.online",
+    "node.offline", "node.key_expired", "node.disabled", "node.enabled", "resync"]) {
+    events.addEventListener(type, reload);
+  }
+}
+
+function stopEvents() {
+  if (events) {
+    events.close();
+    events = null;
+  }
+}
+
+function showLogin() {
+  stopEvents();
+  sessionStorage.removeItem(csrfKey);
+  $("nav").hidden = true;
+  for (const id of ["nodes", "keys", "audit"]) {
+    $(id).hidden = true;
+  }
+  $("login").hidden = false;
+}
+
+function showApp() {
+  $("login").hidden = true;
+  $("nav").hidden = false;
+  watchEvents();
+  showTab("nodes");
+}
+
+async function login(e) {
+  e.preventDefault();
+  const session = await api("POST", "/api/v1/session", { token: $("token").value });
+  sessionStorage.setItem(csrfKey, session.csrf_token);
+  $("token").value = "";
+  showApp();
+}
+
+async function logout() {
+  await api("DELETE", "/api/v1/session");
+  showLogin();
+}
+
+document.addEventListener("DOMContentLoaded", () => {
+  $("login-form").addEventListener("submit", (e) => run(() => login(e)));
+  $("key-form").addEventListener("submit", (e) => run(() => createKey(e)));
+  $("logout").addEventListener("click", () => run(logout));
+  $("nodes-more").addEventListener("click", () => run(() => loadNodes(true)));
+  for (const b of document.querySelectorAll("nav button[data-tab]")) {
+    b.addEventListener("click", () => showTab(b.dataset.tab));
+  }
+
+  if (sessionStorage.getItem(csrfKey)) {
+    showApp();
+  } else {
+    showLogin();
+  }
+});
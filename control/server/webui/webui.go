@@ -0,0 +1,38 @@
+// Package webui serves the embedded admin web UI at /admin/.
+// The UI is a static page that manages the server through the REST API,
+// logging in with an API token that is exchanged for a session cookie.
+package webui
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed static
+var static embed.FS
+
+// contentSecurityPolicy only allows the UI to load its own scripts and styles
+// and to connect back to the server, and stops it being framed.
+const contentSecurityPolicy = "default-src 'none'; script-src 'self'; style-src 'self'; " +
+	"connect-src 'self'; img-src 'self'; form-action 'self'; frame-ancestors 'none'; " +
+	"base-uri 'none'"
+
+func RegisterRoutes(mux *http.ServeMux) {
+	files, err := fs.Sub(static, "static")
+	if err != nil {
+		panic(err)
+	}
+	fileServer := http.StripPrefix("/admin/", http.FileServerFS(files))
+
+	mux.Handle("GET /admin", http.RedirectHandler("/admin/", http.StatusMovedPermanently))
+	mux.HandleFunc("GET /admin/", func(w http.ResponseWriter, req *http.Request) {
+		h := w.Header()
+		h.Set("Content-Security-Policy", contentSecurityPolicy)
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("X-Frame-Options", "DENY")
+		h.Set("Referrer-Policy", "no-referrer")
+		h.Set("Cache-Control", "no-cache")
+		fileServer.ServeHTTP(w, req)
+	})
+}
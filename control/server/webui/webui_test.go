@@ -0,0 +1,39 @@
+package webui
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServeUI(t *testing.T) {
+	mux := http.NewServeMux()
+	RegisterRoutes(mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	for path, contentType := range map[string]string{
+		"/admin/":          "text/html",
+		"/admin/app.js":    "text/javascript",
+		"/admin/style.css": "text/css",
+	} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK || len(body) == 0 {
+			t.Errorf("%s: got status %d with %d bytes", path, resp.StatusCode, len(body))
+		}
+		if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, contentType) {
+			t.Errorf("%s: got content type %q, expected %s", path, ct, contentType)
+		}
+		if resp.Header.Get("Content-Security-Policy") != contentSecurityPolicy {
+			t.Errorf("%s: missing content security policy", path)
+		}
+	}
+}
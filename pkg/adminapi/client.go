@@ -0,0 +1,476 @@
+// Package adminapi contains the models of the control server REST API
+// and a typed client for it. The server documents the API as an OpenAPI 3
+// document at /api/v1/openapi.json, generated from the same models.
+package adminapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Error is returned for responses with a non-2xx status code
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("api error %d: %s", e.StatusCode, e.Message)
+}
+
+// IsNotFound reports whether err is an API error with status 404
+func IsNotFound(err error) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+type Client struct {
+	baseURL    *url.URL
+	token      string
+	httpClient *http.Client
+}
+
+// NewClient returns a client for the server at serverURL authenticating with the API token.
+// A unix:/path server URL connects to the admin Unix socket at path.
+func NewClient(serverURL, token string) (*Client, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server url: %w", err)
+	}
+	httpClient := &http.Client{Timeout: time.Second * 30}
+	switch u.Scheme {
+	case "http", "https":
+	case "unix":
+		if u.Path == "" {
+			return nil, fmt.Errorf("invalid server url %q: missing socket path", serverURL)
+		}
+		httpClient.Transport = unixTransport(u.Path)
+		u = &url.URL{Scheme: "http", Host: "unix"}
+	default:
+		return nil, fmt.Errorf(
+			"invalid server url %q: scheme must be http, https or unix",
+			serverURL,
+		)
+	}
+	return &Client{
+		baseURL:    u,
+		token:      token,
+		httpClient: httpClient,
+	}, nil
+}
+
+// unixTransport returns a transport that connects to the Unix socket at path for
+// every request
+func unixTransport(path string) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", path)
+	}
+	return transport
+}
+
+// SetHTTPClient replaces the http.Client used for requests
+func (c *Client) SetHTTPClient(hc *http.Client) {
+	c.httpClient = hc
+}
+
+// do sends a request with body encoded as JSON if not nil
+// and decodes the response into out if not nil
+func (c *Client) do(
+	ctx context.Context,
+	method, path string,
+	query url.Values,
+	body, out any,
+) error {
+	resp, err := c.send(ctx, method, path, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// download sends a GET request and copies the response body to w
+func (c *Client) download(ctx context.Context, path string, w io.Writer) (int64, error) {
+	resp, err := c.send(ctx, http.MethodGet, path, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return io.Copy(w, resp.Body)
+}
+
+// send sends a request with body encoded as JSON if not nil. Responses with a
+// non-2xx status are returned as an *Error, otherwise the caller must close the body.
+func (c *Client) send(
+	ctx context.Context,
+	method, path string,
+	query url.Values,
+	body any,
+) (*http.Response, error) {
+	u := c.baseURL.JoinPath(path)
+	u.RawQuery = query.Encode()
+
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		apiErr := &Error{StatusCode: resp.StatusCode}
+		jsonErr := ErrorResponse{}
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		if json.Unmarshal(b, &jsonErr) == nil && jsonErr.Error != "" {
+			apiErr.Message = jsonErr.Error
+		} else {
+			apiErr.Message = http.StatusText(resp.StatusCode)
+		}
+		return nil, apiErr
+	}
+	return resp, nil
+}
+
+func nodePath(id uint64, action string) string {
+	p := "/api/v1/node/" + strconv.FormatUint(id, 10)
+	if action != "" {
+		p += "/" + action
+	}
+	return p
+}
+
+// NodeQuery filters, sorts and pages nodes. Zero values are not applied.
+type NodeQuery struct {
+	User     string
+	Tag      string
+	Disabled *bool
+	Expired  *bool
+	Online   *bool
+	// Only nodes with an IP inside the prefix
+	Prefix netip.Prefix
+	// Case-insensitive substring of the node name or hostname
+	Hostname string
+	// Sort by id, created, last_seen or expiry
+	Sort       string
+	Descending bool
+	// Return nodes after this cursor, use the Next cursor of the previous page
+	Cursor string
+	Limit  int
+}
+
+func (q NodeQuery) values() url.Values {
+	v := url.Values{}
+	set := func(key, value string) {
+		if value != "" {
+			v.Set(key, value)
+		}
+	}
+	setBool := func(key string, b *bool) {
+		if b != nil {
+			v.Set(key, strconv.FormatBool(*b))
+		}
+	}
+	set("user", q.User)
+	set("tag", q.Tag)
+	setBool("disabled", q.Disabled)
+	setBool("expired", q.Expired)
+	setBool("online", q.Online)
+	if q.Prefix.IsValid() {
+		v.Set("prefix", q.Prefix.String())
+	}
+	set("hostname", q.Hostname)
+	set("sort", q.Sort)
+	if q.Descending {
+		v.Set("order", "desc")
+	}
+	set("cursor", q.Cursor)
+	if q.Limit != 0 {
+		v.Set("limit", strconv.Itoa(q.Limit))
+	}
+	return v
+}
+
+// Nodes returns a page of nodes matching the query
+func (c *Client) Nodes(ctx context.Context, q NodeQuery) (*Nodes, error) {
+	resp := &Nodes{}
+	err := c.do(ctx, http.MethodGet, "/api/v1/nodes", q.values(), nil, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// AllNodes returns every node matching the query, following the cursor through each page
+func (c *Client) AllNodes(ctx context.Context, q NodeQuery) ([]Node, error) {
+	var nodes []Node
+	for {
+		page, err := c.Nodes(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, page.Nodes...)
+		if page.Next == "" {
+			return nodes, nil
+		}
+		q.Cursor = page.Next
+	}
+}
+
+func (c *Client) Node(ctx context.Context, id uint64) (*Node, error) {
+	n := &Node{}
+	err := c.do(ctx, http.MethodGet, nodePath(id, ""), nil, nil, n)
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func (c *Client) nodeAction(
+	ctx context.Context,
+	id uint64,
+	action string,
+	body any,
+) (*Node, error) {
+	n := &Node{}
+	err := c.do(ctx, http.MethodPost, nodePath(id, action), nil, body, n)
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func (c *Client) DisableNode(ctx context.Context, id uint64) (*Node, error) {
+	return c.nodeAction(ctx, id, "disable", nil)
+}
+
+func (c *Client) EnableNode(ctx context.Context, id uint64) (*Node, error) {
+	return c.nodeAction(ctx, id, "enable", nil)
+}
+
+// ExpireNode expires the node key, the node must log in again to be used
+func (c *Client) ExpireNode(ctx context.Context, id uint64) (*Node, error) {
+	return c.nodeAction(ctx, id, "expire", nil)
+}
+
+func (c *Client) RenameNode(ctx context.Context, id uint64, name string) (*Node, error) {
+	return c.nodeAction(ctx, id, "rename", RenameNodeRequest{Name: name})
+}
+
+// ApproveRoutes replaces the approved routes of a node. An empty list removes every approval.
+func (c *Client) ApproveRoutes(
+	ctx context.Context,
+	id uint64,
+	routes []netip.Prefix,
+) (*Node, error) {
+	if routes == nil {
+		routes = []netip.Prefix{}
+	}
+	return c.nodeAction(ctx, id, "routes", ApproveRoutesRequest{Routes: routes})
+}
+
+func (c *Client) DeleteNode(ctx context.Context, id uint64) error {
+	return c.do(ctx, http.MethodDelete, nodePath(id, ""), nil, nil, nil)
+}
+
+func (c *Client) Users(ctx context.Context) ([]User, error) {
+	resp := Users{}
+	err := c.do(ctx, http.MethodGet, "/api/v1/users", nil, nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Users, nil
+}
+
+func (c *Client) ProvisionKeys(ctx context.Context) ([]ProvisionKey, error) {
+	resp := ProvisionKeys{}
+	err := c.do(ctx, http.MethodGet, "/api/v1/keys", nil, nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Keys, nil
+}
+
+// CreateProvisionKey creates a key. The returned Key field is the only time the key is available.
+func (c *Client) CreateProvisionKey(
+	ctx context.Context,
+	req CreateProvisionKeyRequest,
+) (*ProvisionKey, error) {
+	pk := &ProvisionKey{}
+	err := c.do(ctx, http.MethodPost, "/api/v1/keys", nil, req, pk)
+	if err != nil {
+		return nil, err
+	}
+	return pk, nil
+}
+
+func (c *Client) RevokeProvisionKey(
+	ctx context.Context,
+	id uint64,
+) (*ProvisionKey, error) {
+	pk := &ProvisionKey{}
+	path := "/api/v1/key/" + strconv.FormatUint(id, 10) + "/revoke"
+	err := c.do(ctx, http.MethodPost, path, nil, nil, pk)
+	if err != nil {
+		return nil, err
+	}
+	return pk, nil
+}
+
+// AuditQuery filters audit events. Zero values are not applied.
+type AuditQuery struct {
+	Action string
+	Actor  string
+	NodeID uint64
+	Since  time.Time
+	Until  time.Time
+	// Return events after this ID, use the Next cursor of the previous page
+	After uint64
+	Limit int
+}
+
+func (q AuditQuery) values() url.Values {
+	v := url.Values{}
+	if q.Action != "" {
+		v.Set("action", q.Action)
+	}
+	if q.Actor != "" {
+		v.Set("actor", q.Actor)
+	}
+	if q.NodeID != 0 {
+		v.Set("node_id", strconv.FormatUint(q.NodeID, 10))
+	}
+	if !q.Since.IsZero() {
+		v.Set("since", q.Since.Format(time.RFC3339))
+	}
+	if !q.Until.IsZero() {
+		v.Set("until", q.Until.Format(time.RFC3339))
+	}
+	if q.After != 0 {
+		v.Set("after", strconv.FormatUint(q.After, 10))
+	}
+	if q.Limit != 0 {
+		v.Set("limit", strconv.Itoa(q.Limit))
+	}
+	return v
+}
+
+// AuditEvents returns a page of audit events oldest first
+func (c *Client) AuditEvents(ctx context.Context, q AuditQuery) (*AuditEvents, error) {
+	resp := &AuditEvents{}
+	err := c.do(ctx, http.MethodGet, "/api/v1/audit", q.values(), nil, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *Client) Webhooks(ctx context.Context) ([]Webhook, error) {
+	resp := Webhooks{}
+	err := c.do(ctx, http.MethodGet, "/api/v1/webhooks", nil, nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Webhooks, nil
+}
+
+// CreateWebhook creates a webhook.
+// The returned Secret field is the only time the secret is available.
+func (c *Client) CreateWebhook(
+	ctx context.Context,
+	req CreateWebhookRequest,
+) (*Webhook, error) {
+	wh := &Webhook{}
+	err := c.do(ctx, http.MethodPost, "/api/v1/webhooks", nil, req, wh)
+	if err != nil {
+		return nil, err
+	}
+	return wh, nil
+}
+
+func (c *Client) DeleteWebhook(ctx context.Context, id uint64) error {
+	path := "/api/v1/webhook/" + strconv.FormatUint(id, 10)
+	return c.do(ctx, http.MethodDelete, path, nil, nil, nil)
+}
+
+// WebhookDeliveries returns the most recent delivery attempts of a webhook, newest first.
+// A limit of 0 uses the server default.
+func (c *Client) WebhookDeliveries(
+	ctx context.Context,
+	id uint64,
+	limit int,
+) ([]WebhookDelivery, error) {
+	query := url.Values{}
+	if limit != 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	resp := WebhookDeliveries{}
+	path := "/api/v1/webhook/" + strconv.FormatUint(id, 10) + "/deliveries"
+	err := c.do(ctx, http.MethodGet, path, query, nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Deliveries, nil
+}
+
+// Backup streams a consistent copy of the server store database to w and returns
+// the number of bytes written. The backup is taken while the server is running and
+// can be restored with controlserver restore. Large stores may need a longer
+// timeout than the default, see SetHTTPClient.
+func (c *Client) Backup(ctx context.Context, w io.Writer) (int64, error) {
+	return c.download(ctx, "/api/v1/backup", w)
+}
+
+// Export writes a JSON export of the server nodes, provisioning keys and webhooks
+// to w and returns the number of bytes written. The export can be imported into a
+// server using any store driver with controlserver import.
+func (c *Client) Export(ctx context.Context, w io.Writer) (int64, error) {
+	return c.download(ctx, "/api/v1/export", w)
+}
+
+// ReloadConfig makes the server read its config again and apply the values that
+// can change while it runs. It returns the keys of the values that changed. The
+// server refuses the reload if the config changes values that need a restart.
+func (c *Client) ReloadConfig(ctx context.Context) ([]string, error) {
+	resp := ConfigReload{}
+	err := c.do(ctx, http.MethodPost, "/api/v1/config/reload", nil, nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Changed, nil
+}
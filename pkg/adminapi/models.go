@@ -0,0 +1,182 @@
+package adminapi
+
+import (
+	"encoding/json"
+	"net/netip"
+	"time"
+
+	"github.com/caldog20/calnet/pkg/controlapi"
+	"github.com/caldog20/calnet/pkg/keys"
+)
+
+// ErrorResponse is the body of every response with a non-2xx status code
+type ErrorResponse struct {
+	Error string `json:"error"`
+	Code  int    `json:"code"`
+}
+
+// EventType is the type of a node event, e.g. node.registered or node.updated
+type EventType string
+
+// CreateSessionRequest logs a browser in with an API token
+type CreateSessionRequest struct {
+	Token string `json:"token"`
+}
+
+// Session is returned when a session is created. The session ID is set as an
+// HttpOnly cookie, requests other than GET must send CSRFToken in the X-CSRF-Token header.
+type Session struct {
+	CSRFToken string    `json:"csrf_token"`
+	Expires   time.Time `json:"expires"`
+}
+
+type Node struct {
+	ID        uint64       `json:"id"`
+	Name      string       `json:"name"`
+	IP        netip.Addr   `json:"ip_address"`
+	NetPrefix netip.Prefix `json:"net_prefix"`
+
+	NodeKey   keys.PublicKey `json:"node_key"`
+	KeyExpiry time.Time      `json:"key_expiry"`
+
+	Hostinfo         *controlapi.Hostinfo `json:"hostinfo,omitempty"`
+	AdvertisedRoutes []netip.Prefix       `json:"advertised_routes"`
+	ApprovedRoutes   []netip.Prefix       `json:"approved_routes"`
+
+	User     string   `json:"user"`
+	Tags     []string `json:"tags"`
+	Disabled bool     `json:"disabled"`
+	Online   bool     `json:"online"`
+
+	LastSeen  time.Time `json:"last_seen"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type Nodes struct {
+	Nodes []Node `json:"nodes"`
+	// Cursor for the next page, pass as the cursor query parameter
+	Next string `json:"next,omitempty"`
+}
+
+type RenameNodeRequest struct {
+	Name string `json:"name"`
+}
+
+// ApproveRoutesRequest replaces the approved routes of a node.
+// Every route must be advertised by the node.
+type ApproveRoutesRequest struct {
+	Routes []netip.Prefix `json:"routes"`
+}
+
+type User struct {
+	Name     string    `json:"name"`
+	Nodes    int       `json:"nodes"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+type Users struct {
+	Users []User `json:"users"`
+}
+
+type ProvisionKey struct {
+	ID uint64 `json:"id"`
+	// Only set in the response to creating a key
+	Key         string    `json:"key,omitempty"`
+	Description string    `json:"description"`
+	User        string    `json:"user"`
+	Tags        []string  `json:"tags"`
+	Reusable    bool      `json:"reusable"`
+	Expiry      time.Time `json:"expiry"`
+	Uses        int       `json:"uses"`
+	Revoked     bool      `json:"revoked"`
+	LastUsed    time.Time `json:"last_used"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type ProvisionKeys struct {
+	Keys []ProvisionKey `json:"keys"`
+}
+
+type CreateProvisionKeyRequest struct {
+	Description string   `json:"description"`
+	User        string   `json:"user"`
+	Tags        []string `json:"tags"`
+	Reusable    bool     `json:"reusable"`
+	// Zero means the key never expires
+	Expiry time.Time `json:"expiry"`
+}
+
+// AuditEvent records a change made through the API or by a node.
+// Before and After are the JSON encoded state of the changed object.
+type AuditEvent struct {
+	ID       uint64          `json:"id"`
+	Time     time.Time       `json:"time"`
+	Action   string          `json:"action"`
+	Actor    string          `json:"actor"`
+	SourceIP string          `json:"source_ip"`
+	NodeID   uint64          `json:"node_id,omitempty"`
+	Before   json.RawMessage `json:"before,omitempty"`
+	After    json.RawMessage `json:"after,omitempty"`
+}
+
+type AuditEvents struct {
+	Events []AuditEvent `json:"events"`
+	// Cursor for the next page, pass as the after query parameter
+	Next uint64 `json:"next,omitempty"`
+}
+
+type Webhook struct {
+	ID     uint64      `json:"id"`
+	URL    string      `json:"url"`
+	Events []EventType `json:"events"`
+	// Only set in the response to creating a webhook
+	Secret    string    `json:"secret,omitempty"`
+	Disabled  bool      `json:"disabled"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type Webhooks struct {
+	Webhooks []Webhook `json:"webhooks"`
+}
+
+type CreateWebhookRequest struct {
+	URL string `json:"url"`
+	// Event types to deliver, empty delivers every event
+	Events []EventType `json:"events"`
+	// Signing secret, one is generated if empty
+	Secret string `json:"secret"`
+}
+
+// WebhookDelivery is one attempt to deliver an event to a webhook
+type WebhookDelivery struct {
+	ID             uint64    `json:"id"`
+	SubscriptionID uint64    `json:"subscription_id"`
+	EventID        uint64    `json:"event_id"`
+	EventType      EventType `json:"event_type"`
+	Attempt        int       `json:"attempt"`
+	StatusCode     int       `json:"status_code,omitempty"`
+	Error          string    `json:"error,omitempty"`
+	Success        bool      `json:"success"`
+	Time           time.Time `json:"time"`
+	Duration       string    `json:"duration"`
+}
+
+type WebhookDeliveries struct {
+	Deliveries []WebhookDelivery `json:"deliveries"`
+}
+
+// ConfigReload is the result of reloading the server config
+type ConfigReload struct {
+	// Keys of the config values that changed, such as rate_limit.per_ip_burst
+	Changed []string `json:"changed"`
+}
+
+// Event is the data payload of a Server-Sent Event from /api/v1/events
+type Event struct {
+	ID     uint64    `json:"id"`
+	Type   EventType `json:"type"`
+	Time   time.Time `json:"time"`
+	NodeID uint64    `json:"node_id"`
+	Node   *Node     `json:"node,omitempty"`
+}
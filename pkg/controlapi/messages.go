@@ -2,6 +2,7 @@ package controlapi
 
 import (
 	"net/netip"
+	"slices"
 
 	"github.com/caldog20/calnet/pkg/keys"
 )
@@ -14,6 +15,28 @@ type LoginRequest struct {
 	NodeKey      keys.PublicKey `json:"node_key"`
 	ProvisionKey string         `json:"provision_key"`
 	Logout       bool           `json:"logout"`
+	Hostinfo     *Hostinfo      `json:"hostinfo,omitempty"`
+}
+
+// Hostinfo describes the host a node is running on
+type Hostinfo struct {
+	Hostname string `json:"hostname"`
+	OS       string `json:"os"`
+	Arch     string `json:"arch"`
+	// Prefixes the node is advertising routes for. Routes must be approved
+	// by an admin before they are sent to peers.
+	Routes []netip.Prefix `json:"routes,omitempty"`
+}
+
+// Equal reports whether h and o describe the same host. Either may be nil.
+func (h *Hostinfo) Equal(o *Hostinfo) bool {
+	if h == nil || o == nil {
+		return h == o
+	}
+	return h.Hostname == o.Hostname &&
+		h.OS == o.OS &&
+		h.Arch == o.Arch &&
+		slices.Equal(h.Routes, o.Routes)
 }
 
 type LoginResponse struct {
@@ -42,6 +65,13 @@ type NodeConfig struct {
 
 type Peer struct {
 	ID        uint64         `json:"id"`
+	Name      string         `json:"name,omitempty"`
 	IP        netip.Addr     `json:"ip"`
 	PublicKey keys.PublicKey `json:"public_key"`
+	// Approved routes reachable through the peer
+	Routes []netip.Prefix `json:"routes,omitempty"`
 }
+
+// ReconnectHeader is set on the 503 response to a poll by a control server that is
+// shutting down, to the URL of the control server the node should reconnect to
+const ReconnectHeader = "X-Calnet-Reconnect"
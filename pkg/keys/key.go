@@ -6,6 +6,7 @@ import (
 	"crypto/subtle"
 	"encoding/base64"
 	"io"
+	"log/slog"
 
 	"golang.org/x/crypto/curve25519"
 )
@@ -52,6 +53,11 @@ func (k *PrivateKey) UnmarshalText(text []byte) error {
 	return err
 }
 
+// LogValue keeps private keys out of structured logs
+func (k PrivateKey) LogValue() slog.Value {
+	return slog.StringValue("[REDACTED]")
+}
+
 func (k PrivateKey) PublicKey() PublicKey {
 	pub := PublicKey{}
 	curve25519.ScalarBaseMult(&pub.k, &k.k)
@@ -97,6 +103,10 @@ func (k PublicKey) EncodeToString() string {
 	return base64.StdEncoding.EncodeToString(k.k[:])
 }
 
+func (k PublicKey) LogValue() slog.Value {
+	return slog.StringValue(k.EncodeToString())
+}
+
 func (k PublicKey) Raw() []byte {
 	return bytes.Clone(k.k[:])
 }